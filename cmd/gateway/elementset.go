@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// loadElementSets reads ZSERVER_ELEMENT_SETS, custom element set names
+// each keeping the MARC fields listed for it, as in
+// "title=001,245;ids=001,010,020,022,035". Names match case-insensitively.
+func (s *Server) loadElementSets() {
+	s.elementSets = make(map[string][]string)
+	for _, entry := range strings.Split(os.Getenv("ZSERVER_ELEMENT_SETS"), ";") {
+		name, tags, ok := strings.Cut(entry, "=")
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !ok || name == "" {
+			continue
+		}
+		var keep []string
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				keep = append(keep, tag)
+			}
+		}
+		s.elementSets[name] = keep
+	}
+}
+
+// knownElementSet reports whether records can be presented in element set
+// name: F or none for full records, B for brief ones, or a custom set.
+func (s *Server) knownElementSet(name string) bool {
+	switch name = strings.ToUpper(name); name {
+	case "", z3950.ElementSetFull, z3950.ElementSetBrief:
+		return true
+	}
+	_, ok := s.elementSets[name]
+	return ok
+}
+
+// selectElements returns rec reduced to element set name. A brief record
+// holds what a result list shows: the control number, title, author,
+// ISBN, ISSN, publisher and subject, built from the friendly fields read
+// with the native profile. A custom set keeps the fields it lists, and
+// full records are returned as they are.
+func (s *Server) selectElements(rec *z3950.MARCRecord, name string, native *z3950.MARCProfile) *z3950.MARCRecord {
+	if rec.Leader == "SUTRS" {
+		return rec
+	}
+	name = strings.ToUpper(name)
+	if name == z3950.ElementSetBrief {
+		return z3950.BriefRecord(rec, native)
+	}
+	keep, ok := s.elementSets[name]
+	if !ok {
+		return rec
+	}
+	reduced := &z3950.MARCRecord{Leader: rec.Leader}
+	for _, f := range rec.Fields {
+		for _, tag := range keep {
+			if f.Tag == tag {
+				reduced.Fields = append(reduced.Fields, f)
+				break
+			}
+		}
+	}
+	reduced.PopulateFriendlyFields()
+	return reduced
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -17,6 +19,7 @@ import (
 	"github.com/yourusername/open-z3950-gateway/pkg/auth"
 	"github.com/yourusername/open-z3950-gateway/pkg/notify"
 	"github.com/yourusername/open-z3950-gateway/pkg/provider"
+	"github.com/yourusername/open-z3950-gateway/pkg/sru"
 	"github.com/yourusername/open-z3950-gateway/pkg/ui"
 	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
 )
@@ -30,13 +33,58 @@ const (
 	TagSearchResponse     = 23
 	TagPresentRequest     = 24
 	TagPresentResponse    = 25
+	TagDeleteResultSetRequest  = 30
+	TagDeleteResultSetResponse = 31
 	TagScanRequest        = 35
 	TagScanResponse       = 36
+	TagSortRequest        = 43
+	TagSortResponse       = 44
+	TagClose              = 48
 )
 
+// Close PDU reasons sent to clients that are dropped.
+const (
+	closeReasonProtocolError     = 3
+	closeReasonSecurityViolation = 5
+)
+
+// requestOptions are the Init options a client must have agreed to before
+// sending each request.
+var requestOptions = map[ber.Tag]int{
+	TagSearchRequest:          z3950.OptionSearch,
+	TagPresentRequest:         z3950.OptionPresent,
+	TagDeleteResultSetRequest: z3950.OptionDeleteResultSet,
+	TagScanRequest:            z3950.OptionScan,
+	TagSortRequest:            z3950.OptionSort,
+}
+
+// serverCharsets are the charsets the server can send records in, as
+// offered in charset negotiation.
+var serverCharsets = []string{"UTF-8", "MARC-8"}
+
+// defaultMaxResultSets caps the named result sets a connection may hold
+// unless ZSERVER_MAX_RESULT_SETS says otherwise.
+const defaultMaxResultSets = 10
+
+// /api/search page size when none is given, and the most it may ask for.
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// ResultSet is a named search result kept for Present.
+type ResultSet struct {
+	IDs          []string
+	DBName       string
+	RecordSyntax string // preferredRecordSyntax from the Search, if any
+}
+
 type Session struct {
-	ResultIDs []string
-	DBName    string
+	ResultSets map[string]*ResultSet // keyed by resultSetName
+	DBName     string                // database of the last Search, used by Scan
+	User       *provider.User        // logged in with Init; nil when anonymous
+	Charset    string                // of records sent: ZSERVER_CHARSET unless negotiated at Init
+	Init       z3950.InitParams      // agreed at Init; the server's own until then
 }
 
 type Server struct {
@@ -46,6 +94,12 @@ type Server struct {
 	allowedIPs  []*net.IPNet
 	allowAllIPs bool
 	profile     *z3950.MARCProfile
+	charset     string // "UTF-8" or "MARC-8" for records sent to clients that negotiate none
+	maxResultSets int  // named result sets per connection
+	init          z3950.InitParams // versions, services and message sizes offered at Init
+	requireAuth   bool // refuse Init requests without valid credentials
+	userDatabases map[string][]string // lower-cased user name -> databases it may search
+	elementSets   map[string][]string // upper-cased custom element set name -> MARC tags it keeps
 }
 
 func NewServer(p provider.Provider) *Server {
@@ -54,7 +108,37 @@ func NewServer(p provider.Provider) *Server {
 		sessions: make(map[string]*Session),
 	}
 	s.loadWhitelist()
+	s.loadUserAccess()
+	s.loadElementSets()
+	s.init = z3950.InitParams{
+		Versions:              z3950.Bits(z3950.Version2, z3950.Version3),
+		Options:               z3950.Bits(z3950.OptionSearch, z3950.OptionPresent, z3950.OptionDeleteResultSet, z3950.OptionScan, z3950.OptionSort, z3950.OptionNamedResultSets),
+		PreferredMessageSize:  z3950.DefaultPreferredMessageSize,
+		ExceptionalRecordSize: z3950.DefaultExceptionalRecordSize,
+		ImplementationID:      "GoZServer",
+		ImplementationName:    "Open Z39.50 Gateway",
+	}
+	if n, err := strconv.Atoi(os.Getenv("ZSERVER_MESSAGE_SIZE")); err == nil && n > 0 {
+		s.init.PreferredMessageSize = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("ZSERVER_RECORD_SIZE")); err == nil && n > 0 {
+		s.init.ExceptionalRecordSize = n
+	}
 	s.profile = &z3950.ProfileMARC21
+	switch strings.ToUpper(os.Getenv("ZSERVER_MARC_FORMAT")) {
+	case "CNMARC":
+		s.profile = &z3950.ProfileCNMARC
+	case "UNIMARC":
+		s.profile = &z3950.ProfileUNIMARC
+	}
+	s.charset = "UTF-8"
+	if strings.EqualFold(os.Getenv("ZSERVER_CHARSET"), "MARC-8") {
+		s.charset = "MARC-8"
+	}
+	s.maxResultSets = defaultMaxResultSets
+	if n, err := strconv.Atoi(os.Getenv("ZSERVER_MAX_RESULT_SETS")); err == nil && n > 0 {
+		s.maxResultSets = n
+	}
 	return s
 }
 
@@ -104,41 +188,156 @@ func (s *Server) handleConnection(conn net.Conn) {
 	slog.Info("new z39.50 connection", "conn_id", connID)
 
 	s.mu.Lock()
-	s.sessions[connID] = &Session{ResultIDs: []string{}, DBName: "Default"}
+	s.sessions[connID] = &Session{ResultSets: make(map[string]*ResultSet), DBName: "Default", Charset: s.charset, Init: s.init}
 	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		sess := s.sessions[connID]
+		delete(s.sessions, connID)
+		var sets []*ResultSet
+		for _, rs := range sess.ResultSets {
+			sets = append(sets, rs)
+		}
+		sess.ResultSets = nil
+		dropped := droppedIDs(sess, sets...)
+		s.mu.Unlock()
+		s.release(dropped)
+	}()
 
-	for {
-		pkt, err := ber.ReadPacket(conn)
-		if err != nil {
-			s.mu.Lock()
-			delete(s.sessions, connID)
-			s.mu.Unlock()
-			return
+	// Requests are read on their own goroutine so that a client hanging
+	// up is noticed while its request is still being served: ctx is then
+	// cancelled, and with it any remote search done on its behalf.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	packets := make(chan *ber.Packet)
+	go func() {
+		defer close(packets)
+		for {
+			pkt, err := ber.ReadPacket(conn)
+			if err != nil {
+				cancel()
+				return
+			}
+			select {
+			case packets <- pkt:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
+	for pkt := range packets {
+		if s.requireAuth && pkt.Tag != TagInitializeRequest && s.sessionUser(connID) == nil {
+			slog.Warn("request before login, closing connection", "conn_id", connID, "tag", pkt.Tag)
+			writeClose(conn, closeReasonSecurityViolation)
+			return
+		}
+		if option, ok := requestOptions[pkt.Tag]; ok && !s.sessionInit(connID).Options.Has(option) {
+			slog.Warn("request for a service not agreed at init, closing connection", "conn_id", connID, "tag", pkt.Tag)
+			writeClose(conn, closeReasonProtocolError)
+			return
+		}
 		switch pkt.Tag {
 		case TagInitializeRequest:
-			s.handleInit(conn, connID)
+			if !s.handleInit(ctx, conn, connID, pkt) {
+				return
+			}
 		case TagSearchRequest:
-			s.handleSearch(conn, connID, pkt)
+			s.handleSearch(ctx, conn, connID, pkt)
 		case TagPresentRequest:
-			s.handlePresent(conn, connID, pkt)
+			s.handlePresent(ctx, conn, connID, pkt)
 		case TagScanRequest:
-			s.handleScan(conn, connID, pkt)
+			s.handleScan(ctx, conn, connID, pkt)
+		case TagDeleteResultSetRequest:
+			s.handleDeleteResultSet(conn, connID, pkt)
+		case TagSortRequest:
+			s.handleSort(ctx, conn, connID, pkt)
 		}
 	}
 }
 
-func (s *Server) handleInit(conn net.Conn, connID string) {
-	resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagInitializeResponse, nil, "InitResp")
-	resp.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagBitString, []byte{0x00, 0xC0}, "Ver"))
-	resp.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagBitString, []byte{0x00, 0xF0}, "Opt"))
-	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1048576, "MsgSize"))
-	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1048576, "RecSize"))
-	resp.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Result"))
-	resp.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 110, "GoZServer", "ImpId"))
-	conn.Write(resp.Bytes())
-	slog.Info("init success", "conn_id", connID)
+// handleInit answers an InitializeRequest, agreeing to the versions,
+// services and message sizes both sides support and logging the client in
+// with its idAuthentication if it sent one. It reports whether the
+// connection was accepted; a refused client is closed after the response.
+func (s *Server) handleInit(ctx context.Context, conn net.Conn, connID string, req *ber.Packet) bool {
+	var creds z3950.Authentication
+	for _, c := range req.Children {
+		if c.ClassType == ber.ClassContext && c.Tag == 7 {
+			creds = z3950.ParseAuthentication(c)
+		}
+	}
+	user, err := s.authenticate(ctx, creds)
+
+	proposed := z3950.ParseInitParams(req)
+	if proposed.Versions == 0 && proposed.Options == 0 {
+		// Clients leaving both out get what the server offers
+		proposed.Versions, proposed.Options = s.init.Versions, s.init.Options
+	}
+	agreed := s.init.Negotiate(proposed)
+	if err == nil && agreed.Version() == 0 {
+		err = fmt.Errorf("no common protocol version in %b", proposed.Versions)
+	}
+	accepted := err == nil
+
+	// Charset negotiation: the first proposed charset records can be
+	// served in, or none
+	proposal, negotiate := z3950.ParseCharsetNegotiation(req)
+	var selected z3950.CharsetNegotiation
+	if negotiate {
+		if cs := z3950.SelectCharset(proposal.Charsets, serverCharsets); cs != "" {
+			selected = z3950.CharsetNegotiation{Charsets: []string{cs}, RecordsInCharset: proposal.RecordsInCharset}
+		}
+	}
+
+	var otherInfo []*ber.Packet
+	if negotiate && accepted {
+		otherInfo = append(otherInfo, selected.EncodeResponse())
+	}
+	conn.Write(z3950.EncodeInitResponse(agreed, accepted, otherInfo...).Bytes())
+	if !accepted {
+		slog.Warn("init refused", "conn_id", connID, "error", err)
+		return false
+	}
+
+	s.mu.Lock()
+	if sess, ok := s.sessions[connID]; ok {
+		sess.User = user
+		sess.Init = agreed
+		if selected.RecordsInCharset {
+			sess.Charset = selected.Charsets[0]
+		}
+	}
+	s.mu.Unlock()
+	if negotiate {
+		slog.Info("charset negotiated", "conn_id", connID, "proposed", proposal.Charsets, "selected", selected.Charsets)
+	}
+	username := ""
+	if user != nil {
+		username = user.Username
+	}
+	slog.Info("init success", "conn_id", connID, "user", username, "version", agreed.Version(),
+		"options", fmt.Sprintf("%b", agreed.Options), "message_size", agreed.PreferredMessageSize,
+		"record_size", agreed.ExceptionalRecordSize, "client", proposed.ImplementationName)
+	return true
+}
+
+// sessionInit returns the parameters agreed on connID's Init.
+func (s *Server) sessionInit(connID string) z3950.InitParams {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if sess, ok := s.sessions[connID]; ok {
+		return sess.Init
+	}
+	return s.init
+}
+
+func writeClose(conn net.Conn, reason int) {
+	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagClose, nil, "Close")
+	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 211, int64(reason), "CloseReason"))
+	if _, err := conn.Write(pdu.Bytes()); err != nil {
+		slog.Warn("failed to send close", "error", err)
+	}
 }
 
 func parseOperand(operand *ber.Packet) (z3950.QueryClause, error) {
@@ -157,15 +356,16 @@ func parseOperand(operand *ber.Packet) (z3950.QueryClause, error) {
 
 	for _, child := range apt.Children {
 		if child.Tag == 44 { // AttributeList
-			if len(child.Children) > 0 {
-				attr := child.Children[0] // Attribute
-				if attr.Tag == ber.TagSequence && len(attr.Children) >= 2 {
-					attrType, _ := attr.Children[0].Value.(int64)
-					attrValue, _ := attr.Children[1].Value.(int64)
-					if attrType == 1 { // 1 = Use attribute
-						clause.Attribute = int(attrValue)
-					}
+			for _, attr := range child.Children {
+				for _, c := range attr.Children {
+					if c.ClassType == ber.ClassContext && c.Tag == 1 { clause.AttributeSet = z3950.PacketOID(c) }
+				}
+			}
+			for typ, val := range attributeValues(child) {
+				if typ < z3950.AttributeTypeUse || typ > z3950.AttributeTypeCompleteness {
+					return clause, z3950.NewDiagnostic(z3950.DiagUnsupportedAttributeType, strconv.Itoa(typ))
 				}
+				clause.SetAttribute(typ, val)
 			}
 		} else if child.Tag == 45 { // Term
 			clause.Term = string(child.Data.Bytes())
@@ -179,6 +379,24 @@ func parseOperand(operand *ber.Packet) (z3950.QueryClause, error) {
 	return clause, nil
 }
 
+// attributeValues decodes an AttributeList into a type -> numeric value map.
+// Each AttributeElement carries attributeType [120] and attributeValue [121],
+// optionally preceded by an attributeSet [1].
+func attributeValues(list *ber.Packet) map[int]int {
+	values := make(map[int]int)
+	for _, attr := range list.Children {
+		var ints []int
+		for _, c := range attr.Children {
+			if c.ClassType == ber.ClassContext && c.Tag == 1 { continue }
+			ints = append(ints, int(z3950.DecodeInt(c)))
+		}
+		if len(ints) >= 2 {
+			values[ints[0]] = ints[1]
+		}
+	}
+	return values
+}
+
 // recursiveParseRPN processes the RPN structure recursively
 func recursiveParseRPN(p *ber.Packet) (z3950.QueryNode, error) {
 	// Choice: Operand [0] or RPNRpnOp [1]
@@ -200,23 +418,24 @@ func recursiveParseRPN(p *ber.Packet) (z3950.QueryNode, error) {
 		right, err := recursiveParseRPN(p.Children[1])
 		if err != nil { return nil, err }
 		
+		// Operator [46] is a CHOICE of and [0], or [1], and-not [2] and
+		// prox [3]; the choice is carried by the tag, not the value.
 		opNode := p.Children[2]
-		opStr := "AND"
-		if len(opNode.Children) > 0 {
-			if v, ok := opNode.Children[0].Value.(int64); ok {
-				switch v {
-				case 0: opStr = "AND"
-				case 1: opStr = "OR"
-				case 2: opStr = "AND-NOT"
-				}
-			}
+		if len(opNode.Children) == 0 {
+			return nil, fmt.Errorf("complex RPN missing operator")
 		}
-		
-		return z3950.QueryComplex{
-			Operator: opStr,
-			Left:     left,
-			Right:    right,
-		}, nil
+		node := z3950.QueryComplex{Left: left, Right: right}
+		switch choice := opNode.Children[0]; choice.Tag {
+		case 0: node.Operator = "AND"
+		case 1: node.Operator = "OR"
+		case 2: node.Operator = "AND-NOT"
+		case 3:
+			node.Operator = "PROX"
+			node.Proximity = z3950.ParseProximityOperator(choice)
+		default:
+			return nil, fmt.Errorf("unknown RPN operator: %d", choice.Tag)
+		}
+		return node, nil
 	}
 	
 	return nil, fmt.Errorf("unknown RPN tag: %d", p.Tag)
@@ -256,160 +475,816 @@ func parseRPNQuery(queryPacket *ber.Packet) (z3950.StructuredQuery, error) {
 		return z3950.StructuredQuery{}, err
 	}
 	
-	return z3950.StructuredQuery{Root: root}, nil
+	query := z3950.StructuredQuery{Root: root}
+	if rpnQuery := queryPacket.Children[0]; len(rpnQuery.Children) >= 2 && rpnQuery.Children[0].Tag == ber.TagObjectIdentifier {
+		query.AttributeSet = z3950.PacketOID(rpnQuery.Children[0])
+	}
+	return query, nil
 }
 
-func (s *Server) handleSearch(conn net.Conn, connID string, req *ber.Packet) {
-	dbName := "Default"
-	for _, c := range req.Children {
-		if c.Tag == ber.TagSequence && len(c.Children) > 0 && c.Children[0].Tag == ber.TagVisibleString {
-			dbName = string(c.Children[0].Data.Bytes())
-			break
+// supportedAttributes lists, per Bib-1 attribute type, the values the local
+// providers can search on; 0 means the attribute was not given. Each type
+// has the diagnostic reported for a value outside its list.
+var supportedAttributes = map[int]struct {
+	values map[int]bool
+	diag   int
+}{
+	z3950.AttributeTypeUse: {map[int]bool{
+		0:                               true,
+		z3950.UseAttributePersonalName:  true,
+		z3950.UseAttributeCorporateName: true,
+		z3950.UseAttributeTitle:         true,
+		z3950.UseAttributeTitleSeries:   true,
+		z3950.UseAttributeISBN:          true,
+		z3950.UseAttributeISSN:          true,
+		z3950.UseAttributeSubject:       true,
+		z3950.UseAttributeDatePub:       true,
+		z3950.UseAttributeAuthor:        true,
+		z3950.UseAttributeAny:           true,
+	}, z3950.DiagUnsupportedUseAttribute},
+	z3950.AttributeTypeRelation: {map[int]bool{
+		0: true, z3950.RelationLess: true, z3950.RelationLessEqual: true, z3950.RelationEqual: true,
+		z3950.RelationGreaterEqual: true, z3950.RelationGreater: true, z3950.RelationNotEqual: true,
+	}, z3950.DiagUnsupportedRelation},
+	z3950.AttributeTypePosition: {map[int]bool{
+		0: true, z3950.PositionFirstInField: true, z3950.PositionFirstInSubfield: true, z3950.PositionAny: true,
+	}, z3950.DiagUnsupportedPosition},
+	z3950.AttributeTypeStructure: {map[int]bool{
+		0: true, z3950.StructurePhrase: true, z3950.StructureWord: true, z3950.StructureKey: true,
+		z3950.StructureYear: true, z3950.StructureDateNormalized: true, z3950.StructureWordList: true,
+		z3950.StructureDateUnnormalized: true,
+	}, z3950.DiagUnsupportedStructure},
+	z3950.AttributeTypeTruncation: {map[int]bool{
+		0: true, z3950.TruncationRight: true, z3950.TruncationLeft: true, z3950.TruncationLeftRight: true,
+		z3950.TruncationNone: true,
+	}, z3950.DiagUnsupportedTruncation},
+	z3950.AttributeTypeCompleteness: {map[int]bool{
+		0: true, z3950.CompletenessIncompleteSubfield: true, z3950.CompletenessCompleteSubfield: true,
+		z3950.CompletenessCompleteField: true,
+	}, z3950.DiagUnsupportedCompleteness},
+}
+
+// checkAttributes returns a diagnostic (114 for Use, 117-122 for the other
+// types and attribute sets other than Bib-1) for the first clause carrying
+// an attribute the server cannot search on.
+func checkAttributes(node z3950.QueryNode) *z3950.Diagnostic {
+	switch n := node.(type) {
+	case z3950.QueryClause:
+		if n.AttributeSet != "" && n.AttributeSet != z3950.OID_Bib1 {
+			return z3950.NewDiagnostic(z3950.DiagUnsupportedAttributeSet, n.AttributeSet)
+		}
+		for typ := z3950.AttributeTypeUse; typ <= z3950.AttributeTypeCompleteness; typ++ {
+			val := n.Attributes()[typ]
+			if s := supportedAttributes[typ]; !s.values[val] {
+				return z3950.NewDiagnostic(s.diag, strconv.Itoa(val))
+			}
+		}
+	case z3950.QueryComplex:
+		if d := checkAttributes(n.Left); d != nil { return d }
+		return checkAttributes(n.Right)
+	}
+	return nil
+}
+
+// parseDatabaseNames reads DatabaseNames ([18] in Search, [3] in Scan), each
+// a [105] DatabaseName. A universal SEQUENCE of VisibleString is accepted too.
+func parseDatabaseNames(p *ber.Packet) []string {
+	var names []string
+	for _, c := range p.Children {
+		if (c.ClassType == ber.ClassContext && c.Tag == 105) || (c.ClassType == ber.ClassUniversal && c.Tag == ber.TagVisibleString) {
+			names = append(names, z3950.DecodeString(c))
 		}
 	}
+	return names
+}
 
+// providerDiagnostic turns a provider error into a diagnostic, keeping the
+// one a proxied target or the provider itself reported.
+func providerDiagnostic(err error) *z3950.Diagnostic {
+	var diag *z3950.Diagnostic
+	if errors.As(err, &diag) {
+		return diag
+	}
+	return z3950.NewDiagnostic(z3950.DiagTemporarySystemError, err.Error())
+}
+
+func writeSearchDiagnostic(conn net.Conn, diag *z3950.Diagnostic) {
+	resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagSearchResponse, nil, "SearchResp")
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 23, 0, "ResultCount"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 24, 0, "Returned"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 25, 0, "NextPos"))
+	resp.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 22, false, "SearchStatus"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 26, 3, "ResultSetStatus")) // none
+	resp.AppendChild(diag.Encode(130))
+	conn.Write(resp.Bytes())
+}
+
+func (s *Server) handleSearch(ctx context.Context, conn net.Conn, connID string, req *ber.Packet) {
+	dbName := "Default"
 	var queryNode *ber.Packet
+	syntax := ""
+	setName := "default"
+	replace := true
+	small, large, medium := 0, 0, 0
+	smallSet, mediumSet := "", ""
 	for _, c := range req.Children {
-		if c.Tag == 21 && c.ClassType == ber.ClassContext {
+		switch {
+		case c.Tag == 13 && c.ClassType == ber.ClassContext:
+			small = int(z3950.DecodeInt(c))
+		case c.Tag == 14 && c.ClassType == ber.ClassContext:
+			large = int(z3950.DecodeInt(c))
+		case c.Tag == 15 && c.ClassType == ber.ClassContext:
+			medium = int(z3950.DecodeInt(c))
+		case c.Tag == 100 && c.ClassType == ber.ClassContext:
+			smallSet = z3950.ParseElementSetNames(c)
+		case c.Tag == 101 && c.ClassType == ber.ClassContext:
+			mediumSet = z3950.ParseElementSetNames(c)
+		case c.Tag == 16 && c.ClassType == ber.ClassContext:
+			replace = z3950.DecodeBool(c)
+		case c.Tag == 17 && c.ClassType == ber.ClassContext:
+			if name := z3950.DecodeString(c); name != "" { setName = name }
+		case c.Tag == 18 && c.ClassType == ber.ClassContext, c.Tag == ber.TagSequence && c.ClassType == ber.ClassUniversal:
+			// Several databases make a federated search
+			if names := parseDatabaseNames(c); len(names) > 0 { dbName = strings.Join(names, ",") }
+		case c.Tag == 21 && c.ClassType == ber.ClassContext:
 			queryNode = c
-			break
+		case c.Tag == 104 && c.ClassType == ber.ClassContext:
+			syntax = z3950.PacketOID(c)
 		}
 	}
 
 	if queryNode == nil {
 		slog.Error("missing query node in search request", "conn_id", connID)
-		resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagSearchResponse, nil, "SearchResp")
-		resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "Status"))
-		conn.Write(resp.Bytes())
+		writeSearchDiagnostic(conn, z3950.NewDiagnostic(z3950.DiagMalformedQuery, "missing query"))
+		return
+	}
+	if len(queryNode.Children) == 0 || queryNode.Children[0].Tag != 1 {
+		writeSearchDiagnostic(conn, z3950.NewDiagnostic(z3950.DiagQueryTypeUnsupported, "only type-1 (RPN) queries are supported"))
 		return
 	}
 
 	query, err := parseRPNQuery(queryNode)
 	if err != nil {
 		slog.Error("failed to parse RPN query", "error", err, "conn_id", connID)
-		resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagSearchResponse, nil, "SearchResp")
-		resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "Status"))
-		conn.Write(resp.Bytes())
+		var diag *z3950.Diagnostic
+		if !errors.As(err, &diag) {
+			diag = z3950.NewDiagnostic(z3950.DiagMalformedQuery, err.Error())
+		}
+		writeSearchDiagnostic(conn, diag)
+		return
+	}
+	diag := checkAttributes(query.Root)
+	if query.AttributeSet != "" && query.AttributeSet != z3950.OID_Bib1 {
+		diag = z3950.NewDiagnostic(z3950.DiagUnsupportedAttributeSet, query.AttributeSet)
+	}
+	if diag != nil {
+		slog.Warn("unsupported attribute", "conn_id", connID, "code", diag.Code, "value", diag.AddInfo)
+		writeSearchDiagnostic(conn, diag)
+		return
+	}
+
+	if db := s.deniedDatabase(connID, dbName); db != "" {
+		slog.Warn("database access denied", "conn_id", connID, "db", db)
+		writeSearchDiagnostic(conn, z3950.NewDiagnostic(z3950.DiagDatabaseAccessDenied, db))
 		return
 	}
 
-	ids, err := s.provider.Search(dbName, query)
+	s.mu.RLock()
+	sess, ok := s.sessions[connID]
+	var existing *ResultSet
+	numSets := 0
+	namedSets := false
+	var charset string
+	var agreed z3950.InitParams
+	if ok {
+		existing = sess.ResultSets[setName]
+		numSets = len(sess.ResultSets)
+		namedSets = sess.Init.Options.Has(z3950.OptionNamedResultSets)
+		charset, agreed = sess.Charset, sess.Init
+	}
+	s.mu.RUnlock()
+	if !ok { return }
+	if setName != "default" && !namedSets {
+		writeSearchDiagnostic(conn, z3950.NewDiagnostic(z3950.DiagNamedSetsUnsupported, setName))
+		return
+	}
+	if existing != nil && !replace {
+		writeSearchDiagnostic(conn, z3950.NewDiagnostic(z3950.DiagResultSetExists, setName))
+		return
+	}
+	if existing == nil && numSets >= s.maxResultSets {
+		writeSearchDiagnostic(conn, z3950.NewDiagnostic(z3950.DiagTooManyResultSets, strconv.Itoa(s.maxResultSets)))
+		return
+	}
+
+	// The whole result set is kept so any record can be presented later
+	ids, _, err := s.provider.Search(ctx, dbName, query)
 	if err != nil {
 		slog.Error("provider search failed", "error", err, "conn_id", connID)
-		resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagSearchResponse, nil, "SearchResp")
-		resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "Status"))
-		conn.Write(resp.Bytes())
+		writeSearchDiagnostic(conn, providerDiagnostic(err))
 		return
 	}
 
+	rs := &ResultSet{IDs: ids, DBName: dbName, RecordSyntax: syntax}
 	s.mu.Lock()
-	if sess, ok := s.sessions[connID]; ok {
-		sess.ResultIDs = ids
-		sess.DBName = dbName
-	}
+	replaced := sess.ResultSets[setName]
+	sess.ResultSets[setName] = rs
+	sess.DBName = dbName
+	dropped := droppedIDs(sess, replaced)
 	s.mu.Unlock()
-	
-	slog.Info("search processed", "db", dbName, "found", len(ids))
+	s.release(dropped)
+
+	// Records piggybacked on the response: all of a small set, the first
+	// mediumSetPresentNumber of a medium one and none of a large one
+	n, elementSet := 0, ""
+	switch {
+	case len(ids) <= small:
+		n, elementSet = len(ids), smallSet
+	case len(ids) < large:
+		n, elementSet = min(medium, len(ids)), mediumSet
+	}
+
+	var records *ber.Packet
+	var presentDiag *z3950.Diagnostic
+	returned, status := 0, presentStatusSuccess
+	if n > 0 {
+		recSyntax := s.recordSyntax(rs, "")
+		if supportedSyntax(recSyntax) {
+			records, returned, status, presentDiag = s.presentRecords(ctx, connID, rs, ids[:n], recSyntax, elementSet, charset, agreed)
+		} else {
+			presentDiag = z3950.NewDiagnostic(z3950.DiagRecordSyntaxUnsupported, recSyntax)
+		}
+		if presentDiag != nil {
+			status = presentStatusFailure
+		}
+	}
+
+	slog.Info("search processed", "db", dbName, "result_set", setName, "query", z3950.FormatPQF(query), "found", len(ids), "returned", returned)
 
 	resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagSearchResponse, nil, "SearchResp")
 	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 23, int64(len(ids)), "ResultCount"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 24, int64(returned), "Returned"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 25, int64(returned+1), "NextPos"))
+	resp.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 22, true, "SearchStatus"))
+	if n > 0 {
+		resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 27, int64(status), "PresentStatus"))
+		if presentDiag != nil {
+			resp.AppendChild(presentDiag.Encode(130))
+		} else {
+			resp.AppendChild(records)
+		}
+	}
+	conn.Write(resp.Bytes())
+}
+
+func writePresentDiagnostic(conn net.Conn, next int, diag *z3950.Diagnostic) {
+	resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagPresentResponse, nil, "PresentResp")
+	resp.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 2, "ref", "RefId"))
 	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 24, 0, "Returned"))
-	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 25, 0, "NextPos"))
-	resp.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 26, true, "Status"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 25, int64(next), "Next"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 27, presentStatusFailure, "Status"))
+	resp.AppendChild(diag.Encode(130))
 	conn.Write(resp.Bytes())
 }
 
-func (s *Server) handlePresent(conn net.Conn, connID string, req *ber.Packet) {
+func (s *Server) handlePresent(ctx context.Context, conn net.Conn, connID string, req *ber.Packet) {
 	reqCount, startPoint := 1, 1
+	syntax := ""
+	setName := "default"
+	elementSet := ""
 	for _, c := range req.Children {
-		if c.Tag == 29 { if v, ok := c.Value.(int64); ok { reqCount = int(v) } }
-		if c.Tag == 30 { if v, ok := c.Value.(int64); ok { startPoint = int(v) } }
+		if c.ClassType != ber.ClassContext { continue }
+		switch c.Tag {
+		case 29: reqCount = int(z3950.DecodeInt(c))
+		case 30: startPoint = int(z3950.DecodeInt(c))
+		case 31: setName = z3950.DecodeString(c)
+		case 19: elementSet = z3950.ParseElementSetNames(c)
+		case 104: syntax = z3950.PacketOID(c)
+		}
 	}
 
 	s.mu.RLock()
 	sess, ok := s.sessions[connID]
+	var rs *ResultSet
+	var charset string
+	var agreed z3950.InitParams
+	if ok { rs, charset, agreed = sess.ResultSets[setName], sess.Charset, sess.Init }
 	s.mu.RUnlock()
 	if !ok { return }
 
-	ids := sess.ResultIDs
+	if rs == nil {
+		writePresentDiagnostic(conn, startPoint, z3950.NewDiagnostic(z3950.DiagResultSetNotFound, setName))
+		return
+	}
+	syntax = s.recordSyntax(rs, syntax)
+	if !supportedSyntax(syntax) {
+		slog.Warn("unsupported record syntax", "conn_id", connID, "syntax", syntax)
+		writePresentDiagnostic(conn, startPoint, z3950.NewDiagnostic(z3950.DiagRecordSyntaxUnsupported, syntax))
+		return
+	}
+
+	ids := rs.IDs
+	if startPoint < 1 || startPoint > len(ids) || reqCount < 0 {
+		writePresentDiagnostic(conn, startPoint, z3950.NewDiagnostic(z3950.DiagPresentOutOfRange, fmt.Sprintf("start %d, %d records in set", startPoint, len(ids))))
+		return
+	}
 	startIdx := startPoint - 1
-	if startIdx < 0 { startIdx = 0 }
 	endIdx := startIdx + reqCount
 	if endIdx > len(ids) { endIdx = len(ids) }
-	
-	var subsetIDs []string
-	if startIdx < len(ids) { subsetIDs = ids[startIdx:endIdx] }
-	
-	records, _ := s.provider.Fetch(sess.DBName, subsetIDs)
-	slog.Info("present processed", "conn_id", connID, "returned", len(records))
-
-	profile := &z3950.ProfileMARC21
-	if strings.Contains(strings.ToUpper(sess.DBName), "CNMARC") { profile = &z3950.ProfileCNMARC }
-	if strings.Contains(strings.ToUpper(sess.DBName), "UNIMARC") { profile = &z3950.ProfileUNIMARC }
+	recordsWrapper, returned, status, diag := s.presentRecords(ctx, connID, rs, ids[startIdx:endIdx], syntax, elementSet, charset, agreed)
+	if diag != nil {
+		writePresentDiagnostic(conn, startPoint, diag)
+		return
+	}
+	slog.Info("present processed", "conn_id", connID, "result_set", setName, "returned", returned, "syntax", syntax, "element_set", elementSet)
 
 	resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagPresentResponse, nil, "PresentResp")
 	resp.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 2, "ref", "RefId"))
-	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 29, int64(len(records)), "Returned"))
-	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 30, 0, "Next"))
-	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 27, 0, "Status"))
-	
-	recordsWrapper := ber.Encode(ber.ClassContext, ber.TypeConstructed, 28, nil, "Records")
-	for _, rec := range records {
-		marcData := z3950.BuildMARC(profile, "", rec.GetTitle(profile), rec.GetAuthor(profile), rec.GetISBN(profile), rec.GetPublisher(profile), "", rec.GetISSN(profile), rec.GetSubject(profile))
-		
-		namePlusRecord := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Record")
-		dbRecord := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "DBRecord")
-		octet := ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(marcData), "MARC")
-		dbRecord.AppendChild(octet)
-		namePlusRecord.AppendChild(dbRecord)
-		recordsWrapper.AppendChild(namePlusRecord)
-	}
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 24, int64(returned), "Returned"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 25, int64(startIdx+returned+1), "Next"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 27, int64(status), "Status"))
 	resp.AppendChild(recordsWrapper)
 	conn.Write(resp.Bytes())
 }
 
-func (s *Server) handleScan(conn net.Conn, connID string, req *ber.Packet) {
+// Present statuses (PresentStatus).
+const (
+	presentStatusSuccess     = 0
+	presentStatusMessageSize = 2 // partial-2: not all records fit the message
+	presentStatusFailure     = 5
+)
+
+// recordSyntax returns the syntax to present rs in when syntax is asked
+// for: the one asked for, else the one named with the search, else the
+// database's native syntax.
+func (s *Server) recordSyntax(rs *ResultSet, syntax string) string {
+	if syntax == "" {
+		syntax = rs.RecordSyntax
+	}
+	if syntax == "" {
+		syntax = syntaxForProfile(s.nativeProfile(rs.DBName))
+	}
+	return syntax
+}
+
+// presentRecords fetches the records of rs behind ids and encodes them in
+// syntax and elementSet as the Records of a Present or Search response,
+// returning how many it holds and the presentStatus, or a diagnostic when
+// the element set is unknown or the records cannot be fetched.
+//
+// Records are sent while they fit in the preferred message size. One
+// larger than the exceptional record size is replaced by diagnostic 17; a
+// first record too large for the message is only sent when it was asked
+// for alone, and is otherwise replaced by diagnostic 16.
+func (s *Server) presentRecords(ctx context.Context, connID string, rs *ResultSet, ids []string, syntax, elementSet, charset string, agreed z3950.InitParams) (*ber.Packet, int, int, *z3950.Diagnostic) {
+	if !s.knownElementSet(elementSet) {
+		slog.Warn("unknown element set", "conn_id", connID, "element_set", elementSet)
+		return nil, 0, presentStatusFailure, z3950.NewDiagnostic(z3950.DiagElementSetInvalid, elementSet)
+	}
+	// Custom element sets are selected from full records
+	fetchSet := z3950.ElementSetFull
+	if strings.EqualFold(elementSet, z3950.ElementSetBrief) {
+		fetchSet = z3950.ElementSetBrief
+	}
+	records, err := s.provider.Fetch(ctx, rs.DBName, ids, fetchSet)
+	if err != nil {
+		slog.Error("provider fetch failed", "error", err, "conn_id", connID)
+		return nil, 0, presentStatusFailure, providerDiagnostic(err)
+	}
+
+	profile := s.nativeProfile(rs.DBName)
+	wrapper := ber.Encode(ber.ClassContext, ber.TypeConstructed, 28, nil, "Records")
+	status := presentStatusSuccess
+	size, returned := 0, 0
+	for i, rec := range records {
+		npr := namePlusRecord(rs.DBName, s.encodeRecord(s.selectElements(rec, elementSet, profile), syntax, profile, charset))
+		n := len(npr.Bytes())
+		switch {
+		case n > agreed.ExceptionalRecordSize:
+			npr = surrogateDiagnostic(rs.DBName, z3950.NewDiagnostic(z3950.DiagRecordExceedsRecordSize, strconv.Itoa(n)))
+		case size+n > agreed.PreferredMessageSize && i == 0 && len(ids) > 1:
+			npr = surrogateDiagnostic(rs.DBName, z3950.NewDiagnostic(z3950.DiagRecordExceedsMessageSize, strconv.Itoa(n)))
+		case size+n > agreed.PreferredMessageSize && i > 0:
+			status = presentStatusMessageSize
+		}
+		if status != presentStatusSuccess {
+			break
+		}
+		size += len(npr.Bytes())
+		wrapper.AppendChild(npr)
+		returned++
+	}
+	slog.Debug("records encoded", "conn_id", connID, "returned", returned, "syntax", syntax, "element_set", elementSet, "bytes", size)
+	return wrapper, returned, status, nil
+}
+
+// namePlusRecord wraps an encoded record in a NamePlusRecord of db.
+func namePlusRecord(db string, external *ber.Packet) *ber.Packet {
+	npr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "NamePlusRecord")
+	npr.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, db, "Name"))
+	record := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "Record")
+	retrieval := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "RetrievalRecord")
+	retrieval.AppendChild(external)
+	record.AppendChild(retrieval)
+	npr.AppendChild(record)
+	return npr
+}
+
+// surrogateDiagnostic is a NamePlusRecord standing in for a record of db
+// that cannot be sent.
+func surrogateDiagnostic(db string, diag *z3950.Diagnostic) *ber.Packet {
+	npr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "NamePlusRecord")
+	npr.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, db, "Name"))
+	record := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "Record")
+	sd := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "SurrogateDiagnostic")
+	sd.AppendChild(diag.Encode(ber.TagSequence))
+	record.AppendChild(sd)
+	npr.AppendChild(record)
+	return npr
+}
+
+// Delete result set statuses (DeleteSetStatus).
+const (
+	deleteStatusSuccess          = 0
+	deleteStatusDidNotExist      = 1
+	deleteStatusNotAllRequested  = 9
+)
+
+func (s *Server) handleDeleteResultSet(conn net.Conn, connID string, req *ber.Packet) {
+	deleteAll := false
+	var names []string
+	for _, c := range req.Children {
+		switch {
+		case c.ClassType == ber.ClassContext && c.Tag == 32:
+			deleteAll = z3950.DecodeInt(c) == 1
+		case c.ClassType == ber.ClassContext && c.Tag == 31:
+			names = append(names, z3950.DecodeString(c))
+		case c.ClassType == ber.ClassUniversal && c.Tag == ber.TagSequence:
+			for _, id := range c.Children { names = append(names, z3950.DecodeString(id)) }
+		}
+	}
+
+	resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagDeleteResultSetResponse, nil, "DeleteResultSetResp")
+	s.mu.Lock()
+	sess, ok := s.sessions[connID]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	if deleteAll {
+		var sets []*ResultSet
+		for _, rs := range sess.ResultSets {
+			sets = append(sets, rs)
+		}
+		sess.ResultSets = make(map[string]*ResultSet)
+		dropped := droppedIDs(sess, sets...)
+		s.mu.Unlock()
+		s.release(dropped)
+		resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 0, deleteStatusSuccess, "DeleteOperationStatus"))
+		conn.Write(resp.Bytes())
+		slog.Info("result sets deleted", "conn_id", connID, "all", true)
+		return
+	}
+
+	overall := deleteStatusSuccess
+	statuses := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "DeleteListStatuses")
+	var deleted []*ResultSet
+	for _, name := range names {
+		status := deleteStatusSuccess
+		if rs, exists := sess.ResultSets[name]; exists {
+			delete(sess.ResultSets, name)
+			deleted = append(deleted, rs)
+		} else {
+			status = deleteStatusDidNotExist
+			overall = deleteStatusNotAllRequested
+		}
+		entry := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "ListStatus")
+		entry.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 31, name, "ResultSetId"))
+		entry.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 33, int64(status), "DeleteSetStatus"))
+		statuses.AppendChild(entry)
+	}
+	dropped := droppedIDs(sess, deleted...)
+	s.mu.Unlock()
+	s.release(dropped)
+
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 0, int64(overall), "DeleteOperationStatus"))
+	resp.AppendChild(statuses)
+	conn.Write(resp.Bytes())
+	slog.Info("result sets deleted", "conn_id", connID, "names", names, "status", overall)
+}
+
+// droppedIDs returns, by database, the ids of the dropped result sets that
+// no result set left in sess still holds. Call it with s.mu held, once the
+// dropped sets are gone from sess; nil sets are skipped.
+func droppedIDs(sess *Session, dropped ...*ResultSet) map[string][]string {
+	inUse := make(map[string]map[string]bool)
+	for _, rs := range sess.ResultSets {
+		if inUse[rs.DBName] == nil {
+			inUse[rs.DBName] = make(map[string]bool)
+		}
+		for _, id := range rs.IDs {
+			inUse[rs.DBName][id] = true
+		}
+	}
+	ids := make(map[string][]string)
+	for _, rs := range dropped {
+		if rs == nil {
+			continue
+		}
+		for _, id := range rs.IDs {
+			if !inUse[rs.DBName][id] {
+				ids[rs.DBName] = append(ids[rs.DBName], id)
+			}
+		}
+	}
+	return ids
+}
+
+// release lets the provider free what it holds for ids, such as remote
+// result sets kept open for Present.
+func (s *Server) release(ids map[string][]string) {
+	for db, dbIDs := range ids {
+		releaseResults(s.provider, db, dbIDs)
+	}
+}
+
+// releaseResults tells p, if it holds anything for the ids of db that a
+// Search returned, that they are no longer needed.
+func releaseResults(p provider.Provider, db string, ids []string) {
+	if r, ok := p.(provider.ResultReleaser); ok && len(ids) > 0 {
+		r.Release(db, ids)
+	}
+}
+
+// searchPage returns the page of a search at query.Offset. A session from
+// an earlier page names results p kept, and the page is read from them
+// instead of searching again; once they have expired the search runs
+// again. The session returned names the results for the next page, or is
+// "" when p does not keep them.
+func searchPage(ctx context.Context, p provider.Provider, db, session string, query z3950.StructuredQuery) ([]string, int, string, error) {
+	pager, ok := p.(provider.ResultPager)
+	if ok && session != "" {
+		ids, total, err := pager.Page(ctx, db, session, query.Offset, query.Limit)
+		if err == nil {
+			return ids, total, session, nil
+		}
+		if !errors.Is(err, provider.ErrResultsExpired) {
+			return nil, 0, "", err
+		}
+	}
+	ids, total, err := p.Search(ctx, db, query)
+	if err != nil || !ok {
+		return ids, total, "", err
+	}
+	return ids, total, pager.ResultSession(db, ids), nil
+}
+
+func writeSortDiagnostic(conn net.Conn, diag *z3950.Diagnostic) {
+	conn.Write(z3950.EncodeSortResponse(z3950.SortStatusFailure, 0, diag).Bytes())
+}
+
+// handleSort answers a SortRequest by putting the input result set's ids
+// in the order of the request's keys, into the output result set, which
+// may be the input itself. One input set is sorted at a time, on the
+// attributes the providers sort on.
+func (s *Server) handleSort(ctx context.Context, conn net.Conn, connID string, req *ber.Packet) {
+	sortReq, diag := z3950.ParseSortRequest(req)
+	switch {
+	case diag != nil:
+	case len(sortReq.Input) == 0 || sortReq.Output == "":
+		diag = z3950.NewDiagnostic(z3950.DiagSortNoResultSet, "")
+	case len(sortReq.Input) > 1:
+		diag = z3950.NewDiagnostic(z3950.DiagSortTooManyInputs, strconv.Itoa(len(sortReq.Input)))
+	case len(sortReq.Keys) == 0:
+		diag = z3950.NewDiagnostic(z3950.DiagSortSequenceUnsupported, "no sort keys")
+	}
+	for _, k := range sortReq.Keys {
+		if diag == nil && !provider.SortableAttribute(k.Attribute) {
+			diag = z3950.NewDiagnostic(z3950.DiagSortSequenceUnsupported, fmt.Sprintf("use attribute %d", k.Attribute))
+		}
+	}
+	if diag != nil {
+		slog.Warn("sort refused", "conn_id", connID, "code", diag.Code, "info", diag.AddInfo)
+		writeSortDiagnostic(conn, diag)
+		return
+	}
+
+	s.mu.RLock()
+	sess, ok := s.sessions[connID]
+	var input, existing *ResultSet
+	numSets := 0
+	namedSets := false
+	if ok {
+		input = sess.ResultSets[sortReq.Input[0]]
+		existing = sess.ResultSets[sortReq.Output]
+		numSets = len(sess.ResultSets)
+		namedSets = sess.Init.Options.Has(z3950.OptionNamedResultSets)
+	}
+	s.mu.RUnlock()
+	if !ok { return }
+	switch {
+	case input == nil:
+		diag = z3950.NewDiagnostic(z3950.DiagResultSetNotFound, sortReq.Input[0])
+	case sortReq.Output != "default" && !namedSets:
+		diag = z3950.NewDiagnostic(z3950.DiagNamedSetsUnsupported, sortReq.Output)
+	case existing == nil && numSets >= s.maxResultSets:
+		diag = z3950.NewDiagnostic(z3950.DiagTooManyResultSets, strconv.Itoa(s.maxResultSets))
+	}
+	if diag != nil {
+		writeSortDiagnostic(conn, diag)
+		return
+	}
+
+	sorter, ok := s.provider.(provider.IDSorter)
+	if !ok {
+		writeSortDiagnostic(conn, z3950.NewDiagnostic(z3950.DiagSortSequenceUnsupported, "database "+input.DBName))
+		return
+	}
+	ids, err := sorter.SortIDs(ctx, input.DBName, input.IDs, sortReq.Keys)
+	if err != nil {
+		slog.Error("provider sort failed", "error", err, "conn_id", connID)
+		writeSortDiagnostic(conn, providerDiagnostic(err))
+		return
+	}
+
+	s.mu.Lock()
+	replaced := sess.ResultSets[sortReq.Output]
+	sess.ResultSets[sortReq.Output] = &ResultSet{IDs: ids, DBName: input.DBName, RecordSyntax: input.RecordSyntax}
+	dropped := droppedIDs(sess, replaced)
+	s.mu.Unlock()
+	s.release(dropped)
+
+	slog.Info("sort processed", "conn_id", connID, "input", sortReq.Input[0], "output", sortReq.Output, "keys", len(sortReq.Keys), "count", len(ids))
+	conn.Write(z3950.EncodeSortResponse(z3950.SortStatusSuccess, len(ids), nil).Bytes())
+}
+
+// recordToISO2709 serializes the record the provider fetched, keeping every
+// field, indicator and subfield. A record is only synthesized from the
+// friendly fields when there is no MARC data to serve (e.g. SUTRS).
+func recordToISO2709(rec *z3950.MARCRecord, profile *z3950.MARCProfile) []byte {
+	if rec.Leader != "SUTRS" && len(rec.Fields) > 0 {
+		return rec.MarshalISO2709()
+	}
+	return buildFromFriendly(rec, profile, profile)
+}
+
+// buildFromFriendly synthesizes a record in the target profile from the
+// values read with the source profile.
+func buildFromFriendly(rec *z3950.MARCRecord, source, target *z3950.MARCProfile) []byte {
+	return z3950.BuildMARC(target, rec.RecordID, rec.GetTitle(source), rec.GetAuthor(source), rec.GetISBN(source), rec.GetPublisher(source), "", rec.GetISSN(source), rec.GetSubject(source))
+}
+
+// nativeProfile is the MARC flavour the provider stores for a database:
+// ZSERVER_MARC_FORMAT, overridden by CNMARC/UNIMARC database names.
+func (s *Server) nativeProfile(dbName string) *z3950.MARCProfile {
+	upper := strings.ToUpper(dbName)
+	if strings.Contains(upper, "CNMARC") { return &z3950.ProfileCNMARC }
+	if strings.Contains(upper, "UNIMARC") { return &z3950.ProfileUNIMARC }
+	return s.profile
+}
+
+func syntaxForProfile(profile *z3950.MARCProfile) string {
+	if profile == &z3950.ProfileMARC21 { return z3950.OID_MARC21 }
+	return z3950.OID_UNIMARC
+}
+
+func supportedSyntax(oid string) bool {
+	switch oid {
+	case z3950.OID_MARC21, z3950.OID_UNIMARC, z3950.OID_SUTRS, z3950.OID_XML, z3950.OID_OPAC:
+		return true
+	}
+	return false
+}
+
+// encodeRecord renders a fetched record in the requested record syntax and
+// charset and wraps it in an EXTERNAL. MARC records in the native flavour
+// are served as stored; the other MARC flavour is rebuilt from the
+// friendly fields.
+func (s *Server) encodeRecord(rec *z3950.MARCRecord, syntax string, native *z3950.MARCProfile, charset string) *ber.Packet {
+	marc := func(target string) []byte {
+		var data []byte
+		if target == syntaxForProfile(native) {
+			data = recordToISO2709(rec, native)
+		} else if target == z3950.OID_MARC21 {
+			data = buildFromFriendly(rec, native, &z3950.ProfileMARC21)
+		} else {
+			data = buildFromFriendly(rec, native, &z3950.ProfileUNIMARC)
+		}
+		if charset == "MARC-8" {
+			if converted, err := z3950.ToMARC8(data); err == nil {
+				data = converted
+			}
+		}
+		return data
+	}
+
+	switch syntax {
+	case z3950.OID_SUTRS:
+		ext := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagExternal, nil, "External")
+		ext.AppendChild(z3950.NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, syntax, "DirectReference"))
+		single := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "SingleASN1Type")
+		single.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagGeneralString, rec.FormatSUTRS(), "SUTRS"))
+		ext.AppendChild(single)
+		return ext
+	case z3950.OID_XML:
+		return z3950.NewExternal(ber.ClassUniversal, ber.TagExternal, syntax, rec.MarshalMARCXML(), "External")
+	case z3950.OID_OPAC:
+		bibSyntax := syntaxForProfile(native)
+		ext := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagExternal, nil, "External")
+		ext.AppendChild(z3950.NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, syntax, "DirectReference"))
+		single := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "SingleASN1Type")
+		single.AppendChild(z3950.BuildOPACRecord(bibSyntax, marc(bibSyntax), rec.Holdings))
+		ext.AppendChild(single)
+		return ext
+	default:
+		return z3950.NewExternal(ber.ClassUniversal, ber.TagExternal, syntax, marc(syntax), "External")
+	}
+}
+
+// scanFields maps Bib-1 Use attributes to the fields providers can scan.
+var scanFields = map[int]string{
+	0:                                "title",
+	z3950.UseAttributeTitle:          "title",
+	z3950.UseAttributePersonalName:   "author",
+	z3950.UseAttributeAuthor:         "author",
+	z3950.UseAttributeSubject:        "subject",
+	z3950.UseAttributeISBN:           "isbn",
+	z3950.UseAttributeISSN:           "issn",
+}
+
+func writeScanResponse(conn net.Conn, results []provider.ScanResult, diag *z3950.Diagnostic) {
+	status := 0 // success
+	if diag != nil { status = 6 } // failure
+	resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagScanResponse, nil, "ScanResp")
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 3, 0, "StepSize"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 4, int64(status), "ScanStatus"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 5, int64(len(results)), "NumberOfEntriesReturned"))
+	resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 6, 1, "PositionOfTerm"))
+	listEntries := ber.Encode(ber.ClassContext, ber.TypeConstructed, 7, nil, "ListEntries")
+	if diag != nil {
+		diags := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "NonsurrogateDiagnostics")
+		diags.AppendChild(diag.Encode(ber.TagSequence))
+		listEntries.AppendChild(diags)
+	} else {
+		entries := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "Entries")
+		for _, res := range results {
+			termInfo := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "TermInfo")
+			termInfo.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 45, res.Term, "Term"))
+			termInfo.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 2, int64(res.Count), "GlobalOccurrences"))
+			entries.AppendChild(termInfo)
+		}
+		listEntries.AppendChild(entries)
+	}
+	resp.AppendChild(listEntries)
+	conn.Write(resp.Bytes())
+}
+
+func (s *Server) handleScan(ctx context.Context, conn net.Conn, connID string, req *ber.Packet) {
 	term := ""
-	var findTerm func(*ber.Packet)
-	findTerm = func(p *ber.Packet) {
-		if p.Tag == 45 {
-			if val, ok := p.Value.([]byte); ok { term = string(val) } else { term = string(p.Data.Bytes()) }
+	use := 0
+	var dbNames []string
+	var walk func(*ber.Packet)
+	walk = func(p *ber.Packet) {
+		switch {
+		case p.Tag == 45 && p.ClassType == ber.ClassContext:
+			term = z3950.DecodeString(p)
+		case p.Tag == 44 && p.ClassType == ber.ClassContext:
+			use = attributeValues(p)[1]
 		}
-		for _, c := range p.Children { findTerm(c) }
+		for _, c := range p.Children { walk(c) }
+	}
+	walk(req)
+	for _, c := range req.Children {
+		if c.Tag == 3 && c.ClassType == ber.ClassContext { dbNames = parseDatabaseNames(c) }
 	}
-	findTerm(req)
-	
-	// Default field for Z39.50 scan is often Title if not specified in attributes.
-	// For simplicity, we assume Title unless we parse attributes fully.
-	// (Real Z39.50 scan requests carry attributes just like search)
-	field := "title" 
 
 	s.mu.RLock()
 	sess, ok := s.sessions[connID]
 	s.mu.RUnlock()
 	dbName := "Default"
 	if ok { dbName = sess.DBName }
+	if len(dbNames) > 0 { dbName = dbNames[0] }
+
+	if db := s.deniedDatabase(connID, dbName); db != "" {
+		slog.Warn("database access denied", "conn_id", connID, "db", db)
+		writeScanResponse(conn, nil, z3950.NewDiagnostic(z3950.DiagDatabaseAccessDenied, db))
+		return
+	}
 
-	results, _ := s.provider.Scan(dbName, field, term)
+	field, supported := scanFields[use]
+	if !supported {
+		writeScanResponse(conn, nil, z3950.NewDiagnostic(z3950.DiagUnsupportedUseAttribute, strconv.Itoa(use)))
+		return
+	}
+
+	results, err := s.provider.Scan(ctx, dbName, field, term)
+	if err != nil {
+		slog.Error("provider scan failed", "error", err, "conn_id", connID)
+		writeScanResponse(conn, nil, providerDiagnostic(err))
+		return
+	}
 	slog.Info("scan processed", "term", term, "found", len(results))
-	
-	resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagScanResponse, nil, "ScanResp")
-	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Step"))
-	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Status"))
-	resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(len(results)), "Count"))
-	entriesWrapper := ber.Encode(ber.ClassContext, ber.TypeConstructed, 7, nil, "Entries")
-	listEntries := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "List")
-	for _, res := range results {
-		entry := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Entry")
-		termInfo := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "TermInfo")
-		termInfo.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 45, res.Term, "Term"))
-		termInfo.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 2, int64(res.Count), "Count"))
-		entry.AppendChild(termInfo)
-		listEntries.AppendChild(entry)
-	}
-	entriesWrapper.AppendChild(listEntries)
-	resp.AppendChild(entriesWrapper)
-	conn.Write(resp.Bytes())
+	writeScanResponse(conn, results, nil)
 }
 
 // --- Gateway and Main Logic ---
@@ -425,32 +1300,11 @@ func authMiddleware() gin.HandlerFunc {
 	requiredKey := os.Getenv("GATEWAY_API_KEY")
 	
 	return func(c *gin.Context) {
-		// 1. Check for legacy API Key (header or query)
-		apiKey := c.GetHeader("X-API-Key")
-		if apiKey == "" {
-			apiKey = c.Query("apikey")
-		}
-		if requiredKey != "" && apiKey == requiredKey {
-			c.Set("username", "api-key-user")
-			c.Set("role", "admin")
+		if authenticateRequest(c, requiredKey) {
 			c.Next()
 			return
 		}
 
-		// 2. Check for JWT (Authorization: Bearer <token>)
-		authHeader := c.GetHeader("Authorization")
-		if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
-			tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-			claims, err := auth.ParseToken(tokenString)
-			if err == nil {
-				c.Set("username", claims.Username)
-				c.Set("role", claims.Role)
-				c.Set("userID", claims.UserID)
-				c.Next()
-				return
-			}
-		}
-
 		// 3. Unauthorized
 		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 			"error": "Unauthorized: Invalid API Key or Token",
@@ -458,7 +1312,201 @@ func authMiddleware() gin.HandlerFunc {
 	}
 }
 
+// authenticateRequest checks the API key or JWT of c and, when one is
+// valid, sets username and role (and userID for a JWT) on c.
+func authenticateRequest(c *gin.Context, requiredKey string) bool {
+	// 1. Check for legacy API Key (header or query)
+	apiKey := c.GetHeader("X-API-Key")
+	if apiKey == "" {
+		apiKey = c.Query("apikey")
+	}
+	if requiredKey != "" && apiKey == requiredKey {
+		c.Set("username", "api-key-user")
+		c.Set("role", "admin")
+		return true
+	}
+
+	// 2. Check for JWT (Authorization: Bearer <token>)
+	authHeader := c.GetHeader("Authorization")
+	if authHeader != "" && strings.HasPrefix(authHeader, "Bearer ") {
+		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+		claims, err := auth.ParseToken(tokenString)
+		if err == nil {
+			c.Set("username", claims.Username)
+			c.Set("role", claims.Role)
+			c.Set("userID", claims.UserID)
+			return true
+		}
+	}
+	return false
+}
+
+// searchRequest reads the query, sort and paging parameters shared by
+// /api/search and /api/search/stream.
+func searchRequest(c *gin.Context) (z3950.StructuredQuery, int, int, error) {
+	// A PQF or CQL query takes precedence over the term1/attr1/op2...
+	// parameters.
+	var structuredQuery z3950.StructuredQuery
+	var err error
+	if pqf := c.Query("pqf"); pqf != "" {
+		if structuredQuery, err = z3950.ParsePQF(pqf); err != nil {
+			return structuredQuery, 0, 0, err
+		}
+	} else if cql := c.Query("cql"); cql != "" {
+		if structuredQuery, err = z3950.ParseCQL(cql); err != nil {
+			return structuredQuery, 0, 0, err
+		}
+	} else {
+		root, err := queryFromParams(c)
+		if err != nil {
+			return structuredQuery, 0, 0, err
+		}
+		structuredQuery.Root = root
+	}
+
+	// Parse Sort Options
+	sortAttrStr := c.Query("sortAttr")
+	sortOrderStr := c.Query("sortOrder") // "asc" or "desc"
+
+	var sortKeys []z3950.SortKey
+	if sortAttrStr != "" {
+		attr, _ := strconv.Atoi(sortAttrStr)
+		relation := 0 // Ascending
+		if sortOrderStr == "desc" {
+			relation = 1 // Descending
+		}
+		sortKeys = append(sortKeys, z3950.SortKey{Attribute: attr, Relation: relation})
+	}
+
+	if len(sortKeys) > 0 {
+		structuredQuery.SortKeys = sortKeys
+	}
+
+	// Paging: page is 1-based; pageSize is capped so one request
+	// cannot pull a whole remote result set.
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return structuredQuery, 0, 0, errors.New("page must be a positive integer")
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("pageSize", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 {
+		return structuredQuery, 0, 0, errors.New("pageSize must be a positive integer")
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	structuredQuery.Offset = (page - 1) * pageSize
+	structuredQuery.Limit = pageSize
+	return structuredQuery, page, pageSize, nil
+}
+
+// queryFromParams builds a left-associated query tree from the term1/attr1,
+// term2/attr2/op2, ... search parameters ("query" is accepted for term1).
+func queryFromParams(c *gin.Context) (z3950.QueryNode, error) {
+	var root z3950.QueryNode
+
+	// First term
+	term1 := c.Query("term1")
+	if term1 == "" {
+		term1 = c.Query("query") // Fallback for simple query
+	}
+	if term1 == "" {
+		return nil, fmt.Errorf("Missing query")
+	}
+	
+	attr1Str := c.Query("attr1")
+	attr1 := z3950.UseAttributeAny
+	if attr1Str != "" {
+		attr1, _ = strconv.Atoi(attr1Str)
+	}
+	
+	root = z3950.QueryClause{Attribute: attr1, Term: term1}
+
+	// Subsequent terms
+	for i := 2; ; i++ {
+		termKey := fmt.Sprintf("term%d", i)
+		term, exists := c.GetQuery(termKey)
+		if !exists { break }
+		
+		attrKey := fmt.Sprintf("attr%d", i)
+		attrStr := c.Query(attrKey)
+		attr := z3950.UseAttributeAny
+		if attrStr != "" {
+			attr, _ = strconv.Atoi(attrStr)
+		}
+		
+		opKey := fmt.Sprintf("op%d", i)
+		operator := c.DefaultQuery(opKey, "AND")
+		
+		// Build tree: Complex(Root, NewClause)
+		root = z3950.QueryComplex{
+			Operator: operator,
+			Left:     root,
+			Right:    z3950.QueryClause{Attribute: attr, Term: term},
+		}
+	}
+
+	return root, nil
+}
+
 // setupRouter initializes the Gin engine and routes
+// recordJSON is the /api/search representation of a record.
+func recordJSON(rec *z3950.MARCRecord) map[string]interface{} {
+	if rec.Leader == "SUTRS" {
+		// Special handling for text records
+		txt := ""
+		if len(rec.Fields) > 0 { txt = rec.Fields[0].Value }
+		return map[string]interface{}{
+			"title": "Text Record",
+			"raw":   txt,
+			"format": "SUTRS",
+		}
+	}
+	return map[string]interface{}{
+		"record_id": rec.RecordID,
+		"title":     rec.Title,
+		"author":    rec.Author,
+		"isbn":      rec.ISBN,
+		"issn":      rec.ISSN,
+		"subject":   rec.Subject,
+		"publisher": rec.Publisher,
+		"summary":   rec.Summary,
+		"toc":       rec.TOC,
+		"edition":   rec.Edition,
+		"physical":  rec.PhysicalDescription,
+		"series":    rec.Series,
+		"notes":     rec.Notes,
+		"leader":    rec.Leader,
+		"fields":    rec.Fields,
+		"holdings":  rec.Holdings,
+	}
+}
+
+// sourcedRecordJSON is recordJSON tagged with the record's database.
+func sourcedRecordJSON(r provider.SourcedRecord) map[string]interface{} {
+	item := recordJSON(r.Record)
+	item["source"] = r.Source
+	return item
+}
+
+// clustersJSON lists each cluster's preferred record, with every member of
+// a cluster of several records under members.
+func clustersJSON(clusters []provider.Cluster) []map[string]interface{} {
+	results := make([]map[string]interface{}, 0)
+	for _, cl := range clusters {
+		item := sourcedRecordJSON(cl.Preferred)
+		if len(cl.Members) > 1 {
+			members := make([]map[string]interface{}, len(cl.Members))
+			for i, m := range cl.Members {
+				members[i] = sourcedRecordJSON(m)
+			}
+			item["members"] = members
+		}
+		results = append(results, item)
+	}
+	return results
+}
+
 func setupRouter(dbProvider provider.Provider) *gin.Engine {
 	r := gin.New()
 	r.Use(gin.Recovery())
@@ -476,7 +1524,7 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 			return
 		}
 
-		user, err := dbProvider.GetUserByUsername(creds.Username)
+		user, err := dbProvider.GetUserByUsername(c.Request.Context(), creds.Username)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 			return
@@ -523,7 +1571,7 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 			Role:         "user",
 		}
 
-		if err := dbProvider.CreateUser(user); err != nil {
+		if err := dbProvider.CreateUser(c.Request.Context(), user); err != nil {
 			slog.Error("failed to create user", "error", err)
 			c.JSON(409, gin.H{"error": "Username already exists or create failed"})
 			return
@@ -532,84 +1580,93 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 		c.JSON(201, gin.H{"status": "success", "message": "User created"})
 	})
 
+	// SRU is public for the local catalogue; proxied targets need the
+	// API key or a token
+	registerSRU(r, dbProvider)
+
 	// Protected API routes
 	api := r.Group("/api")
 	api.Use(authMiddleware())
 
+	api.GET("/search/stream", searchStreamHandler(dbProvider))
+
 	api.GET("/search", func(c *gin.Context) {
 		start := time.Now()
 		db := c.DefaultQuery("db", "LCDB")
 
-		// --- Parse URL parameters into a structured Tree (Left-associated) ---
-		var root z3950.QueryNode
-
-		// First term
-		term1 := c.Query("term1")
-		if term1 == "" {
-			term1 = c.Query("query") // Fallback for simple query
-		}
-		if term1 == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing query"})
+		structuredQuery, page, pageSize, err := searchRequest(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		
-		attr1Str := c.Query("attr1")
-		attr1 := z3950.UseAttributeAny
-		if attr1Str != "" {
-			attr1, _ = strconv.Atoi(attr1Str)
-		}
-		
-		root = z3950.QueryClause{Attribute: attr1, Term: term1}
-
-		// Subsequent terms
-		for i := 2; ; i++ {
-			termKey := fmt.Sprintf("term%d", i)
-			term, exists := c.GetQuery(termKey)
-			if !exists { break }
-			
-			attrKey := fmt.Sprintf("attr%d", i)
-			attrStr := c.Query(attrKey)
-			attr := z3950.UseAttributeAny
-			if attrStr != "" {
-				attr, _ = strconv.Atoi(attrStr)
+		// The result list only needs brief records; /api/books has the full ones
+		structuredQuery.ElementSet = z3950.ElementSetBrief
+		ctx := c.Request.Context()
+
+		// Several databases, or the virtual federated one, are searched
+		// at once; targets that fail are listed next to the results.
+		if hybrid, ok := dbProvider.(*provider.HybridProvider); ok {
+			if dbs, ok := hybrid.FederatedDatabases(ctx, db); ok {
+				// Later pages pass back the page token of the first
+				fed := hybrid.FederatedSearch(ctx, dbs, structuredQuery, c.Query("session"))
+
+				// Records found in several databases are shown once, from
+				// the preferred database, with every copy under members;
+				// dedup=false lists each copy on its own.
+				var clusters []provider.Cluster
+				if dedup, _ := strconv.ParseBool(c.DefaultQuery("dedup", "true")); dedup {
+					clusters = provider.Deduplicate(fed.Records, hybrid.TargetPriority)
+				} else {
+					for _, r := range fed.Records {
+						clusters = append(clusters, provider.Cluster{Preferred: r, Members: []provider.SourcedRecord{r}})
+					}
+				}
+				results := clustersJSON(clusters)
+				slog.Info("federated search completed",
+					"query", z3950.FormatPQF(structuredQuery),
+					"databases", dbs,
+					"found", fed.Total,
+					"page", page,
+					"fetched", len(fed.Records),
+					"clusters", len(results),
+					"latency_ms", time.Since(start).Milliseconds(),
+				)
+				status := "success"
+				for _, t := range fed.Targets {
+					if t.Error != "" {
+						status = "partial"
+					}
+				}
+				c.JSON(200, gin.H{
+					"status":   status,
+					"found":    fed.Total,
+					"total":    fed.Total,
+					"page":     page,
+					"pageSize": pageSize,
+					"data":     results,
+					"targets":  fed.Targets,
+					"session":  fed.Session,
+				})
+				return
 			}
-			
-			opKey := fmt.Sprintf("op%d", i)
-			operator := c.DefaultQuery(opKey, "AND")
-			
-			// Build tree: Complex(Root, NewClause)
-			root = z3950.QueryComplex{
-				Operator: operator,
-				Left:     root,
-				Right:    z3950.QueryClause{Attribute: attr, Term: term},
-			                        }
-			                }
-			
-			                // Parse Sort Options
-			                sortAttrStr := c.Query("sortAttr")
-			                sortOrderStr := c.Query("sortOrder") // "asc" or "desc"
-			                
-			                var sortKeys []z3950.SortKey
-			                if sortAttrStr != "" {
-			                        attr, _ := strconv.Atoi(sortAttrStr)
-			                        relation := 0 // Ascending
-			                        if sortOrderStr == "desc" {
-			                                relation = 1 // Descending
-			                        }
-			                        sortKeys = append(sortKeys, z3950.SortKey{Attribute: attr, Relation: relation})
-			                }
-			
-			                structuredQuery := z3950.StructuredQuery{Root: root, SortKeys: sortKeys}
-			                // --- END ---
-		// DIRECT CALL TO PROVIDER
-		ids, err := dbProvider.Search(db, structuredQuery)
+		}
+
+		// DIRECT CALL TO PROVIDER. Later pages pass back the session of
+		// the first, so a target's result set is paged, not searched again.
+		ids, total, session, err := searchPage(ctx, dbProvider, db, c.Query("session"), structuredQuery)
 		if err != nil {
 			slog.Error("provider search failed", "error", err)
+			if errors.Is(err, z3950.ErrAuthentication) {
+				// The target refused the gateway's credentials, which
+				// retrying will not fix
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Search: " + err.Error(), "error_type": "authentication"})
+				return
+			}
 			c.JSON(500, gin.H{"error": "Search: " + err.Error()})
 			return
 		}
 
-		records, err := dbProvider.Fetch(db, ids)
+		records, err := dbProvider.Fetch(ctx, db, ids, structuredQuery.ElementSet)
 		if err != nil {
 			slog.Error("provider fetch failed", "error", err)
 			c.JSON(500, gin.H{"error": "Fetch: " + err.Error()})
@@ -618,56 +1675,37 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 
 		results := make([]map[string]interface{}, 0)
 		for _, rec := range records {
-			if rec.Leader == "SUTRS" {
-				// Special handling for text records
-				txt := ""
-				if len(rec.Fields) > 0 { txt = rec.Fields[0].Value }
-				results = append(results, map[string]interface{}{
-					"title": "Text Record",
-					"raw":   txt,
-					"format": "SUTRS",
-				})
-			} else {
-				results = append(results, map[string]interface{}{
-					"record_id": rec.RecordID,
-					"title":     rec.Title,
-					"author":    rec.Author,
-					"isbn":      rec.ISBN,
-					"issn":      rec.ISSN,
-					"subject":   rec.Subject,
-					"publisher": rec.Publisher,
-					"summary":   rec.Summary,
-					"toc":       rec.TOC,
-					"edition":   rec.Edition,
-					"physical":  rec.PhysicalDescription,
-					"series":    rec.Series,
-					"notes":     rec.Notes,
-					"leader":    rec.Leader,
-					"fields":    rec.Fields,
-					"holdings":  rec.Holdings,
-				})
-			}
+			results = append(results, recordJSON(rec))
 		}
 
 		elapsed := time.Since(start)
 		slog.Info("search request completed",
-			"found", len(ids),
+			"query", z3950.FormatPQF(structuredQuery),
+			"found", total,
+			"page", page,
 			"fetched", len(results),
 			"latency_ms", elapsed.Milliseconds(),
 		)
 
-		c.JSON(200, gin.H{
-			"status": "success",
-			"found":  len(ids),
-			"data":   results,
-		})
+		resp := gin.H{
+			"status":   "success",
+			"found":    total,
+			"total":    total,
+			"page":     page,
+			"pageSize": pageSize,
+			"data":     results,
+		}
+		if session != "" {
+			resp["session"] = session
+		}
+		c.JSON(200, resp)
 	})
 
 	api.GET("/books/:db/:id", func(c *gin.Context) {
 		db := c.Param("db")
 		id := c.Param("id")
 		
-		records, err := dbProvider.Fetch(db, []string{id})
+		records, err := dbProvider.Fetch(c.Request.Context(), db, []string{id}, z3950.ElementSetFull)
 		if err != nil {
 			slog.Error("failed to fetch book", "db", db, "id", id, "error", err)
 			c.JSON(500, gin.H{"error": "Fetch failed: " + err.Error()})
@@ -722,7 +1760,7 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 			req.Requestor = "anonymous" // Should not happen with authMiddleware
 		}
 
-		if err := dbProvider.CreateILLRequest(req); err != nil {
+		if err := dbProvider.CreateILLRequest(c.Request.Context(), req); err != nil {
 			slog.Error("failed to create ILL request", "error", err)
 			c.JSON(500, gin.H{"error": "Failed to create request: " + err.Error()})
 			return
@@ -733,7 +1771,7 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 	})
 
 	api.GET("/ill-requests", func(c *gin.Context) {
-		requests, err := dbProvider.ListILLRequests()
+		requests, err := dbProvider.ListILLRequests(c.Request.Context())
 		if err != nil {
 			slog.Error("failed to list ILL requests", "error", err)
 			c.JSON(500, gin.H{"error": "Failed to list requests: " + err.Error()})
@@ -762,7 +1800,7 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 	})
 
 	api.GET("/targets", func(c *gin.Context) {
-		targets, err := dbProvider.ListTargets()
+		targets, err := dbProvider.ListTargets(c.Request.Context())
 		if err != nil {
 			c.JSON(500, gin.H{"error": "Failed to list targets"})
 			return
@@ -789,7 +1827,7 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 			return
 		}
 
-		results, err := dbProvider.Scan(db, field, term)
+		results, err := dbProvider.Scan(c.Request.Context(), db, field, term)
 		if err != nil {
 			slog.Error("provider scan failed", "db", db, "term", term, "error", err)
 			c.JSON(500, gin.H{"error": "Scan: " + err.Error()})
@@ -820,13 +1858,13 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 		}
 
 		// Fetch existing request to get details for notification
-		existingReq, err := dbProvider.GetILLRequest(id)
+		existingReq, err := dbProvider.GetILLRequest(c.Request.Context(), id)
 		if err != nil {
 			c.JSON(404, gin.H{"error": "Request not found"})
 			return
 		}
 
-		if err := dbProvider.UpdateILLRequestStatus(id, body.Status); err != nil {
+		if err := dbProvider.UpdateILLRequestStatus(c.Request.Context(), id, body.Status); err != nil {
 			slog.Error("failed to update ILL request status", "id", id, "status", body.Status, "error", err)
 			c.JSON(500, gin.H{"error": "Failed to update status: " + err.Error()})
 			return
@@ -858,7 +1896,7 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 	})
 
 	admin.GET("/targets", func(c *gin.Context) {
-		targets, err := dbProvider.ListTargets()
+		targets, err := dbProvider.ListTargets(c.Request.Context())
 		if err != nil {
 			c.JSON(500, gin.H{"error": "Failed to list targets"})
 			return
@@ -872,7 +1910,7 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
 			return
 		}
-		if err := dbProvider.CreateTarget(&t); err != nil {
+		if err := dbProvider.CreateTarget(c.Request.Context(), &t); err != nil {
 			c.JSON(500, gin.H{"error": "Failed to create target: " + err.Error()})
 			return
 		}
@@ -880,33 +1918,80 @@ func setupRouter(dbProvider provider.Provider) *gin.Engine {
 	})
 
 	admin.POST("/targets/test", func(c *gin.Context) {
+		// A stored target can be tested by name; its stored details and
+		// credentials fill in whatever the request leaves out.
 		var t struct {
-			Host string `json:"host" binding:"required"`
-			Port int    `json:"port" binding:"required"`
+			Name         string `json:"name"`
+			Host         string `json:"host"`
+			Port         int    `json:"port"`
+			DatabaseName string `json:"database_name"`
+			Protocol     string `json:"protocol"`
+			AuthUser     string `json:"auth_user"`
+			AuthPass     string `json:"auth_password"`
 		}
 		if err := c.BindJSON(&t); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
 			return
 		}
+		if t.Name != "" {
+			if stored, err := dbProvider.GetTargetByName(c.Request.Context(), t.Name); err == nil {
+				if t.Host == "" {
+					t.Host, t.Port = stored.Host, stored.Port
+				}
+				if t.DatabaseName == "" {
+					t.DatabaseName = stored.DatabaseName
+				}
+				if t.Protocol == "" {
+					t.Protocol = stored.Protocol
+				}
+				if t.AuthUser == "" && t.AuthPass == "" {
+					t.AuthUser, t.AuthPass = stored.AuthUser, stored.AuthPass
+				}
+			}
+		}
+		if t.Host == "" || t.Port == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "host and port are required"})
+			return
+		}
+
+		if strings.EqualFold(t.Protocol, provider.ProtocolSRU) {
+			baseURL := provider.SRUBaseURL(t.Host, t.Port, t.DatabaseName)
+			if err := sru.NewClient(baseURL).Explain(c.Request.Context()); err != nil {
+				c.JSON(200, gin.H{"status": "error", "error_type": "connection", "message": "Explain request failed: " + err.Error()})
+				return
+			}
+			c.JSON(200, gin.H{"status": "success", "message": "SRU server answered the explain request at " + baseURL})
+			return
+		}
 
 		client := z3950.NewClient(t.Host, t.Port)
-		if err := client.Connect(); err != nil {
-			c.JSON(200, gin.H{"status": "error", "message": "Connection failed: " + err.Error()})
+		client.Auth = provider.TargetAuthentication(t.AuthUser, t.AuthPass)
+		if err := client.Connect(c.Request.Context()); err != nil {
+			c.JSON(200, gin.H{"status": "error", "error_type": "connection", "message": "Connection failed: " + err.Error()})
 			return
 		}
 		defer client.Close()
 
-		if err := client.Init(); err != nil {
-			c.JSON(200, gin.H{"status": "error", "message": "Handshake failed: " + err.Error()})
+		if err := client.Init(c.Request.Context()); err != nil {
+			if errors.Is(err, z3950.ErrAuthentication) {
+				c.JSON(200, gin.H{"status": "error", "error_type": "authentication", "message": "Authentication failed: the target rejected the user name or password."})
+				return
+			}
+			c.JSON(200, gin.H{"status": "error", "error_type": "handshake", "message": "Handshake failed: " + err.Error()})
 			return
 		}
 
-		c.JSON(200, gin.H{"status": "success", "message": "Connection and Handshake successful!"})
+		// charset is what the target agreed to at Init, "" if it did not negotiate
+		if client.Auth.IsZero() {
+			c.JSON(200, gin.H{"status": "success", "message": "Connection and Handshake successful!", "charset": client.Charset})
+			return
+		}
+		c.JSON(200, gin.H{"status": "success", "message": "Connection, Handshake and Authentication successful!", "charset": client.Charset})
 	})
 
 	admin.DELETE("/targets/:id", func(c *gin.Context) {
 		id, _ := strconv.ParseInt(c.Param("id"), 10, 64)
-		if err := dbProvider.DeleteTarget(id); err != nil {
+		if err := dbProvider.DeleteTarget(c.Request.Context(), id); err != nil {
 			c.JSON(500, gin.H{"error": "Failed to delete target"})
 			return
 		}
@@ -933,6 +2018,31 @@ func main() {
 		slog.Info("self-test passed", "title", parsed.GetTitle(nil), "fields", len(parsed.Fields))
 	}
 
+	if !z3950.MARC8CodeTablesEmbedded() && os.Getenv("MARC8_CODE_TABLES") == "" {
+		slog.Warn("built without the MARC-8 code tables: EACC, Hebrew, Arabic and Greek MARC-8 records will not decode; run go generate ./pkg/z3950 or set MARC8_CODE_TABLES")
+	}
+	if path := os.Getenv("MARC8_CODE_TABLES"); path != "" {
+		if f, err := os.Open(path); err != nil {
+			slog.Error("failed to open MARC-8 code tables", "path", path, "error", err)
+		} else {
+			if err := z3950.LoadMARC8CodeTables(f); err != nil {
+				slog.Error("failed to load MARC-8 code tables", "path", path, "error", err)
+			}
+			f.Close()
+		}
+	}
+
+	if path := os.Getenv("CQL_MAP_FILE"); path != "" {
+		if f, err := os.Open(path); err != nil {
+			slog.Error("failed to open CQL mapping", "path", path, "error", err)
+		} else {
+			if err := z3950.DefaultCQLMapping.Load(f); err != nil {
+				slog.Error("failed to load CQL mapping", "path", path, "error", err)
+			}
+			f.Close()
+		}
+	}
+
 	// 1. Initialize Provider
 	var dbProvider provider.Provider
 	var err error
@@ -963,6 +2073,26 @@ func main() {
 
 	// Wrap with HybridProvider to support remote targets
 	hybridProvider := provider.NewHybridProvider(dbProvider)
+	if name := os.Getenv("FEDERATED_DB"); name != "" {
+		hybridProvider.FederatedDB = name
+	}
+	if dbs := os.Getenv("FEDERATED_DATABASES"); dbs != "" {
+		for _, name := range strings.Split(dbs, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hybridProvider.FederatedMembers = append(hybridProvider.FederatedMembers, name)
+			}
+		}
+	}
+	if dbs := os.Getenv("FEDERATED_PRIORITY"); dbs != "" {
+		for _, name := range strings.Split(dbs, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hybridProvider.TargetPriority = append(hybridProvider.TargetPriority, name)
+			}
+		}
+	}
+	if n, err := strconv.Atoi(os.Getenv("FEDERATED_TIMEOUT")); err == nil && n > 0 {
+		hybridProvider.TargetTimeout = time.Duration(n) * time.Second
+	}
 	// Update the main dbProvider variable to point to the hybrid one
 	dbProvider = hybridProvider
 
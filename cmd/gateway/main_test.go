@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/yourusername/open-z3950-gateway/pkg/provider"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// startZServer serves s on a loopback port until the test ends and
+// returns the port.
+func startZServer(t *testing.T, s *Server) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleConnection(conn)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// dialZServer opens a raw connection to the server on port.
+func dialZServer(t *testing.T, port int) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// exchange sends pdu and returns the server's answer.
+func exchange(t *testing.T, conn net.Conn, pdu *ber.Packet) *ber.Packet {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(pdu.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ber.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return resp
+}
+
+// initRequest proposes every service the server offers, anonymously.
+func initRequest() *ber.Packet {
+	return z3950.EncodeInitRequest(z3950.InitParams{
+		Versions: z3950.Bits(z3950.Version2, z3950.Version3),
+		Options: z3950.Bits(z3950.OptionSearch, z3950.OptionPresent, z3950.OptionDeleteResultSet,
+			z3950.OptionScan, z3950.OptionSort, z3950.OptionNamedResultSets),
+	}, nil)
+}
+
+// child returns the first context-class child of p with tag, or nil.
+func child(p *ber.Packet, tag ber.Tag) *ber.Packet {
+	for _, c := range p.Children {
+		if c.ClassType == ber.ClassContext && c.Tag == tag {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestDeleteResultSet(t *testing.T) {
+	s := NewServer(provider.NewMemoryProvider())
+	conn := dialZServer(t, startZServer(t, s))
+	exchange(t, conn, initRequest())
+
+	s.mu.Lock()
+	sess := s.sessions[conn.LocalAddr().String()]
+	sess.ResultSets["default"] = &ResultSet{IDs: []string{"1"}, DBName: "Default"}
+	sess.ResultSets["kept"] = &ResultSet{IDs: []string{"2"}, DBName: "Default"}
+	s.mu.Unlock()
+
+	req := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagDeleteResultSetRequest, nil, "DeleteResultSetRequest")
+	req.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 32, 0, "List"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 31, "default", "ResultSetId"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 31, "missing", "ResultSetId"))
+	resp, err := ber.DecodePacketErr(exchange(t, conn, req).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Tag != TagDeleteResultSetResponse {
+		t.Fatalf("response tag = %d", resp.Tag)
+	}
+	if status := child(resp, 0); status == nil || z3950.DecodeInt(status) != deleteStatusNotAllRequested {
+		t.Errorf("deleteOperationStatus = %v, want %d", status, deleteStatusNotAllRequested)
+	}
+	statuses := child(resp, 1)
+	if statuses == nil || len(statuses.Children) != 2 {
+		t.Fatalf("deleteListStatuses = %v", statuses)
+	}
+	for i, want := range []struct {
+		name   string
+		status int64
+	}{{"default", deleteStatusSuccess}, {"missing", deleteStatusDidNotExist}} {
+		entry := statuses.Children[i]
+		id, status := child(entry, 31), child(entry, 33)
+		if id == nil || z3950.DecodeString(id) != want.name || status == nil || z3950.DecodeInt(status) != want.status {
+			t.Errorf("status %d: id %v, [33] status %v, want %s %d", i, id, status, want.name, want.status)
+		}
+	}
+
+	s.mu.RLock()
+	_, deleted := sess.ResultSets["default"]
+	_, kept := sess.ResultSets["kept"]
+	s.mu.RUnlock()
+	if deleted || !kept {
+		t.Errorf("after delete: default present %v, kept present %v", deleted, kept)
+	}
+}
+
+// releaseRecorder records the ids released from it.
+type releaseRecorder struct {
+	*provider.MemoryProvider
+	mu       sync.Mutex
+	released []string
+}
+
+func (r *releaseRecorder) Release(db string, ids []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range ids {
+		r.released = append(r.released, db+":"+id)
+	}
+}
+
+// waitReleased waits for r to have released exactly want, in any order.
+func (r *releaseRecorder) waitReleased(t *testing.T, want ...string) {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		r.mu.Lock()
+		got = slices.Sorted(slices.Values(r.released))
+		r.mu.Unlock()
+		if slices.Equal(got, slices.Sorted(slices.Values(want))) {
+			r.mu.Lock()
+			r.released = nil
+			r.mu.Unlock()
+			return
+		}
+	}
+	t.Fatalf("released %v, want %v", got, want)
+}
+
+func TestResultSetsReleased(t *testing.T) {
+	p := &releaseRecorder{MemoryProvider: provider.NewMemoryProvider()}
+	s := NewServer(p)
+	conn := dialZServer(t, startZServer(t, s))
+	exchange(t, conn, initRequest())
+
+	s.mu.Lock()
+	sess := s.sessions[conn.LocalAddr().String()]
+	sess.ResultSets["default"] = &ResultSet{IDs: []string{"1", "2"}, DBName: "Remote"}
+	sess.ResultSets["kept"] = &ResultSet{IDs: []string{"2", "3"}, DBName: "Remote"}
+	s.mu.Unlock()
+
+	// Ids still in another result set are not released with a deleted one.
+	req := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagDeleteResultSetRequest, nil, "DeleteResultSetRequest")
+	req.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 32, 0, "List"))
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 31, "default", "ResultSetId"))
+	exchange(t, conn, req)
+	p.waitReleased(t, "Remote:1")
+
+	// Closing the connection releases whatever is left.
+	conn.Close()
+	p.waitReleased(t, "Remote:2", "Remote:3")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/yourusername/open-z3950-gateway/pkg/provider"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// sortSet sends a SortRequest and returns the sortStatus and, for a
+// failure, the diagnostic code.
+func sortSet(t *testing.T, conn net.Conn, req z3950.SortRequest) (status, code int) {
+	t.Helper()
+	resp, err := ber.DecodePacketErr(exchange(t, conn, req.Encode()).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Tag != TagSortResponse {
+		t.Fatalf("response tag = %d", resp.Tag)
+	}
+	if s := child(resp, 3); s != nil {
+		status = int(z3950.DecodeInt(s))
+	}
+	if diags := child(resp, 5); diags != nil && len(diags.Children) > 0 {
+		code = z3950.ParseDiagnostic(diags.Children[0]).Code
+	}
+	return status, code
+}
+
+func TestSort(t *testing.T) {
+	s := NewServer(provider.NewHybridProvider(provider.NewMemoryProvider()))
+	conn := dialZServer(t, startZServer(t, s))
+	exchange(t, conn, initRequest())
+
+	// Books 1 "Thinking in Go" by Rob Pike, 2 "Z39.50 for Dummies" by
+	// Index Data and 4 "SaaS Architecture" by Gemini. The stored ids are
+	// sorted, so book 3, which no stored set holds, never appears.
+	s.mu.Lock()
+	sess := s.sessions[conn.LocalAddr().String()]
+	sess.ResultSets["default"] = &ResultSet{IDs: []string{"2", "4", "1"}, DBName: "Default"}
+	sess.ResultSets["remote"] = &ResultSet{IDs: []string{"s:1", "s:2"}, DBName: "Remote"}
+	s.mu.Unlock()
+	sets := func() map[string][]string {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		ids := make(map[string][]string)
+		for name, rs := range sess.ResultSets {
+			ids[name] = rs.IDs
+		}
+		return ids
+	}
+
+	title := []z3950.SortKey{{Attribute: z3950.UseAttributeTitle}}
+	if status, code := sortSet(t, conn, z3950.SortRequest{Input: []string{"default"}, Output: "sorted", Keys: title}); status != z3950.SortStatusSuccess {
+		t.Fatalf("sort into a named set: status %d, diagnostic %d", status, code)
+	}
+	got := sets()
+	if want := []string{"4", "1", "2"}; !slices.Equal(got["sorted"], want) {
+		t.Errorf("sorted = %v, want %v", got["sorted"], want)
+	}
+	if want := []string{"2", "4", "1"}; !slices.Equal(got["default"], want) {
+		t.Errorf("input changed to %v, want %v", got["default"], want)
+	}
+
+	// Sorting a set in place, by author then newest first
+	keys := []z3950.SortKey{{Attribute: z3950.UseAttributeAuthor}, {Attribute: z3950.UseAttributeDatePub, Relation: z3950.SortDescending}}
+	if status, code := sortSet(t, conn, z3950.SortRequest{Input: []string{"default"}, Output: "default", Keys: keys}); status != z3950.SortStatusSuccess {
+		t.Fatalf("sort in place: status %d, diagnostic %d", status, code)
+	}
+	if got, want := sets()["default"], []string{"4", "2", "1"}; !slices.Equal(got, want) {
+		t.Errorf("default = %v, want %v", got, want)
+	}
+
+	failures := []struct {
+		name string
+		req  z3950.SortRequest
+		code int
+	}{
+		{"Unsortable attribute", z3950.SortRequest{Input: []string{"default"}, Output: "default", Keys: []z3950.SortKey{{Attribute: z3950.UseAttributeISBN}}}, z3950.DiagSortSequenceUnsupported},
+		{"Missing input", z3950.SortRequest{Input: []string{"missing"}, Output: "default", Keys: title}, z3950.DiagResultSetNotFound},
+		{"Target result set", z3950.SortRequest{Input: []string{"remote"}, Output: "remote", Keys: title}, z3950.DiagSortSequenceUnsupported},
+	}
+	for _, tc := range failures {
+		t.Run(tc.name, func(t *testing.T) {
+			if status, code := sortSet(t, conn, tc.req); status != z3950.SortStatusFailure || code != tc.code {
+				t.Errorf("status %d, diagnostic %d; want failure with %d", status, code, tc.code)
+			}
+		})
+	}
+	if got := sets()["remote"]; !slices.Equal(got, []string{"s:1", "s:2"}) {
+		t.Errorf("failed sort changed the target's set to %v", got)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yourusername/open-z3950-gateway/pkg/provider"
+	"github.com/yourusername/open-z3950-gateway/pkg/sru"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+const (
+	sruDefaultRecords = 10
+	sruMaxRecords     = 100
+	sruDefaultTerms   = 10
+)
+
+// sruRequest holds the parameters common to every SRU operation. GET and
+// POST (application/x-www-form-urlencoded) requests are both accepted.
+type sruRequest struct {
+	c       *gin.Context
+	db      string
+	version string
+	user    string              // from the API key or token; "" when anonymous
+	limits  map[string][]string // ZSERVER_USER_DATABASES
+}
+
+func (r *sruRequest) param(name string) string {
+	if v, ok := r.c.GetQuery(name); ok {
+		return v
+	}
+	return r.c.PostForm(name)
+}
+
+// intParam parses an optional positive integer parameter.
+func (r *sruRequest) intParam(name string, def int) (int, *sru.Diagnostic) {
+	s := r.param(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, sru.NewDiagnostic(sru.DiagUnsupportedParameterValue, name)
+	}
+	return n, nil
+}
+
+// access checks that the client may search every database named in r.db.
+// Anonymous clients only reach the local catalogue, and the limits apply
+// to them and to logged-in users as over Z39.50.
+func (r *sruRequest) access() *sru.Diagnostic {
+	for _, db := range strings.Split(r.db, ",") {
+		if (r.user == "" && !provider.IsLocalDB(db)) || !mayUseDatabase(r.limits, r.user, db) {
+			return sru.NewDiagnostic(sru.DiagAuthenticationError, db)
+		}
+	}
+	return nil
+}
+
+func (r *sruRequest) write(body []byte) {
+	r.c.Data(http.StatusOK, "text/xml; charset=utf-8", body)
+}
+
+// registerSRU serves SRU 1.2 and 2.0 at /sru (the local catalogue) and
+// /sru/<database>, which may name any configured proxy target. Searching
+// a target takes the API key or a token, as for /api.
+func registerSRU(r *gin.Engine, dbProvider provider.Provider) {
+	requiredKey := os.Getenv("GATEWAY_API_KEY")
+	limits := loadUserDatabases()
+	handler := func(c *gin.Context) {
+		db := c.Param("db")
+		if db == "" {
+			db = "Default"
+		}
+		req := &sruRequest{c: c, db: db, limits: limits}
+		if authenticateRequest(c, requiredKey) {
+			req.user = c.GetString("username")
+		}
+		handleSRU(req, dbProvider)
+	}
+	r.GET("/sru", handler)
+	r.POST("/sru", handler)
+	r.GET("/sru/:db", handler)
+	r.POST("/sru/:db", handler)
+}
+
+func handleSRU(req *sruRequest, dbProvider provider.Provider) {
+	c, db := req.c, req.db
+	operation := req.param("operation")
+
+	// SRU 2.0 drops the operation parameter and infers it from the
+	// request; a 1.x client always sends one.
+	req.version = req.param("version")
+	if req.version == "" {
+		if operation != "" {
+			req.version = "1.2"
+		} else {
+			req.version = "2.0"
+		}
+	}
+	if operation == "" {
+		switch {
+		case req.param("query") != "":
+			operation = "searchRetrieve"
+		case req.param("scanClause") != "":
+			operation = "scan"
+		default:
+			operation = "explain"
+		}
+	}
+
+	switch req.version {
+	case "1.1", "1.2", "2.0":
+	default:
+		req.version = "1.2"
+		req.write(sru.MarshalExplain(req.version, sruExplainInfo(c, db), []*sru.Diagnostic{
+			sru.NewDiagnostic(sru.DiagUnsupportedVersion, "1.2"),
+		}))
+		return
+	}
+
+	switch operation {
+	case "searchRetrieve":
+		sruSearchRetrieve(req, dbProvider)
+	case "scan":
+		sruScan(req, dbProvider)
+	case "explain":
+		req.write(sru.MarshalExplain(req.version, sruExplainInfo(c, db), nil))
+	default:
+		req.write(sru.MarshalExplain(req.version, sruExplainInfo(c, db), []*sru.Diagnostic{
+			sru.NewDiagnostic(sru.DiagUnsupportedOperation, operation),
+		}))
+	}
+}
+
+func sruSearchRetrieve(req *sruRequest, dbProvider provider.Provider) {
+	start := time.Now()
+	fail := func(d *sru.Diagnostic) {
+		req.write(sru.MarshalSearchRetrieve(req.version, 0, nil, 0, []*sru.Diagnostic{d}))
+	}
+	if diag := req.access(); diag != nil {
+		fail(diag)
+		return
+	}
+
+	cql := req.param("query")
+	if cql == "" {
+		fail(sru.NewDiagnostic(sru.DiagMandatoryParameterMissing, "query"))
+		return
+	}
+	startRecord, diag := req.intParam("startRecord", 1)
+	if diag != nil {
+		fail(diag)
+		return
+	}
+	if startRecord < 1 {
+		fail(sru.NewDiagnostic(sru.DiagUnsupportedParameterValue, "startRecord"))
+		return
+	}
+	maximumRecords, diag := req.intParam("maximumRecords", sruDefaultRecords)
+	if diag != nil {
+		fail(diag)
+		return
+	}
+	if maximumRecords > sruMaxRecords {
+		maximumRecords = sruMaxRecords
+	}
+
+	schema := sru.SchemaMARCXML
+	if s := req.param("recordSchema"); s != "" {
+		if id, ok := sru.Schemas[s]; ok {
+			schema = id
+		} else if s == sru.SchemaMARCXML || s == sru.SchemaDC {
+			schema = s
+		} else {
+			fail(sru.NewDiagnostic(sru.DiagUnknownSchema, s))
+			return
+		}
+	}
+	packingParam := "recordPacking"
+	if sru.Is20(req.version) {
+		packingParam = "recordXMLEscaping"
+	}
+	packing := req.param(packingParam)
+	switch packing {
+	case "":
+		packing = "xml"
+	case "xml", "string":
+	default:
+		fail(sru.NewDiagnostic(sru.DiagUnsupportedRecordPacking, packing))
+		return
+	}
+
+	// Only the requested page is searched for; a count-only request still
+	// asks for one id, as a limit of 0 would mean every hit.
+	offset, limit := startRecord-1, maximumRecords
+	if limit == 0 {
+		limit = 1
+	}
+	ctx := req.c.Request.Context()
+	pager, _ := dbProvider.(provider.ResultPager)
+	var ids []string
+	var total int
+	var set sru.ResultSet
+	var err error
+	if id, ok := sru.ResultSetID(cql); ok {
+		// A later page of the result set an earlier request named
+		if pager == nil {
+			fail(sru.NewDiagnostic(sru.DiagResultSetNotFound, id))
+			return
+		}
+		ids, total, err = pager.Page(ctx, req.db, id, offset, limit)
+		if errors.Is(err, provider.ErrResultsExpired) {
+			fail(sru.NewDiagnostic(sru.DiagResultSetNotFound, id))
+			return
+		}
+		set.ID = id
+	} else {
+		var query z3950.StructuredQuery
+		if query, err = z3950.ParseCQL(cql); err != nil {
+			fail(sru.DiagnosticFromError(err))
+			return
+		}
+		query.Offset, query.Limit = offset, limit
+		ids, total, err = dbProvider.Search(ctx, req.db, query)
+		if err == nil && pager != nil {
+			set.ID = pager.ResultSession(req.db, ids)
+		}
+	}
+	if err != nil {
+		slog.Error("sru search failed", "db", req.db, "error", err)
+		fail(sru.DiagnosticFromError(err))
+		return
+	}
+	if set.ID != "" {
+		set.IdleTime = int(pager.ResultTimeout().Seconds())
+	}
+
+	var records []sru.Record
+	next := 0
+	if maximumRecords > 0 && total > 0 {
+		if startRecord > total {
+			req.write(sru.MarshalSearchRetrieve(req.version, total, nil, 0, []*sru.Diagnostic{
+				sru.NewDiagnostic(sru.DiagFirstRecordOutOfRange, strconv.Itoa(startRecord)),
+			}))
+			return
+		}
+		if len(ids) > maximumRecords {
+			ids = ids[:maximumRecords]
+		}
+		fetched, err := dbProvider.Fetch(ctx, req.db, ids, z3950.ElementSetFull)
+		if err != nil {
+			slog.Error("sru fetch failed", "db", req.db, "error", err)
+			fail(sru.DiagnosticFromError(err))
+			return
+		}
+		for i, rec := range fetched {
+			data := rec.MarshalMARCXML()
+			if schema == sru.SchemaDC {
+				data = sru.DublinCore(rec)
+			}
+			records = append(records, sru.Record{
+				Schema:   schema,
+				Packing:  packing,
+				Data:     data,
+				Position: startRecord + i,
+			})
+		}
+		if end := startRecord - 1 + len(ids); end < total {
+			next = end + 1
+		}
+	}
+
+	slog.Info("sru searchRetrieve", "db", req.db, "query", cql, "total", total, "returned", len(records), "duration", time.Since(start))
+	req.write(sru.MarshalSearchRetrieveSet(req.version, total, set, records, next, nil))
+}
+
+func sruScan(req *sruRequest, dbProvider provider.Provider) {
+	fail := func(d *sru.Diagnostic) {
+		req.write(sru.MarshalScan(req.version, nil, []*sru.Diagnostic{d}))
+	}
+	if diag := req.access(); diag != nil {
+		fail(diag)
+		return
+	}
+
+	clause := req.param("scanClause")
+	if clause == "" {
+		fail(sru.NewDiagnostic(sru.DiagMandatoryParameterMissing, "scanClause"))
+		return
+	}
+	maximumTerms, diag := req.intParam("maximumTerms", sruDefaultTerms)
+	if diag != nil {
+		fail(diag)
+		return
+	}
+	// Providers scan forwards from the start term, so the term can only be
+	// placed first (or just before the list).
+	position, diag := req.intParam("responsePosition", 1)
+	if diag != nil {
+		fail(diag)
+		return
+	}
+	if position > 1 {
+		fail(sru.NewDiagnostic(sru.DiagResponsePositionOutOfRange, strconv.Itoa(position)))
+		return
+	}
+
+	query, err := z3950.ParseCQL(clause)
+	if err != nil {
+		fail(sru.DiagnosticFromError(err))
+		return
+	}
+	qc, ok := query.Root.(z3950.QueryClause)
+	if !ok {
+		fail(sru.NewDiagnostic(sru.DiagQuerySyntax, "scanClause must be a single index and term"))
+		return
+	}
+	field, supported := scanFields[qc.Attribute]
+	if !supported {
+		fail(sru.NewDiagnostic(sru.DiagUnsupportedIndex, strconv.Itoa(qc.Attribute)))
+		return
+	}
+
+	results, err := dbProvider.Scan(req.c.Request.Context(), req.db, field, qc.Term)
+	if err != nil {
+		slog.Error("sru scan failed", "db", req.db, "error", err)
+		fail(sru.DiagnosticFromError(err))
+		return
+	}
+	var terms []sru.Term
+	for _, r := range results {
+		if len(terms) >= maximumTerms {
+			break
+		}
+		terms = append(terms, sru.Term{Value: r.Term, NumberOfRecords: r.Count})
+	}
+	req.write(sru.MarshalScan(req.version, terms, nil))
+}
+
+func sruExplainInfo(c *gin.Context, db string) sru.ExplainInfo {
+	host, portStr, err := net.SplitHostPort(c.Request.Host)
+	if err != nil {
+		host, portStr = c.Request.Host, "80"
+	}
+	port, _ := strconv.Atoi(portStr)
+	return sru.ExplainInfo{
+		Host:           host,
+		Port:           port,
+		Database:       c.Request.URL.Path,
+		Title:          db,
+		Indexes:        z3950.DefaultCQLMapping.Indexes(),
+		ContextSets:    z3950.DefaultCQLMapping.ContextSets(),
+		DefaultRecords: sruDefaultRecords,
+		MaxRecords:     sruMaxRecords,
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yourusername/open-z3950-gateway/pkg/provider"
+)
+
+func TestSRUAccess(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("GATEWAY_API_KEY", "secret")
+	t.Setenv("ZSERVER_USER_DATABASES", "")
+	r := gin.New()
+	registerSRU(r, provider.NewMemoryProvider())
+
+	const denied = "diagnostic/1/3<"
+	for _, tc := range []struct {
+		name   string
+		url    string
+		denied bool
+	}{
+		{"anonymous local search", "/sru?query=go", false},
+		{"anonymous target search", "/sru/LCDB?query=go", true},
+		{"anonymous federated search", "/sru/Local,LCDB?query=go", true},
+		{"anonymous target scan", "/sru/LCDB?operation=scan&version=1.2&scanClause=title%3Dgo", true},
+		{"anonymous target explain", "/sru/LCDB", false},
+		{"target search with the API key", "/sru/LCDB?query=go&apikey=secret", false},
+		{"target search with a wrong key", "/sru/LCDB?query=go&apikey=guess", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if got := strings.Contains(w.Body.String(), denied); got != tc.denied {
+				t.Errorf("denied = %v, want %v:\n%s", got, tc.denied, w.Body.String())
+
+			}
+		})
+	}
+
+	// The per-user limits apply to anonymous clients as over Z39.50
+	t.Setenv("ZSERVER_USER_DATABASES", "alice=Local")
+	r = gin.New()
+	registerSRU(r, provider.NewMemoryProvider())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sru?query=go", nil))
+	if !strings.Contains(w.Body.String(), denied) {
+		t.Errorf("anonymous search without an anonymous entry was not denied:\n%s", w.Body.String())
+	}
+}
+
+// pagedProvider keeps every search's results as the session "kept",
+// holding books 1 to 4.
+type pagedProvider struct {
+	*provider.MemoryProvider
+}
+
+func (p pagedProvider) ResultSession(db string, ids []string) string { return "kept" }
+
+func (p pagedProvider) ResultTimeout() time.Duration { return time.Minute }
+
+func (p pagedProvider) Page(ctx context.Context, db, session string, offset, limit int) ([]string, int, error) {
+	if session != "kept" {
+		return nil, 0, provider.ErrResultsExpired
+	}
+	ids := []string{"1", "2", "3", "4"}
+	return ids[min(offset, 4):min(offset+limit, 4)], 4, nil
+}
+
+func TestSRUResultSet(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ZSERVER_USER_DATABASES", "")
+	r := gin.New()
+	registerSRU(r, pagedProvider{provider.NewMemoryProvider()})
+	get := func(url string) string {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w.Body.String()
+	}
+
+	out := get("/sru?version=1.2&query=go")
+	for _, want := range []string{"<resultSetId>kept</resultSetId>", "<resultSetIdleTime>60</resultSetIdleTime>"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("search response missing %s:\n%s", want, out)
+		}
+	}
+
+	// A later page is read from the named result set
+	out = get(`/sru?version=1.2&startRecord=3&query=cql.resultSetId%3D%22kept%22`)
+	for _, want := range []string{"<numberOfRecords>4</numberOfRecords>", "<resultSetId>kept</resultSetId>", "<recordPosition>3</recordPosition>", "<recordPosition>4</recordPosition>"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("page response missing %s:\n%s", want, out)
+		}
+	}
+
+	if out := get(`/sru?version=1.2&query=cql.resultSetId%3Dgone`); !strings.Contains(out, "diagnostic/1/51<") {
+		t.Errorf("expired result set not reported:\n%s", out)
+	}
+}
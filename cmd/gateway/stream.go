@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yourusername/open-z3950-gateway/pkg/provider"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// searchStreamHandler serves /api/search/stream: the databases in db (one,
+// several or the virtual federated one) are searched at once and each
+// one's progress is streamed as it happens, as Server-Sent Events or, with
+// format=ndjson or an application/x-ndjson Accept header, as one JSON
+// object per line. It takes the same parameters as /api/search; page and
+// pageSize select the page of each database's own results, and the done
+// event's session, passed back with a later page, pages the databases
+// whose results are kept instead of searching them again. Before the
+// final done event, a merged event lists every streamed record again with
+// duplicates merged as in /api/search, unless dedup=false.
+func searchStreamHandler(dbProvider provider.Provider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		hybrid, ok := dbProvider.(*provider.HybridProvider)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "streaming search needs remote targets support"})
+			return
+		}
+		db := c.DefaultQuery("db", "LCDB")
+		dbs, ok := hybrid.FederatedDatabases(c.Request.Context(), db)
+		if !ok {
+			dbs = []string{db}
+		}
+		query, _, _, err := searchRequest(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		ndjson := c.Query("format") == "ndjson" ||
+			(c.Query("format") == "" && strings.Contains(c.GetHeader("Accept"), "application/x-ndjson"))
+		if ndjson {
+			c.Header("Content-Type", "application/x-ndjson")
+		} else {
+			c.Header("Content-Type", "text/event-stream")
+		}
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no") // keep proxies from buffering the stream
+		c.Status(http.StatusOK)
+
+		write := func(event string, v interface{}) {
+			data, err := json.Marshal(v)
+			if err != nil {
+				slog.Error("failed to encode stream event", "type", event, "error", err)
+				return
+			}
+			if ndjson {
+				fmt.Fprintf(c.Writer, "%s\n", data)
+			} else {
+				fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data)
+			}
+			c.Writer.Flush()
+		}
+		dedup, _ := strconv.ParseBool(c.DefaultQuery("dedup", "true"))
+		var streamed []provider.SourcedRecord
+		// The result list only needs brief records
+		query.ElementSet = z3950.ElementSetBrief
+		hybrid.FederatedStream(c.Request.Context(), dbs, query, c.Query("session"), func(ev provider.FederatedEvent) {
+			switch ev.Type {
+			case provider.EventRecords:
+				streamed = append(streamed, ev.Records...)
+			case provider.EventDone:
+				if dedup && len(dbs) > 1 {
+					write("merged", gin.H{"type": "merged", "records": clustersJSON(provider.Deduplicate(streamed, hybrid.TargetPriority))})
+				}
+			}
+			write(ev.Type, streamEventJSON(ev))
+		})
+
+		slog.Info("streamed search completed",
+			"query", z3950.FormatPQF(query),
+			"databases", dbs,
+			"latency_ms", time.Since(start).Milliseconds(),
+		)
+	}
+}
+
+// streamEventJSON is the wire form of a stream event; fields that do not
+// apply to the event's type are left out.
+func streamEventJSON(ev provider.FederatedEvent) gin.H {
+	out := gin.H{"type": ev.Type}
+	switch ev.Type {
+	case provider.EventDone:
+		out["total"] = ev.Total
+		out["targets"] = ev.Targets
+		out["session"] = ev.Session
+		return out
+	case provider.EventHits:
+		out["total"] = ev.Total
+	case provider.EventRecords:
+		out["total"] = ev.Total
+		records := make([]map[string]interface{}, len(ev.Records))
+		for i, r := range ev.Records {
+			records[i] = sourcedRecordJSON(r)
+		}
+		out["records"] = records
+	case provider.EventFailed:
+		out["error"] = ev.Error
+		if ev.AuthFailed {
+			out["auth_failed"] = true
+		}
+	}
+	out["db"] = ev.DB
+	if ev.Type != provider.EventConnecting {
+		out["elapsed_ms"] = ev.ElapsedMs
+	}
+	return out
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/auth"
+	"github.com/yourusername/open-z3950-gateway/pkg/provider"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// anonymousUser names the entry of ZSERVER_USER_DATABASES that applies to
+// clients which did not log in.
+const anonymousUser = "anonymous"
+
+// loadUserAccess reads ZSERVER_REQUIRE_AUTH, which refuses anonymous Init
+// requests, and the per-user database limits of ZSERVER_USER_DATABASES.
+func (s *Server) loadUserAccess() {
+	s.requireAuth, _ = strconv.ParseBool(os.Getenv("ZSERVER_REQUIRE_AUTH"))
+	s.userDatabases = loadUserDatabases()
+}
+
+// loadUserDatabases reads ZSERVER_USER_DATABASES, which limits the users
+// it lists to the databases named for them, as in
+// "alice=LCDB,Local;bob=Oxford;anonymous=Local". Keys are lower-cased.
+func loadUserDatabases() map[string][]string {
+	limits := make(map[string][]string)
+	for _, entry := range strings.Split(os.Getenv("ZSERVER_USER_DATABASES"), ";") {
+		user, dbs, ok := strings.Cut(entry, "=")
+		user = strings.ToLower(strings.TrimSpace(user))
+		if !ok || user == "" {
+			continue
+		}
+		var names []string
+		for _, db := range strings.Split(dbs, ",") {
+			if db = strings.TrimSpace(db); db != "" {
+				names = append(names, db)
+			}
+		}
+		limits[user] = names
+	}
+	return limits
+}
+
+// mayUseDatabase reports whether username, or an anonymous client when it
+// is "", may search db under limits. Once any limits are set, anonymous
+// clients only get the databases of the anonymous entry; users that are
+// not listed may search every database.
+func mayUseDatabase(limits map[string][]string, username, db string) bool {
+	if len(limits) == 0 {
+		return true
+	}
+	if username == "" {
+		username = anonymousUser
+	}
+	allowed, limited := limits[strings.ToLower(username)]
+	if !limited {
+		return username != anonymousUser
+	}
+	for _, name := range allowed {
+		if strings.EqualFold(name, db) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the idAuthentication of an InitializeRequest against
+// the gateway's users. Both idPass and an open "user/password" string are
+// accepted. A request without credentials is anonymous, which returns a
+// nil user, or an error when ZSERVER_REQUIRE_AUTH is set.
+func (s *Server) authenticate(ctx context.Context, creds z3950.Authentication) (*provider.User, error) {
+	username, password := creds.UserID, creds.Password
+	if creds.Open != "" {
+		username, password, _ = strings.Cut(creds.Open, "/")
+	}
+	if username == "" {
+		if s.requireAuth {
+			return nil, errors.New("authentication required")
+		}
+		return nil, nil
+	}
+	user, err := s.provider.GetUserByUsername(ctx, username)
+	if err != nil || user == nil || !auth.CheckPassword(password, user.PasswordHash) {
+		return nil, fmt.Errorf("invalid credentials for %q", username)
+	}
+	return user, nil
+}
+
+// sessionUser returns the user connID logged in as, or nil.
+func (s *Server) sessionUser(connID string) *provider.User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if sess, ok := s.sessions[connID]; ok {
+		return sess.User
+	}
+	return nil
+}
+
+// databaseAllowed reports whether the user of sess may search db.
+func (s *Server) databaseAllowed(sess *Session, db string) bool {
+	username := ""
+	if sess.User != nil {
+		username = sess.User.Username
+	}
+	return mayUseDatabase(s.userDatabases, username, db)
+}
+
+// deniedDatabase returns the first of the comma-separated databases in
+// dbName that the user of connID may not search, or "".
+func (s *Server) deniedDatabase(connID, dbName string) string {
+	s.mu.RLock()
+	sess, ok := s.sessions[connID]
+	s.mu.RUnlock()
+	if !ok {
+		return ""
+	}
+	for _, db := range strings.Split(dbName, ",") {
+		if !s.databaseAllowed(sess, db) {
+			return db
+		}
+	}
+	return ""
+}
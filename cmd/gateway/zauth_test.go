@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/yourusername/open-z3950-gateway/pkg/provider"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// initAs sends an Init with idPass credentials and reports whether the
+// server accepted it.
+func initAs(t *testing.T, port int, user, password string) bool {
+	t.Helper()
+	conn := dialZServer(t, port)
+	req := initRequest()
+	auth := z3950.Authentication{UserID: user, Password: password}
+	req = z3950.EncodeInitRequest(z3950.ParseInitParams(req), auth.Encode())
+	resp := exchange(t, conn, req)
+	result := child(resp, 12)
+	if result == nil {
+		t.Fatalf("InitializeResponse without result: %v", resp)
+	}
+	if !z3950.DecodeBool(result) {
+		// A refused client is disconnected
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := ber.ReadPacket(conn); !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("after refusal: read %v, want the connection closed", err)
+		}
+		return false
+	}
+	return true
+}
+
+func TestInitAuthentication(t *testing.T) {
+	s := NewServer(provider.NewMemoryProvider())
+	port := startZServer(t, s)
+
+	if !initAs(t, port, "admin", "admin") {
+		t.Error("valid credentials refused")
+	}
+	if initAs(t, port, "admin", "wrong") {
+		t.Error("bad password accepted")
+	}
+	if initAs(t, port, "nobody", "admin") {
+		t.Error("unknown user accepted")
+	}
+	if !initAs(t, port, "", "") {
+		t.Error("anonymous Init refused without ZSERVER_REQUIRE_AUTH")
+	}
+
+	s.requireAuth = true
+	if initAs(t, port, "", "") {
+		t.Error("anonymous Init accepted with ZSERVER_REQUIRE_AUTH")
+	}
+	if !initAs(t, port, "admin", "admin") {
+		t.Error("valid credentials refused with ZSERVER_REQUIRE_AUTH")
+	}
+}
+
+func TestRequestBeforeLoginCloses(t *testing.T) {
+	s := NewServer(provider.NewMemoryProvider())
+	s.requireAuth = true
+	conn := dialZServer(t, startZServer(t, s))
+
+	search := ber.Encode(ber.ClassContext, ber.TypeConstructed, TagSearchRequest, nil, "SearchRequest")
+	resp := exchange(t, conn, search)
+	if resp.Tag != TagClose {
+		t.Fatalf("response tag = %d, want Close", resp.Tag)
+	}
+	if reason := child(resp, 211); reason == nil || z3950.DecodeInt(reason) != closeReasonSecurityViolation {
+		t.Errorf("closeReason = %v, want %d", reason, closeReasonSecurityViolation)
+	}
+}
+
+func TestDatabaseLimits(t *testing.T) {
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "go"}}
+	search := func(t *testing.T, s *Server, auth z3950.Authentication, db string) error {
+		t.Helper()
+		c := z3950.NewClient("127.0.0.1", startZServer(t, s))
+		c.Auth = auth
+		if err := c.Connect(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		if err := c.Init(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		_, err := c.StructuredSearch(t.Context(), db, query)
+		return err
+	}
+	admin := z3950.Authentication{UserID: "admin", Password: "admin"}
+	denied := func(err error) bool {
+		var diag *z3950.Diagnostic
+		return errors.As(err, &diag) && diag.Code == z3950.DiagDatabaseAccessDenied
+	}
+
+	for _, tc := range []struct {
+		name   string
+		limits string
+		auth   z3950.Authentication
+		db     string
+		denied bool
+	}{
+		{"no limits", "", z3950.Authentication{}, "LCDB", false},
+		{"listed database", "admin=Default", admin, "Default", false},
+		{"unlisted database", "admin=Default", admin, "LCDB", true},
+		{"unlisted user", "alice=Default", admin, "LCDB", false},
+		{"anonymous without an entry", "admin=Default", z3950.Authentication{}, "Default", true},
+		{"anonymous entry", "admin=LCDB;anonymous=Default", z3950.Authentication{}, "Default", false},
+		{"outside the anonymous entry", "anonymous=Default", z3950.Authentication{}, "LCDB", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("ZSERVER_USER_DATABASES", tc.limits)
+			err := search(t, NewServer(provider.NewMemoryProvider()), tc.auth, tc.db)
+			if denied(err) != tc.denied {
+				t.Errorf("search %s: error %v, denied want %v", tc.db, err, tc.denied)
+			}
+			if !tc.denied && err != nil {
+				t.Errorf("search %s failed: %v", tc.db, err)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	
@@ -13,16 +14,17 @@ func main() {
 	port := 210
 	dbName := "gils"
 	term := "computer"
+	ctx := context.Background()
 
 	fmt.Printf("Connecting to %s:%d...\n", host, port)
 	client := z3950.NewClient(host, port)
-	if err := client.Connect(); err != nil {
+	if err := client.Connect(ctx); err != nil {
 		log.Fatalf("Connect failed: %v", err)
 	}
 	defer client.Close()
 	fmt.Println("Connected.")
 
-	if err := client.Init(); err != nil {
+	if err := client.Init(ctx); err != nil {
 		log.Fatalf("Init failed: %v", err)
 	}
 	// Init doesn't return the result boolean in the current client.go implementation (it just checks Tag 21).
@@ -39,7 +41,7 @@ func main() {
 		},
 	}
 
-	count, err := client.StructuredSearch(dbName, query)
+	count, err := client.StructuredSearch(ctx, dbName, query)
 	if err != nil {
 		log.Fatalf("Search failed: %v", err)
 	}
@@ -47,7 +49,7 @@ func main() {
 
 	if count > 0 {
 		fmt.Println("Fetching first record...")
-		recs, err := client.Present(1, 1, z3950.OID_MARC21)
+		recs, err := client.Present(ctx, 1, 1, z3950.OID_MARC21, z3950.ElementSetFull)
 		if err != nil {
 			log.Fatalf("Present failed: %v", err)
 		}
@@ -0,0 +1,293 @@
+package provider
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// Cluster is a group of records judged to describe the same edition.
+// Members holds every record of the group, the preferred one first.
+type Cluster struct {
+	Preferred SourcedRecord
+	Members   []SourcedRecord
+}
+
+// Deduplicate groups records that share a normalized ISBN or ISSN, an
+// LCCN (010), a system control number (035) or a title/author/year key,
+// and picks each group's preferred record: the one from the database
+// listed first in priority (matched case-insensitively, unlisted ones
+// last), or else the first one. Clusters keep the order of their first
+// record.
+func Deduplicate(records []SourcedRecord, priority []string) []Cluster {
+	// Union-find over the records; records sharing any key are joined.
+	parent := make([]int, len(records))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	owner := make(map[string]int)
+	for i, r := range records {
+		for _, key := range DedupKeys(r.Record) {
+			if j, ok := owner[key]; ok {
+				// The lower index becomes the root, keeping clusters in
+				// the order of their first record.
+				a, b := find(i), find(j)
+				if a > b {
+					a, b = b, a
+				}
+				parent[b] = a
+			} else {
+				owner[key] = i
+			}
+		}
+	}
+
+	rank := make(map[string]int, len(priority))
+	for i, db := range priority {
+		rank[strings.ToLower(db)] = i + 1
+	}
+	rankOf := func(db string) int {
+		if r, ok := rank[strings.ToLower(db)]; ok {
+			return r
+		}
+		return len(priority) + 1
+	}
+
+	var clusters []Cluster
+	index := make(map[int]int) // root -> position in clusters
+	for i, r := range records {
+		root := find(i)
+		c, ok := index[root]
+		if !ok {
+			index[root] = len(clusters)
+			clusters = append(clusters, Cluster{Preferred: r, Members: []SourcedRecord{r}})
+			continue
+		}
+		clusters[c].Members = append(clusters[c].Members, r)
+		if rankOf(r.Source) < rankOf(clusters[c].Preferred.Source) {
+			clusters[c].Preferred = r
+		}
+	}
+	for i, c := range clusters {
+		if len(c.Members) < 2 {
+			continue
+		}
+		members := []SourcedRecord{c.Preferred}
+		for _, m := range c.Members {
+			if m != c.Preferred {
+				members = append(members, m)
+			}
+		}
+		clusters[i].Members = members
+	}
+	return clusters
+}
+
+// DedupKeys returns the keys a record is matched on: "isbn:" (ISBN-13),
+// "issn:", "lccn:", "035:" and "tay:" (title/author/year).
+func DedupKeys(rec *z3950.MARCRecord) []string {
+	if rec == nil {
+		return nil
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	isbns := []string{rec.ISBN}
+	for _, f := range rec.GetFields("020") {
+		isbns = append(isbns, f.GetSubfields("a")...)
+	}
+	for _, raw := range isbns {
+		if isbn := normalizeISBN(raw); isbn != "" {
+			add("isbn:" + isbn)
+		}
+	}
+
+	issns := []string{rec.ISSN}
+	for _, f := range rec.GetFields("022") {
+		issns = append(issns, f.GetSubfields("a")...)
+	}
+	for _, raw := range issns {
+		if issn := normalizeISSN(raw); issn != "" {
+			add("issn:" + issn)
+		}
+	}
+
+	for _, f := range rec.GetFields("010") {
+		if lccn := normalizeLCCN(f.GetSubfield("a")); lccn != "" {
+			add("lccn:" + lccn)
+		}
+	}
+	for _, f := range rec.GetFields("035") {
+		for _, raw := range f.GetSubfields("a") {
+			if id := normalizeControlNumber(raw); id != "" {
+				add("035:" + id)
+			}
+		}
+	}
+
+	if key := titleAuthorYearKey(rec); key != "" {
+		add("tay:" + key)
+	}
+	return keys
+}
+
+// normalizeISBN cleans an ISBN and converts an ISBN-10 to its ISBN-13, so
+// both forms of the same book match. Anything that is neither is dropped.
+func normalizeISBN(raw string) string {
+	if fields := strings.Fields(raw); len(fields) > 0 {
+		raw = fields[0] // "0134190440 (pbk.)"
+	}
+	isbn := strings.ToUpper(CleanISBN(raw))
+	switch len(isbn) {
+	case 13:
+		if strings.ContainsRune(isbn, 'X') {
+			return ""
+		}
+		return isbn
+	case 10:
+		if strings.ContainsRune(isbn[:9], 'X') {
+			return ""
+		}
+		isbn13 := "978" + isbn[:9]
+		sum := 0
+		for i, c := range isbn13 {
+			d := int(c - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		return isbn13 + string(rune('0'+(10-sum%10)%10))
+	}
+	return ""
+}
+
+var issnRegex = regexp.MustCompile(`\b(\d{4})-?(\d{3}[\dXx])\b`)
+
+func normalizeISSN(raw string) string {
+	m := issnRegex.FindStringSubmatch(raw)
+	if m == nil {
+		return ""
+	}
+	return m[1] + "-" + strings.ToUpper(m[2])
+}
+
+// normalizeLCCN follows LC's normalization: blanks and anything from a
+// slash on are removed, and the serial part after a hyphen is padded to
+// six digits ("n 79-1234" -> "n79001234").
+func normalizeLCCN(raw string) string {
+	s := strings.Join(strings.Fields(raw), "")
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	if prefix, serial, ok := strings.Cut(s, "-"); ok {
+		if len(serial) < 6 {
+			serial = strings.Repeat("0", 6-len(serial)) + serial
+		}
+		s = prefix + serial
+	}
+	return strings.ToLower(s)
+}
+
+var controlNumberRegex = regexp.MustCompile(`^\(([^)]+)\)\s*(.+)$`)
+
+// normalizeControlNumber keeps 035 numbers that name their organization,
+// "(OCoLC)ocm00012345" becoming "(ocolc)12345"; bare numbers are local to
+// each catalogue and cannot be compared.
+func normalizeControlNumber(raw string) string {
+	m := controlNumberRegex.FindStringSubmatch(strings.TrimSpace(raw))
+	if m == nil {
+		return ""
+	}
+	org, num := strings.ToLower(m[1]), strings.ToLower(strings.TrimSpace(m[2]))
+	if org == "ocolc" {
+		for _, p := range []string{"ocm", "ocn", "on"} {
+			num = strings.TrimPrefix(num, p)
+		}
+		num = strings.TrimLeft(num, "0")
+	}
+	if num == "" {
+		return ""
+	}
+	return "(" + org + ")" + num
+}
+
+// titleAuthorYearKey is the fuzzy key: the first words of the title
+// (without a leading article, case, punctuation or diacritics), the
+// author's surname and the publication year. Records without a title or
+// year have none.
+func titleAuthorYearKey(rec *z3950.MARCRecord) string {
+	title := rec.Title
+	if fields := rec.GetFields("245"); len(fields) > 0 && len(fields[0].Subfields) > 0 {
+		title = strings.Join(append(fields[0].GetSubfields("a"), fields[0].GetSubfields("b")...), " ")
+	}
+	words := fuzzyWords(title)
+	if len(words) > 0 {
+		switch words[0] {
+		case "the", "a", "an", "der", "die", "das", "le", "la", "les", "el", "los":
+			words = words[1:]
+		}
+	}
+	if len(words) > 6 {
+		words = words[:6]
+	}
+
+	// The imprint date ($c) is preferred to 008/07-10, which records built
+	// from database rows only fill with a placeholder.
+	year := ""
+	for _, tag := range []string{"264", "260"} {
+		for _, field := range rec.GetFields(tag) {
+			if year == "" {
+				year = yearRegex.FindString(field.GetSubfield("c"))
+			}
+		}
+	}
+	if f := rec.GetFieldByTag("008"); year == "" && len(f) >= 11 && yearRegex.MatchString(f[7:11]) {
+		year = f[7:11]
+	}
+	if len(words) == 0 || year == "" {
+		return ""
+	}
+
+	author := ""
+	if a := fuzzyWords(strings.SplitN(rec.Author, ",", 2)[0]); len(a) > 0 {
+		// MARC 100 inverts names ("Kernighan, Brian W."); names in direct
+		// order end with the surname.
+		author = a[0]
+		if !strings.Contains(rec.Author, ",") {
+			author = a[len(a)-1]
+		}
+	}
+	return strings.Join(words, " ") + "/" + author + "/" + year
+}
+
+var stripMarks = transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+// fuzzyWords lowercases s, strips diacritics and splits it into words.
+func fuzzyWords(s string) []string {
+	if folded, _, err := transform.String(stripMarks, s); err == nil {
+		s = folded
+	}
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
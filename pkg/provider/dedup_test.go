@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+func dedupRecord(source, title, author, year string, fields ...z3950.MARCField) SourcedRecord {
+	rec := &z3950.MARCRecord{Fields: append([]z3950.MARCField{
+		{Tag: "245", Subfields: []z3950.MARCSubfield{{Code: "a", Value: title}}, Value: title},
+		{Tag: "100", Subfields: []z3950.MARCSubfield{{Code: "a", Value: author}}, Value: author},
+		{Tag: "260", Subfields: []z3950.MARCSubfield{{Code: "c", Value: year}}, Value: year},
+	}, fields...)}
+	rec.PopulateFriendlyFields()
+	return SourcedRecord{Source: source, Record: rec}
+}
+
+func subfieldA(tag, value string) z3950.MARCField {
+	return z3950.MARCField{Tag: tag, Subfields: []z3950.MARCSubfield{{Code: "a", Value: value}}, Value: value}
+}
+
+func TestDedupKeys(t *testing.T) {
+	r := dedupRecord("LCDB", "The Go programming language /", "Donovan, Alan A. A.", "c2016.",
+		subfieldA("020", "0134190440 (pbk.)"),
+		subfieldA("022", "ISSN 1234-567x"),
+		subfieldA("010", "  2015950709 "),
+		subfieldA("035", "(OCoLC)ocn00927105478"),
+		subfieldA("035", "12345"),
+	)
+	want := []string{
+		"isbn:9780134190440",
+		"issn:1234-567X",
+		"lccn:2015950709",
+		"035:(ocolc)927105478",
+		"tay:go programming language/donovan/2016",
+	}
+	if got := DedupKeys(r.Record); !reflect.DeepEqual(got, want) {
+		t.Errorf("DedupKeys = %q, want %q", got, want)
+	}
+
+	if got := normalizeLCCN("n 79-1234/AC/r932"); got != "n79001234" {
+		t.Errorf("normalizeLCCN = %q", got)
+	}
+	if got := DedupKeys(dedupRecord("X", "Untitled", "", "").Record); len(got) != 0 {
+		t.Errorf("record without year or identifiers has keys %q", got)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	records := []SourcedRecord{
+		dedupRecord("Local", "Go in Practice", "Butcher, Matt", "2016", subfieldA("020", "9781633430075")),
+		dedupRecord("LCDB", "The Go Programming Language", "Donovan, Alan", "2015", subfieldA("020", "0134190440")),
+		dedupRecord("Oxford", "Go programming language :", "Alan Donovan", "2015"),
+		dedupRecord("Oxford", "Unrelated", "Someone", "1999"),
+		dedupRecord("Harvard", "Go programming language", "Donovan, A.", "[2015]", subfieldA("020", "978-0-13-419044-0")),
+		dedupRecord("LCDB", "Go in practice", "Butcher, Matt", "2016"),
+	}
+
+	clusters := Deduplicate(records, []string{"Harvard", "lcdb"})
+	if len(clusters) != 3 {
+		t.Fatalf("got %d clusters, want 3", len(clusters))
+	}
+
+	// Clusters keep the order of their first record; the preferred record
+	// follows the priority list and comes first among the members.
+	var sizes []int
+	var preferred []string
+	for _, c := range clusters {
+		sizes = append(sizes, len(c.Members))
+		preferred = append(preferred, c.Preferred.Source)
+		if c.Members[0] != c.Preferred {
+			t.Errorf("cluster %q does not list its preferred record first", c.Preferred.Record.Title)
+		}
+	}
+	if !reflect.DeepEqual(sizes, []int{2, 3, 1}) || !reflect.DeepEqual(preferred, []string{"LCDB", "Harvard", "Oxford"}) {
+		t.Errorf("sizes %v, preferred %v", sizes, preferred)
+	}
+
+	// Without priorities the first record of each cluster is preferred
+	if c := Deduplicate(records, nil); c[0].Preferred.Source != "Local" || c[1].Preferred.Source != "LCDB" {
+		t.Errorf("preferred %s, %s", c[0].Preferred.Source, c[1].Preferred.Source)
+	}
+}
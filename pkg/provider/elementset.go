@@ -0,0 +1,33 @@
+package provider
+
+import (
+	"strings"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// selectElementSet returns records fetched in full, from the local
+// catalogue or an SRU target, in elementSet: brief for
+// z3950.ElementSetBrief, full for z3950.ElementSetFull or "". Any other
+// name is diagnostic 25.
+func selectElementSet(records []*z3950.MARCRecord, elementSet string, profile *z3950.MARCProfile) ([]*z3950.MARCRecord, error) {
+	switch strings.ToUpper(elementSet) {
+	case "", z3950.ElementSetFull:
+		return records, nil
+	case z3950.ElementSetBrief:
+		for i, rec := range records {
+			records[i] = z3950.BriefRecord(rec, profile)
+		}
+		return records, nil
+	}
+	return nil, z3950.NewDiagnostic(z3950.DiagElementSetInvalid, elementSet)
+}
+
+// targetElementSet returns the element set name to ask a Z39.50 target
+// for, z3950.ElementSetFull for "".
+func targetElementSet(name string) string {
+	if name == "" {
+		return z3950.ElementSetFull
+	}
+	return name
+}
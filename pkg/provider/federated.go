@@ -0,0 +1,627 @@
+package provider
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// DefaultFederatedDB is the virtual database that searches several
+// databases at once, and DefaultTargetTimeout the time each of them is
+// given to answer.
+const (
+	DefaultFederatedDB   = "Federated"
+	DefaultTargetTimeout = 15 * time.Second
+)
+
+// federatedIDSep joins a database name to a record id in the ids of a
+// federated result set ("LCDB|1700000000-42:3").
+const federatedIDSep = "|"
+
+// TargetStatus reports how one database fared in a federated search.
+type TargetStatus struct {
+	DB         string `json:"db"`
+	Total      int    `json:"total"`
+	Error      string `json:"error,omitempty"`
+	AuthFailed bool   `json:"auth_failed,omitempty"` // the target refused the gateway's credentials
+	ElapsedMs  int64  `json:"elapsed_ms"`
+}
+
+// fail records err as the database's error.
+func (s *TargetStatus) fail(err error) {
+	s.Error = err.Error()
+	s.AuthFailed = errors.Is(err, z3950.ErrAuthentication)
+}
+
+// SourcedRecord is a record of a federated search tagged with the
+// database it came from and its id there.
+type SourcedRecord struct {
+	Source string
+	ID     string
+	Record *z3950.MARCRecord
+}
+
+// FederatedResult is one page of a federated search. Session is the page
+// token to pass back for later pages.
+type FederatedResult struct {
+	Total   int
+	Records []SourcedRecord
+	Targets []TargetStatus
+	Session string
+}
+
+// FederatedDatabases returns the databases db stands for when it names a
+// federated search: a comma-separated list ("LCDB,Local") or the virtual
+// FederatedDB, which covers FederatedMembers or, if that is empty, the
+// local catalogue and every configured target.
+func (h *HybridProvider) FederatedDatabases(ctx context.Context, db string) ([]string, bool) {
+	if strings.Contains(db, ",") {
+		var dbs []string
+		seen := make(map[string]bool)
+		for _, name := range strings.Split(db, ",") {
+			name = strings.TrimSpace(name)
+			if strings.EqualFold(name, h.FederatedDB) {
+				continue // no nested federated searches
+			}
+			if name != "" && !seen[strings.ToLower(name)] {
+				seen[strings.ToLower(name)] = true
+				dbs = append(dbs, name)
+			}
+		}
+		return dbs, len(dbs) > 0
+	}
+	if h.FederatedDB == "" || !strings.EqualFold(db, h.FederatedDB) {
+		return nil, false
+	}
+	if len(h.FederatedMembers) > 0 {
+		return h.FederatedMembers, true
+	}
+	dbs := []string{"Local"}
+	targets, err := h.local.ListTargets(ctx)
+	if err != nil {
+		slog.Error("failed to list federated targets", "error", err)
+	}
+	for _, t := range targets {
+		dbs = append(dbs, t.Name)
+	}
+	return dbs, true
+}
+
+// withTimeout runs fn with a context that ends after TargetTimeout or
+// with ctx. A target that does not answer in time fails with a friendly
+// timeout error, and the work fn started on it is cancelled.
+func (h *HybridProvider) withTimeout(ctx context.Context, db, action string, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, h.TargetTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return friendlyError(db, action, ctx.Err())
+	}
+}
+
+// federatedMember is one database's part of a federated search. Its
+// total, status and the session its results are kept under make up the
+// page token, so later pages take each database's share of the page
+// from where it left off instead of searching it again.
+type federatedMember struct {
+	TargetStatus
+	Session string `json:"session,omitempty"`
+
+	// ids are the ids at positions from of the database's results that
+	// this request has read
+	ids  []string
+	from int
+}
+
+// encodeFederatedSession returns the page token for members.
+func encodeFederatedSession(members []federatedMember) string {
+	data, err := json.Marshal(members)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeFederatedSession returns the members of a page token, if it is
+// one for dbs.
+func decodeFederatedSession(session string, dbs []string) ([]federatedMember, bool) {
+	if session == "" {
+		return nil, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(session)
+	if err != nil {
+		return nil, false
+	}
+	var members []federatedMember
+	if err := json.Unmarshal(data, &members); err != nil || len(members) != len(dbs) {
+		return nil, false
+	}
+	for i, m := range members {
+		if !strings.EqualFold(m.DB, dbs[i]) || m.Total < 0 {
+			return nil, false
+		}
+		if m.Error == "" {
+			members[i].ElapsedMs = 0
+		}
+	}
+	return members, true
+}
+
+// federatedPage works out the page at offset of merged results that take
+// one record from each database in turn, from each database's total:
+// start[i] is the position in database i's results of its first record
+// on the page, and order lists the database of each record of the page.
+// A limit of 0 takes every record from offset on.
+func federatedPage(totals []int, offset, limit int) ([]int, []int) {
+	if offset < 0 {
+		offset = 0
+	}
+	// Whole rounds before the page are skipped a run at a time, a run
+	// lasting until the next database runs out of records.
+	round, pos := 0, 0
+	for {
+		active, next := 0, 0
+		for _, t := range totals {
+			if t > round {
+				active++
+				if next == 0 || t < next {
+					next = t
+				}
+			}
+		}
+		if active == 0 {
+			break
+		}
+		if run := active * (next - round); pos+run <= offset {
+			round, pos = next, pos+run
+			continue
+		}
+		skip := (offset - pos) / active
+		round, pos = round+skip, pos+skip*active
+		break
+	}
+
+	start := make([]int, len(totals))
+	for i, t := range totals {
+		start[i] = min(t, round)
+	}
+	var order []int
+	for ; limit <= 0 || len(order) < limit; round++ {
+		more := false
+		for i, t := range totals {
+			if t <= round {
+				continue
+			}
+			more = true
+			if pos < offset {
+				start[i]++
+			} else if limit <= 0 || len(order) < limit {
+				order = append(order, i)
+			}
+			pos++
+		}
+		if !more {
+			break
+		}
+	}
+	return start, order
+}
+
+// federatedSearch searches every database concurrently, or, given the page
+// token of an earlier page, reads each one's kept results. The merged
+// result set takes one record from each database in turn, so each
+// database is asked for just its share of the requested page, from the
+// position the page starts at in its results. The ids carry their
+// database's name. The token returned is for later pages.
+func (h *HybridProvider) federatedSearch(ctx context.Context, dbs []string, query z3950.StructuredQuery, session string) ([]string, int, []TargetStatus, string) {
+	offset, limit := max(query.Offset, 0), query.Limit
+	members, paged := decodeFederatedSession(session, dbs)
+	if !paged {
+		// Each database is searched once for its hits. With results spread
+		// evenly, the page is where it starts, so a first request for a
+		// later page needs nothing more.
+		memberQuery := query
+		memberQuery.Offset = 0
+		if limit > 0 {
+			memberQuery.Offset = offset / len(dbs)
+		}
+		members = make([]federatedMember, len(dbs))
+		h.eachMember(ctx, dbs, members, func(ctx context.Context, i int, m *federatedMember) error {
+			ids, total, err := h.Search(ctx, dbs[i], memberQuery)
+			if err != nil {
+				return err
+			}
+			m.Total, m.ids, m.from = total, ids, memberQuery.Offset
+			m.Session = h.ResultSession(dbs[i], ids)
+			return nil
+		})
+	}
+
+	totals := make([]int, len(members))
+	for i, m := range members {
+		totals[i] = m.Total
+	}
+	start, order := federatedPage(totals, offset, limit)
+	counts := make([]int, len(members))
+	for _, i := range order {
+		counts[i]++
+	}
+
+	// A database whose share of the page was not read with its hits is
+	// paged from its kept results, or else searched for just that share.
+	var need []int
+	for i, m := range members {
+		if counts[i] > 0 && (start[i] < m.from || start[i]+counts[i] > m.from+len(m.ids)) {
+			need = append(need, i)
+		}
+	}
+	if len(need) > 0 {
+		h.eachMember(ctx, dbs, members, func(ctx context.Context, i int, m *federatedMember) error {
+			if !slices.Contains(need, i) {
+				return nil
+			}
+			ids, err := h.memberPage(ctx, dbs[i], m, query, start[i], counts[i])
+			if err != nil {
+				return err
+			}
+			m.ids, m.from = ids, start[i]
+			return nil
+		})
+	}
+
+	var merged []string
+	next := make([]int, len(members))
+	for _, i := range order {
+		m := &members[i]
+		if m.Error != "" {
+			continue
+		}
+		if k := start[i] - m.from + next[i]; k >= 0 && k < len(m.ids) {
+			merged = append(merged, dbs[i]+federatedIDSep+m.ids[k])
+		}
+		next[i]++
+	}
+
+	total := 0
+	statuses := make([]TargetStatus, len(members))
+	for i, m := range members {
+		statuses[i] = m.TargetStatus
+		total += m.Total
+	}
+	return merged, total, statuses, encodeFederatedSession(members)
+}
+
+// eachMember runs fn for every database that has not failed, concurrently
+// and with TargetTimeout each, and records a database's error or elapsed
+// time in its status.
+func (h *HybridProvider) eachMember(ctx context.Context, dbs []string, members []federatedMember, fn func(ctx context.Context, i int, m *federatedMember) error) {
+	var wg sync.WaitGroup
+	for i, db := range dbs {
+		if members[i].Error != "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, db string) {
+			defer wg.Done()
+			m := &members[i]
+			start := time.Now()
+			err := h.withTimeout(ctx, db, "search", func(ctx context.Context) error {
+				return fn(ctx, i, m)
+			})
+			m.DB = db
+			m.ElapsedMs += time.Since(start).Milliseconds()
+			if err != nil {
+				slog.Warn("federated search failed", "db", db, "error", err)
+				m.fail(err)
+			}
+		}(i, db)
+	}
+	wg.Wait()
+}
+
+// memberPage returns the ids of db from position start on, n at most,
+// from its kept results or else by searching again for just those.
+func (h *HybridProvider) memberPage(ctx context.Context, db string, m *federatedMember, query z3950.StructuredQuery, start, n int) ([]string, error) {
+	if m.Session != "" {
+		ids, _, err := h.Page(ctx, db, m.Session, start, n)
+		if !errors.Is(err, ErrResultsExpired) {
+			return ids, err
+		}
+	}
+	query.Offset, query.Limit = start, n
+	ids, _, err := h.Search(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	m.Session = h.ResultSession(db, ids)
+	return ids, nil
+}
+
+// federatedError is returned when every database of a federated search
+// failed.
+func federatedError(statuses []TargetStatus) error {
+	var msgs []string
+	for _, s := range statuses {
+		if s.Error == "" {
+			return nil
+		}
+		msgs = append(msgs, s.Error)
+	}
+	return fmt.Errorf("all targets failed: %s", strings.Join(msgs, "; "))
+}
+
+// fetchSourced fetches federated ids in elementSet from their databases
+// concurrently and returns the records in ids order, with the error of
+// each database that failed.
+func (h *HybridProvider) fetchSourced(ctx context.Context, ids []string, elementSet string) ([]SourcedRecord, map[string]error) {
+	var order []string
+	groups := make(map[string][]string)
+	for _, id := range ids {
+		db, local, ok := strings.Cut(id, federatedIDSep)
+		if !ok {
+			continue
+		}
+		if _, seen := groups[db]; !seen {
+			order = append(order, db)
+		}
+		groups[db] = append(groups[db], local)
+	}
+
+	var mu sync.Mutex
+	fetched := make(map[string][]*z3950.MARCRecord)
+	errs := make(map[string]error)
+	var wg sync.WaitGroup
+	for _, db := range order {
+		wg.Add(1)
+		go func(db string, ids []string) {
+			defer wg.Done()
+			var recs []*z3950.MARCRecord
+			err := h.withTimeout(ctx, db, "fetch", func(ctx context.Context) error {
+				var err error
+				recs, err = h.Fetch(ctx, db, ids, elementSet)
+				return err
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.Warn("federated fetch failed", "db", db, "error", err)
+				errs[db] = err
+				return
+			}
+			fetched[db] = orderByID(ids, recs)
+		}(db, groups[db])
+	}
+	wg.Wait()
+
+	// Each database's records come back in its ids' order; walking the
+	// merged ids and taking the next record of its database keeps the
+	// interleaving even when a database returned fewer records.
+	var records []SourcedRecord
+	for _, id := range ids {
+		db, local, _ := strings.Cut(id, federatedIDSep)
+		if len(fetched[db]) == 0 {
+			continue
+		}
+		records = append(records, SourcedRecord{Source: db, ID: local, Record: fetched[db][0]})
+		fetched[db] = fetched[db][1:]
+	}
+	return records, errs
+}
+
+// releaseFederated releases federated ids in the databases they come from.
+func (h *HybridProvider) releaseFederated(ids []string) {
+	groups := make(map[string][]string)
+	for _, id := range ids {
+		if db, local, ok := strings.Cut(id, federatedIDSep); ok {
+			groups[db] = append(groups[db], local)
+		}
+	}
+	for db, ids := range groups {
+		h.Release(db, ids)
+	}
+}
+
+// orderByID puts records in ids order when they can be matched by their
+// record id, as local records can; SQL providers return them in any order.
+func orderByID(ids []string, recs []*z3950.MARCRecord) []*z3950.MARCRecord {
+	byID := make(map[string]*z3950.MARCRecord, len(recs))
+	for _, rec := range recs {
+		if rec != nil {
+			byID[rec.RecordID] = rec
+		}
+	}
+	if len(byID) != len(recs) {
+		return recs
+	}
+	ordered := make([]*z3950.MARCRecord, 0, len(recs))
+	for _, id := range ids {
+		rec, ok := byID[id]
+		if !ok {
+			return recs
+		}
+		ordered = append(ordered, rec)
+		delete(byID, id)
+	}
+	return ordered
+}
+
+// FederatedSearch searches every database in dbs concurrently and fetches
+// the page selected by query.Offset and query.Limit from the merged
+// results, which take one record from each database in turn, in
+// query.ElementSet. Each database
+// has TargetTimeout for its search and again for its fetch; one that fails
+// or times out is reported in Targets and does not fail the others.
+// Cancelling ctx abandons every database still searching. session is the
+// Session of an earlier page of the same search, or "" for a new search.
+func (h *HybridProvider) FederatedSearch(ctx context.Context, dbs []string, query z3950.StructuredQuery, session string) *FederatedResult {
+	ids, total, statuses, session := h.federatedSearch(ctx, dbs, query, session)
+	records, errs := h.fetchSourced(ctx, ids, query.ElementSet)
+	for i := range statuses {
+		if err, ok := errs[statuses[i].DB]; ok {
+			statuses[i].fail(err)
+		}
+	}
+	return &FederatedResult{Total: total, Records: records, Targets: statuses, Session: session}
+}
+
+// Events of a streamed federated search. A database goes through
+// connecting (remote targets only), searching, hits and records, or ends
+// with failed; done comes once, after every database.
+const (
+	EventConnecting = "connecting"
+	EventSearching  = "searching"
+	EventHits       = "hits"
+	EventRecords    = "records"
+	EventFailed     = "failed"
+	EventDone       = "done"
+)
+
+// FederatedEvent reports the progress of one database in a streamed
+// federated search. The done event carries the sum of the totals, the
+// status of every database and the page token for later pages instead.
+type FederatedEvent struct {
+	Type       string
+	DB         string
+	Total      int
+	Records    []SourcedRecord
+	Error      string
+	AuthFailed bool
+	ElapsedMs  int64
+	Targets    []TargetStatus
+	Session    string
+}
+
+// searchConnected is Search for a single database, calling connected once
+// the database is reached and the search itself starts.
+func (h *HybridProvider) searchConnected(ctx context.Context, db string, query z3950.StructuredQuery, connected func()) ([]string, int, error) {
+	if h.isLocalDB(db) {
+		connected()
+		return h.local.Search(ctx, db, query)
+	}
+	if _, err := h.local.GetTargetByName(ctx, db); err != nil {
+		return nil, 0, z3950.NewDiagnostic(z3950.DiagDatabaseNotFound, db)
+	}
+	return h.proxy.search(ctx, db, query, connected)
+}
+
+// FederatedStream searches every database in dbs concurrently, like
+// FederatedSearch, but reports each one's progress through emit as it
+// happens, so that fast databases can be shown while slow ones are still
+// searching. Each database contributes the page query.Offset and
+// query.Limit select from its own results, in query.ElementSet; records
+// are neither interleaved nor merged. Given the page token of an earlier
+// page, a database whose results are kept is paged from them and goes
+// straight to hits. emit is never called concurrently, and not for a
+// database after its failed event, even if it answers after its timeout.
+func (h *HybridProvider) FederatedStream(ctx context.Context, dbs []string, query z3950.StructuredQuery, session string, emit func(FederatedEvent)) {
+	kept, _ := decodeFederatedSession(session, dbs)
+	var mu sync.Mutex
+	failed := make(map[string]bool)
+	send := func(ev FederatedEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failed[ev.DB] {
+			return
+		}
+		if ev.Type == EventFailed {
+			failed[ev.DB] = true
+		}
+		emit(ev)
+	}
+
+	statuses := make([]TargetStatus, len(dbs))
+	sessions := make([]string, len(dbs))
+	var wg sync.WaitGroup
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, db string) {
+			defer wg.Done()
+			start := time.Now()
+			elapsed := func() int64 { return time.Since(start).Milliseconds() }
+			fail := func(err error) {
+				slog.Warn("federated search failed", "db", db, "error", err)
+				statuses[i] = TargetStatus{DB: db, Total: statuses[i].Total, ElapsedMs: elapsed()}
+				statuses[i].fail(err)
+				send(FederatedEvent{Type: EventFailed, DB: db, Error: err.Error(), AuthFailed: statuses[i].AuthFailed, ElapsedMs: elapsed()})
+			}
+
+			var ids []string
+			var total int
+			err := ErrResultsExpired
+			if kept != nil && kept[i].Session != "" {
+				err = h.withTimeout(ctx, db, "search", func(ctx context.Context) error {
+					var err error
+					ids, total, err = h.Page(ctx, db, kept[i].Session, query.Offset, query.Limit)
+					return err
+				})
+				sessions[i] = kept[i].Session
+			}
+			if errors.Is(err, ErrResultsExpired) {
+				if !h.isLocalDB(db) {
+					send(FederatedEvent{Type: EventConnecting, DB: db})
+				}
+				err = h.withTimeout(ctx, db, "search", func(ctx context.Context) error {
+					var err error
+					ids, total, err = h.searchConnected(ctx, db, query, func() {
+						send(FederatedEvent{Type: EventSearching, DB: db, ElapsedMs: elapsed()})
+					})
+					return err
+				})
+				sessions[i] = h.ResultSession(db, ids)
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+			statuses[i].Total = total
+			send(FederatedEvent{Type: EventHits, DB: db, Total: total, ElapsedMs: elapsed()})
+
+			if len(ids) > 0 {
+				var recs []*z3950.MARCRecord
+				err = h.withTimeout(ctx, db, "fetch", func(ctx context.Context) error {
+					var err error
+					recs, err = h.Fetch(ctx, db, ids, query.ElementSet)
+					return err
+				})
+				if err != nil {
+					fail(err)
+					return
+				}
+				recs = orderByID(ids, recs)
+				records := make([]SourcedRecord, len(recs))
+				for j, rec := range recs {
+					records[j] = SourcedRecord{Source: db, Record: rec}
+					if len(recs) == len(ids) {
+						records[j].ID = ids[j]
+					}
+				}
+				send(FederatedEvent{Type: EventRecords, DB: db, Total: total, Records: records, ElapsedMs: elapsed()})
+			}
+			statuses[i] = TargetStatus{DB: db, Total: total, ElapsedMs: elapsed()}
+		}(i, db)
+	}
+	wg.Wait()
+
+	total := 0
+	members := make([]federatedMember, len(dbs))
+	for i, s := range statuses {
+		total += s.Total
+		members[i] = federatedMember{TargetStatus: s, Session: sessions[i]}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	emit(FederatedEvent{Type: EventDone, Total: total, Targets: statuses, Session: encodeFederatedSession(members)})
+}
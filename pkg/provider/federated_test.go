@@ -0,0 +1,251 @@
+package provider
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+func TestFederatedSearch(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 3
+
+	// A port nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Remote", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	local.CreateTarget(t.Context(), &Target{Name: "Dead", Host: "127.0.0.1", Port: deadPort, DatabaseName: "Default", Encoding: "MARC21"})
+	hybrid := NewHybridProvider(local)
+
+	// The virtual database covers the catalogue and every target
+	dbs, ok := hybrid.FederatedDatabases(t.Context(), "Federated")
+	if !ok || dbs[0] != "Local" || !strings.HasSuffix(strings.Join(dbs, ","), ",Remote,Dead") {
+		t.Fatalf("FederatedDatabases = %v, %v", dbs, ok)
+	}
+
+	dbs = []string{"Local", "Remote", "Dead"}
+
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeAny, Term: "a"}, Limit: 4}
+	res := hybrid.FederatedSearch(t.Context(), dbs, query, "")
+	if res.Total != 6 {
+		t.Errorf("Total = %d, want 6", res.Total)
+	}
+	var sources []string
+	for _, r := range res.Records {
+		sources = append(sources, r.Source)
+	}
+	if strings.Join(sources, ",") != "Local,Remote,Local,Remote" {
+		t.Errorf("sources = %v", sources)
+	}
+	if res.Records[1].Record.Title != "Remote Title 1" || res.Records[3].Record.Title != "Remote Title 2" {
+		t.Errorf("remote records = %q, %q", res.Records[1].Record.Title, res.Records[3].Record.Title)
+	}
+	if len(res.Targets) != 3 || res.Targets[2].Error == "" || res.Targets[0].Error != "" || res.Targets[1].Total != 3 {
+		t.Errorf("Targets = %+v", res.Targets)
+	}
+
+	// The next page continues the interleaving through the Provider
+	// interface, as the Z39.50 server uses it.
+	query.Offset = 4
+	ids, total, err := hybrid.Search(t.Context(), "Local,Remote", query)
+	if err != nil || total != 6 || len(ids) != 2 {
+		t.Fatalf("Search = %v of %d, %v", ids, total, err)
+	}
+	recs, err := hybrid.Fetch(t.Context(), "Local,Remote", ids, z3950.ElementSetFull)
+	if err != nil || len(recs) != 2 || recs[1].Title != "Remote Title 3" {
+		t.Fatalf("Fetch = %d records, %v", len(recs), err)
+	}
+
+	if _, _, err := hybrid.Search(t.Context(), "Dead,Missing", query); err == nil {
+		t.Error("expected an error when every database fails")
+	}
+}
+
+func TestFederatedPage(t *testing.T) {
+	tests := []struct {
+		name          string
+		totals        []int
+		offset, limit int
+		start, order  []int
+	}{
+		{"Everything", []int{3, 1, 2}, 0, 0, []int{0, 0, 0}, []int{0, 1, 2, 0, 2, 0}},
+		{"Mid-round", []int{3, 1, 2}, 2, 3, []int{1, 1, 0}, []int{2, 0, 2}},
+		{"Past a short database", []int{1000, 5}, 100, 4, []int{95, 5}, []int{0, 0, 0, 0}},
+		{"Past the end", []int{3, 1}, 10, 4, []int{3, 1}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			start, order := federatedPage(tc.totals, tc.offset, tc.limit)
+			if !slices.Equal(start, tc.start) || !slices.Equal(order, tc.order) {
+				t.Errorf("federatedPage = %v, %v; want %v, %v", start, order, tc.start, tc.order)
+			}
+		})
+	}
+}
+
+func TestFederatedSearchSession(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 30
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Remote", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	hybrid := NewHybridProvider(local)
+	dbs := []string{"Local", "Remote"}
+
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeAny, Term: "a"}, Limit: 4}
+	first := hybrid.FederatedSearch(t.Context(), dbs, query, "")
+	if first.Session == "" || first.Total != 33 {
+		t.Fatalf("first page: session %q, total %d", first.Session, first.Total)
+	}
+
+	// The local catalogue runs out after three rounds, so the third page
+	// is the target's records 6 to 9, read from its held result set.
+	query.Offset = 8
+	third := hybrid.FederatedSearch(t.Context(), dbs, query, first.Session)
+	var titles []string
+	for _, r := range third.Records {
+		titles = append(titles, r.Record.Title)
+	}
+	if want := "Remote Title 6,Remote Title 7,Remote Title 8,Remote Title 9"; strings.Join(titles, ",") != want {
+		t.Errorf("third page = %v, want %s", titles, want)
+	}
+	if third.Total != 33 || third.Session == "" {
+		t.Errorf("third page: session %q, total %d", third.Session, third.Total)
+	}
+	if n := atomic.LoadInt32(&mockServer.Searches); n != 1 {
+		t.Errorf("target searched %d times, want 1", n)
+	}
+
+	// A token for other databases starts a new search
+	if res := hybrid.FederatedSearch(t.Context(), []string{"Remote", "Local"}, query, first.Session); res.Total != 33 || atomic.LoadInt32(&mockServer.Searches) != 2 {
+		t.Errorf("search with a foreign token: total %d, %d target searches", res.Total, atomic.LoadInt32(&mockServer.Searches))
+	}
+}
+
+func TestFederatedSearchTimeout(t *testing.T) {
+	// A target that accepts connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Slow", Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, DatabaseName: "Default", Encoding: "MARC21"})
+	hybrid := NewHybridProvider(local)
+	hybrid.TargetTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	res := hybrid.FederatedSearch(t.Context(), []string{"Local", "Slow"}, z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeAny, Term: "a"}}, "")
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("federated search took %v", time.Since(start))
+	}
+	if !strings.Contains(res.Targets[1].Error, "timed out") {
+		t.Errorf("Slow error = %q", res.Targets[1].Error)
+	}
+	if res.Total != 3 || len(res.Records) != 3 {
+		t.Errorf("got %d of %d local records", len(res.Records), res.Total)
+	}
+}
+
+func TestFederatedStream(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 30
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Remote", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	local.CreateTarget(t.Context(), &Target{Name: "Dead", Host: "127.0.0.1", Port: deadPort, DatabaseName: "Default", Encoding: "MARC21"})
+	hybrid := NewHybridProvider(local)
+
+	var events []FederatedEvent
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeAny, Term: "a"}, Limit: 10}
+	hybrid.FederatedStream(t.Context(), []string{"Local", "Remote", "Dead"}, query, "", func(ev FederatedEvent) {
+		events = append(events, ev)
+	})
+
+	byDB := make(map[string][]string)
+	for _, ev := range events[:len(events)-1] {
+		byDB[ev.DB] = append(byDB[ev.DB], ev.Type)
+		if ev.Type == EventRecords && ev.DB == "Remote" && (len(ev.Records) != 10 || ev.Total != 30) {
+			t.Errorf("Remote records event has %d records of %d", len(ev.Records), ev.Total)
+		}
+	}
+	want := map[string]string{
+		"Local":  "searching,hits,records",
+		"Remote": "connecting,searching,hits,records",
+		"Dead":   "connecting,failed",
+	}
+	for db, seq := range want {
+		if got := strings.Join(byDB[db], ","); got != seq {
+			t.Errorf("%s events = %s, want %s", db, got, seq)
+		}
+	}
+
+	done := events[len(events)-1]
+	if done.Type != EventDone || done.Total != 33 || len(done.Targets) != 3 || done.Targets[2].Error == "" {
+		t.Errorf("last event = %+v", done)
+	}
+
+	// With the done event's token the next page of the target is read
+	// from its held result set.
+	searches := atomic.LoadInt32(&mockServer.Searches)
+	events = nil
+	query.Offset = 10
+	hybrid.FederatedStream(t.Context(), []string{"Local", "Remote", "Dead"}, query, done.Session, func(ev FederatedEvent) {
+		events = append(events, ev)
+	})
+	var remote []string
+	for _, ev := range events {
+		if ev.DB == "Remote" {
+			remote = append(remote, ev.Type)
+			if ev.Type == EventRecords && ev.Records[0].Record.Title != "Remote Title 11" {
+				t.Errorf("second page starts with %q", ev.Records[0].Record.Title)
+			}
+		}
+	}
+	if got := strings.Join(remote, ","); got != "hits,records" {
+		t.Errorf("Remote events on the second page = %s", got)
+	}
+	if n := atomic.LoadInt32(&mockServer.Searches); n != searches {
+		t.Errorf("target searched %d more times", n-searches)
+	}
+}
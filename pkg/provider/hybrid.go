@@ -1,7 +1,9 @@
 package provider
 
 import (
+	"context"
 	"strings"
+	"time"
 
 	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
 )
@@ -9,83 +11,163 @@ import (
 type HybridProvider struct {
 	local  Provider
 	proxy  *ProxyProvider
+
+	// Federated search, see FederatedDatabases
+	FederatedDB      string
+	FederatedMembers []string
+	TargetTimeout    time.Duration
+	// Databases whose record is preferred when federated results are
+	// deduplicated, most preferred first
+	TargetPriority []string
 }
 
 func NewHybridProvider(local Provider) *HybridProvider {
 	return &HybridProvider{
-		local: local,
-		proxy: NewProxyProvider(local), // Pass local as resolver
+		local:         local,
+		proxy:         NewProxyProvider(local), // Pass local as resolver
+		FederatedDB:   DefaultFederatedDB,
+		TargetTimeout: DefaultTargetTimeout,
 	}
 }
 
 func (h *HybridProvider) isLocalDB(db string) bool {
+	return IsLocalDB(db)
+}
+
+// IsLocalDB reports whether db names the local catalogue rather than a
+// proxied target.
+func IsLocalDB(db string) bool {
 	return strings.EqualFold(db, "Default") || strings.EqualFold(db, "Local") || db == ""
 }
 
-func (h *HybridProvider) Search(db string, query z3950.StructuredQuery) ([]string, error) {
+// isFederatedDB reports whether db names a federated search, without
+// listing the databases it covers.
+func (h *HybridProvider) isFederatedDB(db string) bool {
+	return strings.Contains(db, ",") || h.FederatedDB != "" && strings.EqualFold(db, h.FederatedDB)
+}
+
+func (h *HybridProvider) Search(ctx context.Context, db string, query z3950.StructuredQuery) ([]string, int, error) {
+	if dbs, ok := h.FederatedDatabases(ctx, db); ok {
+		ids, total, statuses, _ := h.federatedSearch(ctx, dbs, query, "")
+		if err := federatedError(statuses); err != nil {
+			return nil, 0, err
+		}
+		return ids, total, nil
+	}
 	if h.isLocalDB(db) {
-		return h.local.Search(db, query)
+		return h.local.Search(ctx, db, query)
 	}
 	// Check if target exists
-	if _, err := h.local.GetTargetByName(db); err == nil {
-		return h.proxy.Search(db, query)
+	if _, err := h.local.GetTargetByName(ctx, db); err == nil {
+		return h.proxy.Search(ctx, db, query)
 	}
-	return nil, nil // Or error?
+	return nil, 0, z3950.NewDiagnostic(z3950.DiagDatabaseNotFound, db)
 }
 
-func (h *HybridProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord, error) {
+func (h *HybridProvider) Fetch(ctx context.Context, db string, ids []string, elementSet string) ([]*z3950.MARCRecord, error) {
+	if _, ok := h.FederatedDatabases(ctx, db); ok {
+		sourced, _ := h.fetchSourced(ctx, ids, elementSet)
+		records := make([]*z3950.MARCRecord, len(sourced))
+		for i, r := range sourced {
+			records[i] = r.Record
+		}
+		return records, nil
+	}
 	if h.isLocalDB(db) {
-		return h.local.Fetch(db, ids)
+		return h.local.Fetch(ctx, db, ids, elementSet)
+	}
+	return h.proxy.Fetch(ctx, db, ids, elementSet)
+}
+
+// Release gives up what the proxy holds for ids of db. Federated ids are
+// released in the databases they come from.
+func (h *HybridProvider) Release(db string, ids []string) {
+	switch {
+	case h.isFederatedDB(db):
+		h.releaseFederated(ids)
+	case !h.isLocalDB(db):
+		h.proxy.Release(db, ids)
+	}
+}
+
+// ResultSession names the results a target's search keeps. The local
+// catalogue searches again for every page, so its results are not kept.
+func (h *HybridProvider) ResultSession(db string, ids []string) string {
+	if h.isFederatedDB(db) || h.isLocalDB(db) {
+		return ""
+	}
+	return h.proxy.ResultSession(db, ids)
+}
+
+func (h *HybridProvider) ResultTimeout() time.Duration {
+	return h.proxy.ResultTimeout()
+}
+
+// Page returns another page of a target's kept results.
+func (h *HybridProvider) Page(ctx context.Context, db, session string, offset, limit int) ([]string, int, error) {
+	if h.isFederatedDB(db) || h.isLocalDB(db) {
+		return nil, 0, ErrResultsExpired
+	}
+	return h.proxy.Page(ctx, db, session, offset, limit)
+}
+
+// SortIDs sorts ids of the local catalogue. The ids of a target are
+// positions in its result set, so they cannot be put in another order.
+func (h *HybridProvider) SortIDs(ctx context.Context, db string, ids []string, keys []z3950.SortKey) ([]string, error) {
+	if _, federated := h.FederatedDatabases(ctx, db); !federated && h.isLocalDB(db) {
+		if sorter, ok := h.local.(IDSorter); ok {
+			return sorter.SortIDs(ctx, db, ids, keys)
+		}
 	}
-	return h.proxy.Fetch(db, ids)
+	return nil, z3950.NewDiagnostic(z3950.DiagSortSequenceUnsupported, "database "+db)
 }
 
-func (h *HybridProvider) Scan(db, field, startTerm string) ([]ScanResult, error) {
+func (h *HybridProvider) Scan(ctx context.Context, db, field, startTerm string) ([]ScanResult, error) {
 	if h.isLocalDB(db) {
-		return h.local.Scan(db, field, startTerm)
+		return h.local.Scan(ctx, db, field, startTerm)
 	}
-	return h.proxy.Scan(db, field, startTerm)
+	return h.proxy.Scan(ctx, db, field, startTerm)
 }
 
 // ILL operations ALWAYS go to local storage
-func (h *HybridProvider) CreateILLRequest(req ILLRequest) error {
-	return h.local.CreateILLRequest(req)
+func (h *HybridProvider) CreateILLRequest(ctx context.Context, req ILLRequest) error {
+	return h.local.CreateILLRequest(ctx, req)
 }
 
-func (h *HybridProvider) GetILLRequest(id int64) (*ILLRequest, error) {
-	return h.local.GetILLRequest(id)
+func (h *HybridProvider) GetILLRequest(ctx context.Context, id int64) (*ILLRequest, error) {
+	return h.local.GetILLRequest(ctx, id)
 }
 
-func (h *HybridProvider) ListILLRequests() ([]ILLRequest, error) {
-	return h.local.ListILLRequests()
+func (h *HybridProvider) ListILLRequests(ctx context.Context) ([]ILLRequest, error) {
+	return h.local.ListILLRequests(ctx)
 }
 
-func (h *HybridProvider) UpdateILLRequestStatus(id int64, status string) error {
-	return h.local.UpdateILLRequestStatus(id, status)
+func (h *HybridProvider) UpdateILLRequestStatus(ctx context.Context, id int64, status string) error {
+	return h.local.UpdateILLRequestStatus(ctx, id, status)
 }
 
 // User operations ALWAYS go to local storage
-func (h *HybridProvider) CreateUser(user *User) error {
-	return h.local.CreateUser(user)
+func (h *HybridProvider) CreateUser(ctx context.Context, user *User) error {
+	return h.local.CreateUser(ctx, user)
 }
 
-func (h *HybridProvider) GetUserByUsername(username string) (*User, error) {
-	return h.local.GetUserByUsername(username)
+func (h *HybridProvider) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	return h.local.GetUserByUsername(ctx, username)
 }
 
 // Target operations go to local storage
-func (h *HybridProvider) CreateTarget(target *Target) error {
-	return h.local.CreateTarget(target)
+func (h *HybridProvider) CreateTarget(ctx context.Context, target *Target) error {
+	return h.local.CreateTarget(ctx, target)
 }
 
-func (h *HybridProvider) ListTargets() ([]Target, error) {
-	return h.local.ListTargets()
+func (h *HybridProvider) ListTargets(ctx context.Context) ([]Target, error) {
+	return h.local.ListTargets(ctx)
 }
 
-func (h *HybridProvider) DeleteTarget(id int64) error {
-	return h.local.DeleteTarget(id)
+func (h *HybridProvider) DeleteTarget(ctx context.Context, id int64) error {
+	return h.local.DeleteTarget(ctx, id)
 }
 
-func (h *HybridProvider) GetTargetByName(name string) (*Target, error) {
-	return h.local.GetTargetByName(name)
+func (h *HybridProvider) GetTargetByName(ctx context.Context, name string) (*Target, error) {
+	return h.local.GetTargetByName(ctx, name)
 }
@@ -1,11 +1,19 @@
 package provider
 
 import (
+	"context"
+	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"strings"
+	"time"
 
 	"github.com/go-asn1-ber/asn1-ber"
+	"github.com/yourusername/open-z3950-gateway/pkg/sru"
 	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
 )
 
@@ -14,6 +22,22 @@ import (
 type MockZServer struct {
 	listener net.Listener
 	Port     int
+	Hits     int   // result count reported by Search
+	Searches int32 // Search requests received
+	Presents int32 // Present requests received
+	// SearchDelay holds back Search responses, making a hung target
+	SearchDelay time.Duration
+	// Auth, if set, is the only login Init accepts
+	Auth z3950.Authentication
+	// PresentLimit, if set, is the most records a Present returns, as
+	// with a small message size
+	PresentLimit int
+	// TooLarge, if set, fails a Present of more records than it with
+	// diagnostic 16, as if they exceeded the message size
+	TooLarge int
+	// Piggyback makes Search return the records the request asks for by
+	// its small, large and medium set bounds
+	Piggyback bool
 }
 
 func StartMockZServer() (*MockZServer, error) {
@@ -22,7 +46,7 @@ func StartMockZServer() (*MockZServer, error) {
 		return nil, err
 	}
 	addr := l.Addr().(*net.TCPAddr)
-	s := &MockZServer{listener: l, Port: addr.Port}
+	s := &MockZServer{listener: l, Port: addr.Port, Hits: 1}
 	go s.serve()
 	return s, nil
 }
@@ -48,23 +72,58 @@ func (s *MockZServer) handle(conn net.Conn) {
 		var resp *ber.Packet
 		switch pkt.Tag {
 		case 20: // Init
+			var auth z3950.Authentication
+			for _, c := range pkt.Children {
+				if c.ClassType == ber.ClassContext && c.Tag == 7 {
+					auth = z3950.ParseAuthentication(c)
+				}
+			}
 			resp = ber.Encode(ber.ClassContext, ber.TypeConstructed, 21, nil, "InitResp")
-			resp.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Result"))
+			resp.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, auth == s.Auth, "Result"))
 		case 22: // Search
+			atomic.AddInt32(&s.Searches, 1)
+			time.Sleep(s.SearchDelay)
 			resp = ber.Encode(ber.ClassContext, ber.TypeConstructed, 23, nil, "SearchResp")
 			resp.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Status"))
-			resp.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "Count")) 
+			resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 23, int64(s.Hits), "Count"))
+			bounds := map[ber.Tag]int{}
+			for _, c := range pkt.Children {
+				if c.ClassType == ber.ClassContext && c.Tag >= 13 && c.Tag <= 15 {
+					v, _ := ber.ParseInt64(c.Data.Bytes())
+					bounds[c.Tag] = int(v)
+				}
+			}
+			n := 0
+			if s.Hits <= bounds[13] {
+				n = s.Hits
+			} else if s.Hits < bounds[14] {
+				n = min(bounds[15], s.Hits)
+			}
+			if s.Piggyback && n > 0 {
+				resp.AppendChild(s.records(1, n, elementSetOf(pkt, 100)))
+			}
 		case 24: // Present
+			atomic.AddInt32(&s.Presents, 1)
+			start, count := 1, 1
+			for _, c := range pkt.Children {
+				switch c.Tag {
+				case 30:
+					v, _ := ber.ParseInt64(c.Data.Bytes())
+					start = int(v)
+				case 29:
+					v, _ := ber.ParseInt64(c.Data.Bytes())
+					count = int(v)
+				}
+			}
+			if s.PresentLimit > 0 && count > s.PresentLimit {
+				count = s.PresentLimit
+			}
 			resp = ber.Encode(ber.ClassContext, ber.TypeConstructed, 25, nil, "PresentResp")
-			recs := ber.Encode(ber.ClassContext, ber.TypeConstructed, 28, nil, "Records")
-			rec := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Record")
-			dbrec := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "DBRecord")
-			// "Remote Title"
-			marc := z3950.BuildMARC(&z3950.ProfileMARC21, "999", "Remote Title", "Remote Author", "111", "RemotePub", "2024", "", "")
-			dbrec.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(marc), "MARC"))
-			rec.AppendChild(dbrec)
-			recs.AppendChild(rec)
-			resp.AppendChild(recs)
+			if s.TooLarge > 0 && count > s.TooLarge {
+				resp.AppendChild(z3950.NewDiagnostic(z3950.DiagRecordExceedsMessageSize, "").Encode(130))
+				break
+			}
+			resp.AppendChild(s.records(start, count, elementSetOf(pkt, 19)))
 		default:
 			return
 		}
@@ -72,6 +131,35 @@ func (s *MockZServer) handle(conn net.Conn) {
 	}
 }
 
+// elementSetOf returns the element set name under tag in a request.
+func elementSetOf(pkt *ber.Packet, tag ber.Tag) string {
+	for _, c := range pkt.Children {
+		if c.ClassType == ber.ClassContext && c.Tag == tag {
+			return z3950.ParseElementSetNames(c)
+		}
+	}
+	return ""
+}
+
+// records returns the Records of count positions from start, each titled
+// "Remote Title <position>". Brief records have no publisher.
+func (s *MockZServer) records(start, count int, elementSet string) *ber.Packet {
+	publisher := "RemotePub"
+	if elementSet == z3950.ElementSetBrief {
+		publisher = ""
+	}
+	recs := ber.Encode(ber.ClassContext, ber.TypeConstructed, 28, nil, "Records")
+	for pos := start; pos < start+count; pos++ {
+		rec := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Record")
+		dbrec := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "DBRecord")
+		marc := z3950.BuildMARC(&z3950.ProfileMARC21, "999", "Remote Title "+strconv.Itoa(pos), "Remote Author", "111", publisher, "2024", "", "")
+		dbrec.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(marc), "MARC"))
+		rec.AppendChild(dbrec)
+		recs.AppendChild(rec)
+	}
+	return recs
+}
+
 func TestHybridProvider(t *testing.T) {
 	// 1. Setup Local Provider (Memory)
 	local := NewMemoryProvider()
@@ -82,7 +170,7 @@ func TestHybridProvider(t *testing.T) {
 
 	// 3. Test Local Search
 	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Local"}}
-	ids, err := hybrid.Search("Local", query)
+	ids, _, err := hybrid.Search(t.Context(), "Local", query)
 	if err != nil {
 		t.Fatalf("Local search failed: %v", err)
 	}
@@ -90,7 +178,7 @@ func TestHybridProvider(t *testing.T) {
 		t.Errorf("Expected 1 local result, got %d", len(ids))
 	}
 	
-	recs, err := hybrid.Fetch("Local", ids)
+	recs, err := hybrid.Fetch(t.Context(), "Local", ids, z3950.ElementSetFull)
 	if err != nil {
 		t.Fatalf("Local fetch failed: %v", err)
 	}
@@ -113,11 +201,11 @@ func TestHybridProvider(t *testing.T) {
 		DatabaseName: "Default",
 		Encoding:     "MARC21",
 	}
-	hybrid.CreateTarget(target)
+	hybrid.CreateTarget(t.Context(), target)
 
 	// 6. Test Remote Search via Hybrid
 	rQuery := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}}
-	rIds, err := hybrid.Search("MockRemote", rQuery)
+	rIds, _, err := hybrid.Search(t.Context(), "MockRemote", rQuery)
 	if err != nil {
 		t.Fatalf("Remote search failed: %v", err)
 	}
@@ -127,7 +215,7 @@ func TestHybridProvider(t *testing.T) {
 		t.Errorf("Expected 1 remote result, got %d", len(rIds))
 	}
 
-	rRecs, err := hybrid.Fetch("MockRemote", rIds)
+	rRecs, err := hybrid.Fetch(t.Context(), "MockRemote", rIds, z3950.ElementSetFull)
 	if err != nil {
 		t.Fatalf("Remote fetch failed: %v", err)
 	}
@@ -135,3 +223,505 @@ func TestHybridProvider(t *testing.T) {
 		t.Errorf("Expected 'Remote Title', got '%s'", rRecs[0].GetTitle(nil))
 	}
 }
+
+func TestProxyProviderKeepsResultSet(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 10
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Held", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	proxy := NewProxyProvider(local)
+
+	ids, _, err := proxy.Search(t.Context(), "Held", z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}})
+	if err != nil || len(ids) != 10 {
+		t.Fatalf("Search = %d ids, %v", len(ids), err)
+	}
+
+	// Two runs of consecutive positions, out of order: two Present requests
+	recs, err := proxy.Fetch(t.Context(), "Held", []string{ids[7], ids[1], ids[2], ids[3]}, z3950.ElementSetFull)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	var titles []string
+	for _, r := range recs {
+		titles = append(titles, r.Title)
+	}
+	if strings.Join(titles, ",") != "Remote Title 8,Remote Title 2,Remote Title 3,Remote Title 4" {
+		t.Errorf("titles = %v", titles)
+	}
+	if _, err := proxy.Fetch(t.Context(), "Held", ids[4:6], z3950.ElementSetFull); err != nil {
+		t.Fatalf("second Fetch failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Searches); n != 1 {
+		t.Errorf("target searched %d times, want 1", n)
+	}
+	if n := atomic.LoadInt32(&mockServer.Presents); n != 3 {
+		t.Errorf("target received %d Present requests, want 3", n)
+	}
+
+	// Once the session is gone, Fetch searches again.
+	sessionID, _, _ := parseResultID(ids[0])
+	proxy.pool.Release(sessionID)
+	if recs, err := proxy.Fetch(t.Context(), "Held", ids[:1], z3950.ElementSetFull); err != nil || len(recs) != 1 {
+		t.Fatalf("Fetch after release = %d records, %v", len(recs), err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Searches); n != 2 {
+		t.Errorf("target searched %d times after release, want 2", n)
+	}
+}
+
+func TestProxyProviderRelease(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 3
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Held", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	hybrid := NewHybridProvider(local)
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}}
+
+	ids, _, err := hybrid.Search(t.Context(), "Held", query)
+	if err != nil || len(ids) != 3 {
+		t.Fatalf("Search = %d ids, %v", len(ids), err)
+	}
+	sessionID, _, _ := parseResultID(ids[0])
+
+	// Releasing the ids gives up the session; fetching them searches again.
+	hybrid.Release("Held", ids)
+	if cw, ok := hybrid.proxy.pool.Acquire(sessionID); ok {
+		hybrid.proxy.pool.Hold(sessionID, cw)
+		t.Fatal("session still held after Release")
+	}
+	if recs, err := hybrid.Fetch(t.Context(), "Held", ids[1:2], z3950.ElementSetFull); err != nil || len(recs) != 1 || recs[0].Title != "Remote Title 2" {
+		t.Fatalf("Fetch after Release = %v, %v", recs, err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Searches); n != 2 {
+		t.Errorf("target searched %d times, want 2", n)
+	}
+
+	// Local ids are left alone.
+	hybrid.Release("Local", []string{"1"})
+
+	// A query unused for as long as a session is kept expires with it.
+	hybrid.proxy.queries.mu.Lock()
+	hybrid.proxy.queries.queries[sessionID].lastUsed = time.Now().Add(-hybrid.proxy.queries.timeout - time.Second)
+	hybrid.proxy.queries.mu.Unlock()
+	if _, err := hybrid.Fetch(t.Context(), "Held", ids[:1], z3950.ElementSetFull); err == nil {
+		t.Error("Fetch of an expired query succeeded")
+	}
+}
+
+func TestProxyProviderPage(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 5
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Paged", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	hybrid := NewHybridProvider(local)
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}, Limit: 2}
+
+	ids, _, err := hybrid.Search(t.Context(), "Paged", query)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("Search = %d ids, %v", len(ids), err)
+	}
+	session := hybrid.ResultSession("Paged", ids)
+	if session == "" {
+		t.Fatal("no session for a target's results")
+	}
+
+	// The last page is read from the held result set, not searched again.
+	page, total, err := hybrid.Page(t.Context(), "Paged", session, 4, 2)
+	if err != nil || total != 5 || len(page) != 1 {
+		t.Fatalf("Page = %v, %d, %v", page, total, err)
+	}
+	if recs, err := hybrid.Fetch(t.Context(), "Paged", page, z3950.ElementSetFull); err != nil || len(recs) != 1 || recs[0].Title != "Remote Title 5" {
+		t.Fatalf("Fetch of the last page = %v, %v", recs, err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Searches); n != 1 {
+		t.Errorf("target searched %d times, want 1", n)
+	}
+
+	// A session only pages the database that searched, and not the local
+	// catalogue, whose results are not kept.
+	if _, _, err := hybrid.Page(t.Context(), "Other", session, 0, 2); !errors.Is(err, ErrResultsExpired) {
+		t.Errorf("Page of another database: %v", err)
+	}
+	if s := hybrid.ResultSession("Local", []string{"1"}); s != "" {
+		t.Errorf("local results kept as %q", s)
+	}
+
+	hybrid.proxy.queries.mu.Lock()
+	hybrid.proxy.queries.queries[session].lastUsed = time.Now().Add(-hybrid.proxy.queries.timeout - time.Second)
+	hybrid.proxy.queries.mu.Unlock()
+	if _, _, err := hybrid.Page(t.Context(), "Paged", session, 2, 2); !errors.Is(err, ErrResultsExpired) {
+		t.Errorf("Page of an expired session: %v", err)
+	}
+}
+
+func TestProxyProviderCancel(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.SearchDelay = 10 * time.Second
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Hung", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	proxy := NewProxyProvider(local)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = proxy.Search(ctx, "Hung", z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Search error = %v, want canceled", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("Search took %v after cancel", time.Since(start))
+	}
+	// Not retried on a new connection
+	if n := atomic.LoadInt32(&mockServer.Searches); n != 1 {
+		t.Errorf("target searched %d times, want 1", n)
+	}
+}
+
+func TestProxyProviderAuthentication(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Auth = z3950.Authentication{UserID: "gateway", Password: "secret"}
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Licensed", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", AuthUser: "gateway", AuthPass: "secret"})
+	local.CreateTarget(t.Context(), &Target{Name: "Misconfigured", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", AuthUser: "gateway", AuthPass: "wrong"})
+	hybrid := NewHybridProvider(local)
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}}
+
+	if _, total, err := hybrid.Search(t.Context(), "Licensed", query); err != nil || total != 1 {
+		t.Fatalf("Search with stored credentials = %d, %v", total, err)
+	}
+	_, _, err = hybrid.Search(t.Context(), "Misconfigured", query)
+	if !errors.Is(err, z3950.ErrAuthentication) || !strings.Contains(err.Error(), "credentials") {
+		t.Errorf("Search with wrong password = %v", err)
+	}
+
+	res := hybrid.FederatedSearch(t.Context(), []string{"Licensed", "Misconfigured"}, query, "")
+	if res.Targets[0].AuthFailed || !res.Targets[1].AuthFailed {
+		t.Errorf("Targets = %+v", res.Targets)
+	}
+
+	if a := TargetAuthentication("user/pass", ""); a.Open != "user/pass" || a.UserID != "" {
+		t.Errorf("open authentication = %+v", a)
+	}
+}
+
+func TestProxyProviderPaging(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 45
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Paged", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	proxy := NewProxyProvider(local)
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}, Offset: 40, Limit: 20}
+
+	// The last page is short, and the total is not capped
+	ids, total, err := proxy.Search(t.Context(), "Paged", query)
+	if err != nil || total != 45 || len(ids) != 5 {
+		t.Fatalf("Search = %d ids of %d, %v", len(ids), total, err)
+	}
+	recs, err := proxy.Fetch(t.Context(), "Paged", ids, z3950.ElementSetFull)
+	if err != nil || len(recs) != 5 || recs[0].Title != "Remote Title 41" {
+		t.Fatalf("Fetch = %d records, %v", len(recs), err)
+	}
+
+	query.Offset, query.Limit = 0, 0
+	if ids, total, err = proxy.Search(t.Context(), "Paged", query); err != nil || len(ids) != 45 || total != 45 {
+		t.Errorf("unlimited Search = %d ids of %d, %v", len(ids), total, err)
+	}
+}
+
+func TestProxyProviderShortPresent(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 10
+	mockServer.PresentLimit = 3
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Short", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	proxy := NewProxyProvider(local)
+
+	ids, _, err := proxy.Search(t.Context(), "Short", z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The batch cut short by the target is continued where it stopped
+	recs, err := proxy.Fetch(t.Context(), "Short", ids[1:9], z3950.ElementSetFull)
+	if err != nil || len(recs) != 8 || recs[7].Title != "Remote Title 9" {
+		t.Fatalf("Fetch = %d records, %v", len(recs), err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Presents); n != 3 {
+		t.Errorf("target received %d Present requests, want 3", n)
+	}
+}
+
+func TestProxyProviderPresentTooLarge(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 10
+	mockServer.TooLarge = 2
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Large", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	proxy := NewProxyProvider(local)
+
+	ids, _, err := proxy.Search(t.Context(), "Large", z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Batches of 10 and 5 are refused; the records come two at a time
+	recs, err := proxy.Fetch(t.Context(), "Large", ids, z3950.ElementSetFull)
+	if err != nil || len(recs) != 10 || recs[9].Title != "Remote Title 10" {
+		t.Fatalf("Fetch = %d records, %v", len(recs), err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Presents); n != 7 {
+		t.Errorf("target received %d Present requests, want 7", n)
+	}
+}
+
+func TestProxyProviderPiggyback(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 30
+	mockServer.Piggyback = true
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Piggy", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	proxy := NewProxyProvider(local)
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}, Limit: 10}
+
+	// The first page comes with the search
+	ids, _, err := proxy.Search(t.Context(), "Piggy", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := proxy.Fetch(t.Context(), "Piggy", ids, z3950.ElementSetFull)
+	if err != nil || len(recs) != 10 || recs[9].Title != "Remote Title 10" {
+		t.Fatalf("Fetch = %d records, %v", len(recs), err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Presents); n != 0 {
+		t.Errorf("target received %d Present requests, want 0", n)
+	}
+
+	// Only the positions past the piggybacked ones are presented
+	ids, _, err = proxy.Search(t.Context(), "Piggy", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	more := append(ids[5:], strings.Replace(ids[9], ":10", ":11", 1))
+	recs, err = proxy.Fetch(t.Context(), "Piggy", more, z3950.ElementSetFull)
+	if err != nil || len(recs) != 6 || recs[5].Title != "Remote Title 11" {
+		t.Fatalf("Fetch = %d records, %v", len(recs), err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Presents); n != 1 {
+		t.Errorf("target received %d Present requests, want 1", n)
+	}
+}
+
+func TestProxyProviderElementSet(t *testing.T) {
+	mockServer, err := StartMockZServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer mockServer.Close()
+	mockServer.Hits = 30
+	mockServer.Piggyback = true
+
+	local := NewMemoryProvider()
+	local.CreateTarget(t.Context(), &Target{Name: "Brief", Host: "127.0.0.1", Port: mockServer.Port, DatabaseName: "Default", Encoding: "MARC21"})
+	proxy := NewProxyProvider(local)
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Remote"}, Limit: 5, ElementSet: z3950.ElementSetBrief}
+
+	// A result list is searched and fetched brief
+	ids, _, err := proxy.Search(t.Context(), "Brief", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := proxy.Fetch(t.Context(), "Brief", ids, z3950.ElementSetBrief)
+	if err != nil || len(recs) != 5 || strings.Contains(recs[0].Publisher, "RemotePub") {
+		t.Fatalf("brief Fetch = %d records, %v", len(recs), err)
+	}
+
+	// The full record is presented again rather than served brief
+	recs, err = proxy.Fetch(t.Context(), "Brief", ids[:1], z3950.ElementSetFull)
+	if err != nil || len(recs) != 1 || !strings.Contains(recs[0].Publisher, "RemotePub") {
+		t.Fatalf("full Fetch = %d records, %v", len(recs), err)
+	}
+	if n := atomic.LoadInt32(&mockServer.Presents); n != 1 {
+		t.Errorf("target received %d Present requests, want 1", n)
+	}
+}
+
+func TestHybridProviderSortIDs(t *testing.T) {
+	local := NewMemoryProvider()
+	local.AddBook("Zebra", "", "", "", "", "", "")
+	local.AddBook("Aardvark", "", "", "", "", "", "")
+	hybrid := NewHybridProvider(local)
+	keys := []z3950.SortKey{{Attribute: z3950.UseAttributeTitle}}
+
+	var zebra, aardvark string
+	for _, b := range local.books {
+		switch b.Title {
+		case "Zebra":
+			zebra = b.ID
+		case "Aardvark":
+			aardvark = b.ID
+		}
+	}
+	sorted, err := hybrid.SortIDs(t.Context(), "Local", []string{zebra, aardvark}, keys)
+	if err != nil || len(sorted) != 2 || sorted[0] != aardvark {
+		t.Errorf("local SortIDs = %v, %v", sorted, err)
+	}
+
+	// Target ids are positions in a remote result set
+	var diag *z3950.Diagnostic
+	if _, err := hybrid.SortIDs(t.Context(), "Remote", []string{"s:1", "s:2"}, keys); !errors.As(err, &diag) || diag.Code != z3950.DiagSortSequenceUnsupported {
+		t.Errorf("remote SortIDs error = %v", err)
+	}
+}
+
+func TestHybridProviderUnknownDatabase(t *testing.T) {
+	hybrid := NewHybridProvider(NewMemoryProvider())
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "Go"}}
+
+	_, _, err := hybrid.Search(t.Context(), "NoSuchTarget", query)
+	var diag *z3950.Diagnostic
+	if !errors.As(err, &diag) || diag.Code != z3950.DiagDatabaseNotFound {
+		t.Fatalf("expected diagnostic 235, got %v", err)
+	}
+}
+
+func TestFriendlyErrorKeepsDiagnostic(t *testing.T) {
+	err := friendlyError("LCDB", "search", z3950.NewDiagnostic(z3950.DiagUnsupportedUseAttribute, "9999"))
+	if !strings.Contains(err.Error(), "LCDB reported") || !strings.Contains(err.Error(), "9999") {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+	var diag *z3950.Diagnostic
+	if !errors.As(err, &diag) || diag.Code != z3950.DiagUnsupportedUseAttribute {
+		t.Errorf("diagnostic not reachable through %v", err)
+	}
+}
+
+func TestHybridProviderSRUTarget(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/catalog" || q.Get("version") != "1.2" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		switch q.Get("operation") {
+		case "searchRetrieve":
+			queries = append(queries, q.Get("query"))
+			if strings.Contains(q.Get("query"), "dc.creator") {
+				w.Write(sru.MarshalSearchRetrieve("1.2", 0, nil, 0, []*sru.Diagnostic{sru.NewDiagnostic(sru.DiagUnsupportedIndex, "dc.creator")}))
+				return
+			}
+			start, _ := strconv.Atoi(q.Get("startRecord"))
+			max, _ := strconv.Atoi(q.Get("maximumRecords"))
+			var records []sru.Record
+			for pos := start; pos < start+max && pos <= 3; pos++ {
+				marc, _ := z3950.ParseMARC(z3950.BuildMARC(&z3950.ProfileMARC21, strconv.Itoa(pos), "Remote Title "+strconv.Itoa(pos), "Remote Author", "111", "RemotePub", "2024", "", ""))
+				records = append(records, sru.Record{Schema: sru.SchemaMARCXML, Packing: "string", Data: marc.MarshalMARCXML(), Position: pos})
+			}
+			w.Write(sru.MarshalSearchRetrieve("1.2", 3, records, 0, nil))
+		case "scan":
+			if q.Get("scanClause") != "dc.title = remote" {
+				t.Errorf("scanClause = %q", q.Get("scanClause"))
+			}
+			w.Write(sru.MarshalScan("1.2", []sru.Term{{Value: "remote title", NumberOfRecords: 3}}, nil))
+		}
+	}))
+	defer server.Close()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+	portNum, _ := strconv.Atoi(port)
+	hybrid := NewHybridProvider(NewMemoryProvider())
+	hybrid.CreateTarget(t.Context(), &Target{Name: "SRURemote", Host: host, Port: portNum, DatabaseName: "catalog", Protocol: "sru"})
+
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "remote"}}
+	ids, _, err := hybrid.Search(t.Context(), "SRURemote", query)
+	if err != nil {
+		t.Fatalf("SRU search failed: %v", err)
+	}
+	if len(ids) != 3 || queries[0] != "dc.title = remote" {
+		t.Fatalf("got %d ids for query %q", len(ids), queries[0])
+	}
+
+	recs, err := hybrid.Fetch(t.Context(), "SRURemote", []string{ids[2], ids[1]}, z3950.ElementSetFull)
+	if err != nil {
+		t.Fatalf("SRU fetch failed: %v", err)
+	}
+	if len(recs) != 2 || recs[0].Title != "Remote Title 3" || recs[1].Title != "Remote Title 2" {
+		t.Errorf("unexpected records %+v", recs)
+	}
+	if len(queries) != 2 {
+		t.Errorf("fetch used %d requests, want 1", len(queries)-1)
+	}
+
+	terms, err := hybrid.Scan(t.Context(), "SRURemote", "title", "remote")
+	if err != nil || len(terms) != 1 || terms[0].Count != 3 {
+		t.Errorf("SRU scan = %+v, %v", terms, err)
+	}
+
+	// SRU diagnostics come back as their Bib-1 equivalents.
+	_, _, err = hybrid.Search(t.Context(), "SRURemote", z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeAuthor, Term: "x"}})
+	var diag *z3950.Diagnostic
+	if !errors.As(err, &diag) || diag.Code != z3950.DiagUnsupportedUseAttribute {
+		t.Errorf("expected diagnostic 114, got %v", err)
+	}
+}
+
+func TestSRUBaseURL(t *testing.T) {
+	testCases := []struct {
+		host string
+		port int
+		db   string
+		want string
+	}{
+		{"lx2.loc.gov", 210, "LCDB", "http://lx2.loc.gov:210/LCDB"},
+		{"sru.example.org", 80, "/cat", "http://sru.example.org/cat"},
+		{"sru.example.org", 443, "cat", "https://sru.example.org/cat"},
+		{"https://sru.example.org/", 8443, "cat", "https://sru.example.org:8443/cat"},
+	}
+	for _, tc := range testCases {
+		if got := SRUBaseURL(tc.host, tc.port, tc.db); got != tc.want {
+			t.Errorf("SRUBaseURL(%q, %d, %q) = %s, want %s", tc.host, tc.port, tc.db, got, tc.want)
+		}
+	}
+}
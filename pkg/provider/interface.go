@@ -1,6 +1,12 @@
 package provider
 
-import "github.com/yourusername/open-z3950-gateway/pkg/z3950"
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
 
 type SearchResult struct {
 	ID        string
@@ -76,19 +82,36 @@ type User struct {
 
 		AuthPass     string `json:"auth_password"` // Optional
 
+		Protocol     string `json:"protocol"`      // ProtocolZ3950 (default) or ProtocolSRU
+
 	}
 
+	// Target protocols. An SRU target's base URL is built from Host, Port
+	// and DatabaseName (http://host:port/database); Host may carry the
+	// scheme, e.g. "https://sru.example.org".
+	const (
+		ProtocolZ3950 = "Z39.50"
+		ProtocolSRU   = "SRU"
+	)
+
 	
 
+	// Provider methods take the context of the request they serve and
+	// give up on database or remote work once it is cancelled.
 	type Provider interface {
 
 		// Search now accepts a StructuredQuery from the z3950 package.
+		// It returns the ids of the page selected by query.Offset and
+		// query.Limit (0 means no limit) and the total number of hits.
 
-		Search(db string, query z3950.StructuredQuery) ([]string, error)
+		Search(ctx context.Context, db string, query z3950.StructuredQuery) ([]string, int, error)
 
 	
 
-			Fetch(db string, ids []string) ([]*z3950.MARCRecord, error)
+			// Fetch returns the records behind ids in elementSet, such as
+			// z3950.ElementSetBrief for result lists; "" means
+			// z3950.ElementSetFull.
+			Fetch(ctx context.Context, db string, ids []string, elementSet string) ([]*z3950.MARCRecord, error)
 
 	
 
@@ -100,7 +123,7 @@ type User struct {
 
 	
 
-			Scan(db, field, startTerm string) ([]ScanResult, error)
+			Scan(ctx context.Context, db, field, startTerm string) ([]ScanResult, error)
 
 	
 
@@ -110,40 +133,71 @@ type User struct {
 
 				// CreateILLRequest creates a new Inter-Library Loan request.
 			
-				CreateILLRequest(req ILLRequest) error
+				CreateILLRequest(ctx context.Context, req ILLRequest) error
 			
 				// GetILLRequest retrieves a single ILL request by ID.
-				GetILLRequest(id int64) (*ILLRequest, error)
+				GetILLRequest(ctx context.Context, id int64) (*ILLRequest, error)
 			
 				// ListILLRequests retrieves all Inter-Library Loan requests.
 			
-				ListILLRequests() ([]ILLRequest, error)
+				ListILLRequests(ctx context.Context) ([]ILLRequest, error)
 	
 
 		// UpdateILLRequestStatus updates the status of an ILL request.
 
-		UpdateILLRequestStatus(id int64, status string) error
+		UpdateILLRequestStatus(ctx context.Context, id int64, status string) error
 
 	
 
 		// User Management
 
-		CreateUser(user *User) error
+		CreateUser(ctx context.Context, user *User) error
 
-		GetUserByUsername(username string) (*User, error)
+		GetUserByUsername(ctx context.Context, username string) (*User, error)
 
 	
 
 		// Target Management (Dynamic Z39.50 Targets)
 
-		CreateTarget(target *Target) error
+		CreateTarget(ctx context.Context, target *Target) error
 
-		ListTargets() ([]Target, error)
+		ListTargets(ctx context.Context) ([]Target, error)
 
-		DeleteTarget(id int64) error
+		DeleteTarget(ctx context.Context, id int64) error
 
-		GetTargetByName(name string) (*Target, error)
+		GetTargetByName(ctx context.Context, name string) (*Target, error)
 
 	}
 
 	
+
+	// ResultReleaser is implemented by providers that hold resources, such
+	// as the connection keeping a remote result set open, for the ids a
+	// Search returned. Release tells them the ids of db are no longer
+	// needed; fetching them afterwards may be slower but still works.
+	type ResultReleaser interface {
+		Release(db string, ids []string)
+	}
+
+	// IDSorter is implemented by providers that can put the ids of an
+	// earlier Search in another order, as Z39.50 Sort does with a stored
+	// result set. Keys are on attributes SortableAttribute accepts.
+	type IDSorter interface {
+		SortIDs(ctx context.Context, db string, ids []string, keys []z3950.SortKey) ([]string, error)
+	}
+
+	// ErrResultsExpired is returned by Page for results that have expired,
+	// or that were never kept.
+	var ErrResultsExpired = errors.New("result set expired or unknown")
+
+	// ResultPager is implemented by providers that keep the results of a
+	// Search, so that later pages are read from them instead of searching
+	// again. ResultSession names the results the ids of db came from, or
+	// returns "" when they are not kept; ResultTimeout is how long kept
+	// results last unused. Page returns the ids at offset, and the hit
+	// count, of named results.
+	type ResultPager interface {
+		ResultSession(db string, ids []string) string
+		ResultTimeout() time.Duration
+		Page(ctx context.Context, db, session string, offset, limit int) ([]string, int, error)
+	}
@@ -1,8 +1,9 @@
 package provider
 
 import (
+	"context"
 	"fmt"
-	"log/slog"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -53,35 +54,50 @@ func (m *MemoryProvider) AddBook(title, author, isbn, publisher, pubYear, issn,
 	})
 }
 
+// queryRegexps holds the proximity patterns of one query, compiled once
+// for all the books it is evaluated against.
+type queryRegexps map[string]*regexp.Regexp
+
+func (r queryRegexps) compile(pattern string) *regexp.Regexp {
+	re, ok := r[pattern]
+	if !ok {
+		re = regexp.MustCompile(pattern)
+		r[pattern] = re
+	}
+	return re
+}
+
 // evaluateQuery recursively checks if a book matches the query tree
-func evaluateQuery(node z3950.QueryNode, book SearchResult) bool {
+func evaluateQuery(node z3950.QueryNode, book SearchResult, regexps queryRegexps) bool {
 	if node == nil {
 		return false
 	}
 
 	switch n := node.(type) {
 	case z3950.QueryClause:
-		term := strings.ToLower(n.Term)
 		switch n.Attribute {
 		case z3950.UseAttributeTitle:
-			return strings.Contains(strings.ToLower(book.Title), term)
+			return matchValue(book.Title, n)
 		case z3950.UseAttributeAuthor:
-			return strings.Contains(strings.ToLower(book.Author), term)
+			return matchValue(book.Author, n)
 		case z3950.UseAttributeISBN:
 			return strings.Contains(book.ISBN, CleanISBN(n.Term))
 		case z3950.UseAttributeISSN:
-			return strings.Contains(book.ISSN, term)
+			return matchValue(book.ISSN, n)
 		case z3950.UseAttributeSubject:
-			return strings.Contains(strings.ToLower(book.Subject), term)
+			return matchValue(book.Subject, n)
 		case z3950.UseAttributeDatePub:
-			return strings.Contains(book.PubYear, term)
+			return matchValue(book.PubYear, n)
 		default:
 			// Broad search
-			return strings.Contains(strings.ToLower(book.Title), term) || strings.Contains(strings.ToLower(book.Author), term)
+			return matchValue(book.Title, n) || matchValue(book.Author, n)
 		}
 	case z3950.QueryComplex:
-		l := evaluateQuery(n.Left, book)
-		r := evaluateQuery(n.Right, book)
+		if n.Operator == "PROX" {
+			return evaluateProximity(n, book, regexps)
+		}
+		l := evaluateQuery(n.Left, book, regexps)
+		r := evaluateQuery(n.Right, book, regexps)
 		switch n.Operator {
 		case "AND": return l && r
 		case "OR": return l || r
@@ -91,20 +107,56 @@ func evaluateQuery(node z3950.QueryNode, book SearchResult) bool {
 	return false
 }
 
-func (m *MemoryProvider) Search(db string, query z3950.StructuredQuery) ([]string, error) {
+// evaluateProximity checks both terms of a proximity node against the field
+// of the left term's Use attribute (title and author for Any). Nodes the
+// providers cannot evaluate match nothing.
+func evaluateProximity(n z3950.QueryComplex, book SearchResult, regexps queryRegexps) bool {
+	pattern, err := proximityRegex(n, true)
+	if err != nil {
+		return false
+	}
+	re := regexps.compile(pattern)
+	var fields []string
+	switch n.Left.(z3950.QueryClause).Attribute {
+	case z3950.UseAttributeTitle:
+		fields = []string{book.Title}
+	case z3950.UseAttributeAuthor:
+		fields = []string{book.Author}
+	case z3950.UseAttributeSubject:
+		fields = []string{book.Subject}
+	default:
+		fields = []string{book.Title, book.Author}
+	}
+	matched := false
+	for _, f := range fields {
+		matched = matched || re.MatchString(f)
+	}
+	if n.Proximity != nil && n.Proximity.Exclusion {
+		return !matched
+	}
+	return matched
+}
+
+func (m *MemoryProvider) Search(ctx context.Context, db string, query z3950.StructuredQuery) ([]string, int, error) {
 	if query.Root == nil {
-		return nil, nil
+		return nil, 0, nil
 	}
 
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	var matchingIds []string
+	var matching []SearchResult
+	regexps := make(queryRegexps)
 	for _, book := range m.books {
-		if evaluateQuery(query.Root, book) {
-			matchingIds = append(matchingIds, book.ID)
+		if evaluateQuery(query.Root, book, regexps) {
+			matching = append(matching, book)
 		}
 	}
+	sortResults(matching, query.SortKeys)
+	var matchingIds []string
+	for _, book := range matching {
+		matchingIds = append(matchingIds, book.ID)
+	}
 
 	// Apply pagination
 	offset := 0
@@ -127,11 +179,22 @@ func (m *MemoryProvider) Search(db string, query z3950.StructuredQuery) ([]strin
 		end = len(matchingIds)
 	}
 
-	return matchingIds[start:end], nil
+	return matchingIds[start:end], len(matchingIds), nil
 }
 
+// SortIDs orders ids from an earlier Search on keys.
+func (m *MemoryProvider) SortIDs(ctx context.Context, db string, ids []string, keys []z3950.SortKey) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	books := make(map[string]SearchResult, len(m.books))
+	for _, book := range m.books {
+		books[book.ID] = book
+	}
+	return sortIDs(ids, keys, books), nil
+}
 
-func (m *MemoryProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord, error) {
+func (m *MemoryProvider) Fetch(ctx context.Context, db string, ids []string, elementSet string) ([]*z3950.MARCRecord, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	var records []*z3950.MARCRecord
@@ -147,10 +210,10 @@ func (m *MemoryProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord, er
 			}
 		}
 	}
-	return records, nil
+	return selectElementSet(records, elementSet, nil)
 }
 
-func (m *MemoryProvider) Scan(db, field, startTerm string) ([]ScanResult, error) {
+func (m *MemoryProvider) Scan(ctx context.Context, db, field, startTerm string) ([]ScanResult, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	
@@ -174,7 +237,7 @@ func (m *MemoryProvider) Scan(db, field, startTerm string) ([]ScanResult, error)
 	return results, nil
 }
 
-func (m *MemoryProvider) CreateILLRequest(req ILLRequest) error {
+func (m *MemoryProvider) CreateILLRequest(ctx context.Context, req ILLRequest) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	req.ID = int64(len(m.illRequests) + 1)
@@ -182,7 +245,7 @@ func (m *MemoryProvider) CreateILLRequest(req ILLRequest) error {
 	return nil
 }
 
-func (m *MemoryProvider) GetILLRequest(id int64) (*ILLRequest, error) {
+func (m *MemoryProvider) GetILLRequest(ctx context.Context, id int64) (*ILLRequest, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	for _, req := range m.illRequests {
@@ -195,7 +258,7 @@ func (m *MemoryProvider) GetILLRequest(id int64) (*ILLRequest, error) {
 	return nil, fmt.Errorf("request not found")
 }
 
-func (m *MemoryProvider) ListILLRequests() ([]ILLRequest, error) {
+func (m *MemoryProvider) ListILLRequests(ctx context.Context) ([]ILLRequest, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	requests := make([]ILLRequest, len(m.illRequests))
@@ -203,7 +266,7 @@ func (m *MemoryProvider) ListILLRequests() ([]ILLRequest, error) {
 	return requests, nil
 }
 
-func (m *MemoryProvider) UpdateILLRequestStatus(id int64, status string) error {
+func (m *MemoryProvider) UpdateILLRequestStatus(ctx context.Context, id int64, status string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i, req := range m.illRequests {
@@ -215,7 +278,7 @@ func (m *MemoryProvider) UpdateILLRequestStatus(id int64, status string) error {
 	return fmt.Errorf("request with id %d not found", id)
 }
 
-func (m *MemoryProvider) CreateUser(user *User) error {
+func (m *MemoryProvider) CreateUser(ctx context.Context, user *User) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	user.ID = int64(len(m.users) + 1)
@@ -223,7 +286,7 @@ func (m *MemoryProvider) CreateUser(user *User) error {
 	return nil
 }
 
-func (m *MemoryProvider) GetUserByUsername(username string) (*User, error) {
+func (m *MemoryProvider) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	for _, u := range m.users {
@@ -235,7 +298,7 @@ func (m *MemoryProvider) GetUserByUsername(username string) (*User, error) {
 	return nil, fmt.Errorf("user not found")
 }
 
-func (m *MemoryProvider) CreateTarget(target *Target) error {
+func (m *MemoryProvider) CreateTarget(ctx context.Context, target *Target) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	target.ID = int64(len(m.targets) + 1)
@@ -243,7 +306,7 @@ func (m *MemoryProvider) CreateTarget(target *Target) error {
 	return nil
 }
 
-func (m *MemoryProvider) ListTargets() ([]Target, error) {
+func (m *MemoryProvider) ListTargets(ctx context.Context) ([]Target, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	list := make([]Target, len(m.targets))
@@ -251,7 +314,7 @@ func (m *MemoryProvider) ListTargets() ([]Target, error) {
 	return list, nil
 }
 
-func (m *MemoryProvider) DeleteTarget(id int64) error {
+func (m *MemoryProvider) DeleteTarget(ctx context.Context, id int64) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i, t := range m.targets {
@@ -263,7 +326,7 @@ func (m *MemoryProvider) DeleteTarget(id int64) error {
 	return fmt.Errorf("target not found")
 }
 
-func (m *MemoryProvider) GetTargetByName(name string) (*Target, error) {
+func (m *MemoryProvider) GetTargetByName(ctx context.Context, name string) (*Target, error) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	for _, t := range m.targets {
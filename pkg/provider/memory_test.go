@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+func TestMemorySearchAttributes(t *testing.T) {
+	m := NewMemoryProvider()
+
+	testCases := []struct {
+		name        string
+		node        z3950.QueryNode
+		expectedIDs []string
+	}{
+		{"Substring by default", z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "proto"}, []string{"3"}},
+		{"Word structure", z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Structure: z3950.StructureWord, Term: "proto"}, nil},
+		{"Right truncation", z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Truncation: z3950.TruncationRight, Term: "art of proto"}, []string{"3"}},
+		{"First in field", z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Position: z3950.PositionFirstInField, Term: "the art"}, []string{"3"}},
+		{"Complete field", z3950.QueryClause{Attribute: z3950.UseAttributeAuthor, Completeness: z3950.CompletenessCompleteField, Term: "rob pike"}, []string{"1"}},
+		{"Date greater than", z3950.QueryClause{Attribute: z3950.UseAttributeDatePub, Relation: z3950.RelationGreater, Term: "2012"}, []string{"4"}},
+		{"Date less or equal", z3950.QueryClause{Attribute: z3950.UseAttributeDatePub, Relation: z3950.RelationLessEqual, Term: "1999"}, []string{"2", "3"}},
+		{"Proximity", proximity("art", "protocol", 2, true), []string{"3"}},
+		{"Proximity too far apart", proximity("the", "protocol", 2, true), nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ids, _, err := m.Search(t.Context(), "Default", z3950.StructuredQuery{Root: tc.node})
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			if !reflect.DeepEqual(ids, tc.expectedIDs) {
+				t.Errorf("Expected IDs %v, but got %v", tc.expectedIDs, ids)
+			}
+		})
+	}
+}
+
+func TestMemorySearchSort(t *testing.T) {
+	m := NewMemoryProvider()
+	query := z3950.StructuredQuery{
+		Root:     z3950.QueryClause{Attribute: z3950.UseAttributeAny, Term: "a"},
+		SortKeys: []z3950.SortKey{{Attribute: z3950.UseAttributeTitle, Relation: 1}},
+	}
+	ids, _, err := m.Search(t.Context(), "Default", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, id := range ids {
+		recs, _ := m.Fetch(t.Context(), "Default", []string{id}, z3950.ElementSetFull)
+		titles = append(titles, recs[0].Title)
+	}
+	for i := 1; i < len(titles); i++ {
+		if strings.ToLower(titles[i-1]) < strings.ToLower(titles[i]) {
+			t.Errorf("titles not descending: %q", titles)
+			break
+		}
+	}
+}
+
+func TestMemoryFetchElementSet(t *testing.T) {
+	m := NewMemoryProvider()
+	m.AddBook("Brief Lives", "Aubrey", "", "Clarendon", "1898", "", "")
+	id := m.books[len(m.books)-1].ID
+	year := func(rec *z3950.MARCRecord) string {
+		if fields := rec.GetFields("260"); len(fields) > 0 {
+			return fields[0].GetSubfield("c")
+		}
+		return ""
+	}
+
+	full, err := m.Fetch(t.Context(), "Default", []string{id}, "")
+	if err != nil || len(full) != 1 || year(full[0]) != "1898" {
+		t.Fatalf("full Fetch = %v, %v", full, err)
+	}
+	brief, err := m.Fetch(t.Context(), "Default", []string{id}, "b")
+	if err != nil || len(brief) != 1 {
+		t.Fatalf("brief Fetch = %v, %v", brief, err)
+	}
+	if brief[0].Title != "Brief Lives" || brief[0].Author != "Aubrey" || year(brief[0]) != "" {
+		t.Errorf("brief record = %q by %q, year %q", brief[0].Title, brief[0].Author, year(brief[0]))
+	}
+
+	_, err = m.Fetch(t.Context(), "Default", []string{id}, "Dublin")
+	var diag *z3950.Diagnostic
+	if !errors.As(err, &diag) || diag.Code != z3950.DiagElementSetInvalid {
+		t.Errorf("unknown element set: %v, want diagnostic %d", err, z3950.DiagElementSetInvalid)
+	}
+}
+
+func TestMemorySortIDs(t *testing.T) {
+	m := NewMemoryProvider()
+	m.AddBook("Beta", "Zed", "", "", "2001", "", "")
+	m.AddBook("alpha", "Young", "", "", "1999", "", "")
+	m.AddBook("Gamma", "Xavier", "", "", "2001", "", "")
+	ids, _, err := m.Search(t.Context(), "Default", z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeDatePub, Term: "2001"}})
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("Search = %v, %v", ids, err)
+	}
+	beta, gamma := ids[0], ids[1]
+
+	// Only the given ids are sorted, ties keeping their order.
+	keys := []z3950.SortKey{{Attribute: z3950.UseAttributeDatePub, Relation: 1}, {Attribute: z3950.UseAttributeAuthor}}
+	sorted, err := m.SortIDs(t.Context(), "Default", []string{beta, gamma}, keys)
+	if err != nil || strings.Join(sorted, ",") != gamma+","+beta {
+		t.Errorf("SortIDs = %v, %v; want %s,%s", sorted, err, gamma, beta)
+	}
+	sorted, _ = m.SortIDs(t.Context(), "Default", []string{gamma, beta}, keys[:1])
+	if strings.Join(sorted, ",") != gamma+","+beta {
+		t.Errorf("tie reordered: %v", sorted)
+	}
+}
+
+func TestMemorySearchProximityUnicode(t *testing.T) {
+	m := NewMemoryProvider()
+	m.AddBook("Le café de Paris", "", "", "", "", "", "")
+	m.AddBook("Мир и война", "", "", "", "", "", "")
+
+	truncated := proximity("caf", "paris", 2, true)
+	truncated.Left = z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "caf", Truncation: z3950.TruncationRight}
+	testCases := []struct {
+		name        string
+		node        z3950.QueryNode
+		expectedIDs []string
+	}{
+		{"Accented words", proximity("café", "paris", 2, true), []string{"5"}},
+		{"Cyrillic words", proximity("мир", "война", 2, true), []string{"6"}},
+		{"Cyrillic unordered", proximity("война", "мир", 2, false), []string{"6"}},
+		{"Cyrillic ordered", proximity("война", "мир", 2, true), nil},
+		{"Part of a word", proximity("caf", "paris", 2, true), nil},
+		{"Right truncation", truncated, []string{"5"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ids, _, err := m.Search(t.Context(), "Default", z3950.StructuredQuery{Root: tc.node})
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			if !reflect.DeepEqual(ids, tc.expectedIDs) {
+				t.Errorf("Expected IDs %v, but got %v", tc.expectedIDs, ids)
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package provider
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 
 	_ "github.com/lib/pq"
@@ -68,11 +70,13 @@ func NewPostgresProvider(dsn string) (*PostgresProvider, error) {
 			encoding TEXT DEFAULT 'MARC21',
 			auth_user TEXT,
 			auth_pass TEXT,
+			protocol TEXT DEFAULT 'Z39.50',
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		)
 	`); err != nil {
 		return nil, fmt.Errorf("failed to create targets table: %w", err)
 	}
+	db.Exec("ALTER TABLE targets ADD COLUMN IF NOT EXISTS protocol TEXT DEFAULT 'Z39.50'")
 
 	if _, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS bibliography (
@@ -193,6 +197,78 @@ func (p *PostgresProvider) mapAttribute(attr int) string {
 	}
 }
 
+// postgresMatch builds the condition for one clause against one column,
+// honouring the clause's relation, position, structure, truncation and
+// completeness attributes. Words are matched with the \m and \M word
+// boundary escapes.
+func postgresMatch(col string, c z3950.QueryClause, argCounter *int) (string, []interface{}) {
+	if op, year, ok := dateComparison(c); ok {
+		*argCounter++
+		return fmt.Sprintf("CAST(NULLIF(SUBSTRING(%s FROM '[0-9]{4}'), '') AS INTEGER) %s $%d", col, op, *argCounter), []interface{}{year}
+	}
+
+	term := strings.ToLower(strings.TrimSpace(c.Term))
+	var phrase []string
+	for _, w := range termWords(term) {
+		phrase = append(phrase, regexp.QuoteMeta(w))
+	}
+
+	switch clauseMatchMode(c) {
+	case matchExact:
+		*argCounter++
+		return fmt.Sprintf("LOWER(TRIM(%s)) = $%d", col, *argCounter), []interface{}{term}
+	case matchFieldPrefix:
+		*argCounter++
+		return fmt.Sprintf("LOWER(TRIM(%s)) LIKE $%d", col, *argCounter), []interface{}{likeEscape(term) + "%"}
+	case matchWords:
+		if len(phrase) == 0 {
+			return "FALSE", nil
+		}
+		conds := make([]string, len(phrase))
+		args := make([]interface{}, len(phrase))
+		for i, w := range phrase {
+			*argCounter++
+			conds[i] = fmt.Sprintf("%s ~* $%d", col, *argCounter)
+			args[i] = `\m` + w + `\M`
+		}
+		return "(" + strings.Join(conds, " AND ") + ")", args
+	case matchWordPrefix:
+		*argCounter++
+		return fmt.Sprintf("%s ~* $%d", col, *argCounter), []interface{}{`\m` + strings.Join(phrase, `\W+`)}
+	case matchWordSuffix:
+		*argCounter++
+		return fmt.Sprintf("%s ~* $%d", col, *argCounter), []interface{}{strings.Join(phrase, `\W+`) + `\M`}
+	default:
+		*argCounter++
+		return fmt.Sprintf("LOWER(%s) LIKE $%d", col, *argCounter), []interface{}{"%" + likeEscape(term) + "%"}
+	}
+}
+
+// proximitySQL matches both terms of a proximity node within the field of
+// the left term's Use attribute (title, author and subjects for Any).
+func (p *PostgresProvider) proximitySQL(n z3950.QueryComplex, argCounter *int) (string, []interface{}, error) {
+	pattern, err := proximityRegex(n, false)
+	if err != nil {
+		return "", nil, err
+	}
+	cols := []string{p.mapAttribute(n.Left.(z3950.QueryClause).Attribute)}
+	if cols[0] == "__any__" {
+		cols = []string{"title", "author", "subjects"}
+	}
+	conds := make([]string, len(cols))
+	args := make([]interface{}, len(cols))
+	for i, col := range cols {
+		*argCounter++
+		conds[i] = fmt.Sprintf("COALESCE(%s, '') ~* $%d", col, *argCounter)
+		args[i] = pattern
+	}
+	cond := "(" + strings.Join(conds, " OR ") + ")"
+	if n.Proximity != nil && n.Proximity.Exclusion {
+		cond = "NOT " + cond
+	}
+	return cond, args, nil
+}
+
 // buildSQL recursively builds WHERE clause and args from QueryNode
 func (p *PostgresProvider) buildSQL(node z3950.QueryNode, argCounter *int) (string, []interface{}, error) {
 	if node == nil {
@@ -213,21 +289,23 @@ func (p *PostgresProvider) buildSQL(node z3950.QueryNode, argCounter *int) (stri
 
 		if colName == "__any__" {
 			// Handle 'Any' by searching across title and author and subjects
-			*argCounter++
-			arg1 := *argCounter
-			*argCounter++
-			arg2 := *argCounter
-			*argCounter++
-			arg3 := *argCounter
-			searchTerm := "%" + strings.ToLower(term) + "%"
-			return fmt.Sprintf("(LOWER(title) LIKE $%d OR LOWER(author) LIKE $%d OR LOWER(subjects) LIKE $%d)", arg1, arg2, arg3), []interface{}{searchTerm, searchTerm, searchTerm}, nil
+			var parts []string
+			var args []interface{}
+			for _, col := range []string{"title", "author", "subjects"} {
+				cond, a := postgresMatch(col, n, argCounter)
+				parts = append(parts, cond)
+				args = append(args, a...)
+			}
+			return "(" + strings.Join(parts, " OR ") + ")", args, nil
 		}
 
-		// Default case: simple LIKE search
-		*argCounter++
-		return fmt.Sprintf("LOWER(%s) LIKE $%d", colName, *argCounter), []interface{}{"%" + strings.ToLower(term) + "%"}, nil
+		cond, args := postgresMatch(colName, n, argCounter)
+		return cond, args, nil
 
 	case z3950.QueryComplex:
+		if n.Operator == "PROX" {
+			return p.proximitySQL(n, argCounter)
+		}
 		lSql, lArgs, err := p.buildSQL(n.Left, argCounter)
 		if err != nil {
 			return "", nil, err
@@ -250,9 +328,9 @@ func (p *PostgresProvider) buildSQL(node z3950.QueryNode, argCounter *int) (stri
 	return "", nil, fmt.Errorf("unknown query node type: %T", node)
 }
 
-func (p *PostgresProvider) Search(db string, query z3950.StructuredQuery) ([]string, error) {
+func (p *PostgresProvider) Search(ctx context.Context, db string, query z3950.StructuredQuery) ([]string, int, error) {
 	if query.Root == nil {
-		return nil, nil
+		return nil, 0, nil
 	}
 
 	table := p.getTable(db)
@@ -260,10 +338,11 @@ func (p *PostgresProvider) Search(db string, query z3950.StructuredQuery) ([]str
 	argCounter := 0
 	whereClause, args, err := p.buildSQL(query.Root, &argCounter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to build SQL query: %w", err)
+		return nil, 0, fmt.Errorf("failed to build SQL query: %w", err)
 	}
 
-	limit := 100
+	// A NULL limit is LIMIT ALL
+	var limit interface{}
 	if query.Limit > 0 {
 		limit = query.Limit
 	}
@@ -273,14 +352,14 @@ func (p *PostgresProvider) Search(db string, query z3950.StructuredQuery) ([]str
 	}
 
 	// Append LIMIT and OFFSET to the query and arguments
-	sqlStr := fmt.Sprintf(`SELECT CAST(id AS VARCHAR) FROM %s WHERE %s ORDER BY id LIMIT $%d OFFSET $%d`,
-		table, whereClause, argCounter+1, argCounter+2)
+	sqlStr := fmt.Sprintf(`SELECT CAST(id AS VARCHAR) FROM %s WHERE %s ORDER BY %s LIMIT $%d OFFSET $%d`,
+		table, whereClause, orderBy(query.SortKeys), argCounter+1, argCounter+2)
 
-	finalArgs := append(args, limit, offset)
+	finalArgs := append(append([]interface{}{}, args...), limit, offset)
 
-	rows, err := p.db.Query(sqlStr, finalArgs...)
+	rows, err := p.db.QueryContext(ctx, sqlStr, finalArgs...)
 	if err != nil {
-		return nil, fmt.Errorf("dynamic postgres query failed: %w. SQL: %s. Args: %v", err, sqlStr, finalArgs)
+		return nil, 0, fmt.Errorf("dynamic postgres query failed: %w. SQL: %s. Args: %v", err, sqlStr, finalArgs)
 	}
 	defer rows.Close()
 
@@ -291,10 +370,31 @@ func (p *PostgresProvider) Search(db string, query z3950.StructuredQuery) ([]str
 			ids = append(ids, id)
 		}
 	}
-	return ids, nil
+
+	// A short first page already holds every hit
+	if offset == 0 && (query.Limit <= 0 || len(ids) < query.Limit) {
+		return ids, len(ids), nil
+	}
+	var total int
+	countSQL := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, table, whereClause)
+	if err := p.db.QueryRowContext(ctx, countSQL, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("postgres count query failed: %w. SQL: %s. Args: %v", err, countSQL, args)
+	}
+	return ids, total, nil
+}
+
+// SortIDs orders ids from an earlier Search on keys, comparing the
+// values the search itself sorts on.
+func (p *PostgresProvider) SortIDs(ctx context.Context, db string, ids []string, keys []z3950.SortKey) ([]string, error) {
+	query := fmt.Sprintf(`SELECT CAST(id AS VARCHAR), title, author, pub_year FROM %s WHERE CAST(id AS VARCHAR) IN (%%s)`, p.getTable(db))
+	books, err := lookupSortValues(ctx, p.db, query, func(i int) string { return fmt.Sprintf("$%d", i) }, ids)
+	if err != nil {
+		return nil, err
+	}
+	return sortIDs(ids, keys, books), nil
 }
 
-func (p *PostgresProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord, error) {
+func (p *PostgresProvider) Fetch(ctx context.Context, db string, ids []string, elementSet string) ([]*z3950.MARCRecord, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
@@ -306,7 +406,7 @@ func (p *PostgresProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord,
 		args[i] = id
 	}
 	query := fmt.Sprintf(`SELECT id, title, author, isbn, publisher, pub_year, issn, subjects, raw_record, raw_record_format FROM %s WHERE CAST(id AS VARCHAR) IN (%s)`, table, strings.Join(placeholders, ","))
-	rows, err := p.db.Query(query, args...)
+	rows, err := p.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -328,7 +428,7 @@ func (p *PostgresProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord,
 
 		if rawRecord.Valid && rawRecord.String != "" {
 			isJSON := rawFormat.Valid && rawFormat.String == "MARC_JSON"
-			isMatch := !rawFormat.Valid || rawFormat.String == targetFormat
+			isMatch := !rawFormat.Valid || sameMARCFormat(rawFormat.String, targetFormat)
 			if isJSON || isMatch {
 				parsed, err := z3950.ParseMARC([]byte(rawRecord.String))
 				if err == nil {
@@ -370,13 +470,13 @@ func (p *PostgresProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord,
 			records = append(records, rec)
 		}
 	}
-	return records, nil
+	return selectElementSet(records, elementSet, p.profile)
 }
 
-func (p *PostgresProvider) Scan(db, field, startTerm string) ([]ScanResult, error) {
+func (p *PostgresProvider) Scan(ctx context.Context, db, field, startTerm string) ([]ScanResult, error) {
 	table := p.getTable(db)
 	sqlStr := fmt.Sprintf(`SELECT title, 1 FROM %s WHERE title >= $1 ORDER BY title ASC LIMIT 10`, table)
-	rows, err := p.db.Query(sqlStr, startTerm)
+	rows, err := p.db.QueryContext(ctx, sqlStr, startTerm)
 	if err != nil {
 		return nil, err
 	}
@@ -392,16 +492,16 @@ func (p *PostgresProvider) Scan(db, field, startTerm string) ([]ScanResult, erro
 	return results, nil
 }
 
-func (p *PostgresProvider) CreateILLRequest(req ILLRequest) error {
+func (p *PostgresProvider) CreateILLRequest(ctx context.Context, req ILLRequest) error {
 	sqlStr := `INSERT INTO ill_requests (target_db, record_id, title, author, isbn, status, requestor, comments) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	_, err := p.db.Exec(sqlStr, req.TargetDB, req.RecordID, req.Title, req.Author, req.ISBN, req.Status, req.Requestor, req.Comments)
+	_, err := p.db.ExecContext(ctx, sqlStr, req.TargetDB, req.RecordID, req.Title, req.Author, req.ISBN, req.Status, req.Requestor, req.Comments)
 	return err
 }
 
-func (p *PostgresProvider) GetILLRequest(id int64) (*ILLRequest, error) {
+func (p *PostgresProvider) GetILLRequest(ctx context.Context, id int64) (*ILLRequest, error) {
 	var r ILLRequest
 	var comments sql.NullString
-	err := p.db.QueryRow("SELECT id, target_db, record_id, title, author, isbn, status, requestor, comments FROM ill_requests WHERE id = $1", id).
+	err := p.db.QueryRowContext(ctx, "SELECT id, target_db, record_id, title, author, isbn, status, requestor, comments FROM ill_requests WHERE id = $1", id).
 		Scan(&r.ID, &r.TargetDB, &r.RecordID, &r.Title, &r.Author, &r.ISBN, &r.Status, &r.Requestor, &comments)
 	if err != nil {
 		return nil, err
@@ -412,8 +512,8 @@ func (p *PostgresProvider) GetILLRequest(id int64) (*ILLRequest, error) {
 	return &r, nil
 }
 
-func (p *PostgresProvider) ListILLRequests() ([]ILLRequest, error) {
-	rows, err := p.db.Query("SELECT id, target_db, record_id, title, author, isbn, status, requestor FROM ill_requests ORDER BY created_at DESC")
+func (p *PostgresProvider) ListILLRequests(ctx context.Context) ([]ILLRequest, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT id, target_db, record_id, title, author, isbn, status, requestor FROM ill_requests ORDER BY created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -430,33 +530,33 @@ func (p *PostgresProvider) ListILLRequests() ([]ILLRequest, error) {
 	return requests, nil
 }
 
-func (p *PostgresProvider) UpdateILLRequestStatus(id int64, status string) error {
-	_, err := p.db.Exec("UPDATE ill_requests SET status = $1 WHERE id = $2", status, id)
+func (p *PostgresProvider) UpdateILLRequestStatus(ctx context.Context, id int64, status string) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE ill_requests SET status = $1 WHERE id = $2", status, id)
 	return err
 }
 
-func (p *PostgresProvider) CreateUser(user *User) error {
-	_, err := p.db.Exec("INSERT INTO users (username, password_hash, role) VALUES ($1, $2, $3)", user.Username, user.PasswordHash, user.Role)
+func (p *PostgresProvider) CreateUser(ctx context.Context, user *User) error {
+	_, err := p.db.ExecContext(ctx, "INSERT INTO users (username, password_hash, role) VALUES ($1, $2, $3)", user.Username, user.PasswordHash, user.Role)
 	return err
 }
 
-func (p *PostgresProvider) GetUserByUsername(username string) (*User, error) {
+func (p *PostgresProvider) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	var user User
-	err := p.db.QueryRow("SELECT id, username, password_hash, role FROM users WHERE username = $1", username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role)
+	err := p.db.QueryRowContext(ctx, "SELECT id, username, password_hash, role FROM users WHERE username = $1", username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role)
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
-func (p *PostgresProvider) CreateTarget(target *Target) error {
-	_, err := p.db.Exec("INSERT INTO targets (name, host, port, database_name, encoding, auth_user, auth_pass) VALUES ($1, $2, $3, $4, $5, $6, $7)",
-		target.Name, target.Host, target.Port, target.DatabaseName, target.Encoding, target.AuthUser, target.AuthPass)
+func (p *PostgresProvider) CreateTarget(ctx context.Context, target *Target) error {
+	_, err := p.db.ExecContext(ctx, "INSERT INTO targets (name, host, port, database_name, encoding, auth_user, auth_pass, protocol) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		target.Name, target.Host, target.Port, target.DatabaseName, target.Encoding, target.AuthUser, target.AuthPass, targetProtocol(target))
 	return err
 }
 
-func (p *PostgresProvider) ListTargets() ([]Target, error) {
-	rows, err := p.db.Query("SELECT id, name, host, port, database_name, encoding, auth_user, auth_pass FROM targets ORDER BY name ASC")
+func (p *PostgresProvider) ListTargets(ctx context.Context) ([]Target, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT id, name, host, port, database_name, encoding, auth_user, auth_pass, protocol FROM targets ORDER BY name ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -465,31 +565,33 @@ func (p *PostgresProvider) ListTargets() ([]Target, error) {
 	var targets []Target
 	for rows.Next() {
 		var t Target
-		var user, pass sql.NullString
-		if err := rows.Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.DatabaseName, &t.Encoding, &user, &pass); err != nil {
+		var user, pass, protocol sql.NullString
+		if err := rows.Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.DatabaseName, &t.Encoding, &user, &pass, &protocol); err != nil {
 			return nil, err
 		}
 		if user.Valid { t.AuthUser = user.String }
 		if pass.Valid { t.AuthPass = pass.String }
+		t.Protocol = protocolOrDefault(protocol)
 		targets = append(targets, t)
 	}
 	return targets, nil
 }
 
-func (p *PostgresProvider) DeleteTarget(id int64) error {
-	_, err := p.db.Exec("DELETE FROM targets WHERE id = $1", id)
+func (p *PostgresProvider) DeleteTarget(ctx context.Context, id int64) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM targets WHERE id = $1", id)
 	return err
 }
 
-func (p *PostgresProvider) GetTargetByName(name string) (*Target, error) {
+func (p *PostgresProvider) GetTargetByName(ctx context.Context, name string) (*Target, error) {
 	var t Target
-	var user, pass sql.NullString
-	err := p.db.QueryRow("SELECT id, name, host, port, database_name, encoding, auth_user, auth_pass FROM targets WHERE name = $1", name).
-		Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.DatabaseName, &t.Encoding, &user, &pass)
+	var user, pass, protocol sql.NullString
+	err := p.db.QueryRowContext(ctx, "SELECT id, name, host, port, database_name, encoding, auth_user, auth_pass, protocol FROM targets WHERE name = $1", name).
+		Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.DatabaseName, &t.Encoding, &user, &pass, &protocol)
 	if err != nil {
 		return nil, err
 	}
 	if user.Valid { t.AuthUser = user.String }
 	if pass.Valid { t.AuthPass = pass.String }
+	t.Protocol = protocolOrDefault(protocol)
 	return &t, nil
 }
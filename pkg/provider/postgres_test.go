@@ -100,11 +100,41 @@ func TestPostgresSearch(t *testing.T) {
 			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: "NonExistentBook"}},
 			expectedIDs: nil,
 		},
+		{
+			name:        "Right truncation",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Truncation: z3950.TruncationRight, Term: "prog"}},
+			expectedIDs: []string{"1"},
+		},
+		{
+			name:        "Word structure needs whole words",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Structure: z3950.StructureWord, Term: "prog"}},
+			expectedIDs: nil,
+		},
+		{
+			name:        "First in field",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Position: z3950.PositionFirstInField, Term: "go"}},
+			expectedIDs: []string{"3"},
+		},
+		{
+			name:        "Date greater or equal",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeDatePub, Relation: z3950.RelationGreaterEqual, Term: "2018"}},
+			expectedIDs: []string{"2", "4"},
+		},
+		{
+			name:        "Proximity within distance",
+			query:       z3950.StructuredQuery{Root: proximity("go", "language", 2, true)},
+			expectedIDs: []string{"1"},
+		},
+		{
+			name:        "Proximity unordered",
+			query:       z3950.StructuredQuery{Root: proximity("practice", "go", 2, false)},
+			expectedIDs: []string{"3"},
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			ids, err := provider.Search("bibliography", tc.query)
+			ids, _, err := provider.Search(t.Context(), "bibliography", tc.query)
 			if err != nil {
 				t.Fatalf("Search failed: %v", err)
 			}
@@ -124,7 +154,7 @@ func TestPostgresFetch(t *testing.T) {
 	defer cleanup()
 
 	idsToFetch := []string{"2", "4"}
-	records, err := provider.Fetch("bibliography", idsToFetch)
+	records, err := provider.Fetch(t.Context(), "bibliography", idsToFetch, z3950.ElementSetFull)
 	if err != nil {
 		t.Fatalf("Fetch failed: %v", err)
 	}
@@ -157,7 +187,7 @@ func TestPostgresScan(t *testing.T) {
 	defer cleanup()
 	
 	startTerm := "Go"
-	results, err := provider.Scan("bibliography", "title", startTerm)
+	results, err := provider.Scan(t.Context(), "bibliography", "title", startTerm)
 	if err != nil {
 		t.Fatalf("Scan failed: %v", err)
 	}
@@ -180,3 +210,44 @@ func TestPostgresScan(t *testing.T) {
 		}
 	}
 }
+
+func TestPostgresSearchSort(t *testing.T) {
+	provider, cleanup := setupPostgresTestDB(t)
+	defer cleanup()
+
+	testCases := []struct {
+		name string
+		keys []z3950.SortKey
+		want []string
+	}{
+		{"Title ascending", []z3950.SortKey{{Attribute: z3950.UseAttributeTitle}}, []string{"4", "3", "1", "2"}},
+		{"Author descending", []z3950.SortKey{{Attribute: z3950.UseAttributeAuthor, Relation: 1}}, []string{"4", "2", "3", "1"}},
+		{"Date ascending", []z3950.SortKey{{Attribute: z3950.UseAttributeDatePub}}, []string{"1", "3", "2", "4"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: 0, Term: "go"}, SortKeys: tc.keys}
+			ids, _, err := provider.Search(t.Context(), "bibliography", query)
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			if !reflect.DeepEqual(ids, tc.want) {
+				t.Errorf("got ids %v, want %v", ids, tc.want)
+			}
+		})
+	}
+}
+
+func TestPostgresSortIDs(t *testing.T) {
+	provider, cleanup := setupPostgresTestDB(t)
+	defer cleanup()
+
+	keys := []z3950.SortKey{{Attribute: z3950.UseAttributeTitle}}
+	ids, err := provider.SortIDs(t.Context(), "bibliography", []string{"2", "1", "4", "3"}, keys)
+	if err != nil {
+		t.Fatalf("SortIDs failed: %v", err)
+	}
+	if want := []string{"4", "3", "1", "2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got ids %v, want %v", ids, want)
+	}
+}
@@ -1,15 +1,19 @@
 package provider
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950/pool"
 )
 
 // friendlyError maps technical errors to user-friendly messages
@@ -17,123 +21,354 @@ func friendlyError(target string, action string, err error) error {
 	msg := err.Error()
 	friendly := msg
 
-	if strings.Contains(msg, "i/o timeout") {
+	if strings.Contains(msg, "i/o timeout") || errors.Is(err, context.DeadlineExceeded) {
 		friendly = fmt.Sprintf("Connection to %s timed out.", target)
+	} else if errors.Is(err, context.Canceled) {
+		friendly = fmt.Sprintf("Request to %s was cancelled.", target)
 	} else if strings.Contains(msg, "connection refused") {
 		friendly = fmt.Sprintf("%s server refused the connection.", target)
 	} else if strings.Contains(msg, "no such host") {
 		friendly = fmt.Sprintf("Could not resolve hostname for %s.", target)
+	} else if errors.Is(err, z3950.ErrAuthentication) {
+		friendly = fmt.Sprintf("%s rejected the gateway's credentials; check the target's user name and password.", target)
 	} else if strings.Contains(msg, "server rejected connection") {
 		friendly = fmt.Sprintf("%s rejected the connection (Invalid credentials/options).", target)
+	} else if errors.Is(err, z3950.ErrNotNegotiated) {
+		friendly = fmt.Sprintf("%s does not support %s.", target, action)
 	} else if strings.Contains(msg, "reset by peer") {
 		friendly = fmt.Sprintf("%s closed the connection unexpectedly.", target)
 	}
 
+	var diag *z3950.Diagnostic
+	if errors.As(err, &diag) {
+		friendly = fmt.Sprintf("%s reported: %s", target, diag.Error())
+	}
+
 	// Log original error for debugging but return friendly one
 	slog.Error("Z39.50 Error", "target", target, "action", action, "original_error", err)
-	return fmt.Errorf(friendly)
+	return &targetError{msg: friendly, err: err}
+}
+
+// targetError carries the friendly message while keeping the original
+// error (e.g. a *z3950.Diagnostic) reachable through errors.As.
+type targetError struct {
+	msg string
+	err error
 }
 
-// TargetConfig holds connection details for a remote Z39.50 server
+func (e *targetError) Error() string { return e.msg }
+func (e *targetError) Unwrap() error { return e.err }
+
+// TargetConfig holds connection details for a remote Z39.50 or SRU server
 type TargetConfig struct {
 	Host         string
 	Port         int
 	DatabaseName string
 	Encoding     string // "MARC21", "UNIMARC", "SUTRS"
+	Protocol     string // ProtocolZ3950 or ProtocolSRU
+	Auth         z3950.Authentication
+}
+
+// TargetAuthentication turns a target's stored credentials into the
+// authentication sent with Init: a user name and password are sent as
+// idPass, a user name alone as an open string (e.g. "user/password").
+func TargetAuthentication(user, password string) z3950.Authentication {
+	switch {
+	case user != "" && password != "":
+		return z3950.Authentication{UserID: user, Password: password}
+	case user != "":
+		return z3950.Authentication{Open: user}
+	}
+	return z3950.Authentication{}
 }
 
 type TargetResolver interface {
-	GetTargetByName(name string) (*Target, error)
+	GetTargetByName(ctx context.Context, name string) (*Target, error)
 }
 
+// presentBatchSize caps the records asked for in one Present request,
+// which is also kept within the negotiated message size assuming records
+// of presentRecordSize bytes.
+const (
+	presentBatchSize  = 50
+	presentRecordSize = 4096
+)
+
 type ProxyProvider struct {
-	resolver   TargetResolver
-	queryCache sync.Map
+	resolver TargetResolver
+	// queries keeps each search's query under its session ID, for Fetch to
+	// search again once the remote result set is gone.
+	queries heldQueries
+	// pool keeps each search's connection, and with it the remote result
+	// set, open under the search's session ID so that Fetch can present
+	// from it instead of searching again.
+	pool *pool.Pool
 }
 
 func NewProxyProvider(resolver TargetResolver) *ProxyProvider {
-	return &ProxyProvider{
+	p := &ProxyProvider{
 		resolver: resolver,
+		pool:     pool.GetGlobalPool(),
 	}
+	p.queries.timeout = p.pool.SessionTimeout()
+	return p
 }
 
-// connectToTarget connects and initializes a session
-func (p *ProxyProvider) connectToTarget(targetName string) (*z3950.Client, TargetConfig, error) {
-	// Resolve target from DB
-	t, err := p.resolver.GetTargetByName(targetName)
-	if err != nil {
-		return nil, TargetConfig{}, fmt.Errorf("unknown target: %s", targetName)
+// heldQueries maps session IDs to their queries. A query expires when it
+// has not been used for as long as the pool keeps an idle session.
+type heldQueries struct {
+	mu      sync.Mutex
+	queries map[string]*heldQuery
+	timeout time.Duration
+	swept   time.Time
+}
+
+type heldQuery struct {
+	db       string
+	query    z3950.StructuredQuery
+	count    int
+	lastUsed time.Time
+}
+
+func (h *heldQueries) store(sessionID, db string, query z3950.StructuredQuery, count int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if h.queries == nil {
+		h.queries = make(map[string]*heldQuery)
 	}
+	// Expired queries are swept out at most once a minute
+	if now.Sub(h.swept) > time.Minute {
+		for id, q := range h.queries {
+			if now.Sub(q.lastUsed) > h.timeout {
+				delete(h.queries, id)
+			}
+		}
+		h.swept = now
+	}
+	h.queries[sessionID] = &heldQuery{db: db, query: query, count: count, lastUsed: now}
+}
+
+// load returns the query held under sessionID and its hit count. A
+// session only belongs to the database it searched.
+func (h *heldQueries) load(sessionID, db string) (z3950.StructuredQuery, int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	q, ok := h.queries[sessionID]
+	if !ok || !strings.EqualFold(q.db, db) {
+		return z3950.StructuredQuery{}, 0, false
+	}
+	if time.Since(q.lastUsed) > h.timeout {
+		delete(h.queries, sessionID)
+		return z3950.StructuredQuery{}, 0, false
+	}
+	q.lastUsed = time.Now()
+	return q.query, q.count, true
+}
 
-	config := TargetConfig{
+// resolveTarget looks up a target's connection details by name
+func (p *ProxyProvider) resolveTarget(ctx context.Context, targetName string) (TargetConfig, error) {
+	t, err := p.resolver.GetTargetByName(ctx, targetName)
+	if err != nil {
+		return TargetConfig{}, z3950.NewDiagnostic(z3950.DiagDatabaseNotFound, targetName)
+	}
+	return TargetConfig{
 		Host:         t.Host,
 		Port:         t.Port,
 		DatabaseName: t.DatabaseName,
 		Encoding:     t.Encoding,
-	}
+		Protocol:     targetProtocol(t),
+		Auth:         TargetAuthentication(t.AuthUser, t.AuthPass),
+	}, nil
+}
 
-	client := z3950.NewClient(config.Host, config.Port)
-	if err := client.Connect(); err != nil {
-		return nil, config, friendlyError(targetName, "connect", err)
+// connectToTarget takes an initialized connection from the pool
+func (p *ProxyProvider) connectToTarget(ctx context.Context, targetName string, config TargetConfig) (*pool.ClientWrapper, error) {
+	cw, err := p.pool.Get(ctx, config.Host, config.Port, config.DatabaseName, config.Auth)
+	if err != nil {
+		return nil, friendlyError(targetName, "connect", err)
 	}
+	return cw, nil
+}
 
-	if err := client.Init(); err != nil {
-		client.Close()
-		return nil, config, friendlyError(targetName, "init", err)
-	}
-	
-	return client, config, nil
+// isDiagnostic reports whether err is a diagnostic from the target, after
+// which the connection is still usable.
+func isDiagnostic(err error) bool {
+	var diag *z3950.Diagnostic
+	return errors.As(err, &diag)
 }
 
-// executeRemoteSearch connects, initializes, searches, and returns the client, count AND config.
-func (p *ProxyProvider) executeRemoteSearch(targetName string, query z3950.StructuredQuery) (*z3950.Client, int, TargetConfig, error) {
-	client, config, err := p.connectToTarget(targetName)
+// executeRemoteSearch searches the target on a pooled connection and returns it with the count.
+// Up to piggyback records from the start of the result set are asked for with the search, in
+// query.ElementSet, and kept in the connection's Records. connected, if not nil,
+// is called once the connection is up.
+func (p *ProxyProvider) executeRemoteSearch(ctx context.Context, targetName string, config TargetConfig, query z3950.StructuredQuery, piggyback int, connected func()) (*pool.ClientWrapper, int, error) {
+	cw, err := p.connectToTarget(ctx, targetName, config)
 	if err != nil {
-		return nil, 0, config, err
+		return nil, 0, err
+	}
+	if connected != nil {
+		connected()
 	}
 
-	count, err := client.StructuredSearch(config.DatabaseName, query)
+	if len(query.SortKeys) > 0 {
+		// Records sent with the search would predate the sort
+		piggyback = 0
+	}
+	piggyback = min(piggyback, cw.Client.PresentCount(presentRecordSize))
+	syntaxOID, elementSet := recordSyntaxOID(config), targetElementSet(query.ElementSet)
+	count, records, err := cw.Client.SearchPresent(ctx, config.DatabaseName, query, piggyback, syntaxOID, elementSet)
+	if err != nil && !isDiagnostic(err) && !errors.Is(err, z3950.ErrNotNegotiated) && ctx.Err() == nil {
+		// An idle connection may have been dropped by the target; retry once on a new one
+		cw.Client.Close()
+		if cw, err = p.pool.Dial(ctx, config.Host, config.Port, config.DatabaseName, config.Auth); err != nil {
+			return nil, 0, friendlyError(targetName, "connect", err)
+		}
+		count, records, err = cw.Client.SearchPresent(ctx, config.DatabaseName, query, piggyback, syntaxOID, elementSet)
+	}
 	if err != nil {
-		client.Close()
-		return nil, 0, config, friendlyError(targetName, "search", err)
+		if isDiagnostic(err) {
+			p.pool.Put(cw)
+		} else {
+			cw.Client.Close()
+		}
+		return nil, 0, friendlyError(targetName, "search", err)
+	}
+	cw.Records, cw.ElementSet = nil, elementSet
+	for i, rec := range records {
+		if rec != nil {
+			if cw.Records == nil {
+				cw.Records = make(map[int]*z3950.MARCRecord)
+			}
+			cw.Records[i+1] = rec
+		}
 	}
 
 	// Perform Sort if requested
 	if len(query.SortKeys) > 0 && count > 0 {
-		if err := client.Sort("default", query.SortKeys); err != nil {
+		if err := cw.Client.Sort(ctx, "default", query.SortKeys); err != nil {
+			if !cw.Client.Connected() {
+				// Timed out or cancelled; the connection is gone
+				return nil, 0, friendlyError(targetName, "sort", err)
+			}
 			slog.Warn("sort failed", "target", targetName, "error", err)
 			// Don't fail the search, just log warning
 		}
 	}
 
-	return client, count, config, nil
+	return cw, count, nil
 }
 
-func (p *ProxyProvider) Search(db string, query z3950.StructuredQuery) ([]string, error) {
-	client, count, _, err := p.executeRemoteSearch(db, query)
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
+func (p *ProxyProvider) Search(ctx context.Context, db string, query z3950.StructuredQuery) ([]string, int, error) {
+	return p.search(ctx, db, query, nil)
+}
 
-	if count > 20 {
-		count = 20
+// search is Search calling connected, if not nil, once the target is
+// reached and the search itself starts.
+func (p *ProxyProvider) search(ctx context.Context, db string, query z3950.StructuredQuery, connected func()) ([]string, int, error) {
+	config, err := p.resolveTarget(ctx, db)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// Generate a unique session ID for this search result set
 	sessionID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), rand.Intn(100000))
-	p.queryCache.Store(sessionID, query)
 
-	ids := make([]string, count)
-	for i := 0; i < count; i++ {
+	var count int
+	if config.Protocol == ProtocolSRU {
+		// SRU has no connection to set up
+		if connected != nil {
+			connected()
+		}
+		if count, err = p.sruSearch(ctx, db, config, query); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		// The first page is asked for with the search, saving its Present
+		piggyback := 0
+		if query.Offset <= 0 && query.Limit > 0 {
+			piggyback = min(query.Limit, presentBatchSize)
+		}
+		cw, n, err := p.executeRemoteSearch(ctx, db, config, query, piggyback, connected)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n > 0 {
+			p.pool.Hold(sessionID, cw)
+		} else {
+			p.pool.Put(cw)
+		}
+		count = n
+	}
+
+	p.queries.store(sessionID, db, query, count)
+
+	return resultIDs(sessionID, count, query.Offset, query.Limit), count, nil
+}
+
+// resultIDs returns the ids of the page at offset of the count records in
+// a session's result set. The ids name positions in the remote result set,
+// so a page is just a range of them; records are only presented when
+// fetched.
+func resultIDs(sessionID string, count, offset, limit int) []string {
+	first, last := offset+1, count
+	if offset < 0 {
+		first = 1
+	}
+	if limit > 0 && first-1+limit < last {
+		last = first - 1 + limit
+	}
+
+	var ids []string
+	for i := first; i <= last; i++ {
 		// Return IDs in format "sessionID:index"
-		ids[i] = fmt.Sprintf("%s:%d", sessionID, i+1)
+		ids = append(ids, fmt.Sprintf("%s:%d", sessionID, i))
 	}
-	
-	return ids, nil
+	return ids
 }
 
-func (p *ProxyProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord, error) {
+// ResultSession returns the session the ids of a search belong to.
+func (p *ProxyProvider) ResultSession(db string, ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	sessionID, _, ok := parseResultID(ids[0])
+	if !ok {
+		return ""
+	}
+	return sessionID
+}
+
+// ResultTimeout returns how long a session's query and count are kept
+// unused, which is as long as the pool keeps an idle session.
+func (p *ProxyProvider) ResultTimeout() time.Duration {
+	return p.queries.timeout
+}
+
+// Page returns another page of a session's results without searching
+// again; Fetch presents them from the remote result set while it is held.
+func (p *ProxyProvider) Page(ctx context.Context, db, session string, offset, limit int) ([]string, int, error) {
+	_, count, ok := p.queries.load(session, db)
+	if !ok {
+		return nil, 0, ErrResultsExpired
+	}
+	return resultIDs(session, count, offset, limit), count, nil
+}
+
+// parseResultID splits a "sessionID:index" record id.
+func parseResultID(id string) (string, int, bool) {
+	parts := strings.Split(id, ":")
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+	idx, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false
+	}
+	return parts[0], idx, true
+}
+
+func (p *ProxyProvider) Fetch(ctx context.Context, db string, ids []string, elementSet string) ([]*z3950.MARCRecord, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
@@ -145,77 +380,207 @@ func (p *ProxyProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord, err
 	}
 	sessionID := parts[0]
 
-	val, ok := p.queryCache.Load(sessionID)
+	query, _, ok := p.queries.load(sessionID, db)
 	if !ok {
 		return nil, fmt.Errorf("session expired or unknown query for db: %s", db)
 	}
-	query := val.(z3950.StructuredQuery)
 
-	client, _, config, err := p.executeRemoteSearch(db, query)
+	config, err := p.resolveTarget(ctx, db)
 	if err != nil {
 		return nil, err
 	}
-	defer client.Close()
+	if config.Protocol == ProtocolSRU {
+		records, err := p.sruFetch(ctx, db, config, query, ids)
+		if err != nil {
+			return nil, err
+		}
+		return selectElementSet(records, elementSet, nil)
+	}
 
-	// Determine Syntax OID
-	syntaxOID := z3950.OID_MARC21
-	if config.Encoding == "UNIMARC" {
-		syntaxOID = z3950.OID_UNIMARC
-	} else if config.Encoding == "SUTRS" {
-		syntaxOID = z3950.OID_SUTRS
+	syntaxOID := recordSyntaxOID(config)
+	elementSet = targetElementSet(elementSet)
+
+	// Present from the result set the search left open; if it has expired,
+	// or its connection was dropped, search again on a fresh one.
+	cw, held := p.pool.Acquire(sessionID)
+	for {
+		if cw == nil {
+			slog.Info("remote result set not held, searching again", "db", db, "session", sessionID)
+			if cw, _, err = p.executeRemoteSearch(ctx, db, config, query, 0, nil); err != nil {
+				return nil, err
+			}
+		}
+		// Piggybacked records only serve Fetches for their element set
+		var have map[int]*z3950.MARCRecord
+		if cw.ElementSet == elementSet {
+			have = cw.Records
+		}
+		records, err := presentBatched(ctx, db, cw.Client, syntaxOID, elementSet, ids, have)
+		if err != nil && !isDiagnostic(err) {
+			cw.Client.Close()
+			if held && ctx.Err() == nil && !errors.Is(err, z3950.ErrNotNegotiated) {
+				cw, held = nil, false
+				continue
+			}
+			return nil, friendlyError(db, "present", err)
+		}
+		p.pool.Hold(sessionID, cw)
+		if len(records) == 0 && err != nil {
+			return nil, friendlyError(db, "present", err)
+		}
+		return records, nil
 	}
+}
 
-	var records []*z3950.MARCRecord
+// Release gives up the remote result sets behind ids, returning their
+// connections to the pool. Their queries are kept until they expire, so
+// fetching the ids later searches again.
+func (p *ProxyProvider) Release(db string, ids []string) {
+	released := make(map[string]bool)
 	for _, id := range ids {
-		parts := strings.Split(id, ":")
-		if len(parts) != 2 {
+		sessionID, _, ok := parseResultID(id)
+		if !ok || released[sessionID] {
 			continue
 		}
-		idx, err := strconv.Atoi(parts[1])
-		if err != nil {
+		released[sessionID] = true
+		p.pool.Release(sessionID)
+	}
+}
+
+// recordSyntaxOID returns the record syntax to ask config's target for.
+func recordSyntaxOID(config TargetConfig) string {
+	switch config.Encoding {
+	case "UNIMARC":
+		return z3950.OID_UNIMARC
+	case "SUTRS":
+		return z3950.OID_SUTRS
+	}
+	return z3950.OID_MARC21
+}
+
+// presentBatched retrieves the records behind "sessionID:index" ids in
+// elementSet with one Present per run of consecutive positions, returning
+// them in the order of ids. Positions found in have, the records piggybacked on the
+// search, are not presented again. A diagnostic for one run does not stop
+// the others; it is returned alongside the records that could be fetched.
+func presentBatched(ctx context.Context, db string, client *z3950.Client, syntaxOID, elementSet string, ids []string, have map[int]*z3950.MARCRecord) ([]*z3950.MARCRecord, error) {
+	byPosition := make(map[int]*z3950.MARCRecord)
+	var positions []int
+	for _, id := range ids {
+		if _, idx, ok := parseResultID(id); ok {
+			if rec := have[idx]; rec != nil {
+				byPosition[idx] = rec
+				continue
+			}
+			positions = append(positions, idx)
+		}
+	}
+	sort.Ints(positions)
+
+	batch := min(presentBatchSize, client.PresentCount(presentRecordSize))
+	var lastErr error
+	for i := 0; i < len(positions); {
+		first := i
+		start, count := positions[i], 1
+		for i++; i < len(positions) && count < batch; i++ {
+			if positions[i] == start+count-1 {
+				continue // duplicate id
+			}
+			if positions[i] != start+count {
+				break
+			}
+			count++
+		}
+
+		recs, err := client.PresentAt(ctx, start, count, syntaxOID, elementSet)
+		var diag *z3950.Diagnostic
+		tooLarge := errors.As(err, &diag) && (diag.Code == z3950.DiagRecordExceedsMessageSize || diag.Code == z3950.DiagRecordExceedsRecordSize)
+		if count > 1 && (tooLarge || err == nil && len(recs) == 0) {
+			// The records are larger than assumed, so smaller batches are
+			// asked for; a record that is too large alone is left out
+			batch, i = max(1, count/2), first
+			slog.Info("present too large, asking for fewer records", "db", db, "start", start, "batch", batch)
 			continue
 		}
-		
-		recs, err := client.Present(idx, 1, syntaxOID)
 		if err != nil {
-			slog.Warn("failed to fetch record", "db", db, "index", idx, "error", err)
+			slog.Warn("failed to fetch records", "db", db, "start", start, "count", count, "error", err)
+			if !isDiagnostic(err) {
+				return nil, err
+			}
+			lastErr = err
 			continue
 		}
-		if len(recs) > 0 {
-			records = append(records, recs[0])
+		for j, rec := range recs {
+			if rec != nil {
+				byPosition[start+j] = rec
+			}
+		}
+		if count > 1 && len(recs) > 0 && recs[0] == nil {
+			// A first record too large for the message is only sent when
+			// asked for alone
+			if alone, err := client.PresentAt(ctx, start, 1, syntaxOID, elementSet); err == nil && len(alone) == 1 && alone[0] != nil {
+				byPosition[start] = alone[0]
+			} else if err != nil && !isDiagnostic(err) {
+				return nil, err
+			}
+		}
+		if len(recs) > 0 && len(recs) < count {
+			// The target stopped short to keep within the negotiated
+			// message size; the rest of the run comes next
+			for i > 0 && positions[i-1] >= start+len(recs) {
+				i--
+			}
 		}
 	}
 
-	return records, nil
-}
-
-func (p *ProxyProvider) Scan(db, field, startTerm string) ([]ScanResult, error) {
-	client, config, err := p.connectToTarget(db)
-	if err != nil {
-		return nil, err
+	var records []*z3950.MARCRecord
+	for _, id := range ids {
+		if _, idx, ok := parseResultID(id); ok && byPosition[idx] != nil {
+			records = append(records, byPosition[idx])
+		}
 	}
-	defer client.Close()
+	return records, lastErr
+}
 
-	// Map field string to Bib-1 Use Attribute
-	attrs := make(map[int]int)
+// scanUseAttribute maps a scannable field to its Bib-1 Use Attribute
+func scanUseAttribute(field string) int {
 	switch field {
 	case "author":
-		attrs[1] = 1003
+		return z3950.UseAttributeAuthor
 	case "subject":
-		attrs[1] = 21
+		return z3950.UseAttributeSubject
 	case "isbn":
-		attrs[1] = 7
+		return z3950.UseAttributeISBN
 	case "issn":
-		attrs[1] = 8
-	case "title":
-		attrs[1] = 4
+		return z3950.UseAttributeISSN
 	default:
-		attrs[1] = 4 // Default to Title
+		return z3950.UseAttributeTitle // Default to Title
+	}
+}
+
+func (p *ProxyProvider) Scan(ctx context.Context, db, field, startTerm string) ([]ScanResult, error) {
+	config, err := p.resolveTarget(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if config.Protocol == ProtocolSRU {
+		return p.sruScan(ctx, db, config, field, startTerm)
 	}
 
-	entries, err := client.Scan(config.DatabaseName, startTerm, attrs)
+	cw, err := p.connectToTarget(ctx, db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := map[int]int{z3950.AttributeTypeUse: scanUseAttribute(field)}
+	entries, err := cw.Client.Scan(ctx, config.DatabaseName, startTerm, attrs)
+	if err != nil && !isDiagnostic(err) {
+		cw.Client.Close()
+		return nil, friendlyError(db, "scan", err)
+	}
+	p.pool.Put(cw)
 	if err != nil {
-		return nil, fmt.Errorf("remote scan failed: %w", err)
+		return nil, friendlyError(db, "scan", err)
 	}
 
 	results := make([]ScanResult, len(entries))
@@ -230,42 +595,42 @@ func (p *ProxyProvider) Scan(db, field, startTerm string) ([]ScanResult, error)
 }
 
 // Stub implementations for unsupported methods
-func (p *ProxyProvider) CreateILLRequest(req ILLRequest) error {
+func (p *ProxyProvider) CreateILLRequest(ctx context.Context, req ILLRequest) error {
 	return fmt.Errorf("proxy provider does not support creating ILL requests locally")
 }
 
-func (p *ProxyProvider) GetILLRequest(id int64) (*ILLRequest, error) {
+func (p *ProxyProvider) GetILLRequest(ctx context.Context, id int64) (*ILLRequest, error) {
 	return nil, fmt.Errorf("proxy provider does not support ILL")
 }
 
-func (p *ProxyProvider) ListILLRequests() ([]ILLRequest, error) {
+func (p *ProxyProvider) ListILLRequests(ctx context.Context) ([]ILLRequest, error) {
 	return []ILLRequest{}, nil
 }
 
-func (p *ProxyProvider) UpdateILLRequestStatus(id int64, status string) error {
+func (p *ProxyProvider) UpdateILLRequestStatus(ctx context.Context, id int64, status string) error {
 	return fmt.Errorf("proxy provider does not support updating ILL requests")
 }
 
-func (p *ProxyProvider) CreateUser(user *User) error {
+func (p *ProxyProvider) CreateUser(ctx context.Context, user *User) error {
 	return fmt.Errorf("proxy provider does not support user management")
 }
 
-func (p *ProxyProvider) GetUserByUsername(username string) (*User, error) {
+func (p *ProxyProvider) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	return nil, fmt.Errorf("user not found in proxy provider")
 }
 
-func (p *ProxyProvider) CreateTarget(target *Target) error {
+func (p *ProxyProvider) CreateTarget(ctx context.Context, target *Target) error {
 	return fmt.Errorf("proxy provider does not support managing targets")
 }
 
-func (p *ProxyProvider) ListTargets() ([]Target, error) {
+func (p *ProxyProvider) ListTargets(ctx context.Context) ([]Target, error) {
 	return []Target{}, nil
 }
 
-func (p *ProxyProvider) DeleteTarget(id int64) error {
+func (p *ProxyProvider) DeleteTarget(ctx context.Context, id int64) error {
 	return fmt.Errorf("proxy provider does not support managing targets")
 }
 
-func (p *ProxyProvider) GetTargetByName(name string) (*Target, error) {
+func (p *ProxyProvider) GetTargetByName(ctx context.Context, name string) (*Target, error) {
 	return nil, fmt.Errorf("proxy provider does not store targets")
 }
\ No newline at end of file
@@ -0,0 +1,162 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/sru"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// sruMaxRecordsPerRequest caps the records asked for in one searchRetrieve;
+// servers may return fewer, in which case the next page is requested.
+const sruMaxRecordsPerRequest = 50
+
+// SRUBaseURL builds an SRU target's base URL from its host, port and
+// database. The scheme defaults to http, or https on port 443, unless host
+// carries one; the port is left out when it is the scheme's default.
+func SRUBaseURL(host string, port int, database string) string {
+	scheme := "http"
+	if port == 443 {
+		scheme = "https"
+	}
+	if s, rest, ok := strings.Cut(host, "://"); ok {
+		scheme, host = s, rest
+	}
+	host = strings.TrimRight(host, "/")
+	defaultPort := map[string]int{"http": 80, "https": 443}[scheme]
+	if port != 0 && port != defaultPort {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return scheme + "://" + host + "/" + strings.TrimLeft(database, "/")
+}
+
+// sruError reports an SRU diagnostic as the Bib-1 diagnostic a Z39.50
+// target would have sent, so both kinds of target fail the same way.
+func sruError(target, action string, err error) error {
+	var diag *sru.Diagnostic
+	if errors.As(err, &diag) {
+		err = diag.Bib1()
+	}
+	return friendlyError(target, action, err)
+}
+
+// sruSortUnsupported reports whether a target rejected the sortby clause.
+// Sort diagnostics are numbered 80 to 96.
+func sruSortUnsupported(err error) bool {
+	var diag *sru.Diagnostic
+	return errors.As(err, &diag) && diag.Code >= 80 && diag.Code <= 96
+}
+
+// sruSearchRetrieve renders the query as CQL and runs a searchRetrieve,
+// retrying without sortby when the target cannot sort; like the Z39.50
+// path, a failed sort is only a warning.
+func (p *ProxyProvider) sruSearchRetrieve(ctx context.Context, targetName string, client *sru.Client, query z3950.StructuredQuery, start, max int) (*sru.SearchResponse, error) {
+	cql, err := z3950.FormatCQL(query)
+	if err != nil {
+		return nil, friendlyError(targetName, "search", err)
+	}
+	resp, err := client.SearchRetrieve(ctx, cql, start, max, "marcxml")
+	if err != nil && len(query.SortKeys) > 0 && sruSortUnsupported(err) {
+		slog.Warn("sort failed", "target", targetName, "error", err)
+		query.SortKeys = nil
+		if cql, err = z3950.FormatCQL(query); err == nil {
+			resp, err = client.SearchRetrieve(ctx, cql, start, max, "marcxml")
+		}
+	}
+	if err != nil {
+		return nil, sruError(targetName, "search", err)
+	}
+	return resp, nil
+}
+
+func (p *ProxyProvider) sruSearch(ctx context.Context, targetName string, config TargetConfig, query z3950.StructuredQuery) (int, error) {
+	client := sru.NewClient(SRUBaseURL(config.Host, config.Port, config.DatabaseName))
+	resp, err := p.sruSearchRetrieve(ctx, targetName, client, query, 1, 0)
+	if err != nil {
+		return 0, err
+	}
+	return resp.NumberOfRecords, nil
+}
+
+// sruFetch retrieves the records behind "sessionID:index" ids, asking for
+// the whole span they cover rather than one record at a time.
+func (p *ProxyProvider) sruFetch(ctx context.Context, targetName string, config TargetConfig, query z3950.StructuredQuery, ids []string) ([]*z3950.MARCRecord, error) {
+	first, last := 0, 0
+	for _, id := range ids {
+		_, idx, ok := parseResultID(id)
+		if !ok {
+			continue
+		}
+		if first == 0 || idx < first {
+			first = idx
+		}
+		if idx > last {
+			last = idx
+		}
+	}
+	if first == 0 {
+		return nil, fmt.Errorf("invalid id format")
+	}
+
+	client := sru.NewClient(SRUBaseURL(config.Host, config.Port, config.DatabaseName))
+	byPosition := make(map[int]*z3950.MARCRecord)
+	for start := first; start <= last; {
+		max := last - start + 1
+		if max > sruMaxRecordsPerRequest {
+			max = sruMaxRecordsPerRequest
+		}
+		resp, err := p.sruSearchRetrieve(ctx, targetName, client, query, start, max)
+		if err != nil {
+			return nil, err
+		}
+		next := start
+		for _, r := range resp.Records {
+			if r.Position >= next {
+				next = r.Position + 1
+			}
+			rec, err := z3950.ParseMARCXML(r.Data)
+			if err != nil {
+				slog.Warn("failed to parse record", "db", targetName, "index", r.Position, "schema", r.Schema, "error", err)
+				continue
+			}
+			byPosition[r.Position] = rec
+		}
+		if next == start {
+			break // the target returned nothing new
+		}
+		start = next
+	}
+
+	var records []*z3950.MARCRecord
+	for _, id := range ids {
+		if _, idx, ok := parseResultID(id); ok && byPosition[idx] != nil {
+			records = append(records, byPosition[idx])
+		}
+	}
+	return records, nil
+}
+
+func (p *ProxyProvider) sruScan(ctx context.Context, targetName string, config TargetConfig, field, startTerm string) ([]ScanResult, error) {
+	clause, err := z3950.FormatCQL(z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: scanUseAttribute(field), Term: startTerm}})
+	if err != nil {
+		return nil, friendlyError(targetName, "scan", err)
+	}
+
+	client := sru.NewClient(SRUBaseURL(config.Host, config.Port, config.DatabaseName))
+	terms, err := client.Scan(ctx, clause, 10)
+	if err != nil {
+		return nil, sruError(targetName, "scan", err)
+	}
+
+	results := make([]ScanResult, len(terms))
+	for i, t := range terms {
+		results[i] = ScanResult{Term: t.Value, Count: t.NumberOfRecords}
+	}
+	return results, nil
+}
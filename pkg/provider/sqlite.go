@@ -1,16 +1,69 @@
 package provider
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
 	"golang.org/x/crypto/bcrypt"
 	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
 )
 
+// maxSQLiteRegexps bounds the patterns the REGEXP function keeps compiled.
+const maxSQLiteRegexps = 256
+
+// sqliteRegexps caches the patterns compiled by the REGEXP function. A
+// query evaluates the same few patterns on every row, so the cache is
+// simply emptied when it fills up.
+var sqliteRegexps = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+// sqliteRegexp returns pattern compiled, from the cache when it is there.
+func sqliteRegexp(pattern string) (*regexp.Regexp, error) {
+	sqliteRegexps.Lock()
+	defer sqliteRegexps.Unlock()
+	if re, ok := sqliteRegexps.compiled[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(sqliteRegexps.compiled) >= maxSQLiteRegexps {
+		clear(sqliteRegexps.compiled)
+	}
+	sqliteRegexps.compiled[pattern] = re
+	return re, nil
+}
+
+// SQLite parses "x REGEXP y" but leaves the regexp(y, x) function to the
+// application; proximity searches rely on it.
+func init() {
+	err := sqlite.RegisterDeterministicScalarFunction("regexp", 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		pattern, ok := args[0].(string)
+		text, tok := args[1].(string)
+		if !ok || !tok {
+			return false, nil
+		}
+		re, err := sqliteRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(text), nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
 // SQLiteProvider implements the Provider interface for a SQLite database.
 type SQLiteProvider struct {
 	db      *sql.DB
@@ -99,6 +152,7 @@ func NewSQLiteProvider(path string) (*SQLiteProvider, error) {
 		encoding TEXT DEFAULT 'MARC21',
 		auth_user TEXT,
 		auth_pass TEXT,
+		protocol TEXT DEFAULT 'Z39.50',
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 	`
@@ -152,6 +206,7 @@ func NewSQLiteProvider(path string) (*SQLiteProvider, error) {
 	db.Exec("ALTER TABLE bibliography ADD COLUMN issn TEXT")
 	db.Exec("ALTER TABLE bibliography ADD COLUMN subjects TEXT")
 	db.Exec("ALTER TABLE ill_requests ADD COLUMN comments TEXT")
+	db.Exec("ALTER TABLE targets ADD COLUMN protocol TEXT DEFAULT 'Z39.50'")
 
 	return &SQLiteProvider{db: db, profile: profile}, nil
 }
@@ -195,26 +250,39 @@ func buildSQL(node z3950.QueryNode) (string, []interface{}, error) {
 
 	switch n := node.(type) {
 	case z3950.QueryClause:
-		term := n.Term
 		switch n.Attribute {
 		case z3950.UseAttributeTitle:
-			return "LOWER(title) LIKE ?", []interface{}{"%" + strings.ToLower(term) + "%"}, nil
+			cond, args := sqliteMatch("title", n)
+			return cond, args, nil
 		case z3950.UseAttributeAuthor:
-			return "LOWER(author) LIKE ?", []interface{}{"%" + strings.ToLower(term) + "%"}, nil
+			cond, args := sqliteMatch("author", n)
+			return cond, args, nil
 		case z3950.UseAttributeISBN:
-			return "REPLACE(REPLACE(TRIM(isbn), '-', ''), ' ', '') = ?", []interface{}{"" + CleanISBN(term)}, nil
+			return "REPLACE(REPLACE(TRIM(isbn), '-', ''), ' ', '') = ?", []interface{}{"" + CleanISBN(n.Term)}, nil
 		case z3950.UseAttributeISSN:
-			return "issn LIKE ?", []interface{}{"%" + term + "%"}, nil
+			cond, args := sqliteMatch("issn", n)
+			return cond, args, nil
 		case z3950.UseAttributeSubject:
-			return "LOWER(subjects) LIKE ?", []interface{}{"%" + strings.ToLower(term) + "%"}, nil
+			cond, args := sqliteMatch("subjects", n)
+			return cond, args, nil
 		case z3950.UseAttributeDatePub:
-			return "pub_year LIKE ?", []interface{}{"%" + term + "%"}, nil
+			cond, args := sqliteMatch("pub_year", n)
+			return cond, args, nil
 		default:
 			// Broad search
-			likeTerm := "%" + strings.ToLower(term) + "%"
-			return "(LOWER(title) LIKE ? OR LOWER(author) LIKE ? OR LOWER(subjects) LIKE ?)", []interface{}{"" + likeTerm, "" + likeTerm, "" + likeTerm}, nil
+			var parts []string
+			var args []interface{}
+			for _, col := range []string{"title", "author", "subjects"} {
+				cond, a := sqliteMatch(col, n)
+				parts = append(parts, cond)
+				args = append(args, a...)
+			}
+			return "(" + strings.Join(parts, " OR ") + ")", args, nil
 		}
 	case z3950.QueryComplex:
+		if n.Operator == "PROX" {
+			return sqliteProximity(n)
+		}
 		lSql, lArgs, err := buildSQL(n.Left)
 		if err != nil { return "", nil, err }
 		rSql, rArgs, err := buildSQL(n.Right)
@@ -229,17 +297,97 @@ func buildSQL(node z3950.QueryNode) (string, []interface{}, error) {
 	return "", nil, fmt.Errorf("unknown query node type")
 }
 
-func (p *SQLiteProvider) Search(db string, query z3950.StructuredQuery) ([]string, error) {
+// sqliteWordText pads a column with spaces and blanks out common
+// punctuation so that whole words can be matched with LIKE '% word %'.
+func sqliteWordText(col string) string {
+	expr := "LOWER(" + col + ")"
+	for _, p := range []string{",", ".", ";", ":", "/", "(", ")", "-", "'", "\"", "&"} {
+		expr = fmt.Sprintf("REPLACE(%s, '%s', ' ')", expr, strings.ReplaceAll(p, "'", "''"))
+	}
+	return "(' ' || " + expr + " || ' ')"
+}
+
+// sqliteMatch builds the condition for one clause against one column,
+// honouring the clause's relation, position, structure, truncation and
+// completeness attributes.
+func sqliteMatch(col string, c z3950.QueryClause) (string, []interface{}) {
+	if op, year, ok := dateComparison(c); ok {
+		return fmt.Sprintf("(TRIM(%s) GLOB '[0-9][0-9][0-9][0-9]*' AND CAST(SUBSTR(TRIM(%s), 1, 4) AS INTEGER) %s ?)", col, col, op), []interface{}{year}
+	}
+
+	term := strings.ToLower(strings.TrimSpace(c.Term))
+	switch clauseMatchMode(c) {
+	case matchExact:
+		return fmt.Sprintf("LOWER(TRIM(%s)) = ?", col), []interface{}{term}
+	case matchFieldPrefix:
+		return fmt.Sprintf("LOWER(TRIM(%s)) LIKE ? ESCAPE '\\'", col), []interface{}{likeEscape(term) + "%"}
+	case matchWords:
+		words := termWords(term)
+		if len(words) == 0 {
+			return "0", nil
+		}
+		conds := make([]string, len(words))
+		args := make([]interface{}, len(words))
+		for i, w := range words {
+			conds[i] = sqliteWordText(col) + " LIKE ? ESCAPE '\\'"
+			args[i] = "% " + likeEscape(w) + " %"
+		}
+		return "(" + strings.Join(conds, " AND ") + ")", args
+	case matchWordPrefix:
+		return sqliteWordText(col) + " LIKE ? ESCAPE '\\'", []interface{}{"% " + likeEscape(strings.Join(termWords(term), " ")) + "%"}
+	case matchWordSuffix:
+		return sqliteWordText(col) + " LIKE ? ESCAPE '\\'", []interface{}{"%" + likeEscape(strings.Join(termWords(term), " ")) + " %"}
+	default:
+		return fmt.Sprintf("LOWER(%s) LIKE ? ESCAPE '\\'", col), []interface{}{"%" + likeEscape(term) + "%"}
+	}
+}
+
+// sqliteProximity matches both terms of a proximity node within the field
+// of the left term's Use attribute (title, author and subjects for Any).
+func sqliteProximity(n z3950.QueryComplex) (string, []interface{}, error) {
+	pattern, err := proximityRegex(n, true)
+	if err != nil {
+		return "", nil, err
+	}
+	var cols []string
+	switch n.Left.(z3950.QueryClause).Attribute {
+	case z3950.UseAttributeTitle:
+		cols = []string{"title"}
+	case z3950.UseAttributeAuthor:
+		cols = []string{"author"}
+	case z3950.UseAttributeSubject:
+		cols = []string{"subjects"}
+	case z3950.UseAttributeISSN:
+		cols = []string{"issn"}
+	case z3950.UseAttributeDatePub:
+		cols = []string{"pub_year"}
+	default:
+		cols = []string{"title", "author", "subjects"}
+	}
+	conds := make([]string, len(cols))
+	args := make([]interface{}, len(cols))
+	for i, col := range cols {
+		conds[i] = col + " REGEXP ?"
+		args[i] = pattern
+	}
+	cond := "(" + strings.Join(conds, " OR ") + ")"
+	if n.Proximity != nil && n.Proximity.Exclusion {
+		cond = "NOT " + cond
+	}
+	return cond, args, nil
+}
+
+func (p *SQLiteProvider) Search(ctx context.Context, db string, query z3950.StructuredQuery) ([]string, int, error) {
 	if query.Root == nil {
-		return nil, nil
+		return nil, 0, nil
 	}
 
 	whereClause, args, err := buildSQL(query.Root)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	limit := 100
+	limit := -1 // no limit
 	if query.Limit > 0 {
 		limit = query.Limit
 	}
@@ -248,12 +396,12 @@ func (p *SQLiteProvider) Search(db string, query z3950.StructuredQuery) ([]strin
 		offset = query.Offset
 	}
 
-	sqlStr := fmt.Sprintf(`SELECT CAST(id AS TEXT) FROM bibliography WHERE %s LIMIT ? OFFSET ?`, whereClause)
-	args = append(args, limit, offset)
+	sqlStr := fmt.Sprintf(`SELECT CAST(id AS TEXT) FROM bibliography WHERE %s ORDER BY %s LIMIT ? OFFSET ?`, whereClause, orderBy(query.SortKeys))
+	pageArgs := append(append([]interface{}{}, args...), limit, offset)
 
-	rows, err := p.db.Query(sqlStr, args...)
+	rows, err := p.db.QueryContext(ctx, sqlStr, pageArgs...)
 	if err != nil {
-		return nil, fmt.Errorf("dynamic query failed: %w. SQL: %s. Args: %v", err, sqlStr, args)
+		return nil, 0, fmt.Errorf("dynamic query failed: %w. SQL: %s. Args: %v", err, sqlStr, pageArgs)
 	}
 	defer rows.Close()
 
@@ -264,10 +412,31 @@ func (p *SQLiteProvider) Search(db string, query z3950.StructuredQuery) ([]strin
 			ids = append(ids, id)
 		}
 	}
-	return ids, nil
+
+	// A short first page already holds every hit
+	if offset == 0 && (limit < 0 || len(ids) < limit) {
+		return ids, len(ids), nil
+	}
+	var total int
+	countSQL := fmt.Sprintf(`SELECT COUNT(*) FROM bibliography WHERE %s`, whereClause)
+	if err := p.db.QueryRowContext(ctx, countSQL, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count query failed: %w. SQL: %s. Args: %v", err, countSQL, args)
+	}
+	return ids, total, nil
+}
+
+// SortIDs orders ids from an earlier Search on keys, comparing the
+// values the search itself sorts on.
+func (p *SQLiteProvider) SortIDs(ctx context.Context, db string, ids []string, keys []z3950.SortKey) ([]string, error) {
+	books, err := lookupSortValues(ctx, p.db, `SELECT CAST(id AS TEXT), title, author, pub_year FROM bibliography WHERE CAST(id AS TEXT) IN (%s)`,
+		func(int) string { return "?" }, ids)
+	if err != nil {
+		return nil, err
+	}
+	return sortIDs(ids, keys, books), nil
 }
 
-func (p *SQLiteProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord, error) {
+func (p *SQLiteProvider) Fetch(ctx context.Context, db string, ids []string, elementSet string) ([]*z3950.MARCRecord, error) {
 	if len(ids) == 0 {
 		return nil, nil
 	}
@@ -284,7 +453,7 @@ func (p *SQLiteProvider) Fetch(db string, ids []string) ([]*z3950.MARCRecord, er
 		FROM bibliography 
 		WHERE CAST(id AS TEXT) IN (%s)`, strings.Join(placeholders,","))
 	
-rows, err := p.db.Query(query, args...)
+rows, err := p.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -306,7 +475,7 @@ rows, err := p.db.Query(query, args...)
 		
 		if rawRecord.Valid && rawRecord.String != "" {
 			isJSON := rawFormat.Valid && rawFormat.String == "MARC_JSON"
-			isMatch := !rawFormat.Valid || rawFormat.String == targetFormat
+			isMatch := !rawFormat.Valid || sameMARCFormat(rawFormat.String, targetFormat)
 			if isJSON || isMatch {
 				parsed, err := z3950.ParseMARC([]byte(rawRecord.String))
 				if err == nil {
@@ -332,7 +501,7 @@ rows, err := p.db.Query(query, args...)
 		if rec != nil {
 			// Fetch holdings
 			if id.Valid {
-				hRows, err := p.db.Query("SELECT id, bib_id, call_number, status, location FROM holdings WHERE bib_id = ?", id.String)
+				hRows, err := p.db.QueryContext(ctx, "SELECT id, bib_id, call_number, status, location FROM holdings WHERE bib_id = ?", id.String)
 				if err == nil {
 					defer hRows.Close()
 					var holdings []z3950.Holding
@@ -363,10 +532,10 @@ rows, err := p.db.Query(query, args...)
 			records = append(records, rec)
 		}
 	}
-	return records, nil
+	return selectElementSet(records, elementSet, p.profile)
 }
 
-func (p *SQLiteProvider) Scan(db, field, startTerm string) ([]ScanResult, error) {
+func (p *SQLiteProvider) Scan(ctx context.Context, db, field, startTerm string) ([]ScanResult, error) {
 	var sqlStr string
 	if field == "author" {
 		sqlStr = `SELECT TRIM(author), 1 FROM bibliography WHERE author >= ? ORDER BY author ASC LIMIT 10`
@@ -377,7 +546,7 @@ func (p *SQLiteProvider) Scan(db, field, startTerm string) ([]ScanResult, error)
 		sqlStr = `SELECT TRIM(title), 1 FROM bibliography WHERE title >= ? ORDER BY title ASC LIMIT 10`
 	}
 
-	rows, err := p.db.Query(sqlStr, startTerm)
+	rows, err := p.db.QueryContext(ctx, sqlStr, startTerm)
 	if err != nil {
 		return nil, err
 	}
@@ -394,16 +563,16 @@ func (p *SQLiteProvider) Scan(db, field, startTerm string) ([]ScanResult, error)
 	return results, nil
 }
 
-func (p *SQLiteProvider) CreateILLRequest(req ILLRequest) error {
+func (p *SQLiteProvider) CreateILLRequest(ctx context.Context, req ILLRequest) error {
 	sqlStr := `INSERT INTO ill_requests (target_db, record_id, title, author, isbn, status, requestor, comments) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
-	_, err := p.db.Exec(sqlStr, req.TargetDB, req.RecordID, req.Title, req.Author, req.ISBN, req.Status, req.Requestor, req.Comments)
+	_, err := p.db.ExecContext(ctx, sqlStr, req.TargetDB, req.RecordID, req.Title, req.Author, req.ISBN, req.Status, req.Requestor, req.Comments)
 	return err
 }
 
-func (p *SQLiteProvider) GetILLRequest(id int64) (*ILLRequest, error) {
+func (p *SQLiteProvider) GetILLRequest(ctx context.Context, id int64) (*ILLRequest, error) {
 	var r ILLRequest
 	var comments sql.NullString
-	err := p.db.QueryRow("SELECT id, target_db, record_id, title, author, isbn, status, requestor, comments FROM ill_requests WHERE id = ?", id).
+	err := p.db.QueryRowContext(ctx, "SELECT id, target_db, record_id, title, author, isbn, status, requestor, comments FROM ill_requests WHERE id = ?", id).
 		Scan(&r.ID, &r.TargetDB, &r.RecordID, &r.Title, &r.Author, &r.ISBN, &r.Status, &r.Requestor, &comments)
 	if err != nil {
 		return nil, err
@@ -414,8 +583,8 @@ func (p *SQLiteProvider) GetILLRequest(id int64) (*ILLRequest, error) {
 	return &r, nil
 }
 
-func (p *SQLiteProvider) ListILLRequests() ([]ILLRequest, error) {
-	rows, err := p.db.Query("SELECT id, target_db, record_id, title, author, isbn, status, requestor, comments FROM ill_requests ORDER BY created_at DESC")
+func (p *SQLiteProvider) ListILLRequests(ctx context.Context) ([]ILLRequest, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT id, target_db, record_id, title, author, isbn, status, requestor, comments FROM ill_requests ORDER BY created_at DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -436,33 +605,33 @@ func (p *SQLiteProvider) ListILLRequests() ([]ILLRequest, error) {
 	return requests, nil
 }
 
-func (p *SQLiteProvider) UpdateILLRequestStatus(id int64, status string) error {
-	_, err := p.db.Exec("UPDATE ill_requests SET status = ? WHERE id = ?", status, id)
+func (p *SQLiteProvider) UpdateILLRequestStatus(ctx context.Context, id int64, status string) error {
+	_, err := p.db.ExecContext(ctx, "UPDATE ill_requests SET status = ? WHERE id = ?", status, id)
 	return err
 }
 
-func (p *SQLiteProvider) CreateUser(user *User) error {
-	_, err := p.db.Exec("INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)", user.Username, user.PasswordHash, user.Role)
+func (p *SQLiteProvider) CreateUser(ctx context.Context, user *User) error {
+	_, err := p.db.ExecContext(ctx, "INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)", user.Username, user.PasswordHash, user.Role)
 	return err
 }
 
-func (p *SQLiteProvider) GetUserByUsername(username string) (*User, error) {
+func (p *SQLiteProvider) GetUserByUsername(ctx context.Context, username string) (*User, error) {
 	var user User
-	err := p.db.QueryRow("SELECT id, username, password_hash, role FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role)
+	err := p.db.QueryRowContext(ctx, "SELECT id, username, password_hash, role FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role)
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
-func (p *SQLiteProvider) CreateTarget(target *Target) error {
-	_, err := p.db.Exec("INSERT INTO targets (name, host, port, database_name, encoding, auth_user, auth_pass) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		target.Name, target.Host, target.Port, target.DatabaseName, target.Encoding, target.AuthUser, target.AuthPass)
+func (p *SQLiteProvider) CreateTarget(ctx context.Context, target *Target) error {
+	_, err := p.db.ExecContext(ctx, "INSERT INTO targets (name, host, port, database_name, encoding, auth_user, auth_pass, protocol) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		target.Name, target.Host, target.Port, target.DatabaseName, target.Encoding, target.AuthUser, target.AuthPass, targetProtocol(target))
 	return err
 }
 
-func (p *SQLiteProvider) ListTargets() ([]Target, error) {
-	rows, err := p.db.Query("SELECT id, name, host, port, database_name, encoding, auth_user, auth_pass FROM targets ORDER BY name ASC")
+func (p *SQLiteProvider) ListTargets(ctx context.Context) ([]Target, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT id, name, host, port, database_name, encoding, auth_user, auth_pass, protocol FROM targets ORDER BY name ASC")
 	if err != nil {
 		return nil, err
 	}
@@ -471,31 +640,33 @@ func (p *SQLiteProvider) ListTargets() ([]Target, error) {
 	var targets []Target
 	for rows.Next() {
 		var t Target
-		var user, pass sql.NullString
-		if err := rows.Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.DatabaseName, &t.Encoding, &user, &pass); err != nil {
+		var user, pass, protocol sql.NullString
+		if err := rows.Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.DatabaseName, &t.Encoding, &user, &pass, &protocol); err != nil {
 			return nil, err
 		}
 		if user.Valid { t.AuthUser = user.String }
 		if pass.Valid { t.AuthPass = pass.String }
+		t.Protocol = protocolOrDefault(protocol)
 		targets = append(targets, t)
 	}
 	return targets, nil
 }
 
-func (p *SQLiteProvider) DeleteTarget(id int64) error {
-	_, err := p.db.Exec("DELETE FROM targets WHERE id = ?", id)
+func (p *SQLiteProvider) DeleteTarget(ctx context.Context, id int64) error {
+	_, err := p.db.ExecContext(ctx, "DELETE FROM targets WHERE id = ?", id)
 	return err
 }
 
-func (p *SQLiteProvider) GetTargetByName(name string) (*Target, error) {
+func (p *SQLiteProvider) GetTargetByName(ctx context.Context, name string) (*Target, error) {
 	var t Target
-	var user, pass sql.NullString
-	err := p.db.QueryRow("SELECT id, name, host, port, database_name, encoding, auth_user, auth_pass FROM targets WHERE name = ?", name).
-		Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.DatabaseName, &t.Encoding, &user, &pass)
+	var user, pass, protocol sql.NullString
+	err := p.db.QueryRowContext(ctx, "SELECT id, name, host, port, database_name, encoding, auth_user, auth_pass, protocol FROM targets WHERE name = ?", name).
+		Scan(&t.ID, &t.Name, &t.Host, &t.Port, &t.DatabaseName, &t.Encoding, &user, &pass, &protocol)
 	if err != nil {
 		return nil, err
 	}
 	if user.Valid { t.AuthUser = user.String }
 	if pass.Valid { t.AuthPass = pass.String }
+	t.Protocol = protocolOrDefault(protocol)
 	return &t, nil
 }
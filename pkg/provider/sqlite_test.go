@@ -1,6 +1,8 @@
 package provider
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
 	"sort"
@@ -77,11 +79,86 @@ func TestSearch(t *testing.T) {
 			query: z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: 0, Term: "go"}},
 			expectedIDs: []string{"1", "2", "3", "4"},
 		},
+		{
+			name:        "Right truncation",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Truncation: z3950.TruncationRight, Term: "prog"}},
+			expectedIDs: []string{"1"},
+		},
+		{
+			name:        "Left truncation",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Truncation: z3950.TruncationLeft, Term: "ming"}},
+			expectedIDs: []string{"1"},
+		},
+		{
+			name:        "Word structure needs whole words",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Structure: z3950.StructureWord, Term: "prog"}},
+			expectedIDs: nil,
+		},
+		{
+			name:        "Word list matches words in any order",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Structure: z3950.StructureWordList, Term: "practice go"}},
+			expectedIDs: []string{"3"},
+		},
+		{
+			name:        "Phrase keeps word order",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Structure: z3950.StructurePhrase, Term: "practice go"}},
+			expectedIDs: nil,
+		},
+		{
+			name:        "Complete field",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Completeness: z3950.CompletenessCompleteField, Term: "thinking in go"}},
+			expectedIDs: []string{"2"},
+		},
+		{
+			name:        "Complete field rejects partial title",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Completeness: z3950.CompletenessCompleteField, Term: "Thinking"}},
+			expectedIDs: nil,
+		},
+		{
+			name:        "First in field",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Position: z3950.PositionFirstInField, Term: "go"}},
+			expectedIDs: []string{"3"},
+		},
+		{
+			name:        "Date greater or equal",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeDatePub, Relation: z3950.RelationGreaterEqual, Term: "2018"}},
+			expectedIDs: []string{"2", "4"},
+		},
+		{
+			name:        "Date less than",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeDatePub, Relation: z3950.RelationLess, Term: "2016"}},
+			expectedIDs: []string{"1"},
+		},
+		{
+			name:        "Date less or equal",
+			query:       z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: z3950.UseAttributeDatePub, Relation: z3950.RelationLessEqual, Term: "2016"}},
+			expectedIDs: []string{"1", "3"},
+		},
+		{
+			name:        "Proximity within distance",
+			query:       z3950.StructuredQuery{Root: proximity("go", "language", 2, true)},
+			expectedIDs: []string{"1"},
+		},
+		{
+			name:        "Proximity too far apart",
+			query:       z3950.StructuredQuery{Root: proximity("go", "language", 1, true)},
+			expectedIDs: nil,
+		},
+		{
+			name:        "Proximity ordered",
+			query:       z3950.StructuredQuery{Root: proximity("language", "go", 2, true)},
+			expectedIDs: nil,
+		},
+		{
+			name:        "Proximity unordered",
+			query:       z3950.StructuredQuery{Root: proximity("practice", "go", 2, false)},
+			expectedIDs: []string{"3"},
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			ids, err := provider.Search("bibliography", tc.query)
+			ids, _, err := provider.Search(t.Context(), "bibliography", tc.query)
 			if err != nil {
 				t.Fatalf("Search failed: %v", err)
 			}
@@ -96,12 +173,94 @@ func TestSearch(t *testing.T) {
 	}
 }
 
+// proximity builds a title proximity node: a within distance words of b.
+func proximity(a, b string, distance int, ordered bool) z3950.QueryComplex {
+	return z3950.QueryComplex{
+		Operator:  "PROX",
+		Left:      z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: a},
+		Right:     z3950.QueryClause{Attribute: z3950.UseAttributeTitle, Term: b},
+		Proximity: &z3950.ProximityOperator{Distance: distance, Ordered: ordered, Relation: z3950.RelationLessEqual, Unit: z3950.ProxUnitWord},
+	}
+}
+
+func TestSearchProximityUnsupportedUnit(t *testing.T) {
+	provider, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	q := proximity("go", "language", 1, false)
+	q.Proximity.Unit = z3950.ProxUnitSentence
+	_, _, err := provider.Search(t.Context(), "bibliography", z3950.StructuredQuery{Root: q})
+	var diag *z3950.Diagnostic
+	if !errors.As(err, &diag) || diag.Code != z3950.DiagUnsupportedProxUnit {
+		t.Errorf("Expected diagnostic %d, got %v", z3950.DiagUnsupportedProxUnit, err)
+	}
+}
+
+func TestSearchProximityUnicode(t *testing.T) {
+	provider, cleanup := setupTestDB(t)
+	defer cleanup()
+	if _, err := provider.db.Exec("INSERT INTO bibliography (id, title) VALUES (5, 'Le café de Paris'), (6, 'Мир и война')"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		node        z3950.QueryNode
+		expectedIDs []string
+	}{
+		{proximity("café", "paris", 2, true), []string{"5"}},
+		{proximity("война", "мир", 2, false), []string{"6"}},
+		{proximity("ми", "война", 2, true), nil},
+	} {
+		ids, _, err := provider.Search(t.Context(), "bibliography", z3950.StructuredQuery{Root: tc.node})
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if !reflect.DeepEqual(ids, tc.expectedIDs) {
+			t.Errorf("%+v: expected IDs %v, got %v", tc.node, tc.expectedIDs, ids)
+		}
+	}
+}
+
+func TestSQLiteRegexpCacheBounded(t *testing.T) {
+	for i := 0; i < 2*maxSQLiteRegexps; i++ {
+		if _, err := sqliteRegexp(fmt.Sprintf("^x%d$", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sqliteRegexps.Lock()
+	n := len(sqliteRegexps.compiled)
+	sqliteRegexps.Unlock()
+	if n > maxSQLiteRegexps {
+		t.Errorf("cache holds %d patterns, want at most %d", n, maxSQLiteRegexps)
+	}
+}
+
+func TestSearchPaging(t *testing.T) {
+	provider, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: 0, Term: "go"}, Offset: 1, Limit: 2}
+	ids, total, err := provider.Search(t.Context(), "bibliography", query)
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if total != 4 || !reflect.DeepEqual(ids, []string{"2", "3"}) {
+		t.Errorf("got ids %v of %d, want [2 3] of 4", ids, total)
+	}
+
+	// Without a limit every hit comes back
+	query.Offset, query.Limit = 0, 0
+	if ids, total, err = provider.Search(t.Context(), "bibliography", query); err != nil || len(ids) != 4 || total != 4 {
+		t.Errorf("unlimited search = %v of %d, %v", ids, total, err)
+	}
+}
+
 func TestFetch(t *testing.T) {
 	provider, cleanup := setupTestDB(t)
 	defer cleanup()
 
 	idsToFetch := []string{"1", "3"}
-	records, err := provider.Fetch("bibliography", idsToFetch)
+	records, err := provider.Fetch(t.Context(), "bibliography", idsToFetch, z3950.ElementSetFull)
 	if err != nil {
 		t.Fatalf("Fetch failed: %v", err)
 	}
@@ -132,7 +291,7 @@ func TestScan(t *testing.T) {
 	defer cleanup()
 
 	startTerm := "Go"
-	results, err := provider.Scan("bibliography", "title", startTerm)
+	results, err := provider.Scan(t.Context(), "bibliography", "title", startTerm)
 	if err != nil {
 		t.Fatalf("Scan failed: %v", err)
 	}
@@ -160,3 +319,107 @@ func TestScan(t *testing.T) {
 		}
 	}
 }
+
+func TestFetchRawRecord(t *testing.T) {
+	provider, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	raw, err := z3950.ParseMARC(z3950.BuildMARC(nil, "ocm99", "Raw Title", "Raw Author", "", "Raw Press", "1999", "", ""))
+	if err != nil {
+		t.Fatalf("ParseMARC failed: %v", err)
+	}
+	raw.Fields = append(raw.Fields, z3950.MARCField{Tag: "300", Indicator1: " ", Indicator2: " ",
+		Subfields: []z3950.MARCSubfield{{Code: "a", Value: "xii, 380 p."}}, Value: "xii, 380 p."})
+
+	if _, err := provider.db.Exec("INSERT INTO bibliography (id, title, raw_record, raw_record_format) VALUES (5, 'Raw Title', ?, 'MARC21')",
+		string(raw.MarshalISO2709())); err != nil {
+		t.Fatalf("insert failed: %v", err)
+	}
+
+	records, err := provider.Fetch(t.Context(), "bibliography", []string{"5"}, z3950.ElementSetFull)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	rec := records[0]
+	if rec.RecordID != "ocm99" || rec.PhysicalDescription != "xii, 380 p." {
+		t.Errorf("raw record not served: id=%q physical=%q", rec.RecordID, rec.PhysicalDescription)
+	}
+}
+
+func TestSearchSort(t *testing.T) {
+	provider, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	testCases := []struct {
+		name string
+		keys []z3950.SortKey
+		want []string
+	}{
+		{"Title ascending", []z3950.SortKey{{Attribute: z3950.UseAttributeTitle}}, []string{"4", "3", "1", "2"}},
+		{"Author descending", []z3950.SortKey{{Attribute: z3950.UseAttributeAuthor, Relation: 1}}, []string{"4", "2", "3", "1"}},
+		{"Date descending", []z3950.SortKey{{Attribute: z3950.UseAttributeDatePub, Relation: 1}}, []string{"4", "2", "3", "1"}},
+		{"Unsortable attribute", []z3950.SortKey{{Attribute: z3950.UseAttributeISBN}}, []string{"1", "2", "3", "4"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: 0, Term: "go"}, SortKeys: tc.keys}
+			ids, _, err := provider.Search(t.Context(), "bibliography", query)
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			if !reflect.DeepEqual(ids, tc.want) {
+				t.Errorf("got ids %v, want %v", ids, tc.want)
+			}
+		})
+	}
+
+	// A sorted page is a slice of the sorted result set
+	query := z3950.StructuredQuery{Root: z3950.QueryClause{Attribute: 0, Term: "go"}, SortKeys: []z3950.SortKey{{Attribute: z3950.UseAttributeTitle}}, Offset: 1, Limit: 2}
+	if ids, _, err := provider.Search(t.Context(), "bibliography", query); err != nil || !reflect.DeepEqual(ids, []string{"3", "1"}) {
+		t.Errorf("sorted page = %v, %v", ids, err)
+	}
+}
+
+func TestSortIDs(t *testing.T) {
+	provider, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	testCases := []struct {
+		name string
+		ids  []string
+		keys []z3950.SortKey
+		want []string
+	}{
+		{"Title ascending", []string{"2", "1", "4", "3"}, []z3950.SortKey{{Attribute: z3950.UseAttributeTitle}}, []string{"4", "3", "1", "2"}},
+		{"Author descending", []string{"1", "2", "3", "4"}, []z3950.SortKey{{Attribute: z3950.UseAttributeAuthor, Relation: 1}}, []string{"4", "2", "3", "1"}},
+		{"Only the given ids", []string{"2", "4"}, []z3950.SortKey{{Attribute: z3950.UseAttributeDatePub, Relation: 1}}, []string{"4", "2"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ids, err := provider.SortIDs(t.Context(), "bibliography", tc.ids, tc.keys)
+			if err != nil {
+				t.Fatalf("SortIDs failed: %v", err)
+			}
+			if !reflect.DeepEqual(ids, tc.want) {
+				t.Errorf("got ids %v, want %v", ids, tc.want)
+			}
+		})
+	}
+
+	// Ids are looked up in batches; unknown ones sort as empty values.
+	var ids []string
+	for i := 0; i < 2*sortLookupBatch; i++ {
+		ids = append(ids, fmt.Sprintf("missing-%d", i))
+	}
+	ids = append(ids, "1", "4")
+	sorted, err := provider.SortIDs(t.Context(), "bibliography", ids, []z3950.SortKey{{Attribute: z3950.UseAttributeTitle, Relation: 1}})
+	if err != nil {
+		t.Fatalf("SortIDs failed: %v", err)
+	}
+	if len(sorted) != len(ids) || sorted[0] != "1" || sorted[1] != "4" || sorted[2] != "missing-0" {
+		t.Errorf("sorted %d ids, starting %v", len(sorted), sorted[:3])
+	}
+}
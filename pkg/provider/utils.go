@@ -1,8 +1,16 @@
 package provider
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
 )
 
 // isbnPrefixRegex matches common ISBN prefixes like "ISBN-13:", "ISBN-10:", "ISBN:".
@@ -24,4 +32,435 @@ func CleanISBN(raw string) string {
 	s = isbnCleanRegex.ReplaceAllString(s, "")
 
 	return strings.TrimSpace(s)
-}
\ No newline at end of file
+}
+
+// sortColumns are the bibliography columns results sort on, by Bib-1 use
+// attribute.
+var sortColumns = map[int]string{
+	z3950.UseAttributeTitle:   "title",
+	z3950.UseAttributeAuthor:  "author",
+	z3950.UseAttributeDatePub: "pub_year",
+}
+
+// SortableAttribute reports whether local databases can sort results on
+// the Bib-1 use attribute attr: title, author or date of publication.
+func SortableAttribute(attr int) bool {
+	_, ok := sortColumns[attr]
+	return ok
+}
+
+// orderBy returns the ORDER BY list for keys, ignoring case and skipping
+// keys on attributes that cannot be sorted on. Ties, and searches without
+// keys, are ordered by id so that pages stay stable.
+func orderBy(keys []z3950.SortKey) string {
+	var terms []string
+	for _, k := range keys {
+		col, ok := sortColumns[k.Attribute]
+		if !ok {
+			continue
+		}
+		dir := "ASC"
+		if k.Relation == 1 {
+			dir = "DESC"
+		}
+		terms = append(terms, fmt.Sprintf("LOWER(TRIM(COALESCE(%s, ''))) %s", col, dir))
+	}
+	return strings.Join(append(terms, "id"), ", ")
+}
+
+// sortValue is the value of book that results sort on for attr.
+func sortValue(book SearchResult, attr int) string {
+	switch attr {
+	case z3950.UseAttributeTitle:
+		return strings.ToLower(strings.TrimSpace(book.Title))
+	case z3950.UseAttributeAuthor:
+		return strings.ToLower(strings.TrimSpace(book.Author))
+	case z3950.UseAttributeDatePub:
+		return strings.TrimSpace(book.PubYear)
+	}
+	return ""
+}
+
+// sortResults orders books on keys, keeping books that compare equal in
+// their order.
+func sortResults(books []SearchResult, keys []z3950.SortKey) {
+	sort.SliceStable(books, func(i, j int) bool {
+		for _, k := range keys {
+			a, b := sortValue(books[i], k.Attribute), sortValue(books[j], k.Attribute)
+			if a == b {
+				continue
+			}
+			if k.Relation == 1 {
+				return a > b
+			}
+			return a < b
+		}
+		return false
+	})
+}
+
+// sortIDs returns ids ordered on keys by the books they name. An id with
+// no book, such as one deleted since the search, sorts as empty values.
+func sortIDs(ids []string, keys []z3950.SortKey, books map[string]SearchResult) []string {
+	results := make([]SearchResult, len(ids))
+	for i, id := range ids {
+		results[i] = books[id]
+		results[i].ID = id
+	}
+	sortResults(results, keys)
+	sorted := make([]string, len(results))
+	for i, r := range results {
+		sorted[i] = r.ID
+	}
+	return sorted
+}
+
+// sortLookupBatch is the most ids whose sort values are read in one query.
+const sortLookupBatch = 500
+
+// lookupSortValues reads the sort values of ids from db, a batch at a
+// time. query selects id, title, author and pub_year, with a %s for the
+// batch's placeholders; placeholder(i) is the i-th of them, from 1.
+func lookupSortValues(ctx context.Context, db *sql.DB, query string, placeholder func(int) string, ids []string) (map[string]SearchResult, error) {
+	books := make(map[string]SearchResult, len(ids))
+	for start := 0; start < len(ids); start += sortLookupBatch {
+		batch := ids[start:min(start+sortLookupBatch, len(ids))]
+		placeholders := make([]string, len(batch))
+		args := make([]interface{}, len(batch))
+		for i, id := range batch {
+			placeholders[i] = placeholder(i + 1)
+			args[i] = id
+		}
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(query, strings.Join(placeholders, ",")), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			var title, author, pubYear sql.NullString
+			if err := rows.Scan(&id, &title, &author, &pubYear); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			books[id] = SearchResult{ID: id, Title: title.String, Author: author.String, PubYear: pubYear.String}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return books, nil
+}
+
+// sameMARCFormat compares two MARC format names (raw_record_format,
+// ZSERVER_MARC_FORMAT), treating USMARC and MARC21 as the same format.
+func sameMARCFormat(a, b string) bool {
+	norm := func(f string) string {
+		f = strings.ToUpper(strings.TrimSpace(f))
+		if f == "USMARC" || f == "MARC" {
+			return "MARC21"
+		}
+		return f
+	}
+	return norm(a) == norm(b)
+}
+
+// matchMode is how a clause's term is compared with a field, derived from
+// its Bib-1 structure, truncation, position and completeness attributes.
+type matchMode int
+
+const (
+	matchContains    matchMode = iota // phrase anywhere in the field (default)
+	matchWords                        // every term word as a whole word
+	matchWordPrefix                   // right truncation: words starting with the term
+	matchWordSuffix                   // left truncation: words ending with the term
+	matchFieldPrefix                  // the field starts with the term
+	matchExact                        // the whole field equals the term
+)
+
+func clauseMatchMode(c z3950.QueryClause) matchMode {
+	if c.Completeness == z3950.CompletenessCompleteField || c.Completeness == z3950.CompletenessCompleteSubfield {
+		if c.Truncation == z3950.TruncationRight {
+			return matchFieldPrefix
+		}
+		return matchExact
+	}
+	if c.Position == z3950.PositionFirstInField {
+		return matchFieldPrefix
+	}
+	switch c.Truncation {
+	case z3950.TruncationRight:
+		return matchWordPrefix
+	case z3950.TruncationLeft:
+		return matchWordSuffix
+	case z3950.TruncationLeftRight:
+		return matchContains
+	case z3950.TruncationNone:
+		return matchWords
+	}
+	if c.Structure == z3950.StructureWord || c.Structure == z3950.StructureWordList {
+		return matchWords
+	}
+	return matchContains
+}
+
+// dateComparison reports the SQL comparison operator and year for a clause
+// with an ordering relation on a date (Use 31 or a date/year structure).
+func dateComparison(c z3950.QueryClause) (string, int, bool) {
+	isDate := c.Attribute == z3950.UseAttributeDatePub || c.Structure == z3950.StructureYear ||
+		c.Structure == z3950.StructureDateNormalized || c.Structure == z3950.StructureDateUnnormalized
+	if !isDate {
+		return "", 0, false
+	}
+	op := ""
+	switch c.Relation {
+	case z3950.RelationLess:
+		op = "<"
+	case z3950.RelationLessEqual:
+		op = "<="
+	case z3950.RelationGreaterEqual:
+		op = ">="
+	case z3950.RelationGreater:
+		op = ">"
+	case z3950.RelationNotEqual:
+		op = "<>"
+	default:
+		return "", 0, false
+	}
+	year := leadingYear(c.Term)
+	if year < 0 {
+		return "", 0, false
+	}
+	return op, year, true
+}
+
+var yearRegex = regexp.MustCompile(`\d{4}`)
+
+// leadingYear returns the first four-digit number in s, or -1.
+func leadingYear(s string) int {
+	m := yearRegex.FindString(s)
+	if m == "" {
+		return -1
+	}
+	y, _ := strconv.Atoi(m)
+	return y
+}
+
+// termWords splits text into lower-case words on anything that is not a
+// letter or digit.
+func termWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// matchValue applies a clause's attributes to a single field value.
+func matchValue(value string, c z3950.QueryClause) bool {
+	if op, year, ok := dateComparison(c); ok {
+		y := leadingYear(value)
+		if y < 0 {
+			return false
+		}
+		switch op {
+		case "<":
+			return y < year
+		case "<=":
+			return y <= year
+		case ">=":
+			return y >= year
+		case ">":
+			return y > year
+		default:
+			return y != year
+		}
+	}
+
+	v := strings.ToLower(strings.TrimSpace(value))
+	t := strings.ToLower(strings.TrimSpace(c.Term))
+	switch clauseMatchMode(c) {
+	case matchExact:
+		return v == t
+	case matchFieldPrefix:
+		return strings.HasPrefix(v, t)
+	case matchWords:
+		have := make(map[string]bool)
+		for _, w := range termWords(v) {
+			have[w] = true
+		}
+		want := termWords(t)
+		for _, w := range want {
+			if !have[w] {
+				return false
+			}
+		}
+		return len(want) > 0
+	case matchWordPrefix, matchWordSuffix:
+		return matchTruncatedPhrase(termWords(v), termWords(t), clauseMatchMode(c) == matchWordPrefix)
+	default:
+		return strings.Contains(v, t)
+	}
+}
+
+// matchTruncatedPhrase finds the term words as consecutive words of the
+// field, with the last (right truncation) or first (left truncation) term
+// word allowed to match only the start or end of a field word.
+func matchTruncatedPhrase(words, term []string, right bool) bool {
+	n := len(term)
+	if n == 0 {
+		return false
+	}
+	for i := 0; i+n <= len(words); i++ {
+		ok := true
+		for j := 0; j < n && ok; j++ {
+			w, tw := words[i+j], term[j]
+			switch {
+			case right && j == n-1:
+				ok = strings.HasPrefix(w, tw)
+			case !right && j == 0:
+				ok = strings.HasSuffix(w, tw)
+			default:
+				ok = w == tw
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// likeEscape escapes LIKE wildcards so that a term matches literally; use
+// with ESCAPE '\'.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// proximityRegex builds a case-insensitive regular expression matching the
+// two terms of a proximity node at the distance its operator allows, in
+// words, up to the PostgreSQL repetition limit of 255. goSyntax selects Go's
+// regexp dialect (used by SQLite's REGEXP and the Memory provider);
+// otherwise the pattern is written for PostgreSQL's ~* operator. Exclusion
+// is left to the caller.
+func proximityRegex(n z3950.QueryComplex, goSyntax bool) (string, error) {
+	left, lok := n.Left.(z3950.QueryClause)
+	right, rok := n.Right.(z3950.QueryClause)
+	if !lok || !rok {
+		return "", z3950.NewDiagnostic(z3950.DiagProximityOfSets, "proximity operands must be terms")
+	}
+	prox := n.Proximity
+	if prox == nil {
+		prox = &z3950.ProximityOperator{}
+	}
+	if prox.Unit != 0 && prox.Unit != z3950.ProxUnitWord {
+		return "", z3950.NewDiagnostic(z3950.DiagUnsupportedProxUnit, strconv.Itoa(prox.Unit))
+	}
+
+	// The number of words allowed between the terms; adjacent words are at
+	// distance 1. hi < 0 means no upper bound.
+	d := prox.Distance
+	type gap struct{ lo, hi int }
+	var gaps []gap
+	switch prox.Relation {
+	case z3950.RelationLess:
+		gaps = []gap{{0, d - 2}}
+	case 0, z3950.RelationLessEqual:
+		gaps = []gap{{0, d - 1}}
+	case z3950.RelationEqual:
+		gaps = []gap{{d - 1, d - 1}}
+	case z3950.RelationGreaterEqual:
+		gaps = []gap{{d - 1, -1}}
+	case z3950.RelationGreater:
+		gaps = []gap{{d, -1}}
+	case z3950.RelationNotEqual:
+		gaps = []gap{{0, d - 2}, {d, -1}}
+	}
+	var valid []gap
+	for _, g := range gaps {
+		if g.lo < 0 {
+			g.lo = 0
+		}
+		if (g.hi < 0 || g.lo <= g.hi) && g.lo <= 255 && g.hi <= 255 {
+			valid = append(valid, g)
+		}
+	}
+	if d < 1 || len(valid) == 0 {
+		return "", z3950.NewDiagnostic(z3950.DiagUnsupportedProxRelation, fmt.Sprintf("relation %d, distance %d", prox.Relation, d))
+	}
+
+	// Go's \w and \b are ASCII-only, so the Go dialect spells out Unicode
+	// word characters and, lacking lookarounds, bounds words at the edges
+	// of the match with a separator or the end of the text. Between the
+	// terms the separator itself marks the word boundaries.
+	word, nonWord, wordStart, wordEnd := `\w`, `\W`, `\m`, `\M`
+	if goSyntax {
+		word, nonWord = `[\pL\pN_]`, `[^\pL\pN_]`
+		wordStart, wordEnd = "(?:^|"+nonWord+")", "(?:"+nonWord+"|$)"
+	}
+	words := func(c z3950.QueryClause) string {
+		var quoted []string
+		for _, w := range termWords(c.Term) {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+		return strings.Join(quoted, nonWord+"+")
+	}
+	leftTrunc := func(c z3950.QueryClause) bool {
+		return c.Truncation == z3950.TruncationLeft || c.Truncation == z3950.TruncationLeftRight
+	}
+	rightTrunc := func(c z3950.QueryClause) bool {
+		return c.Truncation == z3950.TruncationRight || c.Truncation == z3950.TruncationLeftRight
+	}
+	// first and second are a term before and after the separator
+	first := func(c z3950.QueryClause) string {
+		pat := words(c)
+		if !leftTrunc(c) {
+			pat = wordStart + pat
+		}
+		if rightTrunc(c) {
+			pat += word + "*"
+		}
+		return pat
+	}
+	second := func(c z3950.QueryClause) string {
+		pat := words(c)
+		if leftTrunc(c) {
+			pat = word + "*" + pat
+		}
+		if !rightTrunc(c) {
+			pat += wordEnd
+		}
+		return pat
+	}
+	var between []string
+	for _, g := range valid {
+		hi := ""
+		if g.hi >= 0 {
+			hi = strconv.Itoa(g.hi)
+		}
+		between = append(between, fmt.Sprintf(`(?:%s+%s+){%d,%s}%s+`, nonWord, word, g.lo, hi, nonWord))
+	}
+	sep := "(?:" + strings.Join(between, "|") + ")"
+
+	pat := first(left) + sep + second(right)
+	if !prox.Ordered {
+		pat = "(?:" + pat + "|" + first(right) + sep + second(left) + ")"
+	}
+	if goSyntax {
+		pat = "(?i)" + pat
+	}
+	return pat, nil
+}
+
+// targetProtocol normalises a target's protocol for storage; anything but
+// SRU is Z39.50.
+func targetProtocol(t *Target) string {
+	if strings.EqualFold(t.Protocol, ProtocolSRU) {
+		return ProtocolSRU
+	}
+	return ProtocolZ3950
+}
+
+// protocolOrDefault reads a stored protocol, treating NULL as Z39.50.
+func protocolOrDefault(s sql.NullString) string {
+	return targetProtocol(&Target{Protocol: s.String})
+}
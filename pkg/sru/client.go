@@ -0,0 +1,180 @@
+package sru
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client issues SRU requests to a remote server over HTTP GET.
+type Client struct {
+	BaseURL    string // e.g. http://lx2.loc.gov:210/LCDB
+	Version    string // SRU version sent with each request
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client speaking SRU 1.2 to baseURL.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		Version:    "1.2",
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// SearchResponse is the outcome of a searchRetrieve request.
+type SearchResponse struct {
+	NumberOfRecords    int
+	NextRecordPosition int
+	Records            []Record // Data holds the unescaped record XML
+}
+
+// SearchRetrieve runs a CQL query and retrieves up to maximumRecords
+// records from startRecord on (1-based) in the given schema. A
+// maximumRecords of 0 only counts the hits. The request is abandoned when
+// ctx is cancelled.
+func (c *Client) SearchRetrieve(ctx context.Context, query string, startRecord, maximumRecords int, schema string) (*SearchResponse, error) {
+	params := url.Values{}
+	params.Set("operation", "searchRetrieve")
+	params.Set("query", query)
+	params.Set("startRecord", strconv.Itoa(startRecord))
+	params.Set("maximumRecords", strconv.Itoa(maximumRecords))
+	params.Set("recordPacking", "xml")
+	if schema != "" {
+		params.Set("recordSchema", schema)
+	}
+
+	var resp xmlSearchRetrieveResponse
+	if err := c.get(ctx, params, &resp); err != nil {
+		return nil, err
+	}
+	if err := fatalDiagnostic(resp.Diagnostics, resp.Records == nil); err != nil {
+		return nil, err
+	}
+
+	result := &SearchResponse{NumberOfRecords: resp.NumberOfRecords, NextRecordPosition: resp.NextRecordPosition}
+	if resp.Records == nil {
+		return result, nil
+	}
+	for i, r := range resp.Records.Records {
+		packing := r.Packing
+		if packing == "" {
+			packing = r.Escaping
+		}
+		data := []byte(r.Data.Inner)
+		if packing == "string" {
+			var text struct {
+				Value string `xml:",chardata"`
+			}
+			if err := xml.Unmarshal([]byte("<d>"+r.Data.Inner+"</d>"), &text); err != nil {
+				return nil, fmt.Errorf("sru: invalid string-packed record: %w", err)
+			}
+			data = []byte(strings.TrimSpace(text.Value))
+		}
+		position := r.Position
+		if position == 0 {
+			position = startRecord + i
+		}
+		result.Records = append(result.Records, Record{
+			Schema:   r.Schema,
+			Packing:  "xml",
+			Data:     data,
+			Position: position,
+		})
+	}
+	return result, nil
+}
+
+// Scan browses the index named in scanClause (e.g. dc.title = "go"),
+// returning up to maximumTerms terms from the given one on.
+func (c *Client) Scan(ctx context.Context, scanClause string, maximumTerms int) ([]Term, error) {
+	params := url.Values{}
+	params.Set("operation", "scan")
+	params.Set("scanClause", scanClause)
+	params.Set("maximumTerms", strconv.Itoa(maximumTerms))
+	params.Set("responsePosition", "1")
+
+	var resp xmlScanResponse
+	if err := c.get(ctx, params, &resp); err != nil {
+		return nil, err
+	}
+	if err := fatalDiagnostic(resp.Diagnostics, resp.Terms == nil); err != nil {
+		return nil, err
+	}
+	var terms []Term
+	if resp.Terms != nil {
+		for _, t := range resp.Terms.Terms {
+			terms = append(terms, Term{Value: t.Value, NumberOfRecords: t.NumberOfRecords})
+		}
+	}
+	return terms, nil
+}
+
+// Explain fetches the server's explain record, which is how a connection
+// is tested.
+func (c *Client) Explain(ctx context.Context) error {
+	params := url.Values{}
+	params.Set("operation", "explain")
+	var resp xmlExplainResponse
+	if err := c.get(ctx, params, &resp); err != nil {
+		return err
+	}
+	return fatalDiagnostic(resp.Diagnostics, resp.Record == nil)
+}
+
+func (c *Client) get(ctx context.Context, params url.Values, v interface{}) error {
+	params.Set("version", c.Version)
+	sep := "?"
+	if strings.Contains(c.BaseURL, "?") {
+		sep = "&"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+sep+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// Servers may send diagnostics with a 4xx/5xx status, so the body is
+	// decoded first and the status only reported when that fails.
+	if err := xml.Unmarshal(body, v); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("sru: server returned %s", resp.Status)
+		}
+		return fmt.Errorf("sru: invalid response: %w", err)
+	}
+	return nil
+}
+
+// fatalDiagnostic returns the first diagnostic of a response that carries
+// no results; diagnostics next to results are warnings and are ignored.
+func fatalDiagnostic(diags *xmlDiagnostics, empty bool) error {
+	if diags == nil || len(diags.Diagnostics) == 0 || !empty {
+		return nil
+	}
+	d := diags.Diagnostics[0]
+	code := DiagGeneralSystemError
+	if i := strings.LastIndexByte(d.URI, '/'); i >= 0 {
+		if n, err := strconv.Atoi(d.URI[i+1:]); err == nil {
+			code = n
+		}
+	}
+	diag := NewDiagnostic(code, d.Details)
+	if d.Message != "" {
+		diag.Message = d.Message
+	}
+	return diag
+}
@@ -0,0 +1,58 @@
+package sru
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// DublinCore renders a record as simple Dublin Core in the SRU dc schema.
+// Elements come from the record's friendly fields, with publisher and date taken from
+// 260/264 $b $c and every 650 heading given as its own subject.
+func DublinCore(rec *z3950.MARCRecord) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<srw_dc:dc xmlns:srw_dc="info:srw/schema/1/dc-schema" xmlns:dc="http://purl.org/dc/elements/1.1/">`)
+	element := func(name, value string) {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return
+		}
+		b.WriteString("<dc:" + name + ">")
+		b.WriteString(xmlText(value))
+		b.WriteString("</dc:" + name + ">")
+	}
+
+	element("title", rec.Title)
+	element("creator", rec.Author)
+	subjects := rec.GetFields("650")
+	for _, f := range subjects {
+		element("subject", f.GetSubfield("a"))
+	}
+	if len(subjects) == 0 {
+		element("subject", rec.Subject)
+	}
+	element("description", rec.Summary)
+	publisher, date := rec.Publisher, ""
+	for _, tag := range []string{"260", "264"} {
+		if f := rec.GetFields(tag); len(f) > 0 {
+			if b := f[0].GetSubfield("b"); b != "" {
+				publisher = strings.TrimRight(b, " ,:;")
+			}
+			date = strings.TrimRight(f[0].GetSubfield("c"), " .")
+			break
+		}
+	}
+	element("publisher", publisher)
+	element("date", date)
+	element("format", rec.PhysicalDescription)
+	if isbn := strings.TrimSpace(rec.ISBN); isbn != "" {
+		element("identifier", "urn:isbn:"+isbn)
+	}
+	if issn := strings.TrimSpace(rec.ISSN); issn != "" {
+		element("identifier", "urn:issn:"+issn)
+	}
+	element("relation", rec.Series)
+	b.WriteString("</srw_dc:dc>")
+	return b.Bytes()
+}
@@ -0,0 +1,468 @@
+// Package sru encodes SRU (Search/Retrieve via URL) 1.2 and 2.0 responses.
+package sru
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+// Response and diagnostic namespaces for each protocol version.
+const (
+	Namespace12      = "http://www.loc.gov/zing/srw/"
+	Namespace20      = "http://docs.oasis-open.org/ns/search-ws/sruResponse"
+	DiagNamespace12  = "http://www.loc.gov/zing/srw/diagnostic/"
+	DiagNamespace20  = "http://docs.oasis-open.org/ns/search-ws/diagnostic"
+	ExplainNamespace = "http://explain.z3950.org/dtd/2.0/"
+)
+
+// Record schemas served by the gateway.
+const (
+	SchemaMARCXML = "info:srw/schema/1/marcxml-v1.1"
+	SchemaDC      = "info:srw/schema/1/dc-v1.1"
+)
+
+// Schemas maps the short record schema names accepted in recordSchema to
+// their identifiers.
+var Schemas = map[string]string{
+	"marcxml": SchemaMARCXML,
+	"marc21":  SchemaMARCXML,
+	"dc":      SchemaDC,
+}
+
+// SRU diagnostics (info:srw/diagnostic/1/N). Query errors use the codes of
+// z3950.CQLError.
+const (
+	DiagGeneralSystemError         = 1
+	DiagSystemUnavailable          = 2
+	DiagAuthenticationError        = 3
+	DiagUnsupportedOperation       = 4
+	DiagUnsupportedVersion         = 5
+	DiagUnsupportedParameterValue  = 6
+	DiagMandatoryParameterMissing  = 7
+	DiagQuerySyntax                = 10
+	DiagResultSetNotFound          = 51
+	DiagUnsupportedIndex           = 16
+	DiagUnsupportedRelation        = 19
+	DiagMaskingUnsupported         = 28
+	DiagProximityUnsupported       = 39
+	DiagUnsupportedProxRelation    = 40
+	DiagUnsupportedProxUnit        = 42
+	DiagFirstRecordOutOfRange      = 61
+	DiagUnknownSchema              = 66
+	DiagUnsupportedRecordPacking   = 71
+	DiagResponsePositionOutOfRange = 120
+	DiagDatabaseNotFound           = 235
+)
+
+var diagMessages = map[int]string{
+	DiagGeneralSystemError:               "General system error",
+	DiagSystemUnavailable:                "System temporarily unavailable",
+	DiagAuthenticationError:              "Authentication error",
+	DiagUnsupportedOperation:             "Unsupported operation",
+	DiagUnsupportedVersion:               "Unsupported version",
+	DiagUnsupportedParameterValue:        "Unsupported parameter value",
+	DiagMandatoryParameterMissing:        "Mandatory parameter not supplied",
+	DiagQuerySyntax:                      "Query syntax error",
+	z3950.CQLDiagUnsupportedContextSet:   "Unsupported context set",
+	DiagUnsupportedIndex:                 "Unsupported index",
+	DiagUnsupportedRelation:              "Unsupported relation",
+	z3950.CQLDiagUnsupportedRelationMod:  "Unsupported relation modifier",
+	z3950.CQLDiagEmptyTerm:               "Empty term unsupported",
+	DiagMaskingUnsupported:               "Masking character not supported",
+	z3950.CQLDiagAnchoringUnsupported:    "Anchoring character not supported",
+	DiagProximityUnsupported:             "Proximity not supported",
+	DiagUnsupportedProxRelation:          "Unsupported proximity relation",
+	z3950.CQLDiagUnsupportedProxDistance: "Unsupported proximity distance",
+	DiagUnsupportedProxUnit:              "Unsupported proximity unit",
+	z3950.CQLDiagUnsupportedBooleanMod:   "Unsupported boolean modifier",
+	DiagResultSetNotFound:                "Result set does not exist",
+	DiagFirstRecordOutOfRange:            "First record position out of range",
+	DiagUnknownSchema:                    "Unknown schema for retrieval",
+	DiagUnsupportedRecordPacking:         "Record packing not supported",
+	z3950.CQLDiagSortUnsupported:         "Sort not supported",
+	z3950.CQLDiagUnsupportedSortIndex:    "Unsupported path for sort",
+	DiagResponsePositionOutOfRange:       "Response position out of range",
+	DiagDatabaseNotFound:                 "Database does not exist",
+}
+
+// Diagnostic is an SRU diagnostic.
+type Diagnostic struct {
+	Code    int
+	Details string
+	Message string
+}
+
+// NewDiagnostic returns a diagnostic for code with the standard message.
+func NewDiagnostic(code int, details string) *Diagnostic {
+	msg, ok := diagMessages[code]
+	if !ok {
+		msg = "Unknown diagnostic"
+	}
+	return &Diagnostic{Code: code, Details: details, Message: msg}
+}
+
+// URI returns the diagnostic's identifier, e.g. info:srw/diagnostic/1/16.
+func (d *Diagnostic) URI() string {
+	return "info:srw/diagnostic/1/" + strconv.Itoa(d.Code)
+}
+
+func (d *Diagnostic) Error() string {
+	if d.Details != "" {
+		return fmt.Sprintf("%s: %s (SRU diagnostic %d)", d.Message, d.Details, d.Code)
+	}
+	return fmt.Sprintf("%s (SRU diagnostic %d)", d.Message, d.Code)
+}
+
+// bib1Diagnostics maps Bib-1 conditions from providers and Z39.50 targets
+// to their SRU counterparts.
+var bib1Diagnostics = map[int]int{
+	z3950.DiagTemporarySystemError:    DiagSystemUnavailable,
+	z3950.DiagPresentOutOfRange:       DiagFirstRecordOutOfRange,
+	z3950.DiagMalformedQuery:          DiagQuerySyntax,
+	z3950.DiagUnsupportedUseAttribute: DiagUnsupportedIndex,
+	z3950.DiagUnsupportedRelation:     DiagUnsupportedRelation,
+	z3950.DiagUnsupportedTruncation:   DiagMaskingUnsupported,
+	z3950.DiagProximityOfSets:         DiagProximityUnsupported,
+	z3950.DiagUnsupportedProxRelation: DiagUnsupportedProxRelation,
+	z3950.DiagUnsupportedProxUnit:     DiagUnsupportedProxUnit,
+	z3950.DiagDatabaseNotFound:        DiagDatabaseNotFound,
+	z3950.DiagDatabaseAccessDenied:    DiagAuthenticationError,
+	z3950.DiagRecordSyntaxUnsupported: DiagUnknownSchema,
+}
+
+// DiagnosticFromError converts a CQL error or Bib-1 diagnostic into an SRU
+// diagnostic; anything else becomes a general system error.
+func DiagnosticFromError(err error) *Diagnostic {
+	var sruDiag *Diagnostic
+	if errors.As(err, &sruDiag) {
+		return sruDiag
+	}
+	var cqlErr *z3950.CQLError
+	if errors.As(err, &cqlErr) {
+		d := NewDiagnostic(cqlErr.Code, cqlErr.Detail)
+		if _, known := diagMessages[cqlErr.Code]; !known {
+			d.Message = cqlErr.Msg
+		}
+		return d
+	}
+	var bib1 *z3950.Diagnostic
+	if errors.As(err, &bib1) {
+		if code, ok := bib1Diagnostics[bib1.Code]; ok {
+			return NewDiagnostic(code, bib1.AddInfo)
+		}
+	}
+	return NewDiagnostic(DiagGeneralSystemError, err.Error())
+}
+
+// Bib1 converts the diagnostic into the Bib-1 diagnostic a Z39.50 target
+// would have returned, so that errors from SRU targets reach Z39.50 and
+// HTTP clients the same way. Conditions without a counterpart become a
+// temporary system error carrying the SRU message.
+func (d *Diagnostic) Bib1() *z3950.Diagnostic {
+	for bib1, code := range bib1Diagnostics {
+		if code == d.Code {
+			addInfo := d.Details
+			if addInfo == "" {
+				addInfo = d.Message
+			}
+			return z3950.NewDiagnostic(bib1, addInfo)
+		}
+	}
+	return z3950.NewDiagnostic(z3950.DiagTemporarySystemError, d.Error())
+}
+
+// Record is a record in a searchRetrieve response. Data is an XML document
+// in Schema; Packing is "xml" (embedded) or "string" (escaped).
+type Record struct {
+	Schema   string
+	Packing  string
+	Data     []byte
+	Position int
+}
+
+// Term is an entry of a scan response.
+type Term struct {
+	Value           string
+	NumberOfRecords int
+}
+
+type xmlDiagnostic struct {
+	XMLName xml.Name
+	URI     string `xml:"uri"`
+	Details string `xml:"details,omitempty"`
+	Message string `xml:"message,omitempty"`
+}
+
+type xmlDiagnostics struct {
+	Diagnostics []xmlDiagnostic `xml:"diagnostic"`
+}
+
+type xmlRecords struct {
+	Records []xmlRecord `xml:"record"`
+}
+
+type xmlTerms struct {
+	Terms []xmlTerm `xml:"term"`
+}
+
+type xmlRecordData struct {
+	Inner string `xml:",innerxml"`
+}
+
+type xmlRecord struct {
+	Schema   string        `xml:"recordSchema"`
+	Packing  string        `xml:"recordPacking,omitempty"`
+	Escaping string        `xml:"recordXMLEscaping,omitempty"`
+	Data     xmlRecordData `xml:"recordData"`
+	Position int           `xml:"recordPosition,omitempty"`
+}
+
+type xmlSearchRetrieveResponse struct {
+	XMLName            xml.Name
+	Version            string          `xml:"version"`
+	NumberOfRecords    int             `xml:"numberOfRecords"`
+	ResultSetID        string          `xml:"resultSetId,omitempty"`
+	ResultSetIdleTime  int             `xml:"resultSetIdleTime,omitempty"`
+	ResultSetTTL       int             `xml:"resultSetTTL,omitempty"`
+	Records            *xmlRecords     `xml:"records"`
+	NextRecordPosition int             `xml:"nextRecordPosition,omitempty"`
+	Diagnostics        *xmlDiagnostics `xml:"diagnostics"`
+}
+
+type xmlTerm struct {
+	Value           string `xml:"value"`
+	NumberOfRecords int    `xml:"numberOfRecords"`
+}
+
+type xmlScanResponse struct {
+	XMLName     xml.Name
+	Version     string          `xml:"version"`
+	Terms       *xmlTerms       `xml:"terms"`
+	Diagnostics *xmlDiagnostics `xml:"diagnostics"`
+}
+
+type xmlExplainResponse struct {
+	XMLName     xml.Name
+	Version     string          `xml:"version"`
+	Record      *xmlRecord      `xml:"record"`
+	Diagnostics *xmlDiagnostics `xml:"diagnostics"`
+}
+
+// Is20 reports whether version selects the SRU 2.0 response format.
+func Is20(version string) bool {
+	return strings.HasPrefix(version, "2.")
+}
+
+func responseName(version, local string) xml.Name {
+	if Is20(version) {
+		return xml.Name{Space: Namespace20, Local: local}
+	}
+	return xml.Name{Space: Namespace12, Local: local}
+}
+
+func encodeDiagnostics(version string, diags []*Diagnostic) *xmlDiagnostics {
+	if len(diags) == 0 {
+		return nil
+	}
+	space := DiagNamespace12
+	if Is20(version) {
+		space = DiagNamespace20
+	}
+	out := &xmlDiagnostics{}
+	for _, d := range diags {
+		out.Diagnostics = append(out.Diagnostics, xmlDiagnostic{
+			XMLName: xml.Name{Space: space, Local: "diagnostic"},
+			URI:     d.URI(),
+			Details: d.Details,
+			Message: d.Message,
+		})
+	}
+	return out
+}
+
+// encodeRecord embeds a record. SRU 1.2 calls the packing recordPacking;
+// 2.0 renamed it recordXMLEscaping.
+func encodeRecord(version string, r Record) xmlRecord {
+	x := xmlRecord{Schema: r.Schema, Position: r.Position}
+	packing := r.Packing
+	if packing == "" {
+		packing = "xml"
+	}
+	if Is20(version) {
+		x.Escaping = packing
+	} else {
+		x.Packing = packing
+	}
+	if packing == "string" {
+		var b bytes.Buffer
+		xml.EscapeText(&b, r.Data)
+		x.Data.Inner = b.String()
+	} else {
+		x.Data.Inner = string(r.Data)
+	}
+	return x
+}
+
+func marshal(v interface{}) []byte {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		// The response types contain nothing that can fail to encode.
+		panic(err)
+	}
+	return append([]byte(xml.Header), out...)
+}
+
+// ResultSet names the result set a searchRetrieveResponse was read from,
+// which later requests page with a cql.resultSetId query. IdleTime is how
+// many seconds it is kept unused.
+type ResultSet struct {
+	ID       string
+	IdleTime int
+}
+
+// MarshalSearchRetrieve encodes a searchRetrieveResponse. next is the
+// nextRecordPosition, 0 when there are no more records.
+func MarshalSearchRetrieve(version string, total int, records []Record, next int, diags []*Diagnostic) []byte {
+	return MarshalSearchRetrieveSet(version, total, ResultSet{}, records, next, diags)
+}
+
+// MarshalSearchRetrieveSet is MarshalSearchRetrieve also naming the
+// result set, unless set.ID is "". SRU 2.0 calls the idle time
+// resultSetTTL.
+func MarshalSearchRetrieveSet(version string, total int, set ResultSet, records []Record, next int, diags []*Diagnostic) []byte {
+	resp := xmlSearchRetrieveResponse{
+		XMLName:            responseName(version, "searchRetrieveResponse"),
+		Version:            version,
+		NumberOfRecords:    total,
+		ResultSetID:        set.ID,
+		NextRecordPosition: next,
+		Diagnostics:        encodeDiagnostics(version, diags),
+	}
+	if set.ID != "" {
+		if Is20(version) {
+			resp.ResultSetTTL = set.IdleTime
+		} else {
+			resp.ResultSetIdleTime = set.IdleTime
+		}
+	}
+	if len(records) > 0 {
+		resp.Records = &xmlRecords{}
+		for _, r := range records {
+			resp.Records.Records = append(resp.Records.Records, encodeRecord(version, r))
+		}
+	}
+	return marshal(resp)
+}
+
+// ResultSetID returns the result set a query of the form
+// cql.resultSetId="id" names; other queries return false.
+func ResultSetID(query string) (string, bool) {
+	const index = "cql.resultSetId"
+	q := strings.TrimSpace(query)
+	if len(q) <= len(index) || !strings.EqualFold(q[:len(index)], index) {
+		return "", false
+	}
+	q = strings.TrimSpace(q[len(index):])
+	switch {
+	case strings.HasPrefix(q, "=="):
+		q = q[2:]
+	case strings.HasPrefix(q, "="):
+		q = q[1:]
+	default:
+		return "", false
+	}
+	q = strings.TrimSpace(q)
+	if len(q) >= 2 && q[0] == '"' && q[len(q)-1] == '"' {
+		q = q[1 : len(q)-1]
+	}
+	if q == "" || strings.ContainsAny(q, " \t\"()") {
+		return "", false
+	}
+	return q, true
+}
+
+// MarshalScan encodes a scanResponse.
+func MarshalScan(version string, terms []Term, diags []*Diagnostic) []byte {
+	resp := xmlScanResponse{
+		XMLName:     responseName(version, "scanResponse"),
+		Version:     version,
+		Diagnostics: encodeDiagnostics(version, diags),
+	}
+	if len(terms) > 0 {
+		resp.Terms = &xmlTerms{}
+		for _, t := range terms {
+			resp.Terms.Terms = append(resp.Terms.Terms, xmlTerm{Value: t.Value, NumberOfRecords: t.NumberOfRecords})
+		}
+	}
+	return marshal(resp)
+}
+
+// ExplainInfo describes a database for an explain response.
+type ExplainInfo struct {
+	Host           string
+	Port           int
+	Database       string
+	Title          string
+	Indexes        []string          // CQL index names, e.g. "dc.title"
+	ContextSets    map[string]string // prefix -> identifier
+	DefaultRecords int
+	MaxRecords     int
+}
+
+// MarshalExplain encodes an explainResponse carrying a ZeeRex record.
+func MarshalExplain(version string, info ExplainInfo, diags []*Diagnostic) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<explain xmlns="` + ExplainNamespace + `">`)
+	fmt.Fprintf(&b, `<serverInfo protocol="SRU" version="%s"><host>%s</host><port>%d</port><database>%s</database></serverInfo>`,
+		xmlText(version), xmlText(info.Host), info.Port, xmlText(info.Database))
+	fmt.Fprintf(&b, `<databaseInfo><title>%s</title></databaseInfo>`, xmlText(info.Title))
+
+	b.WriteString("<indexInfo>")
+	prefixes := make([]string, 0, len(info.ContextSets))
+	for prefix := range info.ContextSets {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		fmt.Fprintf(&b, `<set name="%s" identifier="%s"/>`, xmlText(prefix), xmlText(info.ContextSets[prefix]))
+	}
+	for _, index := range info.Indexes {
+		set, name, ok := strings.Cut(index, ".")
+		if !ok {
+			fmt.Fprintf(&b, `<index><title>%s</title><map><name>%s</name></map></index>`, xmlText(index), xmlText(index))
+			continue
+		}
+		fmt.Fprintf(&b, `<index><title>%s</title><map><name set="%s">%s</name></map></index>`, xmlText(index), xmlText(set), xmlText(name))
+	}
+	b.WriteString("</indexInfo>")
+
+	b.WriteString("<schemaInfo>")
+	fmt.Fprintf(&b, `<schema identifier="%s" name="marcxml"><title>MARCXML</title></schema>`, SchemaMARCXML)
+	fmt.Fprintf(&b, `<schema identifier="%s" name="dc"><title>Dublin Core</title></schema>`, SchemaDC)
+	b.WriteString("</schemaInfo>")
+
+	fmt.Fprintf(&b, `<configInfo><default type="numberOfRecords">%d</default><setting type="maximumRecords">%d</setting></configInfo>`,
+		info.DefaultRecords, info.MaxRecords)
+	b.WriteString("</explain>")
+
+	rec := encodeRecord(version, Record{Schema: ExplainNamespace, Data: b.Bytes()})
+	return marshal(xmlExplainResponse{
+		XMLName:     responseName(version, "explainResponse"),
+		Version:     version,
+		Record:      &rec,
+		Diagnostics: encodeDiagnostics(version, diags),
+	})
+}
+
+func xmlText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
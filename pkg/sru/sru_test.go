@@ -0,0 +1,144 @@
+package sru
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
+)
+
+func TestDiagnosticFromError(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"CQL error keeps its code", &z3950.CQLError{Code: z3950.CQLDiagUnsupportedIndex, Detail: "foo"}, DiagUnsupportedIndex},
+		{"Bib-1 use attribute", z3950.NewDiagnostic(z3950.DiagUnsupportedUseAttribute, "99"), DiagUnsupportedIndex},
+		{"Bib-1 unknown database", z3950.NewDiagnostic(z3950.DiagDatabaseNotFound, "X"), DiagDatabaseNotFound},
+		{"Wrapped Bib-1 diagnostic", fmt.Errorf("proxy: %w", z3950.NewDiagnostic(z3950.DiagUnsupportedProxUnit, "")), DiagUnsupportedProxUnit},
+		{"Plain error", fmt.Errorf("connection refused"), DiagGeneralSystemError},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := DiagnosticFromError(tc.err).Code; got != tc.code {
+				t.Errorf("code = %d, want %d", got, tc.code)
+			}
+		})
+	}
+}
+
+func TestMarshalSearchRetrieve(t *testing.T) {
+	rec := []byte(`<record xmlns="http://www.loc.gov/MARC21/slim"><leader>x</leader></record>`)
+	records := []Record{{Schema: SchemaMARCXML, Packing: "xml", Data: rec, Position: 3}}
+
+	out := string(MarshalSearchRetrieve("1.2", 7, records, 4, nil))
+	for _, want := range []string{
+		`<searchRetrieveResponse xmlns="` + Namespace12 + `">`,
+		`<numberOfRecords>7</numberOfRecords>`,
+		`<recordPacking>xml</recordPacking>`,
+		`<recordData>` + string(rec) + `</recordData>`,
+		`<recordPosition>3</recordPosition>`,
+		`<nextRecordPosition>4</nextRecordPosition>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("1.2 response missing %s\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "<diagnostics>") {
+		t.Errorf("unexpected diagnostics element\n%s", out)
+	}
+
+	records[0].Packing = "string"
+	out = string(MarshalSearchRetrieve("2.0", 7, records, 0, nil))
+	for _, want := range []string{
+		`<searchRetrieveResponse xmlns="` + Namespace20 + `">`,
+		`<recordXMLEscaping>string</recordXMLEscaping>`,
+		`<recordData>&lt;record xmlns=`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("2.0 response missing %s\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "nextRecordPosition") {
+		t.Errorf("unexpected nextRecordPosition on last page\n%s", out)
+	}
+
+	var parsed struct {
+		Diagnostics []struct {
+			URI     string `xml:"uri"`
+			Details string `xml:"details"`
+		} `xml:"diagnostics>diagnostic"`
+	}
+	out = string(MarshalSearchRetrieve("1.2", 0, nil, 0, []*Diagnostic{NewDiagnostic(DiagFirstRecordOutOfRange, "50")}))
+	if err := xml.Unmarshal([]byte(out), &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Diagnostics) != 1 || parsed.Diagnostics[0].URI != "info:srw/diagnostic/1/61" || parsed.Diagnostics[0].Details != "50" {
+		t.Errorf("diagnostics = %+v", parsed.Diagnostics)
+	}
+}
+
+func TestResultSet(t *testing.T) {
+	out := string(MarshalSearchRetrieveSet("1.2", 7, ResultSet{ID: "42-7", IdleTime: 600}, nil, 0, nil))
+	for _, want := range []string{`<resultSetId>42-7</resultSetId>`, `<resultSetIdleTime>600</resultSetIdleTime>`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("1.2 response missing %s\n%s", want, out)
+		}
+	}
+	out = string(MarshalSearchRetrieveSet("2.0", 7, ResultSet{ID: "42-7", IdleTime: 600}, nil, 0, nil))
+	if !strings.Contains(out, `<resultSetTTL>600</resultSetTTL>`) {
+		t.Errorf("2.0 response missing resultSetTTL\n%s", out)
+	}
+	if out := string(MarshalSearchRetrieve("1.2", 7, nil, 0, nil)); strings.Contains(out, "resultSet") {
+		t.Errorf("unexpected result set\n%s", out)
+	}
+
+	tests := []struct {
+		query string
+		id    string
+		ok    bool
+	}{
+		{`cql.resultSetId="42-7"`, "42-7", true},
+		{` CQL.RESULTSETID == 42-7 `, "42-7", true},
+		{`cql.resultSetId="42-7" and dc.title=go`, "", false},
+		{`cql.resultSetId=""`, "", false},
+		{`dc.title="42-7"`, "", false},
+	}
+	for _, tc := range tests {
+		if id, ok := ResultSetID(tc.query); id != tc.id || ok != tc.ok {
+			t.Errorf("ResultSetID(%q) = %q, %v; want %q, %v", tc.query, id, ok, tc.id, tc.ok)
+		}
+	}
+}
+
+func TestDublinCore(t *testing.T) {
+	rec := &z3950.MARCRecord{
+		Title:  "Thinking in Go",
+		Author: "Pike, Rob",
+		ISBN:   "0201548550",
+		Fields: []z3950.MARCField{
+			{Tag: "260", Subfields: []z3950.MARCSubfield{{Code: "b", Value: "Addison-Wesley,"}, {Code: "c", Value: "2012."}}},
+			{Tag: "650", Subfields: []z3950.MARCSubfield{{Code: "a", Value: "Programming"}}},
+			{Tag: "650", Subfields: []z3950.MARCSubfield{{Code: "a", Value: "Go <language>"}}},
+		},
+	}
+	out := string(DublinCore(rec))
+	for _, want := range []string{
+		`<dc:title>Thinking in Go</dc:title>`,
+		`<dc:creator>Pike, Rob</dc:creator>`,
+		`<dc:publisher>Addison-Wesley</dc:publisher>`,
+		`<dc:date>2012</dc:date>`,
+		`<dc:subject>Programming</dc:subject><dc:subject>Go &lt;language&gt;</dc:subject>`,
+		`<dc:identifier>urn:isbn:0201548550</dc:identifier>`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "urn:issn") {
+		t.Errorf("unexpected empty ISSN identifier\n%s", out)
+	}
+}
@@ -0,0 +1,82 @@
+package z3950
+
+import (
+	"errors"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// ErrAuthentication is wrapped by the error Init returns when a target
+// refuses a connection that carried credentials, so that a failed login
+// can be told apart from network and protocol errors with errors.Is.
+var ErrAuthentication = errors.New("authentication rejected")
+
+// Authentication is the idAuthentication of an InitializeRequest. Open,
+// if set, is sent as an open string, which many targets expect in the
+// form "user/password"; otherwise GroupID, UserID and Password are sent
+// as idPass. The zero value sends no credentials.
+type Authentication struct {
+	Open     string
+	GroupID  string
+	UserID   string
+	Password string
+}
+
+// IsZero reports whether a carries no credentials.
+func (a Authentication) IsZero() bool {
+	return a == Authentication{}
+}
+
+// Encode returns the idAuthentication [7] element, or nil for the zero
+// value. The field is an ANY, so the CHOICE is wrapped explicitly.
+func (a Authentication) Encode() *ber.Packet {
+	if a.IsZero() {
+		return nil
+	}
+	p := ber.Encode(ber.ClassContext, ber.TypeConstructed, 7, nil, "IdAuthentication")
+	if a.Open != "" {
+		p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagVisibleString, a.Open, "Open"))
+		return p
+	}
+	idPass := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "IdPass")
+	if a.GroupID != "" {
+		idPass.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, a.GroupID, "GroupId"))
+	}
+	if a.UserID != "" {
+		idPass.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 1, a.UserID, "UserId"))
+	}
+	if a.Password != "" {
+		idPass.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 2, a.Password, "Password"))
+	}
+	p.AppendChild(idPass)
+	return p
+}
+
+// ParseAuthentication decodes the idAuthentication [7] element of an
+// InitializeRequest. Anonymous and other forms decode to the zero value.
+func ParseAuthentication(p *ber.Packet) Authentication {
+	var a Authentication
+	if p == nil || len(p.Children) == 0 {
+		return a
+	}
+	choice := p.Children[0]
+	switch {
+	case choice.ClassType == ber.ClassUniversal && choice.Tag == ber.TagSequence:
+		for _, c := range choice.Children {
+			if c.ClassType != ber.ClassContext {
+				continue
+			}
+			switch c.Tag {
+			case 0:
+				a.GroupID = DecodeString(c)
+			case 1:
+				a.UserID = DecodeString(c)
+			case 2:
+				a.Password = DecodeString(c)
+			}
+		}
+	case choice.ClassType == ber.ClassUniversal && choice.Tag != ber.TagNULL && choice.Tag != ber.TagExternal:
+		a.Open = DecodeString(choice)
+	}
+	return a
+}
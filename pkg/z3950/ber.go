@@ -0,0 +1,132 @@
+package z3950
+
+import (
+	"strconv"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// DecodeInt decodes a BER integer from a packet. The asn1-ber library only
+// decodes universal-class values, so context-tagged (IMPLICIT) integers have
+// to be read from the raw content.
+func DecodeInt(p *ber.Packet) int64 {
+	if v, ok := p.Value.(int64); ok {
+		return v
+	}
+	data := p.Data.Bytes()
+	if len(data) == 0 {
+		return 0
+	}
+	var val int64
+	if data[0]&0x80 != 0 {
+		val = -1
+	}
+	for _, b := range data {
+		val = (val << 8) | int64(b)
+	}
+	return val
+}
+
+// DecodeBool decodes a BER boolean, whatever its tag class.
+func DecodeBool(p *ber.Packet) bool {
+	if v, ok := p.Value.(bool); ok {
+		return v
+	}
+	data := p.Data.Bytes()
+	return len(data) > 0 && data[0] != 0
+}
+
+// DecodeString returns the content of a string packet, whatever its tag class.
+func DecodeString(p *ber.Packet) string {
+	if v, ok := p.Value.(string); ok {
+		return v
+	}
+	return string(p.Data.Bytes())
+}
+
+// EncodeOID returns the BER content octets of a dotted object identifier.
+func EncodeOID(oid string) []byte {
+	parts := strings.Split(oid, ".")
+	if len(parts) < 2 {
+		return nil
+	}
+	arcs := make([]int64, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil
+		}
+		arcs[i] = v
+	}
+	out := appendBase128(nil, arcs[0]*40+arcs[1])
+	for _, a := range arcs[2:] {
+		out = appendBase128(out, a)
+	}
+	return out
+}
+
+func appendBase128(dst []byte, n int64) []byte {
+	var tmp [10]byte
+	i := len(tmp) - 1
+	tmp[i] = byte(n & 0x7F)
+	for n >>= 7; n > 0; n >>= 7 {
+		i--
+		tmp[i] = byte(n&0x7F) | 0x80
+	}
+	return append(dst, tmp[i:]...)
+}
+
+// DecodeOID converts BER object identifier content octets to dotted form.
+func DecodeOID(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var arcs []string
+	var v int64
+	first := true
+	for _, b := range data {
+		v = v<<7 | int64(b&0x7F)
+		if b&0x80 != 0 {
+			continue
+		}
+		if first {
+			x := v / 40
+			if x > 2 {
+				x = 2
+			}
+			arcs = append(arcs, strconv.FormatInt(x, 10), strconv.FormatInt(v-x*40, 10))
+			first = false
+		} else {
+			arcs = append(arcs, strconv.FormatInt(v, 10))
+		}
+		v = 0
+	}
+	return strings.Join(arcs, ".")
+}
+
+// NewOID builds a primitive object identifier packet with the given tag.
+func NewOID(class ber.Class, tag ber.Tag, oid, description string) *ber.Packet {
+	p := ber.Encode(class, ber.TypePrimitive, tag, nil, description)
+	p.Data.Write(EncodeOID(oid))
+	return p
+}
+
+// PacketOID returns the dotted object identifier held by a packet.
+func PacketOID(p *ber.Packet) string {
+	if v, ok := p.Value.(string); ok && p.Tag == ber.TagObjectIdentifier && p.ClassType == ber.ClassUniversal {
+		return v
+	}
+	return DecodeOID(p.Data.Bytes())
+}
+
+// NewExternal wraps an octet-aligned payload in an EXTERNAL identified by
+// oid. Pass a non-universal tag to use it as an IMPLICIT EXTERNAL.
+func NewExternal(class ber.Class, tag ber.Tag, oid string, data []byte, description string) *ber.Packet {
+	ext := ber.Encode(class, ber.TypeConstructed, tag, nil, description)
+	ext.AppendChild(NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, oid, "DirectReference"))
+	octets := ber.Encode(ber.ClassContext, ber.TypePrimitive, 1, nil, "OctetAligned")
+	octets.Data.Write(data)
+	ext.AppendChild(octets)
+	return ext
+}
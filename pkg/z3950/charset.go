@@ -0,0 +1,180 @@
+package z3950
+
+import (
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// OID_CharsetNegotiation identifies the charset-negotiation-3 Init
+// extension, carried in the otherInfo of InitializeRequest and
+// InitializeResponse.
+const OID_CharsetNegotiation = "1.2.840.10003.15.3"
+
+// OID_UTF8 is the ISO 10646 encoding level of UTF-8, the form in which
+// UTF-8 is proposed and selected.
+const OID_UTF8 = "1.0.10646.1.0.8"
+
+// oidCharsetName identifies a character set named by a string in a private
+// charset's EXTERNAL, as YAZ sends charsets without an ISO 10646 form.
+const oidCharsetName = "1.2.840.10003.15.1000.81.1"
+
+// CharsetNegotiation is the charset-negotiation-3 Init extension. In an
+// origin's proposal Charsets lists the charsets it accepts, most preferred
+// first; in a target's response it holds the selected charset, or nothing
+// when the target selected none. Charsets are named as in "UTF-8" and
+// "MARC-8". RecordsInCharset says that records, too, are to be sent in
+// the selected charset.
+type CharsetNegotiation struct {
+	Charsets         []string
+	RecordsInCharset bool
+}
+
+// EncodeProposal returns the otherInfo [201] element proposing n's
+// charsets, for an InitializeRequest.
+func (n CharsetNegotiation) EncodeProposal() *ber.Packet {
+	proposal := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "OriginProposal")
+	charsets := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "ProposedCharSets")
+	for _, name := range n.Charsets {
+		charsets.AppendChild(encodeCharset(name))
+	}
+	proposal.AppendChild(charsets)
+	proposal.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 3, n.RecordsInCharset, "RecordsInSelectedCharSets"))
+	return charsetOtherInfo(proposal)
+}
+
+// EncodeResponse returns the otherInfo [201] element selecting the first
+// of n's charsets, or none when it has none, for an InitializeResponse.
+func (n CharsetNegotiation) EncodeResponse() *ber.Packet {
+	response := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "TargetResponse")
+	selected := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "SelectedCharSets")
+	if len(n.Charsets) > 0 {
+		selected.AppendChild(encodeCharset(n.Charsets[0]))
+	} else {
+		selected.AppendChild(ber.Encode(ber.ClassContext, ber.TypePrimitive, 4, nil, "None"))
+	}
+	response.AppendChild(selected)
+	response.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 3, n.RecordsInCharset && len(n.Charsets) > 0, "RecordsInSelectedCharSets"))
+	return charsetOtherInfo(response)
+}
+
+// charsetOtherInfo wraps a CharSetandLanguageNegotiation in an otherInfo
+// externallyDefinedInfo.
+func charsetOtherInfo(choice *ber.Packet) *ber.Packet {
+	ext := ber.Encode(ber.ClassContext, ber.TypeConstructed, 4, nil, "ExternallyDefinedInfo")
+	ext.AppendChild(NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, OID_CharsetNegotiation, "DirectReference"))
+	single := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "SingleASN1Type")
+	single.AppendChild(choice)
+	ext.AppendChild(single)
+	unit := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "OtherInfoUnit")
+	unit.AppendChild(ext)
+	info := ber.Encode(ber.ClassContext, ber.TypeConstructed, 201, nil, "OtherInfo")
+	info.AppendChild(unit)
+	return info
+}
+
+// encodeCharset encodes UTF-8 as ISO 10646 and any other charset as a
+// private charset carrying its name.
+func encodeCharset(name string) *ber.Packet {
+	if strings.EqualFold(name, "UTF-8") {
+		iso := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "Iso10646")
+		iso.AppendChild(NewOID(ber.ClassContext, 2, OID_UTF8, "EncodingLevel"))
+		return iso
+	}
+	private := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "Private")
+	specified := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "ExternallySpecified")
+	specified.AppendChild(NewExternal(ber.ClassUniversal, ber.TagExternal, oidCharsetName, []byte(name), "Charset"))
+	private.AppendChild(specified)
+	return private
+}
+
+// decodeCharset returns the name of a proposed or selected charset, or ""
+// for none and for charsets given in forms it does not know.
+func decodeCharset(p *ber.Packet) string {
+	if p.ClassType != ber.ClassContext {
+		return ""
+	}
+	switch p.Tag {
+	case 2: // iso10646
+		for _, c := range p.Children {
+			if c.ClassType == ber.ClassContext && c.Tag == 2 && PacketOID(c) == OID_UTF8 {
+				return "UTF-8"
+			}
+		}
+	case 3: // private, named in an EXTERNAL
+		var name string
+		var walk func(*ber.Packet)
+		walk = func(p *ber.Packet) {
+			if p.Tag == ber.TagExternal && p.ClassType == ber.ClassUniversal {
+				name = string(externalOctets(p))
+				return
+			}
+			for _, c := range p.Children {
+				walk(c)
+			}
+		}
+		walk(p)
+		return strings.TrimSpace(name)
+	}
+	return ""
+}
+
+// ParseCharsetNegotiation finds the charset negotiation in the otherInfo
+// of an InitializeRequest or InitializeResponse. ok is false when the PDU
+// carries none.
+func ParseCharsetNegotiation(init *ber.Packet) (n CharsetNegotiation, ok bool) {
+	for _, info := range init.Children {
+		if info.ClassType != ber.ClassContext || info.Tag != 201 {
+			continue
+		}
+		for _, unit := range info.Children {
+			for _, ext := range unit.Children {
+				if ext.ClassType != ber.ClassContext || ext.Tag != 4 || len(ext.Children) < 2 ||
+					PacketOID(ext.Children[0]) != OID_CharsetNegotiation {
+					continue
+				}
+				single := ext.Children[1]
+				if len(single.Children) == 0 {
+					continue
+				}
+				return parseNegotiation(single.Children[0]), true
+			}
+		}
+	}
+	return n, false
+}
+
+// parseNegotiation decodes an OriginProposal [1] or TargetResponse [2].
+func parseNegotiation(choice *ber.Packet) CharsetNegotiation {
+	var n CharsetNegotiation
+	for _, c := range choice.Children {
+		if c.ClassType != ber.ClassContext {
+			continue
+		}
+		switch c.Tag {
+		case 1:
+			for _, cs := range c.Children {
+				if name := decodeCharset(cs); name != "" {
+					n.Charsets = append(n.Charsets, name)
+				}
+			}
+		case 3:
+			n.RecordsInCharset = DecodeBool(c)
+		}
+	}
+	return n
+}
+
+// SelectCharset picks the first of the proposed charsets found in
+// supported, comparing names case-insensitively, and returns it as
+// spelled in supported, or "" if there is none.
+func SelectCharset(proposed, supported []string) string {
+	for _, p := range proposed {
+		for _, s := range supported {
+			if strings.EqualFold(p, s) {
+				return s
+			}
+		}
+	}
+	return ""
+}
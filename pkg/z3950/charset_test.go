@@ -0,0 +1,49 @@
+package z3950
+
+import (
+	"reflect"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestCharsetNegotiationRoundTrip(t *testing.T) {
+	decode := func(info *ber.Packet) (CharsetNegotiation, bool) {
+		init := ber.Encode(ber.ClassContext, ber.TypeConstructed, 20, nil, "Init")
+		init.AppendChild(info)
+		pkt, err := ber.DecodePacketErr(init.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ParseCharsetNegotiation(pkt)
+	}
+
+	proposal := CharsetNegotiation{Charsets: []string{"UTF-8", "MARC-8"}, RecordsInCharset: true}
+	if got, ok := decode(proposal.EncodeProposal()); !ok || !reflect.DeepEqual(got, proposal) {
+		t.Errorf("proposal decoded as %+v, %v", got, ok)
+	}
+
+	response := CharsetNegotiation{Charsets: []string{"MARC-8"}, RecordsInCharset: true}
+	if got, ok := decode(response.EncodeResponse()); !ok || !reflect.DeepEqual(got, response) {
+		t.Errorf("response decoded as %+v, %v", got, ok)
+	}
+
+	// Selecting none never claims records in a charset
+	if got, ok := decode(CharsetNegotiation{RecordsInCharset: true}.EncodeResponse()); !ok || len(got.Charsets) != 0 || got.RecordsInCharset {
+		t.Errorf("none decoded as %+v, %v", got, ok)
+	}
+
+	if _, ok := ParseCharsetNegotiation(ber.Encode(ber.ClassContext, ber.TypeConstructed, 20, nil, "Init")); ok {
+		t.Error("found a negotiation in an Init without otherInfo")
+	}
+}
+
+func TestSelectCharset(t *testing.T) {
+	supported := []string{"UTF-8", "MARC-8"}
+	if got := SelectCharset([]string{"ISO-8859-1", "marc-8", "utf-8"}, supported); got != "MARC-8" {
+		t.Errorf("SelectCharset = %q, want MARC-8", got)
+	}
+	if got := SelectCharset([]string{"ISO-8859-1"}, supported); got != "" {
+		t.Errorf("SelectCharset = %q, want none", got)
+	}
+}
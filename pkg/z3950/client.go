@@ -1,9 +1,14 @@
 package z3950
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net"
+	"os"
+	"strconv"
 	"time"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
@@ -14,21 +19,56 @@ const (
 	OID_MARC21  = "1.2.840.10003.5.10" // MARC 21 (USMARC)
 	OID_UNIMARC = "1.2.840.10003.5.1"  // UNIMARC
 	OID_SUTRS   = "1.2.840.10003.5.101" // Simple Unstructured Text
+	OID_OPAC    = "1.2.840.10003.5.102" // OPAC (bibliographic record plus holdings)
+	OID_XML     = "1.2.840.10003.5.109.10" // XML (MARCXML)
+)
+
+// Timeouts applied when the caller's context sets no deadline of its own.
+const (
+	DialTimeout = 10 * time.Second
+	IOTimeout   = 30 * time.Second
 )
 
 type Client struct {
 	conn net.Conn
 	host string
 	port int
+	// Auth is sent with Init; set it before calling Init.
+	Auth Authentication
+	// Charset is the charset the target selected when Init proposed
+	// UTF-8, or "" if it negotiated none. Records are decoded in it when
+	// the target agreed to send them so; otherwise it is guessed.
+	Charset       string
+	recordCharset string
+	// Negotiated holds what the target agreed to at Init: the protocol
+	// version, the services the client may use and the message sizes.
+	Negotiated InitParams
+}
+
+// ErrNotNegotiated is wrapped by the error of an operation the target did
+// not agree to at Init.
+var ErrNotNegotiated = errors.New("service not agreed at Init")
+
+// clientInit is what Init proposes: the services the client implements.
+var clientInit = InitParams{
+	Versions:              Bits(Version2, Version3),
+	Options:               Bits(OptionSearch, OptionPresent, OptionDeleteResultSet, OptionScan, OptionSort),
+	PreferredMessageSize:  DefaultPreferredMessageSize,
+	ExceptionalRecordSize: DefaultExceptionalRecordSize,
+	ImplementationID:      "GoZ3950",
+	ImplementationName:    "Open Z39.50 Gateway",
 }
 
 func NewClient(host string, port int) *Client {
 	return &Client{host: host, port: port}
 }
 
-func (c *Client) Connect() error {
-	address := fmt.Sprintf("%s:%d", c.host, c.port)
-	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+// Connect dials the target. The dial gives up after DialTimeout, or
+// earlier if ctx is cancelled or its deadline passes.
+func (c *Client) Connect(ctx context.Context) error {
+	address := net.JoinHostPort(c.host, strconv.Itoa(c.port))
+	dialer := net.Dialer{Timeout: DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return err
 	}
@@ -40,12 +80,67 @@ func (c *Client) Close() {
 	if c.conn != nil {
 		pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 48, nil, "Close")
 		pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 211, 0, "Reason"))
+		// A target that stopped reading must not hold up the close
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
 		c.conn.Write(pdu.Bytes())
 		c.conn.Close()
+		c.conn = nil
 	}
 }
 
-func (c *Client) sendPDU(pdu *ber.Packet) (*ber.Packet, error) {
+// requireOption fails with ErrNotNegotiated when Init was done and the
+// target did not agree to the service behind option.
+func (c *Client) requireOption(option int, service string) error {
+	if c.Negotiated.Versions != 0 && !c.Negotiated.Options.Has(option) {
+		return fmt.Errorf("%s: %w", service, ErrNotNegotiated)
+	}
+	return nil
+}
+
+// Connected reports whether the client holds an open connection; it no
+// longer does after Close or an exchange aborted by its context.
+func (c *Client) Connected() bool {
+	return c.conn != nil
+}
+
+// sendPDU writes pdu and reads the response. The exchange is bounded by
+// ctx's deadline (IOTimeout if it has none) and aborted as soon as ctx is
+// cancelled; the connection is then closed, since a response may still be
+// on its way and the next exchange would read it.
+func (c *Client) sendPDU(ctx context.Context, pdu *ber.Packet) (*ber.Packet, error) {
+	if c.conn == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(IOTimeout)
+	}
+	conn := c.conn
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		// Unblocks the pending read or write at once
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	pkt, err := c.exchange(pdu)
+	if !stop() || err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		} else if ok && errors.Is(err, os.ErrDeadlineExceeded) {
+			// The socket deadline can fire just before ctx's own timer
+			err = context.DeadlineExceeded
+		}
+		conn.Close()
+		c.conn = nil
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return pkt, nil
+}
+
+func (c *Client) exchange(pdu *ber.Packet) (*ber.Packet, error) {
 	data := pdu.Bytes()
 	slog.Info("sending PDU", "hex", fmt.Sprintf("%X", data))
 	if _, err := c.conn.Write(data); err != nil {
@@ -69,7 +164,7 @@ func (c *Client) sendPDU(pdu *ber.Packet) (*ber.Packet, error) {
 			if v, ok := pkt.Children[0].Value.(int64); ok {
 				reason = fmt.Sprintf("code %d", v)
 			} else {
-				v := decodeInt(pkt.Children[0])
+				v := DecodeInt(pkt.Children[0])
 				reason = fmt.Sprintf("code %d", v)
 			}
 		}
@@ -79,30 +174,14 @@ func (c *Client) sendPDU(pdu *ber.Packet) (*ber.Packet, error) {
 	return pkt, nil
 }
 
-func (c *Client) Init() error {
-	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 20, nil, "InitializeRequest")
-	
-	// ProtocolVersion [3] IMPLICIT BIT STRING
-	// v3 (bit 2) set. 0010 0000 = 0x20.
-	ver := ber.Encode(ber.ClassContext, ber.TypePrimitive, 3, nil, "ProtocolVersion")
-	ver.Data.Write([]byte{0x00, 0x20}) 
-	pdu.AppendChild(ver)
-
-	// Options [4] IMPLICIT BIT STRING
-	// search(0)|present(1) = 1100 0000 = 0xC0
-	opts := ber.Encode(ber.ClassContext, ber.TypePrimitive, 4, nil, "Options")
-	opts.Data.Write([]byte{0x00, 0xC0})
-	pdu.AppendChild(opts)
-
-	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 5, 65536, "PreferredMessageSize"))
-	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 6, 65536, "MaximumRecordSize"))
-	
-	// Optional fields removed for compatibility (yaz-client imitation)
-	// pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 110, "yaz-client", "Id"))
-	// pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 111, "YAZ", "Name"))
-	// pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 112, "5.34.0", "Ver"))
+// Init proposes protocol versions 2 and 3, the services the client
+// implements, message sizes and UTF-8, and keeps what the target agreed to
+// in Negotiated and Charset.
+func (c *Client) Init(ctx context.Context) error {
+	pdu := EncodeInitRequest(clientInit, c.Auth.Encode(),
+		CharsetNegotiation{Charsets: []string{"UTF-8"}, RecordsInCharset: true}.EncodeProposal())
 
-	resp, err := c.sendPDU(pdu)
+	resp, err := c.sendPDU(ctx, pdu)
 	if err != nil {
 		return err
 	}
@@ -127,25 +206,37 @@ func (c *Client) Init() error {
 	}
 
 	if !accepted {
+		if !c.Auth.IsZero() {
+			return fmt.Errorf("server rejected connection (Init=False): %w", ErrAuthentication)
+		}
 		return fmt.Errorf("server rejected connection (Init=False)")
 	}
-	return nil
-}
 
-// decodeInt manually decodes a BER integer from a packet's data
-func decodeInt(p *ber.Packet) int64 {
-	if v, ok := p.Value.(int64); ok {
-		return v
+	reply := ParseInitParams(resp)
+	if reply.Versions == 0 && reply.Options == 0 {
+		// Some targets leave both out; take it as agreeing to the proposal
+		reply.Versions, reply.Options = clientInit.Versions, clientInit.Options
 	}
-	data := p.Data.Bytes()
-	if len(data) == 0 {
-		return 0
+	c.Negotiated = clientInit.Negotiate(reply)
+	c.Negotiated.ImplementationID = reply.ImplementationID
+	c.Negotiated.ImplementationName = reply.ImplementationName
+	c.Negotiated.ImplementationVersion = reply.ImplementationVersion
+	if c.Negotiated.Version() == 0 {
+		return fmt.Errorf("target supports neither Z39.50 version 2 nor 3")
 	}
-	var val int64
-	for _, b := range data {
-		val = (val << 8) | int64(b)
+	slog.Info("init negotiated", "version", c.Negotiated.Version(), "options", fmt.Sprintf("%b", c.Negotiated.Options),
+		"message_size", c.Negotiated.PreferredMessageSize, "record_size", c.Negotiated.ExceptionalRecordSize,
+		"implementation", c.Negotiated.ImplementationName)
+
+	c.Charset, c.recordCharset = "", ""
+	if n, ok := ParseCharsetNegotiation(resp); ok && len(n.Charsets) > 0 {
+		c.Charset = n.Charsets[0]
+		if n.RecordsInCharset {
+			c.recordCharset = c.Charset
+		}
+		slog.Info("charset negotiated", "charset", c.Charset, "records", n.RecordsInCharset)
 	}
-	return val
+	return nil
 }
 
 // buildOperand creates a BER packet for a single search clause
@@ -154,10 +245,20 @@ func buildOperand(clause QueryClause) *ber.Packet {
 	apt := ber.Encode(ber.ClassContext, ber.TypeConstructed, 102, nil, "AttributesPlusTerm")
 
 	attrs := ber.Encode(ber.ClassContext, ber.TypeConstructed, 44, nil, "Attrs")
-	attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attr")
-	attr.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 120, 1, "Type"))
-	attr.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 121, int64(clause.Attribute), "Value"))
-	attrs.AppendChild(attr)
+	values := clause.Attributes()
+	for typ := AttributeTypeUse; typ <= AttributeTypeCompleteness; typ++ {
+		val, ok := values[typ]
+		if !ok {
+			continue
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attr")
+		if clause.AttributeSet != "" {
+			attr.AppendChild(NewOID(ber.ClassContext, 1, clause.AttributeSet, "AttributeSet"))
+		}
+		attr.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 120, int64(typ), "Type"))
+		attr.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 121, int64(val), "Value"))
+		attrs.AppendChild(attr)
+	}
 	apt.AppendChild(attrs)
 
 	term := ber.NewString(ber.ClassContext, ber.TypePrimitive, 45, clause.Term, "Term")
@@ -180,14 +281,16 @@ func buildRPN(node QueryNode) *ber.Packet {
 		complex.AppendChild(buildRPN(n.Left))
 		complex.AppendChild(buildRPN(n.Right))
 		
-		opVal := 0 // AND
+		op := ber.Encode(ber.ClassContext, ber.TypeConstructed, 46, nil, "Operator")
 		switch n.Operator {
-		case "OR": opVal = 1
-		case "AND-NOT": opVal = 2
+		case "OR": op.AppendChild(ber.Encode(ber.ClassContext, ber.TypePrimitive, 1, nil, "Or"))
+		case "AND-NOT": op.AppendChild(ber.Encode(ber.ClassContext, ber.TypePrimitive, 2, nil, "AndNot"))
+		case "PROX":
+			prox := n.Proximity
+			if prox == nil { prox = &ProximityOperator{} }
+			op.AppendChild(prox.Encode())
+		default: op.AppendChild(ber.Encode(ber.ClassContext, ber.TypePrimitive, 0, nil, "And"))
 		}
-		
-		op := ber.Encode(ber.ClassContext, ber.TypeConstructed, 46, nil, "Operator")
-		op.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, ber.Tag(opVal), 0, "OpCode"))
 		complex.AppendChild(op)
 		
 		return complex
@@ -195,11 +298,33 @@ func buildRPN(node QueryNode) *ber.Packet {
 	return nil
 }
 
-func (c *Client) StructuredSearch(dbName string, query StructuredQuery) (int, error) {
+// StructuredSearch searches dbName into the "default" result set and
+// returns the hit count; records are left to Present.
+func (c *Client) StructuredSearch(ctx context.Context, dbName string, query StructuredQuery) (int, error) {
+	count, _, err := c.SearchPresent(ctx, dbName, query, 0, "", "")
+	return count, err
+}
+
+// SearchPresent is StructuredSearch asking the target to send up to count
+// records in syntaxOID and elementSet with the search response (a
+// piggybacked Present): all of a result set of up to count records, else
+// its first count. records holds those sent, from position 1, with nil
+// where the target sent a surrogate diagnostic; a target that does not
+// piggyback sends none, and they are left to Present.
+func (c *Client) SearchPresent(ctx context.Context, dbName string, query StructuredQuery, count int, syntaxOID, elementSet string) (int, []*MARCRecord, error) {
+	if err := c.requireOption(OptionSearch, "search"); err != nil {
+		return 0, nil, err
+	}
+	// Every set is small up to count and medium above it; with count 0
+	// no set is small and every non-empty one is large.
+	large := int64(math.MaxInt32)
+	if count <= 0 {
+		count, large = 0, 1
+	}
 	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 22, nil, "SearchRequest")
-	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 13, 1, "SmallSetUpperBound"))
-	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 14, 1, "LargeSetLowerBound"))
-	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 15, 0, "MediumSetPresentNumber"))
+	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 13, int64(count), "SmallSetUpperBound"))
+	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 14, large, "LargeSetLowerBound"))
+	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 15, int64(count), "MediumSetPresentNumber"))
 	pdu.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 16, true, "ReplaceIndicator"))
 	pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 17, "default", "ResultSetName"))
 
@@ -207,17 +332,22 @@ func (c *Client) StructuredSearch(dbName string, query StructuredQuery) (int, er
 	dbs.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 105, dbName, "DatabaseName"))
 	pdu.AppendChild(dbs)
 
-	// Add Small/Medium Set Element Set Names to hint format "B" (Brief) or "F" (Full)
-	// This might help servers default to a known format without needing RecordComposition in Present
-	// pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 100, "B", "SmallSetElementSetNames"))
-	// pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 101, "B", "MediumSetElementSetNames"))
+	if count > 0 {
+		if elementSet != "" {
+			pdu.AppendChild(EncodeElementSetNames(100, elementSet))
+			pdu.AppendChild(EncodeElementSetNames(101, elementSet))
+		}
+		if syntaxOID != "" {
+			pdu.AppendChild(NewOID(ber.ClassContext, 104, syntaxOID, "PreferredRecordSyntax"))
+		}
+	}
 
 	searchQuery := ber.Encode(ber.ClassContext, ber.TypeConstructed, 21, nil, "SearchQuery")
 	rpnQuery := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "RPNQuery")
 	
-	attrSetId := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagObjectIdentifier, nil, "AttributeSetId")
-	attrSetId.Data.Write([]byte{0x2A, 0x86, 0x48, 0xCE, 0x13, 0x03, 0x01})
-	rpnQuery.AppendChild(attrSetId)
+	attrSet := query.AttributeSet
+	if attrSet == "" { attrSet = OID_Bib1 }
+	rpnQuery.AppendChild(NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, attrSet, "AttributeSetId"))
 
 	struct_ := buildRPN(query.Root)
 	if struct_ == nil {
@@ -228,31 +358,86 @@ func (c *Client) StructuredSearch(dbName string, query StructuredQuery) (int, er
 	searchQuery.AppendChild(rpnQuery)
 	pdu.AppendChild(searchQuery)
 
-	resp, err := c.sendPDU(pdu)
+	resp, err := c.sendPDU(ctx, pdu)
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 	if resp.Tag != 23 {
-		return 0, fmt.Errorf("bad tag: %d", resp.Tag)
+		return 0, nil, fmt.Errorf("bad tag: %d", resp.Tag)
 	}
 
+	hits, status := 0, true
 	for _, child := range resp.Children {
-		if child.Tag == 23 {
-			return int(decodeInt(child)), nil
+		if child.ClassType != ber.ClassContext {
+			continue
+		}
+		switch child.Tag {
+		case 23:
+			hits = int(DecodeInt(child))
+		case 22:
+			status = DecodeBool(child)
+		}
+	}
+	if !status {
+		if diag := responseDiagnostic(resp); diag != nil {
+			return 0, nil, diag
 		}
+		return 0, nil, fmt.Errorf("search failed without diagnostic")
+	}
+	if diag := responseDiagnostic(resp); diag != nil {
+		// The search worked; only its piggybacked records failed
+		slog.Warn("piggybacked present failed", "diagnostic", diag)
+		return hits, nil, nil
 	}
-	return 0, nil
+	return hits, c.decodeRecords(resp, syntaxOID), nil
 }
 
 
-func (c *Client) Search(dbName string, simpleTerm string) (int, error) {
+func (c *Client) Search(ctx context.Context, dbName string, simpleTerm string) (int, error) {
 	query := StructuredQuery{
 		Root: QueryClause{Attribute: UseAttributeAny, Term: simpleTerm},
 	}
-	return c.StructuredSearch(dbName, query)
+	return c.StructuredSearch(ctx, dbName, query)
 }
 
-func (c *Client) Present(start int, count int, syntaxOID string) ([]*MARCRecord, error) {
+// Present retrieves count records from the default result set, starting
+// at the 1-based position start, in syntaxOID and in elementSet, such as
+// ElementSetBrief; with no element set the target sends its default.
+// Records the target replaced with a surrogate diagnostic, or that cannot
+// be decoded, are left out.
+func (c *Client) Present(ctx context.Context, start int, count int, syntaxOID, elementSet string) ([]*MARCRecord, error) {
+	records, err := c.PresentAt(ctx, start, count, syntaxOID, elementSet)
+	var present []*MARCRecord
+	for _, rec := range records {
+		if rec != nil {
+			present = append(present, rec)
+		}
+	}
+	return present, err
+}
+
+// PresentCount returns how many records of about recordSize bytes fit in
+// one Present response within the message size agreed at Init, at least
+// one: a record larger than that is still sent alone, up to the agreed
+// exceptional record size.
+func (c *Client) PresentCount(recordSize int) int {
+	size := c.Negotiated.PreferredMessageSize
+	if c.Negotiated.Versions == 0 || size <= 0 {
+		size = DefaultPreferredMessageSize
+	}
+	if recordSize <= 0 {
+		return 1
+	}
+	return max(1, size/recordSize)
+}
+
+// PresentAt is Present keeping positions: entry i is the record at
+// start+i, or nil where the target sent a surrogate diagnostic or the
+// record could not be decoded.
+func (c *Client) PresentAt(ctx context.Context, start int, count int, syntaxOID, elementSet string) ([]*MARCRecord, error) {
+	if err := c.requireOption(OptionPresent, "present"); err != nil {
+		return nil, err
+	}
 
 	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 24, nil, "PresentRequest")
 
@@ -262,39 +447,19 @@ func (c *Client) Present(start int, count int, syntaxOID string) ([]*MARCRecord,
 
 	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 29, int64(count), "NumberOfRecordsRequested"))
 
-
+	if elementSet != "" {
+		pdu.AppendChild(EncodeElementSetNames(19, elementSet))
+	}
 
 	if syntaxOID != "" {
 
-		var oidBytes []byte
-
-		if syntaxOID == OID_MARC21 {
-
-			oidBytes = []byte{0x2A, 0x86, 0x48, 0xCE, 0x13, 0x05, 0x0A}
-
-		} else if syntaxOID == OID_SUTRS {
-
-			oidBytes = []byte{0x2A, 0x86, 0x48, 0xCE, 0x13, 0x05, 0x65}
-
-		} else if syntaxOID == OID_UNIMARC {
-
-			oidBytes = []byte{0x2A, 0x86, 0x48, 0xCE, 0x13, 0x05, 0x01}
-
-		} else {
-
-			// Default to MARC21
-
-			oidBytes = []byte{0x2A, 0x86, 0x48, 0xCE, 0x13, 0x05, 0x0A}
-
-		}
-
-		pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 104, string(oidBytes), "PreferredRecordSyntax"))
+		pdu.AppendChild(NewOID(ber.ClassContext, 104, syntaxOID, "PreferredRecordSyntax"))
 
 	}
 
 
 
-	resp, err := c.sendPDU(pdu)
+	resp, err := c.sendPDU(ctx, pdu)
 
 	if err != nil {
 
@@ -340,69 +505,83 @@ func (c *Client) Present(start int, count int, syntaxOID string) ([]*MARCRecord,
 
 
 
-		var records []*MARCRecord
-
-		for _, child := range resp.Children {
-
-			if child.Tag == 28 {
-
-				for i, recSeq := range child.Children {
-
-					octet := findOctetString(recSeq)
-
-					if octet != nil {
-
-						slog.Info("Found OctetString", "size", len(octet))
-
-						if syntaxOID == OID_SUTRS {
-
-							rec := &MARCRecord{
-
-								Leader: "SUTRS",
-
-								Fields: []MARCField{
-
-									{Tag: "TXT", Value: string(octet)},
-
-								},
-
-							}
-
-							records = append(records, rec)
-
-						} else {
-
-							marc, err := ParseMARC(octet)
-
-							if err == nil {
-
-								records = append(records, marc)
-
-							} else {
-
-								slog.Error("ParseMARC failed", "error", err, "hex_start", fmt.Sprintf("%X", octet[:min(len(octet), 20)]))
-
-							}
-
-						}
-
-					} else {
-
-						slog.Warn("No OctetString found in record", "index", i)
-
-						logPacketStructure(recSeq, 0)
+		if diag := responseDiagnostic(resp); diag != nil {
+			return nil, diag
+		}
 
-					}
+		return c.decodeRecords(resp, syntaxOID), nil
 
-				}
+	}
 
+// decodeRecords decodes the Records [28] of a Present or Search response,
+// keeping positions: nil stands for a surrogate diagnostic or a record
+// that could not be decoded.
+func (c *Client) decodeRecords(resp *ber.Packet, syntaxOID string) []*MARCRecord {
+	var records []*MARCRecord
+	for _, child := range resp.Children {
+		if child.ClassType != ber.ClassContext || child.Tag != 28 {
+			continue
+		}
+		for i, recSeq := range child.Children {
+			if diag := surrogateDiagnostic(recSeq); diag != nil {
+				slog.Warn("surrogate diagnostic in records", "index", i, "diagnostic", diag)
+				records = append(records, nil)
+				continue
 			}
+			records = append(records, decodeRecord(recSeq, syntaxOID, c.recordCharset, i))
+		}
+	}
+	return records
+}
 
+// decodeRecord decodes one NamePlusRecord in the requested syntax, and
+// ISO 2709 records in charset if one was negotiated. It returns nil, after
+// logging why, when the record cannot be decoded.
+func decodeRecord(recSeq *ber.Packet, syntaxOID, charset string, index int) *MARCRecord {
+	if syntaxOID == OID_OPAC {
+		if opac := externalSingleType(recSeq); opac != nil {
+			bib, holdings := ParseOPACRecord(opac)
+			marc, err := ParseMARCCharset(bib, charset)
+			if err != nil {
+				slog.Error("ParseMARC failed for OPAC record", "error", err)
+				return nil
+			}
+			marc.Holdings = holdings
+			return marc
 		}
+	}
 
-		return records, nil
+	octet := findOctetString(recSeq)
+	if octet == nil {
+		slog.Warn("No OctetString found in record", "index", index)
+		logPacketStructure(recSeq, 0)
+		return nil
+	}
+	slog.Info("Found OctetString", "size", len(octet))
 
+	switch syntaxOID {
+	case OID_SUTRS:
+		return &MARCRecord{
+			Leader: "SUTRS",
+			Fields: []MARCField{
+				{Tag: "TXT", Value: string(octet)},
+			},
+		}
+	case OID_XML:
+		marc, err := ParseMARCXML(octet)
+		if err != nil {
+			slog.Error("ParseMARCXML failed", "error", err)
+			return nil
+		}
+		return marc
+	}
+	marc, err := ParseMARCCharset(octet, charset)
+	if err != nil {
+		slog.Error("ParseMARC failed", "error", err, "hex_start", fmt.Sprintf("%X", octet[:min(len(octet), 20)]))
+		return nil
 	}
+	return marc
+}
 
 	
 
@@ -432,8 +611,23 @@ func (c *Client) Present(start int, count int, syntaxOID string) ([]*MARCRecord,
 
 	}
 
+// surrogateDiagnostic returns the diagnostic a NamePlusRecord carries in
+// place of a record (record [1] -> surrogateDiagnostic [2]), if any.
+func surrogateDiagnostic(npr *ber.Packet) *Diagnostic {
+	for _, c := range npr.Children {
+		if c.ClassType != ber.ClassContext || c.Tag != 1 || len(c.Children) == 0 {
+			continue
+		}
+		sd := c.Children[0]
+		if sd.ClassType == ber.ClassContext && sd.Tag == 2 && len(sd.Children) > 0 {
+			return ParseDiagnostic(sd.Children[0])
+		}
+	}
+	return nil
+}
+
 func findOctetString(p *ber.Packet) []byte {
-	if p.Tag == ber.TagOctetString && p.ClassType == ber.ClassUniversal {
+	if (p.Tag == ber.TagOctetString || p.Tag == ber.TagGeneralString) && p.ClassType == ber.ClassUniversal {
 		return p.Data.Bytes()
 	}
 	// Handle EXTERNAL (Tag 8)
@@ -467,7 +661,10 @@ func findOctetString(p *ber.Packet) []byte {
 	return nil
 }
 
-func (c *Client) Scan(dbName string, startTerm string, attributes map[int]int) ([]ScanEntry, error) {
+func (c *Client) Scan(ctx context.Context, dbName string, startTerm string, attributes map[int]int) ([]ScanEntry, error) {
+	if err := c.requireOption(OptionScan, "scan"); err != nil {
+		return nil, err
+	}
 	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 35, nil, "ScanRequest")
 	
 	dbs := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "DatabaseNames")
@@ -500,7 +697,7 @@ func (c *Client) Scan(dbName string, startTerm string, attributes map[int]int) (
 	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 32, 0, "StepSize"))
 	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 33, 1, "PositionOfTerm"))
 
-	resp, err := c.sendPDU(pdu)
+	resp, err := c.sendPDU(ctx, pdu)
 	if err != nil {
 		return nil, err
 	}
@@ -510,33 +707,53 @@ func (c *Client) Scan(dbName string, startTerm string, attributes map[int]int) (
 	}
 
 	var entries []ScanEntry
-	
+	var diag *Diagnostic
+	failed := false
+
 	for _, child := range resp.Children {
-		if child.Tag == 7 { 
-			list := child.Children[0] 
-			for _, entry := range list.Children {
-				termStr := ""
-				cnt := 0
-				
-				var walk func(*ber.Packet)
-				walk = func(p *ber.Packet) {
-					if p.Tag == 45 {
-						if v, ok := p.Value.([]byte); ok { termStr = string(v) } else { termStr = string(p.Data.Bytes()) }
-					}
-					if p.Tag == 2 {
-						if v, ok := p.Value.(int64); ok { cnt = int(v) }
+		if child.Tag == 4 && child.ClassType == ber.ClassContext {
+			failed = DecodeInt(child) == 6 // scanStatus failure
+		}
+		if child.Tag == 7 {
+			for _, list := range child.Children {
+				if list.Tag == 2 && list.ClassType == ber.ClassContext {
+					// nonsurrogateDiagnostics
+					if len(list.Children) > 0 && diag == nil {
+						diag = ParseDiagnostic(list.Children[0])
 					}
-					for _, sub := range p.Children { walk(sub) }
+					continue
 				}
-				walk(entry)
+				for _, entry := range list.Children {
+					termStr := ""
+					cnt := 0
 				
-				if termStr != "" {
-					entries = append(entries, ScanEntry{Term: termStr, Count: cnt})
+					var walk func(*ber.Packet)
+					walk = func(p *ber.Packet) {
+						if p.Tag == 45 {
+							if v, ok := p.Value.([]byte); ok { termStr = string(v) } else { termStr = string(p.Data.Bytes()) }
+						}
+						if p.Tag == 2 {
+							cnt = int(DecodeInt(p))
+						}
+						for _, sub := range p.Children { walk(sub) }
+					}
+					walk(entry)
+
+					if termStr != "" {
+						entries = append(entries, ScanEntry{Term: termStr, Count: cnt})
+					}
 				}
 			}
 		}
 	}
 
+	if diag != nil && (failed || len(entries) == 0) {
+		return nil, diag
+	}
+	if failed {
+		return nil, fmt.Errorf("scan failed without diagnostic")
+	}
+
 	return entries, nil
 }
 
@@ -545,96 +762,52 @@ type ScanEntry struct {
 	Count int
 }
 
-func (c *Client) Sort(resultSetName string, keys []SortKey) error {
-	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 43, nil, "SortRequest")
-	
-	// ReferenceID (Optional)
-	
-	// InputResultSetNames [3] IMPLICIT SEQUENCE OF InternationalString
-	input := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "InputResultSets")
-	input.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagVisibleString, resultSetName, "ResultSetName"))
-	pdu.AppendChild(input)
-
-	// SortedResultSetName [4] IMPLICIT InternationalString
-	pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 4, resultSetName, "SortedResultSetName"))
-
-	// SortSequence [5] IMPLICIT SEQUENCE OF SortKeySpec
-	seq := ber.Encode(ber.ClassContext, ber.TypeConstructed, 5, nil, "SortSequence")
-	
-	for _, k := range keys {
-		spec := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeySpec")
-		
-		// SortKey [0] CHOICE { privateSortKey, elementSpec, sortAttributes }
-		sk := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "SortKey")
-		// sortAttributes [2] IMPLICIT SEQUENCE { id, list }
-		sa := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "SortAttributes")
-		sa.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagObjectIdentifier, OID_Bib1, "AttributeSetId"))
-		
-		list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "AttributeList")
-		
-		// Use Attribute
-		useAttr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attr")
-		useAttr.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 1, "Type"))
-		useAttr.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(k.Attribute), "Value"))
-		list.AppendChild(useAttr)
-
-		// Relation Attribute (Sort Relation: 1=Ascending, 2=Descending)
-		relVal := 1 // Default Ascending
-		if k.Relation == 1 { relVal = 2 } // Descending
-		
-		relAttr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attr")
-		relAttr.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 2, "Type")) // 2 = Relation
-		// Relation: 3=Equal (default?), 1=Less, 2=LE... 
-		// Actually, for Sort, Bib-1 Relation values are often repurposed or specific sort attributes used.
-		// Standard Sort Relation attribute (type 7?): 1=Ascending, 2=Descending.
-		// But in Bib-1, standard Use attributes are used.
-		// The standard way is using SortKeySpec -> SortRelation (Tag 1) INTEGER { ascending(0), descending(1), ascendingByKey(3)... }
-		// Wait, SortKeySpec has `sortRelation [1] IMPLICIT INTEGER DEFAULT ascending`.
-		// It is NOT inside the AttributeList.
-		
-		sa.AppendChild(list)
-		sk.AppendChild(sa)
-		spec.AppendChild(sk)
-
-		// SortRelation [1] IMPLICIT INTEGER DEFAULT 0 (ascending)
-		relation := 0 
-		if k.Relation == 1 { relation = 1 } // 1 = descending
-		spec.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, int64(relation), "SortRelation"))
-		
-		// CaseSensitivity [2] IMPLICIT INTEGER { caseSensitive(0), caseInsensitive(1) }
-		spec.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 2, 1, "CaseInsensitive"))
-
-		seq.AppendChild(spec)
+// Sort sorts the result set resultSetName on keys in place. A target that
+// cannot sort as asked returns its diagnostic.
+func (c *Client) Sort(ctx context.Context, resultSetName string, keys []SortKey) error {
+	if err := c.requireOption(OptionSort, "sort"); err != nil {
+		return err
 	}
-	pdu.AppendChild(seq)
-
-	resp, err := c.sendPDU(pdu)
+	req := SortRequest{Input: []string{resultSetName}, Output: resultSetName, Keys: keys}
+	resp, err := c.sendPDU(ctx, req.Encode())
 	if err != nil {
 		return err
 	}
-
 	if resp.Tag != 44 {
 		return fmt.Errorf("unexpected sort response tag: %d", resp.Tag)
 	}
-	
-	// Check SortStatus [3] IMPLICIT INTEGER { success(0), partial-1(1), failure(2) }
+
 	for _, child := range resp.Children {
-		if child.Tag == 3 {
-			status := decodeInt(child)
-			if status != 0 {
-				return fmt.Errorf("sort failed with status: %d", status)
+		if child.ClassType != ber.ClassContext || child.Tag != 3 {
+			continue
+		}
+		if status := DecodeInt(child); status != SortStatusSuccess {
+			if diag := sortResponseDiagnostic(resp); diag != nil {
+				return diag
 			}
+			return fmt.Errorf("sort failed with status: %d", status)
 		}
 	}
-
 	return nil
 }
 
-func (c *Client) DeleteResultSet(resultSetName string) error {
+// DeleteResultSet deletes the named result set on the target, or all of
+// them when resultSetName is empty.
+func (c *Client) DeleteResultSet(ctx context.Context, resultSetName string) error {
+	if err := c.requireOption(OptionDeleteResultSet, "delete"); err != nil {
+		return err
+	}
 	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 30, nil, "DeleteRequest")
-	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 32, 1, "DeleteAll"))
+	if resultSetName == "" {
+		pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 32, 1, "DeleteAll"))
+	} else {
+		pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 32, 0, "DeleteList"))
+		list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "ResultSetList")
+		list.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 31, resultSetName, "ResultSetId"))
+		pdu.AppendChild(list)
+	}
 
-	resp, err := c.sendPDU(pdu)
+	resp, err := c.sendPDU(ctx, pdu)
 	if err != nil {
 		return err
 	}
@@ -642,5 +815,12 @@ func (c *Client) DeleteResultSet(resultSetName string) error {
 	if resp.Tag != 31 {
 		return fmt.Errorf("bad delete response: %d", resp.Tag)
 	}
+	for _, child := range resp.Children {
+		if child.ClassType == ber.ClassContext && child.Tag == 0 {
+			if status := DecodeInt(child); status != 0 {
+				return fmt.Errorf("delete result set failed: status %d", status)
+			}
+		}
+	}
 	return nil
-}
\ No newline at end of file
+}
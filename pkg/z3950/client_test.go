@@ -1,10 +1,13 @@
 package z3950
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
 )
@@ -14,6 +17,12 @@ type MockServer struct {
 	listener net.Listener
 	Addr     string
 	stop     chan struct{}
+	// Charsets are those the server selects from when an Init proposes
+	// charsets; with none it does not negotiate.
+	Charsets []string
+	// Init, if set, is what the server agrees to at Init; otherwise its
+	// response leaves the parameters out.
+	Init *InitParams
 }
 
 func NewMockServer() (*MockServer, error) {
@@ -64,16 +73,53 @@ func (s *MockServer) handle(conn net.Conn) {
 		switch pkt.Tag {
 		case 20: // InitializeRequest
 			resp = ber.Encode(ber.ClassContext, ber.TypeConstructed, 21, nil, "InitializeResponse")
-			resp.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Result"))
+			if s.Init != nil {
+				resp = EncodeInitResponse(s.Init.Negotiate(ParseInitParams(pkt)), true)
+			} else {
+				resp.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Result"))
+			}
+			if proposal, ok := ParseCharsetNegotiation(pkt); ok && len(s.Charsets) > 0 {
+				var selected CharsetNegotiation
+				if cs := SelectCharset(proposal.Charsets, s.Charsets); cs != "" {
+					selected = CharsetNegotiation{Charsets: []string{cs}, RecordsInCharset: proposal.RecordsInCharset}
+				}
+				resp.AppendChild(selected.EncodeResponse())
+			}
 		
 		case 22: // SearchRequest
+			// Five hits; a medium set's records are piggybacked
+			medium := 0
+			for _, c := range pkt.Children {
+				if c.ClassType == ber.ClassContext && c.Tag == 15 {
+					medium = int(DecodeInt(c))
+				}
+			}
 			resp = ber.Encode(ber.ClassContext, ber.TypeConstructed, 23, nil, "SearchResponse")
 			resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 23, 5, "Count"))
-			resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 24, 0, "Returned"))
-			resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 25, 0, "NextPos"))
-			resp.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 26, true, "Status"))
+			resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 24, int64(medium), "Returned"))
+			resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 25, int64(medium+1), "NextPos"))
+			resp.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 22, true, "Status"))
+			if medium > 0 {
+				recordsWrapper := ber.Encode(ber.ClassContext, ber.TypeConstructed, 28, nil, "Records")
+				for i := 0; i < medium; i++ {
+					namePlusRecord := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Record")
+					dbRecord := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "DBRecord")
+					marcData := BuildMARC(&ProfileMARC21, fmt.Sprint(i+1), fmt.Sprintf("Piggybacked %d", i+1), "Mock Author", "", "", "", "", "")
+					dbRecord.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(marcData), "MARC"))
+					namePlusRecord.AppendChild(dbRecord)
+					recordsWrapper.AppendChild(namePlusRecord)
+				}
+				resp.AppendChild(recordsWrapper)
+			}
 
 		case 24: // PresentRequest
+			// Brief records leave out the publisher and subject
+			publisher, subject := "Mock Pub", "Mock Subj"
+			for _, c := range pkt.Children {
+				if c.ClassType == ber.ClassContext && c.Tag == 19 && ParseElementSetNames(c) == ElementSetBrief {
+					publisher, subject = "", ""
+				}
+			}
 			resp = ber.Encode(ber.ClassContext, ber.TypeConstructed, 25, nil, "PresentResponse")
 			// Create a dummy MARC record
 			recordsWrapper := ber.Encode(ber.ClassContext, ber.TypeConstructed, 28, nil, "Records")
@@ -83,7 +129,7 @@ func (s *MockServer) handle(conn net.Conn) {
 			dbRecord := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "DBRecord")
 			
 			// Minimal MARC
-			marcData := BuildMARC(&ProfileMARC21, "001", "Mock Title", "Mock Author", "1234567890", "Mock Pub", "2024", "", "Mock Subj")
+			marcData := BuildMARC(&ProfileMARC21, "001", "Mock Title", "Mock Author", "1234567890", publisher, "2024", "", subject)
 			octet := ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, string(marcData), "MARC")
 			
 			dbRecord.AppendChild(octet)
@@ -133,12 +179,12 @@ func TestClient_ConnectAndInit(t *testing.T) {
 	fmt.Sscanf(portStr, "%d", &port)
 
 	client := NewClient(host, port)
-	if err := client.Connect(); err != nil {
+	if err := client.Connect(t.Context()); err != nil {
 		t.Fatalf("Connect failed: %v", err)
 	}
 	defer client.Close()
 
-	if err := client.Init(); err != nil {
+	if err := client.Init(t.Context()); err != nil {
 		t.Fatalf("Init failed: %v", err)
 	}
 }
@@ -155,15 +201,15 @@ func TestClient_SearchAndPresent(t *testing.T) {
 	fmt.Sscanf(portStr, "%d", &port)
 
 	client := NewClient(host, port)
-	client.Connect()
+	client.Connect(t.Context())
 	defer client.Close()
-	client.Init()
+	client.Init(t.Context())
 
 	// Test Structured Search
 	query := StructuredQuery{
 		Root: QueryClause{Attribute: UseAttributeTitle, Term: "Mock"},
 	}
-	count, err := client.StructuredSearch("Default", query)
+	count, err := client.StructuredSearch(t.Context(), "Default", query)
 	if err != nil {
 		t.Fatalf("Search failed: %v", err)
 	}
@@ -172,7 +218,7 @@ func TestClient_SearchAndPresent(t *testing.T) {
 	}
 
 	// Test Present
-	recs, err := client.Present(1, 1, OID_MARC21)
+	recs, err := client.Present(t.Context(), 1, 1, OID_MARC21, "")
 	if err != nil {
 		t.Fatalf("Present failed: %v", err)
 	}
@@ -199,11 +245,11 @@ func TestClient_Scan(t *testing.T) {
 	fmt.Sscanf(portStr, "%d", &port)
 
 	client := NewClient(host, port)
-	client.Connect()
+	client.Connect(t.Context())
 	defer client.Close()
-	client.Init()
+	client.Init(t.Context())
 
-	results, err := client.Scan("Default", "Mock", nil)
+	results, err := client.Scan(t.Context(), "Default", "Mock", nil)
 	if err != nil {
 		t.Fatalf("Scan failed: %v", err)
 	}
@@ -215,3 +261,319 @@ func TestClient_Scan(t *testing.T) {
 		t.Errorf("Expected term 'MockTerm1', got '%s'", results[0].Term)
 	}
 }
+
+func TestClient_DeleteResultSet(t *testing.T) {
+	server, err := NewMockServer()
+	if err != nil {
+		t.Fatalf("failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	host, portStr, _ := net.SplitHostPort(server.Addr)
+	port := 0
+	fmt.Sscanf(portStr, "%d", &port)
+
+	client := NewClient(host, port)
+	client.Connect(t.Context())
+	defer client.Close()
+
+	if err := client.DeleteResultSet(t.Context(), "default"); err != nil {
+		t.Errorf("DeleteResultSet(default) failed: %v", err)
+	}
+	if err := client.DeleteResultSet(t.Context(), ""); err != nil {
+		t.Errorf("DeleteResultSet(all) failed: %v", err)
+	}
+}
+
+func TestClient_ContextAbortsHungTarget(t *testing.T) {
+	// A target that accepts the connection and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	t.Run("Deadline", func(t *testing.T) {
+		client := NewClient("127.0.0.1", port)
+		if err := client.Connect(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := client.Init(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Init error = %v, want deadline exceeded", err)
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Errorf("Init took %v", time.Since(start))
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		client := NewClient("127.0.0.1", port)
+		if err := client.Connect(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		ctx, cancel := context.WithCancel(t.Context())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		if _, err := client.Search(ctx, "Default", "x"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Search error = %v, want canceled", err)
+		}
+		// The interrupted connection is not reused
+		if err := client.Init(t.Context()); err == nil {
+			t.Error("Init succeeded on an aborted connection")
+		}
+	})
+}
+
+func TestClient_InitAuthentication(t *testing.T) {
+	// A target accepting "user"/"secret" as idPass or open "user/secret"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				pkt, err := ber.ReadPacket(conn)
+				if err != nil {
+					return
+				}
+				var auth Authentication
+				for _, c := range pkt.Children {
+					if c.ClassType == ber.ClassContext && c.Tag == 7 {
+						auth = ParseAuthentication(c)
+					}
+				}
+				ok := auth.Open == "user/secret" || (auth.UserID == "user" && auth.Password == "secret")
+				resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, 21, nil, "InitializeResponse")
+				resp.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 12, ok, "Result"))
+				conn.Write(resp.Bytes())
+			}()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		name string
+		auth Authentication
+		ok   bool
+	}{
+		{"idPass", Authentication{UserID: "user", Password: "secret"}, true},
+		{"open", Authentication{Open: "user/secret"}, true},
+		{"wrong password", Authentication{UserID: "user", Password: "guess"}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewClient("127.0.0.1", port)
+			client.Auth = tc.auth
+			if err := client.Connect(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			err := client.Init(t.Context())
+			if tc.ok && err != nil {
+				t.Errorf("Init failed: %v", err)
+			}
+			if !tc.ok && !errors.Is(err, ErrAuthentication) {
+				t.Errorf("Init error = %v, want authentication error", err)
+			}
+		})
+	}
+
+	// Without credentials a refusal is not reported as a failed login
+	client := NewClient("127.0.0.1", port)
+	if err := client.Connect(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(t.Context()); err == nil || errors.Is(err, ErrAuthentication) {
+		t.Errorf("Init without credentials = %v", err)
+	}
+}
+
+func TestClient_InitCharset(t *testing.T) {
+	tests := []struct {
+		name     string
+		charsets []string
+		want     string
+	}{
+		{"UTF-8 selected", []string{"MARC-8", "utf-8"}, "UTF-8"},
+		{"none in common", []string{"MARC-8"}, ""},
+		{"not negotiated", nil, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server, err := NewMockServer()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			server.Charsets = tc.charsets
+
+			_, portStr, _ := net.SplitHostPort(server.Addr)
+			port := 0
+			fmt.Sscanf(portStr, "%d", &port)
+			client := NewClient("127.0.0.1", port)
+			if err := client.Connect(t.Context()); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if err := client.Init(t.Context()); err != nil {
+				t.Fatalf("Init failed: %v", err)
+			}
+			if client.Charset != tc.want || client.recordCharset != tc.want {
+				t.Errorf("Charset = %q, records in %q, want %q", client.Charset, client.recordCharset, tc.want)
+			}
+			if tc.want != "" {
+				recs, err := client.Present(t.Context(), 1, 1, OID_MARC21, "")
+				if err != nil || len(recs) != 1 || recs[0].Title != "Mock Title" {
+					t.Errorf("Present = %v, %v", recs, err)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_InitNegotiation(t *testing.T) {
+	server, err := NewMockServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	server.Init = &InitParams{
+		Versions:              Bits(Version1, Version2, Version3),
+		Options:               Bits(OptionSearch, OptionPresent, OptionConcurrentOperations),
+		PreferredMessageSize:  4096,
+		ExceptionalRecordSize: 1 << 24,
+		ImplementationName:    "Mock",
+	}
+
+	_, portStr, _ := net.SplitHostPort(server.Addr)
+	port := 0
+	fmt.Sscanf(portStr, "%d", &port)
+	client := NewClient("127.0.0.1", port)
+	if err := client.Connect(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Init(t.Context()); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+
+	got := client.Negotiated
+	if got.Version() != 3 || got.Options != Bits(OptionSearch, OptionPresent) || got.ImplementationName != "Mock" {
+		t.Errorf("Negotiated = version %d, options %b, implementation %q", got.Version(), got.Options, got.ImplementationName)
+	}
+	if got.PreferredMessageSize != 4096 || got.ExceptionalRecordSize != DefaultExceptionalRecordSize {
+		t.Errorf("sizes = %d, %d", got.PreferredMessageSize, got.ExceptionalRecordSize)
+	}
+
+	// Services the target did not agree to are not requested
+	if _, err := client.Scan(t.Context(), "Default", "a", nil); !errors.Is(err, ErrNotNegotiated) {
+		t.Errorf("Scan error = %v, want ErrNotNegotiated", err)
+	}
+	if err := client.DeleteResultSet(t.Context(), "default"); !errors.Is(err, ErrNotNegotiated) {
+		t.Errorf("DeleteResultSet error = %v, want ErrNotNegotiated", err)
+	}
+	if _, err := client.Search(t.Context(), "Default", "a"); err != nil {
+		t.Errorf("Search failed: %v", err)
+	}
+
+	// Presents are sized to the agreed message size
+	if n := client.PresentCount(1024); n != 4 {
+		t.Errorf("PresentCount(1024) = %d, want 4", n)
+	}
+	if n := client.PresentCount(8192); n != 1 {
+		t.Errorf("PresentCount(8192) = %d, want 1", n)
+	}
+
+	client.Negotiated.Options = Bits(OptionPresent)
+	if _, err := client.Search(t.Context(), "Default", "a"); !errors.Is(err, ErrNotNegotiated) {
+		t.Errorf("Search error = %v, want ErrNotNegotiated", err)
+	}
+	client.Negotiated.Options = Bits(OptionSearch)
+	if _, err := client.Present(t.Context(), 1, 1, OID_MARC21, ""); !errors.Is(err, ErrNotNegotiated) {
+		t.Errorf("Present error = %v, want ErrNotNegotiated", err)
+	}
+}
+
+func TestClient_SearchPresent(t *testing.T) {
+	server, err := NewMockServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	parts := strings.Split(server.Addr, ":")
+	var port int
+	fmt.Sscanf(parts[1], "%d", &port)
+	client := NewClient(parts[0], port)
+	if err := client.Connect(t.Context()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	query := StructuredQuery{Root: QueryClause{Attribute: UseAttributeTitle, Term: "Go"}}
+	count, records, err := client.SearchPresent(t.Context(), "Default", query, 3, OID_MARC21, ElementSetFull)
+	if err != nil || count != 5 || len(records) != 3 {
+		t.Fatalf("SearchPresent = %d records of %d, %v", len(records), count, err)
+	}
+	if records[2] == nil || records[2].Title != "Piggybacked 3" {
+		t.Errorf("record 3 = %+v", records[2])
+	}
+
+	// A plain search asks for no records
+	if count, err = client.StructuredSearch(t.Context(), "Default", query); err != nil || count != 5 {
+		t.Errorf("StructuredSearch = %d, %v", count, err)
+	}
+}
+
+func TestClient_PresentElementSet(t *testing.T) {
+	server, err := NewMockServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	parts := strings.Split(server.Addr, ":")
+	var port int
+	fmt.Sscanf(parts[1], "%d", &port)
+	client := NewClient(parts[0], port)
+	if err := client.Connect(t.Context()); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	defer client.Close()
+
+	brief, err := client.Present(t.Context(), 1, 1, OID_MARC21, ElementSetBrief)
+	if err != nil || len(brief) != 1 {
+		t.Fatalf("brief Present = %d records, %v", len(brief), err)
+	}
+	if brief[0].Title != "Mock Title" || brief[0].Subject != "" {
+		t.Errorf("brief record = %q / %q", brief[0].Title, brief[0].Subject)
+	}
+	full, err := client.Present(t.Context(), 1, 1, OID_MARC21, ElementSetFull)
+	if err != nil || len(full) != 1 || full[0].Subject != "Mock Subj" {
+		t.Fatalf("full Present = %d records, %v", len(full), err)
+	}
+}
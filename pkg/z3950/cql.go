@@ -0,0 +1,954 @@
+package z3950
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CQL errors carry the SRU diagnostic (info:srw/diagnostic/1/N) that
+// describes them, so that an SRU front end can report them unchanged.
+const (
+	CQLDiagSyntax                  = 10
+	CQLDiagUnsupportedContextSet   = 15
+	CQLDiagUnsupportedIndex        = 16
+	CQLDiagUnsupportedRelation     = 19
+	CQLDiagUnsupportedRelationMod  = 20
+	CQLDiagEmptyTerm               = 27
+	CQLDiagMaskingUnsupported      = 28
+	CQLDiagAnchoringUnsupported    = 32
+	CQLDiagUnsupportedProxRelation = 40
+	CQLDiagUnsupportedProxDistance = 41
+	CQLDiagUnsupportedProxUnit     = 42
+	CQLDiagUnsupportedBooleanMod   = 46
+	CQLDiagSortUnsupported         = 80
+	CQLDiagUnsupportedSortIndex    = 88
+)
+
+// CQLError reports a query that cannot be parsed or mapped to RPN.
+type CQLError struct {
+	Code   int    // SRU diagnostic number
+	Detail string // the offending part of the query
+	Msg    string
+}
+
+func (e *CQLError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("cql: %s: %s", e.Msg, e.Detail)
+	}
+	return "cql: " + e.Msg
+}
+
+func cqlError(code int, detail, msg string) *CQLError {
+	return &CQLError{Code: code, Detail: detail, Msg: msg}
+}
+
+// defaultCQLProperties is the built-in CQL to Bib-1 mapping, in the format
+// of YAZ's cql2pqf.txt. Index names without a context set are tried in the
+// cql, dc and bath sets.
+const defaultCQLProperties = `
+set.cql  = info:srw/cql-context-set/1/cql-v1.2
+set.dc   = info:srw/cql-context-set/1/dc-v1.1
+set.bath = http://zing.z3950.org/cql/bath/2.0/
+
+index.cql.serverChoice   = 1=1016
+index.cql.anywhere       = 1=1016
+index.dc.title           = 1=4
+index.dc.creator         = 1=1003
+index.dc.author          = 1=1003
+index.dc.subject         = 1=21
+index.dc.date            = 1=31
+index.bath.author        = 1=1003
+index.bath.name          = 1=1003
+index.bath.personalName  = 1=1
+index.bath.corporateName = 1=2
+index.bath.seriesTitle   = 1=5
+index.bath.isbn          = 1=7
+index.bath.issn          = 1=8
+index.bath.subject       = 1=21
+index.year               = 1=31
+
+relation.<     = 2=1
+relation.<=    = 2=2
+relation.=     = 2=3
+relation.scr   = 2=3
+relation.>=    = 2=4
+relation.>     = 2=5
+relation.<>    = 2=6
+relation.==    = 2=3 6=3
+relation.exact = 2=3 6=3
+relation.adj   = 2=3 4=1
+relation.all   = 2=3 4=6
+relation.any   = 2=3 4=2
+
+position.first        = 3=1
+position.firstAndLast = 3=1 6=3
+
+truncation.right = 5=1
+truncation.left  = 5=2
+truncation.both  = 5=3
+`
+
+// CQLMapping maps CQL indexes, relations, relation modifiers, anchoring
+// and truncation to Bib-1 attributes, like YAZ's cql2pqf properties. Keys
+// are case-insensitive.
+type CQLMapping struct {
+	attrs map[string]map[int]int
+	names map[string]string // lower-case key -> key as written
+	sets  map[string]string // context set prefix -> URI
+	order []string          // keys in the order first loaded
+}
+
+// DefaultCQLMapping is the mapping used by ParseCQL. Load a properties
+// file into it at start-up to add or override entries.
+var DefaultCQLMapping = NewCQLMapping()
+
+// NewCQLMapping returns a mapping holding the built-in defaults.
+func NewCQLMapping() *CQLMapping {
+	m := &CQLMapping{attrs: make(map[string]map[int]int), names: make(map[string]string), sets: make(map[string]string)}
+	if err := m.Load(strings.NewReader(defaultCQLProperties)); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Load merges "key = value" lines into the mapping. Attribute entries take
+// space-separated type=value pairs ("index.local.shelfmark = 1=1007 4=1");
+// "set.<prefix> = <uri>" declares a context set. Lines starting with # are
+// comments.
+func (m *CQLMapping) Load(r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Relation names may themselves contain '=' ("relation.<= = 2=2"),
+		// so split on the first '=' surrounded by blanks, if there is one.
+		key, value, ok := strings.Cut(line, " = ")
+		if !ok {
+			key, value, ok = strings.Cut(line, "=")
+		}
+		if !ok {
+			return fmt.Errorf("cql mapping line %d: missing '='", n)
+		}
+		name := strings.TrimSpace(key)
+		key, value = strings.ToLower(name), strings.TrimSpace(value)
+		if prefix, found := strings.CutPrefix(key, "set."); found {
+			m.sets[prefix] = value
+			continue
+		}
+		attrs := make(map[int]int)
+		for _, pair := range strings.Fields(value) {
+			t, v, ok := strings.Cut(pair, "=")
+			typ, terr := strconv.Atoi(t)
+			val, verr := strconv.Atoi(v)
+			if !ok || terr != nil || verr != nil {
+				return fmt.Errorf("cql mapping line %d: invalid attribute %q", n, pair)
+			}
+			attrs[typ] = val
+		}
+		if _, exists := m.attrs[key]; !exists {
+			m.order = append(m.order, key)
+		}
+		m.attrs[key] = attrs
+		m.names[key] = name
+	}
+	return sc.Err()
+}
+
+// Indexes returns the mapped index names ("dc.title", ...), sorted.
+func (m *CQLMapping) Indexes() []string {
+	var indexes []string
+	for key, name := range m.names {
+		if strings.HasPrefix(key, "index.") {
+			indexes = append(indexes, name[len("index."):])
+		}
+	}
+	sort.Strings(indexes)
+	return indexes
+}
+
+// ContextSets returns the declared context sets as prefix -> identifier.
+func (m *CQLMapping) ContextSets() map[string]string {
+	sets := make(map[string]string, len(m.sets))
+	for prefix, uri := range m.sets {
+		sets[prefix] = uri
+	}
+	return sets
+}
+
+// ParseCQL parses a CQL query with DefaultCQLMapping.
+func ParseCQL(query string) (StructuredQuery, error) {
+	return DefaultCQLMapping.Parse(query)
+}
+
+// cqlToken is a CQL lexical token. Quoted strings are always terms; kind
+// is "sym" for ( ) / = == < > <= >= <>, otherwise "word".
+type cqlToken struct {
+	text   string
+	kind   string
+	quoted bool
+}
+
+func tokenizeCQL(s string) ([]cqlToken, error) {
+	var tokens []cqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			// Backslash escapes are kept so that term processing can tell
+			// escaped masking and anchoring characters from real ones.
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, cqlError(CQLDiagSyntax, s[i:], "unterminated quoted string")
+			}
+			tokens = append(tokens, cqlToken{text: s[i+1 : j], kind: "word", quoted: true})
+			i = j + 1
+		case strings.IndexByte("()/", c) >= 0:
+			tokens = append(tokens, cqlToken{text: string(c), kind: "sym"})
+			i++
+		case strings.IndexByte("=<>", c) >= 0:
+			op := string(c)
+			if i+1 < len(s) {
+				if two := s[i : i+2]; two == "==" || two == "<=" || two == ">=" || two == "<>" {
+					op = two
+				}
+			}
+			tokens = append(tokens, cqlToken{text: op, kind: "sym"})
+			i += len(op)
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\n\r()/=<>\"", s[j]) < 0 {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, cqlToken{text: s[i:j], kind: "word"})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// cqlParser holds the state of one Parse call. prefixes are the context
+// set prefixes assigned in the query itself.
+type cqlParser struct {
+	m        *CQLMapping
+	tokens   []cqlToken
+	pos      int
+	prefixes map[string]string
+}
+
+// cqlNamedRelations are the relations written as words.
+var cqlNamedRelations = map[string]bool{
+	"adj": true, "all": true, "any": true, "within": true, "encloses": true, "exact": true, "scr": true,
+}
+
+var cqlBooleans = map[string]string{"and": "AND", "or": "OR", "not": "AND-NOT", "prox": "PROX"}
+
+// Parse parses a CQL query into an RPN query tree, e.g.
+//
+//	title = "go" and dc.creator = pike sortby date/sort.descending
+//
+// Booleans are left-associative, as CQL requires; "any" is expanded into
+// an OR of its words. A trailing sortby clause becomes SortKeys.
+func (m *CQLMapping) Parse(query string) (StructuredQuery, error) {
+	tokens, err := tokenizeCQL(query)
+	if err != nil {
+		return StructuredQuery{}, err
+	}
+	if len(tokens) == 0 {
+		return StructuredQuery{}, cqlError(CQLDiagSyntax, "", "empty query")
+	}
+	p := &cqlParser{m: m, tokens: tokens, prefixes: make(map[string]string)}
+	root, err := p.parseQuery()
+	if err != nil {
+		return StructuredQuery{}, err
+	}
+	q := StructuredQuery{Root: root}
+	if tok, ok := p.peek(); ok && p.isWord(tok, "sortby") {
+		p.pos++
+		if q.SortKeys, err = p.parseSortKeys(); err != nil {
+			return StructuredQuery{}, err
+		}
+	}
+	if tok, ok := p.peek(); ok {
+		return StructuredQuery{}, cqlError(CQLDiagSyntax, tok.text, "unexpected token")
+	}
+	return q, nil
+}
+
+func (p *cqlParser) peek() (cqlToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return cqlToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// peekAt returns the token n places ahead, or an empty token.
+func (p *cqlParser) peekAt(n int) cqlToken {
+	if p.pos+n >= len(p.tokens) {
+		return cqlToken{}
+	}
+	return p.tokens[p.pos+n]
+}
+
+func (p *cqlParser) next(what string) (cqlToken, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return cqlToken{}, cqlError(CQLDiagSyntax, "", "missing "+what)
+	}
+	p.pos++
+	return tok, nil
+}
+
+func (p *cqlParser) isWord(tok cqlToken, word string) bool {
+	return tok.kind == "word" && !tok.quoted && strings.EqualFold(tok.text, word)
+}
+
+func (p *cqlParser) isSym(tok cqlToken, sym string) bool {
+	return tok.kind == "sym" && tok.text == sym
+}
+
+// parseQuery reads prefix assignments followed by a scoped clause.
+func (p *cqlParser) parseQuery() (QueryNode, error) {
+	for {
+		tok, ok := p.peek()
+		if !ok || !p.isSym(tok, ">") {
+			break
+		}
+		p.pos++
+		name, err := p.next("context set")
+		if err != nil {
+			return nil, err
+		}
+		prefix, uri := "", name.text
+		if p.isSym(p.peekAt(0), "=") {
+			p.pos++
+			u, err := p.next("context set identifier")
+			if err != nil {
+				return nil, err
+			}
+			prefix, uri = strings.ToLower(name.text), u.text
+		}
+		p.prefixes[prefix] = uri
+	}
+
+	left, err := p.parseSearchClause()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.quoted || tok.kind != "word" {
+			return left, nil
+		}
+		op, isBool := cqlBooleans[strings.ToLower(tok.text)]
+		if !isBool {
+			return left, nil
+		}
+		p.pos++
+		node := QueryComplex{Operator: op, Left: left}
+		mods, err := p.parseModifiers()
+		if err != nil {
+			return nil, err
+		}
+		if op == "PROX" {
+			if node.Proximity, err = cqlProximity(mods); err != nil {
+				return nil, err
+			}
+		} else if len(mods) > 0 {
+			return nil, cqlError(CQLDiagUnsupportedBooleanMod, mods[0].name, "unsupported boolean modifier")
+		}
+		if node.Right, err = p.parseSearchClause(); err != nil {
+			return nil, err
+		}
+		left = node
+	}
+}
+
+// cqlModifier is a "/name", "/name=value" or "/name<=value" modifier.
+type cqlModifier struct {
+	name, comparitor, value string
+}
+
+func (p *cqlParser) parseModifiers() ([]cqlModifier, error) {
+	var mods []cqlModifier
+	for {
+		tok, ok := p.peek()
+		if !ok || !p.isSym(tok, "/") {
+			return mods, nil
+		}
+		p.pos++
+		name, err := p.next("modifier")
+		if err != nil {
+			return nil, err
+		}
+		mod := cqlModifier{name: strings.ToLower(name.text)}
+		if cmp := p.peekAt(0); cmp.kind == "sym" && strings.ContainsAny(cmp.text, "=<>") {
+			p.pos++
+			value, err := p.next("modifier value")
+			if err != nil {
+				return nil, err
+			}
+			mod.comparitor, mod.value = cmp.text, value.text
+		}
+		mods = append(mods, mod)
+	}
+}
+
+// cqlProximity maps prox modifiers (distance, unit, ordered, unordered)
+// to a ProximityOperator. The default is within one word, in any order.
+func cqlProximity(mods []cqlModifier) (*ProximityOperator, error) {
+	prox := &ProximityOperator{Distance: 1, Relation: RelationLessEqual, Unit: ProxUnitWord}
+	relations := map[string]int{"<": RelationLess, "<=": RelationLessEqual, "=": RelationEqual, ">=": RelationGreaterEqual, ">": RelationGreater, "<>": RelationNotEqual}
+	units := map[string]int{"character": ProxUnitCharacter, "word": ProxUnitWord, "sentence": ProxUnitSentence, "paragraph": ProxUnitParagraph, "element": ProxUnitElement}
+	for _, mod := range mods {
+		switch strings.TrimPrefix(mod.name, "prox.") {
+		case "distance":
+			rel, ok := relations[mod.comparitor]
+			if !ok {
+				return nil, cqlError(CQLDiagUnsupportedProxRelation, mod.comparitor, "unsupported proximity relation")
+			}
+			d, err := strconv.Atoi(mod.value)
+			if err != nil || d < 0 {
+				return nil, cqlError(CQLDiagUnsupportedProxDistance, mod.value, "unsupported proximity distance")
+			}
+			prox.Relation, prox.Distance = rel, d
+		case "unit":
+			unit, ok := units[strings.ToLower(mod.value)]
+			if !ok || mod.comparitor != "=" {
+				return nil, cqlError(CQLDiagUnsupportedProxUnit, mod.value, "unsupported proximity unit")
+			}
+			prox.Unit = unit
+		case "ordered":
+			prox.Ordered = true
+		case "unordered":
+			prox.Ordered = false
+		default:
+			return nil, cqlError(CQLDiagUnsupportedBooleanMod, mod.name, "unsupported proximity modifier")
+		}
+	}
+	return prox, nil
+}
+
+// parseSearchClause reads "( query )", "index relation term" or "term".
+func (p *cqlParser) parseSearchClause() (QueryNode, error) {
+	tok, err := p.next("search clause")
+	if err != nil {
+		return nil, err
+	}
+	if p.isSym(tok, "(") {
+		node, err := p.parseQuery()
+		if err != nil {
+			return nil, err
+		}
+		if closing, err := p.next("')'"); err != nil || !p.isSym(closing, ")") {
+			return nil, cqlError(CQLDiagSyntax, closing.text, "expected ')'")
+		}
+		return node, nil
+	}
+	if tok.kind != "word" {
+		return nil, cqlError(CQLDiagSyntax, tok.text, "expected a search term")
+	}
+
+	// An index is followed by a symbolic relation, or by a named one that
+	// is itself followed by a term.
+	index, relation := "cql.serverChoice", "="
+	var mods []cqlModifier
+	next := p.peekAt(0)
+	symbolic := next.kind == "sym" && strings.ContainsAny(next.text, "=<>")
+	named := p.isNamedRelation(next) && p.peekAt(1).kind == "word" || p.isNamedRelation(next) && p.isSym(p.peekAt(1), "/")
+	if !tok.quoted && (symbolic || named) {
+		index, relation = tok.text, strings.ToLower(next.text)
+		p.pos++
+		if mods, err = p.parseModifiers(); err != nil {
+			return nil, err
+		}
+		if tok, err = p.next("search term"); err != nil {
+			return nil, err
+		}
+		if tok.kind != "word" {
+			return nil, cqlError(CQLDiagSyntax, tok.text, "expected a search term")
+		}
+	}
+	return p.clause(index, relation, mods, tok.text)
+}
+
+func (p *cqlParser) isNamedRelation(tok cqlToken) bool {
+	return tok.kind == "word" && !tok.quoted && cqlNamedRelations[strings.ToLower(tok.text)]
+}
+
+// indexAttributes resolves an index name, expanding a prefix assigned in
+// the query to the context set it names.
+func (p *cqlParser) indexAttributes(index string) (map[int]int, error) {
+	name := strings.ToLower(index)
+	prefix, base, qualified := strings.Cut(name, ".")
+	if !qualified {
+		if uri, ok := p.prefixes[""]; ok {
+			for set, known := range p.m.sets {
+				if known == uri {
+					name = set + "." + name
+				}
+			}
+		}
+	} else if uri, ok := p.prefixes[prefix]; ok {
+		resolved := ""
+		for set, known := range p.m.sets {
+			if known == uri {
+				resolved = set
+			}
+		}
+		if resolved == "" {
+			return nil, cqlError(CQLDiagUnsupportedContextSet, uri, "unsupported context set")
+		}
+		name = resolved + "." + base
+	}
+
+	candidates := []string{name}
+	if !strings.Contains(name, ".") {
+		candidates = append(candidates, "cql."+name, "dc."+name, "bath."+name)
+	}
+	for _, c := range candidates {
+		if attrs, ok := p.m.attrs["index."+c]; ok {
+			return attrs, nil
+		}
+	}
+	return nil, cqlError(CQLDiagUnsupportedIndex, index, "unsupported index")
+}
+
+// clause maps one "index relation term" to a query clause, or to an OR of
+// clauses for the "any" relation.
+func (p *cqlParser) clause(index, relation string, mods []cqlModifier, raw string) (QueryNode, error) {
+	var c QueryClause
+	apply := func(attrs map[int]int) {
+		for typ, val := range attrs {
+			c.SetAttribute(typ, val)
+		}
+	}
+
+	indexAttrs, err := p.indexAttributes(index)
+	if err != nil {
+		return nil, err
+	}
+	apply(p.m.attrs["always"])
+	apply(indexAttrs)
+
+	relAttrs, ok := p.m.attrs["relation."+relation]
+	if !ok {
+		return nil, cqlError(CQLDiagUnsupportedRelation, relation, "unsupported relation")
+	}
+	apply(relAttrs)
+	for _, mod := range mods {
+		attrs, ok := p.m.attrs["relationmodifier."+mod.name]
+		if !ok {
+			return nil, cqlError(CQLDiagUnsupportedRelationMod, mod.name, "unsupported relation modifier")
+		}
+		apply(attrs)
+	}
+
+	term, anchors, truncation, err := cqlTerm(raw)
+	if err != nil {
+		return nil, err
+	}
+	if anchors != "" {
+		attrs, ok := p.m.attrs["position."+anchors]
+		if !ok {
+			return nil, cqlError(CQLDiagAnchoringUnsupported, raw, "unsupported anchoring")
+		}
+		apply(attrs)
+	}
+	if truncation != "" {
+		attrs, ok := p.m.attrs["truncation."+truncation]
+		if !ok {
+			return nil, cqlError(CQLDiagMaskingUnsupported, raw, "unsupported truncation")
+		}
+		apply(attrs)
+	}
+	if term == "" && c.Attribute != 0 {
+		return nil, cqlError(CQLDiagEmptyTerm, index, "empty term")
+	}
+
+	if relation != "any" {
+		c.Term = term
+		return c, nil
+	}
+	var node QueryNode
+	for _, w := range strings.Fields(term) {
+		word := c
+		word.Term = w
+		if node == nil {
+			node = word
+		} else {
+			node = QueryComplex{Operator: "OR", Left: node, Right: word}
+		}
+	}
+	if node == nil {
+		return nil, cqlError(CQLDiagEmptyTerm, index, "empty term")
+	}
+	return node, nil
+}
+
+// cqlTerm strips anchoring (^) and truncation (*) from a raw term and
+// resolves backslash escapes. anchors is "", "first", "last" or
+// "firstAndLast"; truncation is "", "left", "right" or "both". Masking
+// inside the term (* or ?) is not supported.
+func cqlTerm(raw string) (term, anchors, truncation string, err error) {
+	var b strings.Builder
+	var special []int // positions in the output of unescaped * ? ^
+	var specialChars []byte
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c == '\\' && i+1 < len(raw) {
+			i++
+			b.WriteByte(raw[i])
+			continue
+		}
+		if c == '*' || c == '?' || c == '^' {
+			special = append(special, b.Len())
+			specialChars = append(specialChars, c)
+		}
+		b.WriteByte(c)
+	}
+	s := b.String()
+
+	first, last := 0, len(s)
+	take := func(at int, want byte) bool {
+		for k, pos := range special {
+			if pos == at && specialChars[k] == want && first <= at && at < last {
+				specialChars[k] = 0
+				return true
+			}
+		}
+		return false
+	}
+	anchorFirst := take(first, '^')
+	if anchorFirst {
+		first++
+	}
+	anchorLast := last > first && take(last-1, '^')
+	if anchorLast {
+		last--
+	}
+	left := last > first && take(first, '*')
+	if left {
+		first++
+	}
+	right := last > first && take(last-1, '*')
+	if right {
+		last--
+	}
+	for k, c := range specialChars {
+		if c != 0 && special[k] >= first && special[k] < last {
+			return "", "", "", cqlError(CQLDiagMaskingUnsupported, raw, "masking characters inside a term are not supported")
+		}
+	}
+
+	switch {
+	case anchorFirst && anchorLast:
+		anchors = "firstandlast"
+	case anchorFirst:
+		anchors = "first"
+	case anchorLast:
+		anchors = "last"
+	}
+	switch {
+	case left && right:
+		truncation = "both"
+	case left:
+		truncation = "left"
+	case right:
+		truncation = "right"
+	}
+	return s[first:last], anchors, truncation, nil
+}
+
+// parseSortKeys reads "index[/modifiers] ..." after sortby.
+func (p *cqlParser) parseSortKeys() ([]SortKey, error) {
+	var keys []SortKey
+	for {
+		tok, ok := p.peek()
+		if !ok || tok.kind != "word" {
+			break
+		}
+		p.pos++
+		attrs, err := p.indexAttributes(tok.text)
+		if err != nil {
+			return nil, cqlError(CQLDiagUnsupportedSortIndex, tok.text, "unsupported sort index")
+		}
+		key := SortKey{Attribute: attrs[AttributeTypeUse]}
+		mods, err := p.parseModifiers()
+		if err != nil {
+			return nil, err
+		}
+		for _, mod := range mods {
+			switch strings.TrimPrefix(mod.name, "sort.") {
+			case "ascending":
+				key.Relation = 0
+			case "descending":
+				key.Relation = 1
+			case "ignorecase", "respectcase", "missinglow", "missinghigh", "missingomit":
+			default:
+				return nil, cqlError(CQLDiagSortUnsupported, mod.name, "unsupported sort modifier")
+			}
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, cqlError(CQLDiagSyntax, "sortby", "missing sort key")
+	}
+	return keys, nil
+}
+
+// FormatCQL renders a query as CQL with DefaultCQLMapping.
+func FormatCQL(q StructuredQuery) (string, error) {
+	return DefaultCQLMapping.Format(q)
+}
+
+// Format renders a query as CQL, the inverse of Parse. Attributes are
+// mapped back through the table as YAZ's rpn2cql does: for each clause the
+// most specific index, relation, anchoring and truncation entries whose
+// attributes it carries are chosen, the one listed first winning a tie.
+// Attributes no entry accounts for yield the Bib-1 diagnostic a Z39.50
+// target would have returned.
+func (m *CQLMapping) Format(q StructuredQuery) (string, error) {
+	if q.AttributeSet != "" && q.AttributeSet != OID_Bib1 {
+		return "", NewDiagnostic(DiagUnsupportedAttributeSet, q.AttributeSet)
+	}
+	var b strings.Builder
+	if err := m.formatNode(&b, q.Root); err != nil {
+		return "", err
+	}
+	if len(q.SortKeys) > 0 {
+		b.WriteString(" sortby")
+		for _, key := range q.SortKeys {
+			index, _ := m.bestMatch("index.", map[int]int{AttributeTypeUse: key.Attribute}, AttributeTypeUse)
+			if index == "" {
+				return "", NewDiagnostic(DiagUnsupportedUseAttribute, strconv.Itoa(key.Attribute))
+			}
+			b.WriteString(" " + index)
+			if key.Relation == 1 {
+				b.WriteString("/sort.descending")
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func (m *CQLMapping) formatNode(b *strings.Builder, node QueryNode) error {
+	switch n := node.(type) {
+	case QueryClause:
+		return m.formatClause(b, n)
+	case QueryComplex:
+		if err := m.formatOperand(b, n.Left); err != nil {
+			return err
+		}
+		switch n.Operator {
+		case "OR":
+			b.WriteString(" or ")
+		case "AND-NOT":
+			b.WriteString(" not ")
+		case "PROX":
+			mods, err := formatCQLProximity(n.Proximity)
+			if err != nil {
+				return err
+			}
+			b.WriteString(" prox" + mods + " ")
+		default:
+			b.WriteString(" and ")
+		}
+		return m.formatOperand(b, n.Right)
+	}
+	return NewDiagnostic(DiagMalformedQuery, "empty query")
+}
+
+// formatOperand parenthesises nested booleans so that CQL's left
+// associativity cannot regroup them.
+func (m *CQLMapping) formatOperand(b *strings.Builder, node QueryNode) error {
+	if _, nested := node.(QueryComplex); !nested {
+		return m.formatNode(b, node)
+	}
+	b.WriteByte('(')
+	if err := m.formatNode(b, node); err != nil {
+		return err
+	}
+	b.WriteByte(')')
+	return nil
+}
+
+func formatCQLProximity(prox *ProximityOperator) (string, error) {
+	if prox == nil {
+		return "", nil
+	}
+	if prox.Exclusion {
+		return "", NewDiagnostic(DiagUnsupportedProxRelation, "exclusion")
+	}
+	relations := map[int]string{RelationLess: "<", RelationLessEqual: "<=", RelationEqual: "=", RelationGreaterEqual: ">=", RelationGreater: ">", RelationNotEqual: "<>"}
+	units := map[int]string{ProxUnitCharacter: "character", ProxUnitWord: "word", ProxUnitSentence: "sentence", ProxUnitParagraph: "paragraph", ProxUnitElement: "element"}
+	rel, ok := relations[prox.Relation]
+	if !ok {
+		return "", NewDiagnostic(DiagUnsupportedProxRelation, strconv.Itoa(prox.Relation))
+	}
+	unit, ok := units[prox.Unit]
+	if !ok {
+		return "", NewDiagnostic(DiagUnsupportedProxUnit, strconv.Itoa(prox.Unit))
+	}
+	mods := fmt.Sprintf("/distance%s%d/unit=%s", rel, prox.Distance, unit)
+	if prox.Ordered {
+		mods += "/ordered"
+	}
+	return mods, nil
+}
+
+func (m *CQLMapping) formatClause(b *strings.Builder, c QueryClause) error {
+	if c.AttributeSet != "" && c.AttributeSet != OID_Bib1 {
+		return NewDiagnostic(DiagUnsupportedAttributeSet, c.AttributeSet)
+	}
+	attrs := c.Attributes()
+	if attrs[AttributeTypeUse] == 0 {
+		attrs[AttributeTypeUse] = UseAttributeAny
+	}
+	if attrs[AttributeTypeRelation] == 0 {
+		attrs[AttributeTypeRelation] = RelationEqual
+	}
+	// Values that merely restate the default behaviour need no mapping.
+	if attrs[AttributeTypePosition] == PositionAny {
+		delete(attrs, AttributeTypePosition)
+	}
+	if attrs[AttributeTypeTruncation] == TruncationNone {
+		delete(attrs, AttributeTypeTruncation)
+	}
+	if attrs[AttributeTypeCompleteness] == CompletenessIncompleteSubfield {
+		delete(attrs, AttributeTypeCompleteness)
+	}
+
+	index, used := m.bestMatch("index.", attrs, AttributeTypeUse)
+	if index == "" {
+		return NewDiagnostic(DiagUnsupportedUseAttribute, strconv.Itoa(attrs[AttributeTypeUse]))
+	}
+	consume(attrs, used)
+	relation, used := m.bestMatch("relation.", attrs, AttributeTypeRelation)
+	if relation == "" {
+		// Relations such as stem are written as modifiers of "=".
+		if mod, modUsed := m.bestMatch("relationmodifier.", attrs, AttributeTypeRelation); mod != "" {
+			relation, used = "=/"+mod, modUsed
+		}
+	}
+	if relation == "" {
+		return NewDiagnostic(DiagUnsupportedRelation, strconv.Itoa(attrs[AttributeTypeRelation]))
+	}
+	consume(attrs, used)
+	anchors := ""
+	if _, ok := attrs[AttributeTypePosition]; ok {
+		if anchors, used = m.bestMatch("position.", attrs, AttributeTypePosition); anchors == "" {
+			return NewDiagnostic(DiagUnsupportedPosition, strconv.Itoa(attrs[AttributeTypePosition]))
+		}
+		consume(attrs, used)
+	}
+	truncation := ""
+	if _, ok := attrs[AttributeTypeTruncation]; ok {
+		if truncation, used = m.bestMatch("truncation.", attrs, AttributeTypeTruncation); truncation == "" {
+			return NewDiagnostic(DiagUnsupportedTruncation, strconv.Itoa(attrs[AttributeTypeTruncation]))
+		}
+		consume(attrs, used)
+	}
+	if val, ok := attrs[AttributeTypeCompleteness]; ok {
+		return NewDiagnostic(DiagUnsupportedCompleteness, strconv.Itoa(val))
+	}
+	// Any remaining structure attribute only restates what the index
+	// already implies (word, phrase, year...), so it is dropped.
+
+	term := cqlEscape(c.Term)
+	switch strings.ToLower(truncation) {
+	case "left":
+		term = "*" + term
+	case "right":
+		term = term + "*"
+	case "both":
+		term = "*" + term + "*"
+	}
+	switch strings.ToLower(anchors) {
+	case "first":
+		term = "^" + term
+	case "last":
+		term = term + "^"
+	case "firstandlast":
+		term = "^" + term + "^"
+	}
+	term = cqlQuote(term)
+
+	if strings.EqualFold(index, "cql.serverChoice") && relation == "=" {
+		b.WriteString(term)
+		return nil
+	}
+	b.WriteString(index + " " + relation + " " + term)
+	return nil
+}
+
+// bestMatch finds the most specific entry under prefix that sets attribute
+// type want and whose attributes all appear in attrs. It returns the entry
+// name without the prefix and the attributes it accounts for.
+func (m *CQLMapping) bestMatch(prefix string, attrs map[int]int, want int) (string, map[int]int) {
+	best, bestAttrs := "", map[int]int(nil)
+	for _, key := range m.order {
+		entry := m.attrs[key]
+		if !strings.HasPrefix(key, prefix) || len(entry) <= len(bestAttrs) {
+			continue
+		}
+		if _, ok := entry[want]; !ok {
+			continue
+		}
+		matches := true
+		for typ, val := range entry {
+			if attrs[typ] != val {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			best, bestAttrs = m.names[key][len(prefix):], entry
+		}
+	}
+	return best, bestAttrs
+}
+
+func consume(attrs, used map[int]int) {
+	for typ := range used {
+		delete(attrs, typ)
+	}
+}
+
+// cqlEscape escapes the characters that CQL would read as masking,
+// anchoring or the end of a quoted string.
+func cqlEscape(term string) string {
+	var b strings.Builder
+	for _, r := range term {
+		if strings.ContainsRune(`\"*?^`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// cqlQuote quotes a term unless it reads back as a single bare word.
+func cqlQuote(term string) string {
+	_, keyword := cqlBooleans[strings.ToLower(term)]
+	if term != "" && !keyword && !cqlNamedRelations[strings.ToLower(term)] && !strings.EqualFold(term, "sortby") &&
+		!strings.ContainsAny(term, " \t\r\n()/=<>\"") {
+		return term
+	}
+	return `"` + term + `"`
+}
@@ -0,0 +1,238 @@
+package z3950
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCQL(t *testing.T) {
+	title := func(term string) QueryClause {
+		return QueryClause{Attribute: UseAttributeTitle, Relation: RelationEqual, Term: term}
+	}
+	testCases := []struct {
+		name  string
+		cql   string
+		query StructuredQuery
+	}{
+		{
+			name:  "Bare term uses server choice",
+			cql:   "dinosaur",
+			query: StructuredQuery{Root: QueryClause{Attribute: UseAttributeAny, Relation: RelationEqual, Term: "dinosaur"}},
+		},
+		{
+			name: "Boolean with context sets",
+			cql:  `title="go" and dc.creator=pike`,
+			query: StructuredQuery{Root: QueryComplex{
+				Operator: "AND",
+				Left:     title("go"),
+				Right:    QueryClause{Attribute: UseAttributeAuthor, Relation: RelationEqual, Term: "pike"},
+			}},
+		},
+		{
+			name: "Left associative with parentheses",
+			cql:  `title=a or (title=b not title=c)`,
+			query: StructuredQuery{Root: QueryComplex{
+				Operator: "OR",
+				Left:     title("a"),
+				Right:    QueryComplex{Operator: "AND-NOT", Left: title("b"), Right: title("c")},
+			}},
+		},
+		{
+			name:  "Truncation and anchoring",
+			cql:   `title = "^go prog*"`,
+			query: StructuredQuery{Root: QueryClause{Attribute: UseAttributeTitle, Relation: RelationEqual, Position: PositionFirstInField, Truncation: TruncationRight, Term: "go prog"}},
+		},
+		{
+			name:  "Escaped star is literal",
+			cql:   `title = "c\*"`,
+			query: StructuredQuery{Root: title("c*")},
+		},
+		{
+			name:  "Date relation",
+			cql:   `dc.date >= 2001`,
+			query: StructuredQuery{Root: QueryClause{Attribute: UseAttributeDatePub, Relation: RelationGreaterEqual, Term: "2001"}},
+		},
+		{
+			name:  "Exact",
+			cql:   `title exact "thinking in go"`,
+			query: StructuredQuery{Root: QueryClause{Attribute: UseAttributeTitle, Relation: RelationEqual, Completeness: CompletenessCompleteField, Term: "thinking in go"}},
+		},
+		{
+			name: "Any expands to OR",
+			cql:  `subject any "go rust"`,
+			query: StructuredQuery{Root: QueryComplex{
+				Operator: "OR",
+				Left:     QueryClause{Attribute: UseAttributeSubject, Relation: RelationEqual, Structure: StructureWord, Term: "go"},
+				Right:    QueryClause{Attribute: UseAttributeSubject, Relation: RelationEqual, Structure: StructureWord, Term: "rust"},
+			}},
+		},
+		{
+			name: "Proximity",
+			cql:  `title=a prox/unit=word/distance<=3/ordered title=b`,
+			query: StructuredQuery{Root: QueryComplex{
+				Operator:  "PROX",
+				Left:      title("a"),
+				Right:     title("b"),
+				Proximity: &ProximityOperator{Distance: 3, Ordered: true, Relation: RelationLessEqual, Unit: ProxUnitWord},
+			}},
+		},
+		{
+			name:  "Prefix assignment",
+			cql:   `> x = "info:srw/cql-context-set/1/dc-v1.1" x.title = go`,
+			query: StructuredQuery{Root: title("go")},
+		},
+		{
+			name:  "Sortby",
+			cql:   `title=go sortby dc.date/sort.descending title`,
+			query: StructuredQuery{Root: title("go"), SortKeys: []SortKey{{Attribute: UseAttributeDatePub, Relation: 1}, {Attribute: UseAttributeTitle}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseCQL(tc.cql)
+			if err != nil {
+				t.Fatalf("ParseCQL(%q) failed: %v", tc.cql, err)
+			}
+			if !reflect.DeepEqual(got, tc.query) {
+				t.Errorf("ParseCQL(%q) =\n%+v\nwant\n%+v", tc.cql, got, tc.query)
+			}
+		})
+	}
+}
+
+func TestParseCQLErrors(t *testing.T) {
+	testCases := []struct {
+		cql  string
+		code int
+	}{
+		{"", CQLDiagSyntax},
+		{`title = "open`, CQLDiagSyntax},
+		{"(title = go", CQLDiagSyntax},
+		{"title = go and", CQLDiagSyntax},
+		{"shelfmark = QA76", CQLDiagUnsupportedIndex},
+		{"title within go", CQLDiagUnsupportedRelation},
+		{"title =/stem go", CQLDiagUnsupportedRelationMod},
+		{"title = g?o", CQLDiagMaskingUnsupported},
+		{"title = go^", CQLDiagAnchoringUnsupported},
+		{"a prox/unit=chapter b", CQLDiagUnsupportedProxUnit},
+		{"a and/fuzzy b", CQLDiagUnsupportedBooleanMod},
+		{`> x = "urn:nothing" x.title = go`, CQLDiagUnsupportedContextSet},
+		{"go sortby shelfmark", CQLDiagUnsupportedSortIndex},
+	}
+	for _, tc := range testCases {
+		_, err := ParseCQL(tc.cql)
+		var cqlErr *CQLError
+		if !errors.As(err, &cqlErr) || cqlErr.Code != tc.code {
+			t.Errorf("ParseCQL(%q) error = %v, want diagnostic %d", tc.cql, err, tc.code)
+		}
+	}
+}
+
+func TestCQLMappingLoad(t *testing.T) {
+	m := NewCQLMapping()
+	props := "# local indexes\nindex.local.shelfmark = 1=1007 4=1\nrelationModifier.stem = 2=101\n"
+	if err := m.Load(strings.NewReader(props)); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	q, err := m.Parse("local.shelfmark =/stem QA76")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := QueryClause{Attribute: 1007, Relation: 101, Structure: StructurePhrase, Term: "QA76"}
+	if !reflect.DeepEqual(q.Root, want) {
+		t.Errorf("Root = %+v, want %+v", q.Root, want)
+	}
+	// The default mapping is untouched.
+	if _, err := ParseCQL("local.shelfmark = QA76"); err == nil {
+		t.Error("DefaultCQLMapping picked up a private mapping")
+	}
+	if err := m.Load(strings.NewReader("index.bad = 1=x\n")); err == nil {
+		t.Error("Load accepted an invalid attribute")
+	}
+}
+
+func TestFormatCQL(t *testing.T) {
+	testCases := []struct {
+		name  string
+		query StructuredQuery
+		cql   string
+	}{
+		{
+			name:  "Bare term for any",
+			query: StructuredQuery{Root: QueryClause{Attribute: UseAttributeAny, Term: "dinosaur"}},
+			cql:   "dinosaur",
+		},
+		{
+			name: "Boolean tree keeps its grouping",
+			query: StructuredQuery{Root: QueryComplex{
+				Operator: "AND",
+				Left:     QueryClause{Attribute: UseAttributeTitle, Term: "go programming"},
+				Right: QueryComplex{
+					Operator: "AND-NOT",
+					Left:     QueryClause{Attribute: UseAttributeAuthor, Term: "pike"},
+					Right:    QueryClause{Attribute: UseAttributeISBN, Term: "123"},
+				},
+			}},
+			cql: `dc.title = "go programming" and (dc.creator = pike not bath.isbn = 123)`,
+		},
+		{
+			name:  "Relation, anchoring and truncation",
+			query: StructuredQuery{Root: QueryClause{Attribute: UseAttributeTitle, Relation: RelationEqual, Structure: StructurePhrase, Position: PositionFirstInField, Truncation: TruncationRight, Term: "art of"}},
+			cql:   `dc.title adj "^art of*"`,
+		},
+		{
+			name:  "Date range and escaping",
+			query: StructuredQuery{Root: QueryClause{Attribute: UseAttributeDatePub, Relation: RelationGreaterEqual, Term: `20*"x"`}},
+			cql:   `dc.date >= "20\*\"x\""`,
+		},
+		{
+			name: "Proximity and sort",
+			query: StructuredQuery{
+				Root: QueryComplex{
+					Operator:  "PROX",
+					Left:      QueryClause{Term: "a"},
+					Right:     QueryClause{Term: "b"},
+					Proximity: &ProximityOperator{Distance: 2, Relation: RelationLessEqual, Unit: ProxUnitWord, Ordered: true},
+				},
+				SortKeys: []SortKey{{Attribute: UseAttributeTitle, Relation: 1}},
+			},
+			cql: "a prox/distance<=2/unit=word/ordered b sortby dc.title/sort.descending",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := FormatCQL(tc.query)
+			if err != nil {
+				t.Fatalf("FormatCQL failed: %v", err)
+			}
+			if got != tc.cql {
+				t.Errorf("FormatCQL = %s, want %s", got, tc.cql)
+			}
+			if _, err := ParseCQL(got); err != nil {
+				t.Errorf("ParseCQL(%s) failed: %v", got, err)
+			}
+		})
+	}
+
+	m := NewCQLMapping()
+	if err := m.Load(strings.NewReader("relationModifier.stem = 2=101\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := m.Format(StructuredQuery{Root: QueryClause{Attribute: UseAttributeTitle, Relation: 101, Term: "run"}}); err != nil || got != "dc.title =/stem run" {
+		t.Errorf("Format with relation modifier = %q, %v", got, err)
+	}
+
+	for _, q := range []QueryClause{
+		{Attribute: 9999, Term: "x"},
+		{Attribute: UseAttributeTitle, Relation: 102, Term: "x"},
+		{Attribute: UseAttributeTitle, Truncation: 101, Term: "x"},
+	} {
+		var diag *Diagnostic
+		if _, err := FormatCQL(StructuredQuery{Root: q}); !errors.As(err, &diag) {
+			t.Errorf("FormatCQL(%+v) error = %v, want a diagnostic", q, err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package z3950
+
+import (
+	"fmt"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// OID_Bib1Diag identifies the Bib-1 diagnostic set.
+const OID_Bib1Diag = "1.2.840.10003.4.1"
+
+// Bib-1 diagnostic conditions.
+const (
+	DiagPermanentSystemError     = 1
+	DiagTemporarySystemError     = 2
+	DiagUnsupportedSearch        = 3
+	DiagPresentOutOfRange        = 13
+	DiagRecordExceedsMessageSize = 16
+	DiagRecordExceedsRecordSize  = 17
+	DiagResultSetExists          = 21
+	DiagNamedSetsUnsupported     = 22
+	DiagElementSetInvalid        = 25
+	DiagResultSetNotFound        = 30
+	DiagQueryTypeUnsupported     = 107
+	DiagMalformedQuery           = 108
+	DiagTooManyResultSets        = 112
+	DiagUnsupportedAttributeType = 113
+	DiagUnsupportedUseAttribute  = 114
+	DiagUnsupportedRelation      = 117
+	DiagUnsupportedStructure     = 118
+	DiagUnsupportedPosition      = 119
+	DiagUnsupportedTruncation    = 120
+	DiagUnsupportedAttributeSet  = 121
+	DiagUnsupportedCompleteness  = 122
+	DiagProximityOfSets          = 129
+	DiagUnsupportedProxRelation  = 131
+	DiagUnsupportedProxUnit      = 132
+	DiagSortSequenceUnsupported  = 207
+	DiagSortNoResultSet          = 208
+	DiagSortRelationIllegal      = 214
+	DiagSortTooManyInputs        = 230
+	DiagDatabaseNotFound         = 235
+	DiagDatabaseAccessDenied     = 236
+	DiagRecordSyntaxUnsupported  = 239
+)
+
+var diagMessages = map[int]string{
+	DiagPermanentSystemError:     "Permanent system error",
+	DiagTemporarySystemError:     "Temporary system error",
+	DiagUnsupportedSearch:        "Unsupported search",
+	DiagPresentOutOfRange:        "Present request out of range",
+	DiagRecordExceedsMessageSize: "Record exceeds Preferred-message-size",
+	DiagRecordExceedsRecordSize:  "Record exceeds Exceptional-record-size",
+	DiagResultSetExists:          "Result set exists and replace indicator off",
+	DiagNamedSetsUnsupported:     "Result set naming not supported",
+	DiagElementSetInvalid:        "Specified element set name not valid for specified database",
+	DiagResultSetNotFound:        "Specified result set does not exist",
+	DiagQueryTypeUnsupported:     "Query type not supported",
+	DiagMalformedQuery:           "Malformed query",
+	DiagTooManyResultSets:        "Too many result sets created",
+	DiagUnsupportedAttributeType: "Unsupported attribute type",
+	DiagUnsupportedUseAttribute:  "Unsupported use attribute",
+	DiagUnsupportedRelation:      "Unsupported relation attribute",
+	DiagUnsupportedStructure:     "Unsupported structure attribute",
+	DiagUnsupportedPosition:      "Unsupported position attribute",
+	DiagUnsupportedTruncation:    "Unsupported truncation attribute",
+	DiagUnsupportedAttributeSet:  "Unsupported attribute set",
+	DiagUnsupportedCompleteness:  "Unsupported completeness attribute",
+	DiagProximityOfSets:          "Proximity search of sets not supported",
+	DiagUnsupportedProxRelation:  "Unsupported proximity relation",
+	DiagUnsupportedProxUnit:      "Unsupported proximity unit code",
+	DiagSortSequenceUnsupported:  "Cannot sort according to sequence",
+	DiagSortNoResultSet:          "No result set name supplied on Sort",
+	DiagSortRelationIllegal:      "Illegal sort relation",
+	DiagSortTooManyInputs:        "Sort: too many input results",
+	DiagDatabaseNotFound:         "Database does not exist",
+	DiagDatabaseAccessDenied:     "Access to specified database denied",
+	DiagRecordSyntaxUnsupported:  "Record syntax not supported",
+}
+
+// DiagnosticMessage returns the Bib-1 description of a diagnostic code.
+func DiagnosticMessage(code int) string {
+	if msg, ok := diagMessages[code]; ok {
+		return msg
+	}
+	return "Unknown diagnostic"
+}
+
+// Diagnostic is a Bib-1 diagnostic condition with optional additional
+// information. It is used as an error both by the server, which encodes it
+// into responses, and by the client, which returns the ones a target sends.
+type Diagnostic struct {
+	Code    int
+	AddInfo string
+}
+
+// NewDiagnostic returns a diagnostic for code with addinfo.
+func NewDiagnostic(code int, addinfo string) *Diagnostic {
+	return &Diagnostic{Code: code, AddInfo: addinfo}
+}
+
+func (d *Diagnostic) Error() string {
+	if d.AddInfo != "" {
+		return fmt.Sprintf("%s: %s (diagnostic %d)", DiagnosticMessage(d.Code), d.AddInfo, d.Code)
+	}
+	return fmt.Sprintf("%s (diagnostic %d)", DiagnosticMessage(d.Code), d.Code)
+}
+
+// Encode builds a DefaultDiagFormat with the given context tag, e.g. 130
+// for a nonSurrogateDiagnostic in Search and Present responses. Pass
+// ber.TagSequence to get the untagged form used inside a DiagRec list.
+func (d *Diagnostic) Encode(tag ber.Tag) *ber.Packet {
+	class := ber.ClassContext
+	if tag == ber.TagSequence {
+		class = ber.ClassUniversal
+	}
+	p := ber.Encode(class, ber.TypeConstructed, tag, nil, "DefaultDiagFormat")
+	p.AppendChild(NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, OID_Bib1Diag, "DiagnosticSetId"))
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, int64(d.Code), "Condition"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagVisibleString, d.AddInfo, "AddInfo"))
+	return p
+}
+
+// ParseDiagnostic decodes a DefaultDiagFormat, whatever its tag. Diagnostics
+// from other diagnostic sets keep their condition code.
+func ParseDiagnostic(p *ber.Packet) *Diagnostic {
+	d := &Diagnostic{Code: DiagPermanentSystemError}
+	for _, c := range p.Children {
+		if c.ClassType != ber.ClassUniversal {
+			continue
+		}
+		switch c.Tag {
+		case ber.TagInteger:
+			d.Code = int(DecodeInt(c))
+		case ber.TagVisibleString, ber.TagGeneralString, ber.TagOctetString, ber.TagUTF8String:
+			d.AddInfo = DecodeString(c)
+		}
+	}
+	return d
+}
+
+// responseDiagnostic returns the first nonSurrogateDiagnostic [130] or
+// multipleNonSurDiagnostics [205] entry of a Search or Present response.
+func responseDiagnostic(resp *ber.Packet) *Diagnostic {
+	for _, c := range resp.Children {
+		if c.ClassType != ber.ClassContext {
+			continue
+		}
+		switch c.Tag {
+		case 130:
+			return ParseDiagnostic(c)
+		case 205:
+			if len(c.Children) > 0 {
+				return ParseDiagnostic(c.Children[0])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package z3950
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestDiagnosticRoundTrip(t *testing.T) {
+	d := NewDiagnostic(DiagUnsupportedUseAttribute, "9999")
+	pkt := ber.DecodePacket(d.Encode(130).Bytes())
+	if pkt.ClassType != ber.ClassContext || pkt.Tag != 130 {
+		t.Fatalf("unexpected tag %d/%d", pkt.ClassType, pkt.Tag)
+	}
+	if oid := PacketOID(pkt.Children[0]); oid != OID_Bib1Diag {
+		t.Errorf("diagnostic set = %s", oid)
+	}
+	got := ParseDiagnostic(pkt)
+	if *got != *d {
+		t.Errorf("ParseDiagnostic = %+v, want %+v", got, d)
+	}
+	if msg := got.Error(); !strings.Contains(msg, "Unsupported use attribute") || !strings.Contains(msg, "9999") {
+		t.Errorf("Error() = %q", msg)
+	}
+}
+
+// serveOnce answers every request on a single connection with resp.
+func serveOnce(t *testing.T, resp *ber.Packet) *Client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			if _, err := ber.ReadPacket(conn); err != nil {
+				return
+			}
+			conn.Write(resp.Bytes())
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	c := NewClient("127.0.0.1", addr.Port)
+	if err := c.Connect(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestClientReturnsDiagnostics(t *testing.T) {
+	t.Run("Search", func(t *testing.T) {
+		resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, 23, nil, "SearchResponse")
+		resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 23, 0, "Count"))
+		resp.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 22, false, "SearchStatus"))
+		resp.AppendChild(NewDiagnostic(DiagDatabaseNotFound, "Nowhere").Encode(130))
+
+		_, err := serveOnce(t, resp).Search(t.Context(), "Nowhere", "x")
+		var diag *Diagnostic
+		if !errors.As(err, &diag) || diag.Code != DiagDatabaseNotFound || diag.AddInfo != "Nowhere" {
+			t.Errorf("Search error = %v", err)
+		}
+	})
+
+	t.Run("Present", func(t *testing.T) {
+		resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, 25, nil, "PresentResponse")
+		resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 27, 5, "Status"))
+		resp.AppendChild(NewDiagnostic(DiagPresentOutOfRange, "7").Encode(130))
+
+		_, err := serveOnce(t, resp).Present(t.Context(), 7, 1, OID_MARC21, "")
+		var diag *Diagnostic
+		if !errors.As(err, &diag) || diag.Code != DiagPresentOutOfRange {
+			t.Errorf("Present error = %v", err)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		resp := ber.Encode(ber.ClassContext, ber.TypeConstructed, 36, nil, "ScanResponse")
+		resp.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 4, 6, "ScanStatus"))
+		entries := ber.Encode(ber.ClassContext, ber.TypeConstructed, 7, nil, "ListEntries")
+		diags := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "NonsurrogateDiagnostics")
+		diags.AppendChild(NewDiagnostic(DiagUnsupportedUseAttribute, "1035").Encode(ber.TagSequence))
+		entries.AppendChild(diags)
+		resp.AppendChild(entries)
+
+		_, err := serveOnce(t, resp).Scan(t.Context(), "Default", "a", map[int]int{1: 1035})
+		var diag *Diagnostic
+		if !errors.As(err, &diag) || diag.Code != DiagUnsupportedUseAttribute || diag.AddInfo != "1035" {
+			t.Errorf("Scan error = %v", err)
+		}
+	})
+
+	t.Run("Sort", func(t *testing.T) {
+		resp := EncodeSortResponse(SortStatusFailure, 0, NewDiagnostic(DiagSortSequenceUnsupported, "use attribute 7"))
+
+		err := serveOnce(t, resp).Sort(t.Context(), "default", []SortKey{{Attribute: 7}})
+		var diag *Diagnostic
+		if !errors.As(err, &diag) || diag.Code != DiagSortSequenceUnsupported || diag.AddInfo != "use attribute 7" {
+			t.Errorf("Sort error = %v", err)
+		}
+	})
+}
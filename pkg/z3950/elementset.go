@@ -0,0 +1,51 @@
+package z3950
+
+import (
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Generic element set names. Targets may define further names of their own.
+const (
+	ElementSetBrief = "B"
+	ElementSetFull  = "F"
+)
+
+// EncodeElementSetNames returns an ElementSetNames holding the generic
+// element set name, under tag: [100] and [101] for the small and medium
+// set names of a SearchRequest, [19] for a PresentRequest's simple record
+// composition.
+func EncodeElementSetNames(tag ber.Tag, name string) *ber.Packet {
+	p := ber.Encode(ber.ClassContext, ber.TypeConstructed, tag, nil, "ElementSetNames")
+	p.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, name, "GenericElementSetName"))
+	return p
+}
+
+// ParseElementSetNames returns the generic element set name of an
+// ElementSetNames, or "" for database-specific names. Names sent as a bare
+// string under the outer tag are accepted too.
+func ParseElementSetNames(p *ber.Packet) string {
+	if len(p.Children) == 0 {
+		return DecodeString(p)
+	}
+	if c := p.Children[0]; c.ClassType == ber.ClassContext && c.Tag == 0 {
+		return DecodeString(c)
+	}
+	return ""
+}
+
+// BriefRecord returns rec reduced to the brief element set: the control
+// number, title, author, ISBN, ISSN, publisher and subject, read and
+// rebuilt with profile. Holdings are kept, as result lists show them.
+// SUTRS records, and records that cannot be rebuilt, are returned as they
+// are.
+func BriefRecord(rec *MARCRecord, profile *MARCProfile) *MARCRecord {
+	if rec == nil || rec.Leader == "SUTRS" {
+		return rec
+	}
+	brief, err := ParseMARC(BuildMARC(profile, rec.RecordID, rec.GetTitle(profile), rec.GetAuthor(profile), rec.GetISBN(profile), rec.GetPublisher(profile), "", rec.GetISSN(profile), rec.GetSubject(profile)))
+	if err != nil {
+		return rec
+	}
+	brief.Holdings = rec.Holdings
+	return brief
+}
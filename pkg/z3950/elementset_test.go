@@ -0,0 +1,36 @@
+package z3950
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestElementSetNames(t *testing.T) {
+	p, err := ber.DecodePacketErr(EncodeElementSetNames(19, ElementSetBrief).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ParseElementSetNames(p); got != "B" {
+		t.Errorf("round trip = %q, want B", got)
+	}
+
+	// A bare string under the outer tag
+	bare := ber.NewString(ber.ClassContext, ber.TypePrimitive, 100, "F", "SmallSetElementSetNames")
+	if p, err = ber.DecodePacketErr(bare.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ParseElementSetNames(p); got != "F" {
+		t.Errorf("bare name = %q, want F", got)
+	}
+
+	// Database-specific names are not generic ones
+	specific := ber.Encode(ber.ClassContext, ber.TypeConstructed, 19, nil, "ElementSetNames")
+	specific.AppendChild(ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "DatabaseSpecific"))
+	if p, err = ber.DecodePacketErr(specific.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ParseElementSetNames(p); got != "" {
+		t.Errorf("database-specific = %q, want none", got)
+	}
+}
@@ -0,0 +1,215 @@
+package z3950
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// MARCXMLNamespace is the MARC 21 slim schema namespace.
+const MARCXMLNamespace = "http://www.loc.gov/MARC21/slim"
+
+// marcXMLRecord mirrors the MARCXML <record> element for decoding.
+type marcXMLRecord struct {
+	Leader        string `xml:"leader"`
+	ControlFields []struct {
+		Tag   string `xml:"tag,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"controlfield"`
+	DataFields []struct {
+		Tag       string `xml:"tag,attr"`
+		Ind1      string `xml:"ind1,attr"`
+		Ind2      string `xml:"ind2,attr"`
+		Subfields []struct {
+			Code  string `xml:"code,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"subfield"`
+	} `xml:"datafield"`
+}
+
+// ParseMARCXML parses a single MARCXML <record> element. Control and data
+// fields keep their document order within each kind; control fields come
+// first, as they do in ISO 2709.
+func ParseMARCXML(data []byte) (*MARCRecord, error) {
+	var x marcXMLRecord
+	if err := xml.Unmarshal(data, &x); err != nil {
+		return nil, fmt.Errorf("invalid MARCXML: %w", err)
+	}
+	rec := &MARCRecord{Leader: x.Leader}
+	for _, cf := range x.ControlFields {
+		rec.Fields = append(rec.Fields, MARCField{Tag: cf.Tag, Value: cf.Value})
+	}
+	for _, df := range x.DataFields {
+		f := MARCField{Tag: df.Tag, Indicator1: df.Ind1, Indicator2: df.Ind2}
+		for _, sf := range df.Subfields {
+			f.Subfields = append(f.Subfields, MARCSubfield{Code: sf.Code, Value: sf.Value})
+		}
+		f.Value = flattenSubfields(f.Subfields)
+		rec.Fields = append(rec.Fields, f)
+	}
+	rec.PopulateFriendlyFields()
+	return rec, nil
+}
+
+// MarshalMARCXML renders the record as a MARCXML <record> element.
+func (r *MARCRecord) MarshalMARCXML() []byte {
+	var b bytes.Buffer
+	b.WriteString(`<record xmlns="` + MARCXMLNamespace + `">`)
+	leader := r.Leader
+	if len(leader) != 24 {
+		leader = "00000nam a2200000 a 4500"
+	}
+	b.WriteString("<leader>")
+	xml.EscapeText(&b, []byte(leader))
+	b.WriteString("</leader>")
+	for _, f := range r.Fields {
+		if f.IsControl() {
+			b.WriteString(`<controlfield tag="` + f.Tag + `">`)
+			xml.EscapeText(&b, []byte(f.Value))
+			b.WriteString("</controlfield>")
+			continue
+		}
+		b.WriteString(`<datafield tag="` + f.Tag + `" ind1="` + xmlAttr(indicatorOrBlank(f.Indicator1)) + `" ind2="` + xmlAttr(indicatorOrBlank(f.Indicator2)) + `">`)
+		subs := f.Subfields
+		if len(subs) == 0 && f.Value != "" {
+			subs = []MARCSubfield{{Code: "a", Value: f.Value}}
+		}
+		for _, sf := range subs {
+			b.WriteString(`<subfield code="` + xmlAttr(sf.Code) + `">`)
+			xml.EscapeText(&b, []byte(sf.Value))
+			b.WriteString("</subfield>")
+		}
+		b.WriteString("</datafield>")
+	}
+	b.WriteString("</record>")
+	return b.Bytes()
+}
+
+func xmlAttr(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// FormatSUTRS renders the record as simple unstructured text, one field per
+// line ("245 10 $a Title $c Author").
+func (r *MARCRecord) FormatSUTRS() string {
+	var b strings.Builder
+	for _, f := range r.Fields {
+		b.WriteString(f.Tag)
+		b.WriteByte(' ')
+		if f.IsControl() || len(f.Subfields) == 0 {
+			b.WriteString(f.Value)
+		} else {
+			b.WriteString(indicatorOrBlank(f.Indicator1))
+			b.WriteString(indicatorOrBlank(f.Indicator2))
+			for _, sf := range f.Subfields {
+				b.WriteString(" $")
+				b.WriteString(sf.Code)
+				b.WriteByte(' ')
+				b.WriteString(sf.Value)
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// BuildOPACRecord builds an OPACRecord with the given ISO 2709 record as
+// bibliographicRecord and one HoldingsRecord per holding. The result is
+// meant to be carried as the single-ASN1-type of an EXTERNAL.
+func BuildOPACRecord(bibSyntax string, bib []byte, holdings []Holding) *ber.Packet {
+	opac := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "OPACRecord")
+	opac.AppendChild(NewExternal(ber.ClassContext, 1, bibSyntax, bib, "BibliographicRecord"))
+	if len(holdings) == 0 {
+		return opac
+	}
+	list := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "HoldingsData")
+	for _, h := range holdings {
+		hc := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "HoldingsAndCirc")
+		if h.Location != "" {
+			hc.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 9, h.Location, "LocalLocation"))
+		}
+		if h.CallNumber != "" {
+			hc.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 11, h.CallNumber, "CallNumber"))
+		}
+		if h.Status != "" {
+			hc.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 14, h.Status, "PublicNote"))
+		}
+		circ := ber.Encode(ber.ClassContext, ber.TypeConstructed, 19, nil, "CirculationData")
+		cr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "CircRecord")
+		cr.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, strings.EqualFold(h.Status, "Available"), "AvailableNow"))
+		cr.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 6, false, "Renewable"))
+		cr.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 7, false, "OnHold"))
+		circ.AppendChild(cr)
+		hc.AppendChild(circ)
+		list.AppendChild(hc)
+	}
+	opac.AppendChild(list)
+	return opac
+}
+
+// ParseOPACRecord extracts the bibliographic record and holdings from an
+// OPACRecord.
+func ParseOPACRecord(p *ber.Packet) ([]byte, []Holding) {
+	var bib []byte
+	var holdings []Holding
+	for _, c := range p.Children {
+		switch c.Tag {
+		case 1:
+			bib = externalOctets(c)
+		case 2:
+			for _, hr := range c.Children {
+				if hr.Tag != 2 {
+					continue
+				}
+				var h Holding
+				for _, f := range hr.Children {
+					switch f.Tag {
+					case 9:
+						h.Location = DecodeString(f)
+					case 11:
+						h.CallNumber = DecodeString(f)
+					case 14:
+						h.Status = DecodeString(f)
+					}
+				}
+				holdings = append(holdings, h)
+			}
+		}
+	}
+	return bib, holdings
+}
+
+// externalOctets returns the octet-aligned encoding of an EXTERNAL,
+// whatever tag the EXTERNAL itself carries.
+func externalOctets(p *ber.Packet) []byte {
+	for _, c := range p.Children {
+		if c.ClassType == ber.ClassContext && c.Tag == 1 {
+			return c.Data.Bytes()
+		}
+	}
+	return nil
+}
+
+// externalSingleType returns the single-ASN1-type encoding of an EXTERNAL
+// found anywhere below p, or nil.
+func externalSingleType(p *ber.Packet) *ber.Packet {
+	if p.Tag == ber.TagExternal && p.ClassType == ber.ClassUniversal {
+		for _, c := range p.Children {
+			if c.ClassType == ber.ClassContext && c.Tag == 0 && len(c.Children) > 0 {
+				return c.Children[0]
+			}
+		}
+		return nil
+	}
+	for _, c := range p.Children {
+		if res := externalSingleType(c); res != nil {
+			return res
+		}
+	}
+	return nil
+}
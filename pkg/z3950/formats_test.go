@@ -0,0 +1,110 @@
+package z3950
+
+import (
+	"strings"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestOIDRoundTrip(t *testing.T) {
+	for _, oid := range []string{OID_MARC21, OID_UNIMARC, OID_SUTRS, OID_OPAC, OID_XML, OID_Bib1, OID_Bib1Diag} {
+		enc := EncodeOID(oid)
+		if got := DecodeOID(enc); got != oid {
+			t.Errorf("DecodeOID(EncodeOID(%s)) = %s", oid, got)
+		}
+	}
+	// 1.2.840.10003.5.10 as sent by YAZ
+	want := []byte{0x2A, 0x86, 0x48, 0xCE, 0x13, 0x05, 0x0A}
+	if got := EncodeOID(OID_MARC21); string(got) != string(want) {
+		t.Errorf("EncodeOID(MARC21) = % X, want % X", got, want)
+	}
+
+	pkt := ber.DecodePacket(NewOID(ber.ClassContext, 104, OID_XML, "PreferredRecordSyntax").Bytes())
+	if got := PacketOID(pkt); got != OID_XML {
+		t.Errorf("PacketOID = %s, want %s", got, OID_XML)
+	}
+}
+
+func TestDecodeIntContextTag(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 300, 1048576, -1} {
+		pkt := ber.DecodePacket(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 29, v, "N").Bytes())
+		if got := DecodeInt(pkt); got != v {
+			t.Errorf("DecodeInt(%d) = %d", v, got)
+		}
+	}
+}
+
+func sampleRecord() *MARCRecord {
+	return &MARCRecord{
+		Leader: "00000nam a2200000 a 4500",
+		Fields: []MARCField{
+			{Tag: "001", Value: "rec-1"},
+			{Tag: "245", Indicator1: "1", Indicator2: "0", Subfields: []MARCSubfield{
+				{Code: "a", Value: "Fish & chips <a history>"}, {Code: "c", Value: "Jane Doe"},
+			}},
+			{Tag: "650", Indicator1: " ", Indicator2: "0", Subfields: []MARCSubfield{{Code: "a", Value: "Cooking"}}},
+		},
+	}
+}
+
+func TestMARCXMLRoundTrip(t *testing.T) {
+	x := sampleRecord().MarshalMARCXML()
+	if !strings.Contains(string(x), `xmlns="`+MARCXMLNamespace+`"`) {
+		t.Errorf("missing namespace: %s", x)
+	}
+	if !strings.Contains(string(x), "Fish &amp; chips &lt;a history&gt;") {
+		t.Errorf("text not escaped: %s", x)
+	}
+
+	rec, err := ParseMARCXML(x)
+	if err != nil {
+		t.Fatalf("ParseMARCXML failed: %v", err)
+	}
+	f := rec.GetFields("245")
+	if len(f) != 1 || f[0].Indicator1 != "1" || f[0].GetSubfield("c") != "Jane Doe" {
+		t.Fatalf("245 not preserved: %+v", f)
+	}
+	if rec.GetFieldByTag("001") != "rec-1" {
+		t.Errorf("001 = %q", rec.GetFieldByTag("001"))
+	}
+}
+
+func TestFormatSUTRS(t *testing.T) {
+	got := sampleRecord().FormatSUTRS()
+	want := "001 rec-1\n245 10 $a Fish & chips <a history> $c Jane Doe\n650  0 $a Cooking\n"
+	if got != want {
+		t.Errorf("FormatSUTRS() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestOPACRecordRoundTrip(t *testing.T) {
+	rec := sampleRecord()
+	holdings := []Holding{
+		{CallNumber: "TX 1 .D6", Status: "Available", Location: "Main Library"},
+		{CallNumber: "TX 1 .D6 c.2", Status: "Checked Out", Location: "Science Branch"},
+	}
+	opac := BuildOPACRecord(OID_MARC21, rec.MarshalISO2709(), holdings)
+
+	ext := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagExternal, nil, "External")
+	ext.AppendChild(NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, OID_OPAC, "DirectReference"))
+	single := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "SingleASN1Type")
+	single.AppendChild(opac)
+	ext.AppendChild(single)
+
+	decoded := externalSingleType(ber.DecodePacket(ext.Bytes()))
+	if decoded == nil {
+		t.Fatal("single-ASN1-type not found")
+	}
+	bib, got := ParseOPACRecord(decoded)
+	parsed, err := ParseMARC(bib)
+	if err != nil {
+		t.Fatalf("ParseMARC(bibliographicRecord) failed: %v", err)
+	}
+	if !strings.Contains(parsed.Title, "Fish & chips") {
+		t.Errorf("Title = %q", parsed.Title)
+	}
+	if len(got) != 2 || got[0] != holdings[0] || got[1] != holdings[1] {
+		t.Errorf("holdings = %+v", got)
+	}
+}
@@ -0,0 +1,248 @@
+package z3950
+
+import (
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Protocol versions, as bits of the Init protocolVersion bit string.
+const (
+	Version1 = 0
+	Version2 = 1
+	Version3 = 2
+)
+
+// Services, as bits of the Init options bit string.
+const (
+	OptionSearch               = 0
+	OptionPresent              = 1
+	OptionDeleteResultSet      = 2
+	OptionScan                 = 7
+	OptionSort                 = 8
+	OptionExtendedServices     = 10
+	OptionConcurrentOperations = 13
+	OptionNamedResultSets      = 14
+)
+
+// Message sizes proposed when none are configured.
+const (
+	DefaultPreferredMessageSize  = 1 << 20
+	DefaultExceptionalRecordSize = 1 << 20
+)
+
+// BitString is a BER BIT STRING of up to 64 bits, bit 0 being the first.
+type BitString uint64
+
+// Bits returns a BitString with the given bits set.
+func Bits(bits ...int) BitString {
+	var b BitString
+	for _, n := range bits {
+		b |= 1 << n
+	}
+	return b
+}
+
+// Has reports whether bit n is set.
+func (b BitString) Has(n int) bool {
+	return n >= 0 && n < 64 && b&(1<<n) != 0
+}
+
+// Encode returns the BIT STRING content octets: the count of unused bits,
+// then the bits from bit 0 on, at least up to the last one set.
+func (b BitString) Encode() []byte {
+	n := 8
+	for i := 63; i >= 0; i-- {
+		if b.Has(i) {
+			n = i + 1
+			break
+		}
+	}
+	data := make([]byte, 1+(n+7)/8)
+	data[0] = byte(len(data[1:])*8 - n)
+	for i := 0; i < n; i++ {
+		if b.Has(i) {
+			data[1+i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return data
+}
+
+// ParseBitString decodes BIT STRING content octets; bits past 63 are
+// dropped.
+func ParseBitString(data []byte) BitString {
+	var b BitString
+	if len(data) < 2 {
+		return b
+	}
+	for i, octet := range data[1:] {
+		for j := 0; j < 8; j++ {
+			if n := i*8 + j; n < 64 && octet&(0x80>>j) != 0 {
+				b |= 1 << n
+			}
+		}
+	}
+	return b
+}
+
+// InitParams are the parameters exchanged by InitializeRequest and
+// InitializeResponse: what an origin proposes, or what a target agreed to.
+type InitParams struct {
+	Versions              BitString
+	Options               BitString
+	PreferredMessageSize  int
+	ExceptionalRecordSize int
+	ImplementationID      string
+	ImplementationName    string
+	ImplementationVersion string
+}
+
+// Version returns the highest protocol version in p, or 0 if none is set.
+func (p InitParams) Version() int {
+	for v := Version3; v >= Version1; v-- {
+		if p.Versions.Has(v) {
+			return v + 1
+		}
+	}
+	return 0
+}
+
+// Negotiate returns what a target with parameters p agrees to for an
+// origin proposing proposed: the versions and options both support, and
+// the smaller of each message size. Sizes proposed as 0 leave p's.
+func (p InitParams) Negotiate(proposed InitParams) InitParams {
+	agreed := p
+	agreed.Versions &= proposed.Versions
+	agreed.Options &= proposed.Options
+	if proposed.PreferredMessageSize > 0 && proposed.PreferredMessageSize < p.PreferredMessageSize {
+		agreed.PreferredMessageSize = proposed.PreferredMessageSize
+	}
+	if proposed.ExceptionalRecordSize > 0 && proposed.ExceptionalRecordSize < p.ExceptionalRecordSize {
+		agreed.ExceptionalRecordSize = proposed.ExceptionalRecordSize
+	}
+	// The highest common version is the one in use
+	if v := agreed.Version(); v > 0 {
+		agreed.Versions = Bits(v - 1)
+	}
+	return agreed
+}
+
+// header returns the protocolVersion [3], options [4],
+// preferredMessageSize [5] and exceptionalRecordSize [6] elements.
+func (p InitParams) header() []*ber.Packet {
+	ver := ber.Encode(ber.ClassContext, ber.TypePrimitive, 3, nil, "ProtocolVersion")
+	ver.Data.Write(p.Versions.Encode())
+	opts := ber.Encode(ber.ClassContext, ber.TypePrimitive, 4, nil, "Options")
+	opts.Data.Write(p.Options.Encode())
+	return []*ber.Packet{
+		ver,
+		opts,
+		ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 5, int64(p.PreferredMessageSize), "PreferredMessageSize"),
+		ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 6, int64(p.ExceptionalRecordSize), "ExceptionalRecordSize"),
+	}
+}
+
+// implementation returns the implementationId [110], implementationName
+// [111] and implementationVersion [112] elements that are set.
+func (p InitParams) implementation() []*ber.Packet {
+	var info []*ber.Packet
+	for _, f := range []struct {
+		tag   ber.Tag
+		value string
+		name  string
+	}{
+		{110, p.ImplementationID, "ImplementationId"},
+		{111, p.ImplementationName, "ImplementationName"},
+		{112, p.ImplementationVersion, "ImplementationVersion"},
+	} {
+		if f.value != "" {
+			info = append(info, ber.NewString(ber.ClassContext, ber.TypePrimitive, f.tag, f.value, f.name))
+		}
+	}
+	return info
+}
+
+// EncodeInitRequest builds an InitializeRequest proposing p. auth, if
+// not nil, is sent as idAuthentication, and otherInfo follows the
+// implementation information.
+func EncodeInitRequest(p InitParams, auth *ber.Packet, otherInfo ...*ber.Packet) *ber.Packet {
+	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 20, nil, "InitializeRequest")
+	for _, c := range p.header() {
+		pdu.AppendChild(c)
+	}
+	if auth != nil {
+		pdu.AppendChild(auth)
+	}
+	for _, c := range p.implementation() {
+		pdu.AppendChild(c)
+	}
+	for _, c := range otherInfo {
+		pdu.AppendChild(c)
+	}
+	return pdu
+}
+
+// EncodeInitResponse builds an InitializeResponse agreeing to p, with
+// result [12] telling whether the connection is accepted.
+func EncodeInitResponse(p InitParams, result bool, otherInfo ...*ber.Packet) *ber.Packet {
+	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 21, nil, "InitializeResponse")
+	for _, c := range p.header() {
+		pdu.AppendChild(c)
+	}
+	pdu.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 12, result, "Result"))
+	for _, c := range p.implementation() {
+		pdu.AppendChild(c)
+	}
+	for _, c := range otherInfo {
+		pdu.AppendChild(c)
+	}
+	return pdu
+}
+
+// ParseInitParams reads the parameters of an InitializeRequest or
+// InitializeResponse. Older targets sending them with universal tags are
+// understood too, in the order of the standard's fields.
+func ParseInitParams(pdu *ber.Packet) InitParams {
+	var p InitParams
+	bitStrings, integers := 0, 0
+	for _, c := range pdu.Children {
+		if c.ClassType == ber.ClassUniversal {
+			// Positional: version, options, then the two sizes
+			switch c.Tag {
+			case ber.TagBitString:
+				if bitStrings == 0 {
+					p.Versions = ParseBitString(c.Data.Bytes())
+				} else {
+					p.Options = ParseBitString(c.Data.Bytes())
+				}
+				bitStrings++
+			case ber.TagInteger:
+				if integers == 0 {
+					p.PreferredMessageSize = int(DecodeInt(c))
+				} else {
+					p.ExceptionalRecordSize = int(DecodeInt(c))
+				}
+				integers++
+			}
+			continue
+		}
+		if c.ClassType != ber.ClassContext {
+			continue
+		}
+		switch c.Tag {
+		case 3:
+			p.Versions = ParseBitString(c.Data.Bytes())
+		case 4:
+			p.Options = ParseBitString(c.Data.Bytes())
+		case 5:
+			p.PreferredMessageSize = int(DecodeInt(c))
+		case 6:
+			p.ExceptionalRecordSize = int(DecodeInt(c))
+		case 110:
+			p.ImplementationID = DecodeString(c)
+		case 111:
+			p.ImplementationName = DecodeString(c)
+		case 112:
+			p.ImplementationVersion = DecodeString(c)
+		}
+	}
+	return p
+}
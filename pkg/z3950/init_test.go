@@ -0,0 +1,92 @@
+package z3950
+
+import (
+	"bytes"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestBitString(t *testing.T) {
+	b := Bits(OptionSearch, OptionPresent, OptionScan, OptionNamedResultSets)
+	data := b.Encode()
+	if want := []byte{0x01, 0xC1, 0x02}; !bytes.Equal(data, want) {
+		t.Errorf("Encode = % X, want % X", data, want)
+	}
+	if got := ParseBitString(data); got != b {
+		t.Errorf("ParseBitString = %b, want %b", got, b)
+	}
+	if got := Bits(Version3).Encode(); !bytes.Equal(got, []byte{0x05, 0x20}) {
+		t.Errorf("version 3 = % X", got)
+	}
+	// A lone zero octet of unused bits is an empty bit string
+	if got := ParseBitString([]byte{0x00}); got != 0 {
+		t.Errorf("empty bit string = %b", got)
+	}
+}
+
+func TestInitParamsNegotiate(t *testing.T) {
+	target := InitParams{
+		Versions:              Bits(Version2, Version3),
+		Options:               Bits(OptionSearch, OptionPresent, OptionScan),
+		PreferredMessageSize:  1 << 20,
+		ExceptionalRecordSize: 1 << 20,
+		ImplementationID:      "T",
+	}
+	origin := InitParams{
+		Versions:              Bits(Version1, Version2, Version3),
+		Options:               Bits(OptionSearch, OptionPresent, OptionSort),
+		PreferredMessageSize:  65536,
+		ExceptionalRecordSize: 0,
+	}
+	got := target.Negotiate(origin)
+	want := InitParams{
+		Versions:              Bits(Version3),
+		Options:               Bits(OptionSearch, OptionPresent),
+		PreferredMessageSize:  65536,
+		ExceptionalRecordSize: 1 << 20,
+		ImplementationID:      "T",
+	}
+	if got != want {
+		t.Errorf("Negotiate = %+v, want %+v", got, want)
+	}
+	if v := target.Negotiate(InitParams{Versions: Bits(Version1)}).Version(); v != 0 {
+		t.Errorf("version with no common one = %d", v)
+	}
+}
+
+func TestInitParamsRoundTrip(t *testing.T) {
+	p := InitParams{
+		Versions:              Bits(Version3),
+		Options:               Bits(OptionSearch, OptionPresent, OptionDeleteResultSet),
+		PreferredMessageSize:  4096,
+		ExceptionalRecordSize: 8192,
+		ImplementationID:      "42",
+		ImplementationName:    "Test",
+		ImplementationVersion: "1.0",
+	}
+	pkt, err := ber.DecodePacketErr(EncodeInitResponse(p, true).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ParseInitParams(pkt); got != p {
+		t.Errorf("ParseInitParams = %+v, want %+v", got, p)
+	}
+
+	// Universal tags, as some targets send, are read in order
+	legacy := ber.Encode(ber.ClassContext, ber.TypeConstructed, 21, nil, "InitResp")
+	for _, bits := range [][]byte{{0x00, 0x20}, {0x00, 0xC0}} {
+		p := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagBitString, nil, "BitString")
+		p.Data.Write(bits)
+		legacy.AppendChild(p)
+	}
+	legacy.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 4096, "MsgSize"))
+	legacy.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 8192, "RecSize"))
+	if pkt, err = ber.DecodePacketErr(legacy.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	got := ParseInitParams(pkt)
+	if got.Version() != 3 || got.Options != Bits(OptionSearch, OptionPresent) || got.PreferredMessageSize != 4096 || got.ExceptionalRecordSize != 8192 {
+		t.Errorf("legacy ParseInitParams = %+v", got)
+	}
+}
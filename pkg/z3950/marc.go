@@ -7,13 +7,54 @@ import (
 	"strconv"
 	"strings"
 	"regexp"
+	"sort"
+	"unicode/utf8"
 )
 
 var isbnCleanRegex = regexp.MustCompile(`[^0-9xX]`)
 
+// MARCSubfield is a single subfield (e.g. 245 $a) of a data field.
+type MARCSubfield struct {
+	Code  string `json:"code"`
+	Value string `json:"value"`
+}
+
+// MARCField is a control or data field. Value holds the subfield values
+// flattened into one string; data fields additionally keep their indicators
+// and the subfields in record order.
 type MARCField struct {
-	Tag   string
-	Value string
+	Tag        string         `json:"Tag"`
+	Indicator1 string         `json:"ind1,omitempty"`
+	Indicator2 string         `json:"ind2,omitempty"`
+	Subfields  []MARCSubfield `json:"subfields,omitempty"`
+	Value      string         `json:"Value"`
+}
+
+// IsControl reports whether the field is a control field (00X), which has
+// neither indicators nor subfields.
+func (f MARCField) IsControl() bool {
+	return isControlTag(f.Tag)
+}
+
+// GetSubfield returns the first subfield with the given code.
+func (f MARCField) GetSubfield(code string) string {
+	for _, sf := range f.Subfields {
+		if sf.Code == code { return sf.Value }
+	}
+	return ""
+}
+
+// GetSubfields returns every subfield value with the given code, in order.
+func (f MARCField) GetSubfields(code string) []string {
+	var vals []string
+	for _, sf := range f.Subfields {
+		if sf.Code == code { vals = append(vals, sf.Value) }
+	}
+	return vals
+}
+
+func isControlTag(tag string) bool {
+	return len(tag) == 3 && tag[0] == '0' && tag[1] == '0'
 }
 
 type Holding struct {
@@ -56,18 +97,36 @@ var (
 	ProfileUNIMARC = MARCProfile{ISBNTag: "010", ISSNTag: "011", TitleTag: "200", AuthorTag: "700", PublisherTag: "210", SubjectTag: "606"}
 )
 
+// baseAddress reads the base address of data from leader/12-16. It must
+// leave room for the leader and the directory terminator and lie within
+// the record's n bytes.
+func baseAddress(leader string, n int) (int, error) {
+	baseAddr, err := strconv.Atoi(leader[12:17])
+	if err != nil { return 0, fmt.Errorf("bad base addr") }
+	if baseAddr < 25 || baseAddr > n { return 0, fmt.Errorf("bad base addr %d for %d bytes", baseAddr, n) }
+	return baseAddr, nil
+}
+
 func ParseMARC(data []byte) (*MARCRecord, error) {
+	return ParseMARCCharset(data, "")
+}
+
+// ParseMARCCharset is ParseMARC for records known to be in charset, as
+// negotiated at Init: "UTF-8" or "MARC-8". With any other charset the
+// encoding is guessed from the leader and the data.
+func ParseMARCCharset(data []byte, charset string) (*MARCRecord, error) {
 	if len(data) < 24 { return nil, fmt.Errorf("data too short") }
 	if len(data) > 0 && data[0] == '{' {
 		return ParseMARCJSON(string(data))
 	}
 	leader := string(data[:24])
-	baseAddrStr := leader[12:17]
-	baseAddr, err := strconv.Atoi(baseAddrStr)
-	if err != nil { return nil, fmt.Errorf("bad base addr") }
-	dirEnd := baseAddr - 1
-	if dirEnd > len(data) || dirEnd < 24 { return nil, fmt.Errorf("bad directory") }
-	directory := data[24:dirEnd]
+	baseAddr, err := baseAddress(leader, len(data))
+	if err != nil { return nil, err }
+	directory := data[24 : baseAddr-1]
+	decode := charsetDecoder(charset)
+	if decode == nil {
+		decode = textDecoderFor(leader, data[baseAddr:])
+	}
 	rec := &MARCRecord{Leader: leader}
 	for i := 0; i < len(directory); i += 12 {
 		if i+12 > len(directory) { break }
@@ -76,10 +135,10 @@ func ParseMARC(data []byte) (*MARCRecord, error) {
 		length, _ := strconv.Atoi(string(entry[3:7]))
 		start, _ := strconv.Atoi(string(entry[7:12]))
 		fieldStart, fieldEnd := baseAddr+start, baseAddr+start+length
-		if fieldEnd > len(data) { continue }
+		if start < 0 || length < 0 || fieldEnd > len(data) { continue }
 		valData := data[fieldStart:fieldEnd]
 		valData = bytes.TrimSuffix(valData, []byte{0x1e})
-		rec.Fields = append(rec.Fields, MARCField{Tag: tag, Value: cleanSubfields(valData)})
+		rec.Fields = append(rec.Fields, parseField(tag, decode(valData)))
 	}
 	rec.PopulateFriendlyFields()
 	return rec, nil
@@ -95,27 +154,28 @@ func ParseMARCJSON(jsonStr string) (*MARCRecord, error) {
 	rec := &MARCRecord{Leader: mj.Leader}
 	for _, fMap := range mj.Fields {
 		for tag, content := range fMap {
-			val := ""
+			f := MARCField{Tag: tag}
 			switch v := content.(type) {
 			case string:
-				val = v
+				f.Value = v
 			case map[string]interface{}:
+				f.Indicator1, _ = v["ind1"].(string)
+				f.Indicator2, _ = v["ind2"].(string)
 				if subs, ok := v["subfields"].([]interface{}); ok {
-					var sb strings.Builder
 					for _, s := range subs {
 						if sm, ok := s.(map[string]interface{}); ok {
-							for _, sv := range sm {
+							for code, sv := range sm {
 								if svs, ok := sv.(string); ok {
-									sb.WriteString(" "); sb.WriteString(svs)
+									f.Subfields = append(f.Subfields, MARCSubfield{Code: code, Value: svs})
 								}
 							}
 						}
 					}
-					val = strings.TrimSpace(sb.String())
 				}
+				f.Value = flattenSubfields(f.Subfields)
 			}
-			if val != "" {
-				rec.Fields = append(rec.Fields, MARCField{Tag: tag, Value: val})
+			if f.Value != "" {
+				rec.Fields = append(rec.Fields, f)
 			}
 		}
 	}
@@ -149,8 +209,74 @@ func (r *MARCRecord) PopulateFriendlyFields() {
 	r.Notes = r.GetFieldByTag("500")
 }
 
-func cleanSubfields(data []byte) string {
-	decoded := DecodeText(data)
+// textDecoderFor picks the character decoder for a record from leader/09
+// (character coding scheme): "a" means UCS/Unicode and blank means MARC-8.
+// Many targets leave position 9 blank while actually sending UTF-8 or a CJK
+// codepage, so MARC-8 is only used when the data looks like it.
+func textDecoderFor(leader string, data []byte) func([]byte) string {
+	if len(leader) > 9 && leader[9] == ' ' {
+		if bytes.IndexByte(data, marc8Escape) >= 0 || (!utf8.Valid(data) && looksLikeMARC8(data)) {
+			return DecodeMARC8
+		}
+	}
+	return DecodeText
+}
+
+// charsetDecoder returns the decoder for a negotiated charset, or nil when
+// the charset is unknown and has to be guessed. Invalid UTF-8 still falls
+// back to guessing, as some targets accept UTF-8 and send legacy records.
+func charsetDecoder(charset string) func([]byte) string {
+	switch strings.ToUpper(charset) {
+	case "UTF-8":
+		return func(data []byte) string {
+			if utf8.Valid(data) {
+				return string(data)
+			}
+			return DecodeText(data)
+		}
+	case "MARC-8":
+		return DecodeMARC8
+	}
+	return nil
+}
+
+// parseField splits a decoded data field into indicators and subfields.
+// Control fields, and data fields that do not follow the indicator/subfield
+// layout, only get the flattened Value.
+func parseField(tag, decoded string) MARCField {
+	f := MARCField{Tag: tag}
+	if isControlTag(tag) {
+		f.Value = cleanSubfields(decoded)
+		return f
+	}
+	rest := decoded
+	if len(rest) >= 2 && rest[0] != 0x1f && rest[1] != 0x1f && rest[0] < utf8.RuneSelf && rest[1] < utf8.RuneSelf {
+		f.Indicator1, f.Indicator2 = rest[0:1], rest[1:2]
+		rest = rest[2:]
+	}
+	if !strings.HasPrefix(rest, "\x1f") {
+		f.Indicator1, f.Indicator2 = "", ""
+		f.Value = cleanSubfields(decoded)
+		return f
+	}
+	for _, part := range strings.Split(rest[1:], "\x1f") {
+		if part == "" { continue }
+		r, size := utf8.DecodeRuneInString(part)
+		f.Subfields = append(f.Subfields, MARCSubfield{Code: string(r), Value: part[size:]})
+	}
+	f.Value = flattenSubfields(f.Subfields)
+	return f
+}
+
+func flattenSubfields(subs []MARCSubfield) string {
+	vals := make([]string, 0, len(subs))
+	for _, sf := range subs {
+		vals = append(vals, sf.Value)
+	}
+	return strings.Join(vals, " ")
+}
+
+func cleanSubfields(decoded string) string {
 	res := bytes.Buffer{}
 	skip := false
 	for _, r := range decoded {
@@ -161,6 +287,89 @@ func cleanSubfields(data []byte) string {
 	return res.String()
 }
 
+// MarshalISO2709 serializes the record back to ISO 2709 (UTF-8). Data
+// fields are rebuilt from their indicators and subfields, so a record
+// parsed from a target or from storage round-trips without loss.
+// Holdings that are not already present as 852 fields are appended as
+// 852 $b location, $h call number, $z status.
+func (r *MARCRecord) MarshalISO2709() []byte {
+	var body, dir bytes.Buffer
+	add := func(f MARCField) {
+		if len(f.Tag) != 3 { return }
+		s := body.Len()
+		if !f.IsControl() && (len(f.Subfields) > 0 || f.Indicator1 != "" || f.Indicator2 != "") {
+			body.WriteString(indicatorOrBlank(f.Indicator1))
+			body.WriteString(indicatorOrBlank(f.Indicator2))
+		}
+		if len(f.Subfields) > 0 {
+			for _, sf := range f.Subfields {
+				body.WriteByte(0x1f); body.WriteString(sf.Code); body.WriteString(sf.Value)
+			}
+		} else {
+			body.WriteString(f.Value)
+		}
+		body.WriteByte(0x1e)
+		dir.WriteString(fmt.Sprintf("%s%04d%05d", f.Tag, body.Len()-s, s))
+	}
+	for _, f := range r.Fields { add(f) }
+	if len(r.GetFields("852")) == 0 {
+		for _, h := range r.Holdings {
+			add(MARCField{Tag: "852", Indicator1: " ", Indicator2: " ", Subfields: []MARCSubfield{
+				{Code: "b", Value: h.Location}, {Code: "h", Value: h.CallNumber}, {Code: "z", Value: h.Status},
+			}})
+		}
+	}
+
+	leader := []byte(r.Leader)
+	if len(leader) != 24 { leader = []byte("00000nam a2200000 a 4500") }
+	ba := 24 + dir.Len() + 1
+	copy(leader[0:5], fmt.Sprintf("%05d", ba+body.Len()+1))
+	leader[9], leader[10], leader[11] = 'a', '2', '2'
+	copy(leader[12:17], fmt.Sprintf("%05d", ba))
+	copy(leader[20:24], "4500")
+	return append(append(append(leader, dir.Bytes()...), 0x1e), append(body.Bytes(), 0x1d)...)
+}
+
+func indicatorOrBlank(ind string) string {
+	if len(ind) != 1 { return " " }
+	return ind
+}
+
+// ToMARC8 re-encodes an ISO 2709 record in MARC-8, rebuilding the directory
+// and setting leader/09 to blank. Records already in MARC-8 are returned as is.
+func ToMARC8(data []byte) ([]byte, error) {
+	if len(data) < 24 { return nil, fmt.Errorf("data too short") }
+	leader := string(data[:24])
+	baseAddr, err := baseAddress(leader, len(data))
+	if err != nil { return nil, err }
+	decode := textDecoderFor(leader, data[baseAddr:])
+	if leader[9] == ' ' && !utf8.Valid(data[baseAddr:]) {
+		return data, nil
+	}
+
+	var body, dir bytes.Buffer
+	directory := data[24 : baseAddr-1]
+	for i := 0; i+12 <= len(directory); i += 12 {
+		entry := directory[i : i+12]
+		length, _ := strconv.Atoi(string(entry[3:7]))
+		start, _ := strconv.Atoi(string(entry[7:12]))
+		fieldStart, fieldEnd := baseAddr+start, baseAddr+start+length
+		if start < 0 || length < 0 || fieldEnd > len(data) { continue }
+		val := bytes.TrimSuffix(data[fieldStart:fieldEnd], []byte{0x1e})
+		s := body.Len()
+		body.Write(EncodeMARC8(decode(val)))
+		body.WriteByte(0x1e)
+		dir.WriteString(fmt.Sprintf("%s%04d%05d", entry[:3], body.Len()-s, s))
+	}
+
+	ba := 24 + dir.Len() + 1
+	l := []byte(leader)
+	copy(l[0:5], fmt.Sprintf("%05d", ba+body.Len()+1))
+	l[9] = ' '
+	copy(l[12:17], fmt.Sprintf("%05d", ba))
+	return append(append(append(l, dir.Bytes()...), 0x1e), append(body.Bytes(), 0x1d)...), nil
+}
+
 func BuildMARC(profile *MARCProfile, id, title, author, isbn, publisher, pubYear, issn, subject string) []byte {
 	if profile == nil { profile = &ProfileMARC21 }
 	var db, dir bytes.Buffer
@@ -172,7 +381,12 @@ func BuildMARC(profile *MARCProfile, id, title, author, isbn, publisher, pubYear
 	}
 	addD := func(t string, subs map[string]string) {
 		s := db.Len()
-		for c, v := range subs {
+		codes := make([]string, 0, len(subs))
+		for c := range subs { codes = append(codes, c) }
+		sort.Strings(codes)
+		db.WriteString("  ")
+		for _, c := range codes {
+			v := subs[c]
 			if v == "" { continue }
 			db.WriteByte(0x1f); db.WriteByte(c[0]); db.WriteString(v)
 		}
@@ -200,6 +414,13 @@ func BuildMARC(profile *MARCProfile, id, title, author, isbn, publisher, pubYear
 	return append(append(append([]byte(l), dir.Bytes()...), 0x1e), append(db.Bytes(), 0x1d)...)
 }
 
+// GetFields returns every field with the given tag, in record order.
+func (r *MARCRecord) GetFields(tag string) []MARCField {
+	var fields []MARCField
+	for _, f := range r.Fields { if f.Tag == tag { fields = append(fields, f) } }
+	return fields
+}
+
 func (r *MARCRecord) GetFieldByTag(tag string) string {
 	for _, f := range r.Fields { if f.Tag == tag { return f.Value } }
 	return ""
@@ -0,0 +1,529 @@
+package z3950
+
+import (
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MARC-8 character sets, identified by the final byte of the escape
+// sequence that designates them (see MARC 21 Specifications, Part 3).
+const (
+	MARC8BasicLatin    = 0x42 // ASCII
+	MARC8ANSEL         = 0x45 // Extended Latin (ANSEL)
+	MARC8EACC          = 0x31 // East Asian Character Code (multibyte)
+	MARC8BasicHebrew   = 0x32
+	MARC8BasicArabic   = 0x33
+	MARC8ExtArabic     = 0x34
+	MARC8BasicCyrillic = 0x4E
+	MARC8ExtCyrillic   = 0x51
+	MARC8BasicGreek    = 0x53
+	MARC8GreekSymbols  = 0x67 // Technique 1: ESC g
+	MARC8Subscripts    = 0x62 // Technique 1: ESC b
+	MARC8Superscripts  = 0x70 // Technique 1: ESC p
+)
+
+const marc8Escape = 0x1B
+
+type marc8Char struct {
+	r         rune
+	combining bool
+}
+
+type marc8Ref struct {
+	set  byte
+	code uint32
+}
+
+// marc8Tables holds the character sets known to the codec. Single-byte sets
+// are keyed by the low seven bits of the code so that a set can be used
+// whether it is designated as G0 or G1. EACC codes are keyed by their three
+// bytes (again with the high bit stripped).
+var (
+	marc8Mu      sync.RWMutex
+	marc8Tables  = map[byte]map[uint32]marc8Char{}
+	marc8Reverse map[rune]marc8Ref
+)
+
+// marc8EncodeOrder is the order in which sets are tried when encoding, so
+// that e.g. "α" is written as Basic Greek rather than a Greek symbol when
+// both tables are loaded.
+var marc8EncodeOrder = []byte{
+	MARC8BasicLatin, MARC8ANSEL, MARC8BasicCyrillic, MARC8ExtCyrillic,
+	MARC8BasicGreek, MARC8BasicHebrew, MARC8BasicArabic, MARC8ExtArabic,
+	MARC8GreekSymbols, MARC8Subscripts, MARC8Superscripts, MARC8EACC,
+}
+
+func init() {
+	ansel := map[uint32]marc8Char{
+		0x21: {r: 0x0141}, 0x22: {r: 0x00D8}, 0x23: {r: 0x0110}, 0x24: {r: 0x00DE},
+		0x25: {r: 0x00C6}, 0x26: {r: 0x0152}, 0x27: {r: 0x02B9}, 0x28: {r: 0x00B7},
+		0x29: {r: 0x266D}, 0x2A: {r: 0x00AE}, 0x2B: {r: 0x00B1}, 0x2C: {r: 0x01A0},
+		0x2D: {r: 0x01AF}, 0x2E: {r: 0x02BC}, 0x30: {r: 0x02BB}, 0x31: {r: 0x0142},
+		0x32: {r: 0x00F8}, 0x33: {r: 0x0111}, 0x34: {r: 0x00FE}, 0x35: {r: 0x00E6},
+		0x36: {r: 0x0153}, 0x37: {r: 0x02BA}, 0x38: {r: 0x0131}, 0x39: {r: 0x00A3},
+		0x3A: {r: 0x00F0}, 0x3C: {r: 0x01A1}, 0x3D: {r: 0x01B0}, 0x40: {r: 0x00B0},
+		0x41: {r: 0x2113}, 0x42: {r: 0x2117}, 0x43: {r: 0x00A9}, 0x44: {r: 0x266F},
+		0x45: {r: 0x00BF}, 0x46: {r: 0x00A1}, 0x47: {r: 0x00DF}, 0x48: {r: 0x20AC},
+	}
+	// Combining diacritics (0xE0-0xFE). In MARC-8 these precede the base
+	// character; in Unicode they follow it.
+	for code, r := range map[uint32]rune{
+		0x60: 0x0309, 0x61: 0x0300, 0x62: 0x0301, 0x63: 0x0302, 0x64: 0x0303,
+		0x65: 0x0304, 0x66: 0x0306, 0x67: 0x0307, 0x68: 0x0308, 0x69: 0x030C,
+		0x6A: 0x030A, 0x6B: 0xFE20, 0x6C: 0xFE21, 0x6D: 0x0315, 0x6E: 0x030B,
+		0x6F: 0x0310, 0x70: 0x0327, 0x71: 0x0328, 0x72: 0x0323, 0x73: 0x0324,
+		0x74: 0x0325, 0x75: 0x0333, 0x76: 0x0332, 0x77: 0x0326, 0x78: 0x031C,
+		0x79: 0x032E, 0x7A: 0xFE22, 0x7B: 0xFE23, 0x7E: 0x0313,
+	} {
+		ansel[code] = marc8Char{r: r, combining: true}
+	}
+	marc8Tables[MARC8ANSEL] = ansel
+
+	marc8Tables[MARC8GreekSymbols] = map[uint32]marc8Char{
+		0x61: {r: 0x03B1}, 0x62: {r: 0x03B2}, 0x63: {r: 0x03B3},
+	}
+
+	sub := map[uint32]marc8Char{0x28: {r: 0x208D}, 0x29: {r: 0x208E}, 0x2B: {r: 0x208A}, 0x2D: {r: 0x208B}}
+	sup := map[uint32]marc8Char{0x28: {r: 0x207D}, 0x29: {r: 0x207E}, 0x2B: {r: 0x207A}, 0x2D: {r: 0x207B},
+		0x30: {r: 0x2070}, 0x31: {r: 0x00B9}, 0x32: {r: 0x00B2}, 0x33: {r: 0x00B3}}
+	for i := uint32(0); i < 10; i++ {
+		sub[0x30+i] = marc8Char{r: 0x2080 + rune(i)}
+		if i >= 4 {
+			sup[0x30+i] = marc8Char{r: 0x2074 + rune(i-4)}
+		}
+	}
+	marc8Tables[MARC8Subscripts] = sub
+	marc8Tables[MARC8Superscripts] = sup
+
+	// Basic Cyrillic (ISO 5427): punctuation and digits as ASCII, letters in
+	// KOI order from 0x40 (lowercase) and 0x60 (uppercase).
+	cyr := map[uint32]marc8Char{}
+	for c := uint32(0x21); c < 0x40; c++ {
+		cyr[c] = marc8Char{r: rune(c)}
+	}
+	for i, r := range []rune("юабцдефгхийклмнопярстужвьызшэщчъ") {
+		cyr[0x40+uint32(i)] = marc8Char{r: r}
+	}
+	for i, r := range []rune("ЮАБЦДЕФГХИЙКЛМНОПЯРСТУЖВЬЫЗШЭЩЧ") {
+		cyr[0x60+uint32(i)] = marc8Char{r: r}
+	}
+	marc8Tables[MARC8BasicCyrillic] = cyr
+
+	rebuildMARC8Reverse()
+}
+
+// rebuildMARC8Reverse recomputes the Unicode -> MARC-8 map. Callers must hold
+// marc8Mu for writing (or be in init).
+func rebuildMARC8Reverse() {
+	rev := make(map[rune]marc8Ref)
+	for c := uint32(0x21); c < 0x7F; c++ {
+		rev[rune(c)] = marc8Ref{set: MARC8BasicLatin, code: c}
+	}
+	for _, set := range marc8EncodeOrder {
+		for code, ch := range marc8Tables[set] {
+			if existing, ok := rev[ch.r]; ok && existing.set != set {
+				continue
+			}
+			if existing, ok := rev[ch.r]; ok && existing.code < code {
+				continue
+			}
+			rev[ch.r] = marc8Ref{set: set, code: code}
+		}
+	}
+	marc8Reverse = rev
+}
+
+func isMultibyteMARC8(set byte) bool {
+	return set == MARC8EACC
+}
+
+func lookupMARC8(set byte, code uint32) (marc8Char, bool) {
+	if set == MARC8BasicLatin {
+		return marc8Char{r: rune(code)}, code >= 0x21 && code < 0x7F
+	}
+	loadEmbeddedMARC8()
+	marc8Mu.RLock()
+	defer marc8Mu.RUnlock()
+	ch, ok := marc8Tables[set][code]
+	return ch, ok
+}
+
+// parseMARC8Escape interprets the escape sequence at the start of data and
+// returns its length together with the (possibly unchanged) G0/G1 sets.
+func parseMARC8Escape(data []byte, g0, g1 byte) (int, byte, byte) {
+	if len(data) < 2 {
+		return 1, g0, g1
+	}
+	switch b := data[1]; b {
+	case MARC8GreekSymbols, MARC8Subscripts, MARC8Superscripts:
+		return 2, b, g1
+	case 's':
+		return 2, MARC8BasicLatin, g1
+	case '(', ',', ')', '-':
+		i := 2
+		if i < len(data) && data[i] == '!' {
+			i++
+		}
+		if i >= len(data) {
+			return 1, g0, g1
+		}
+		if b == '(' || b == ',' {
+			return i + 1, data[i], g1
+		}
+		return i + 1, g0, data[i]
+	case '$':
+		if len(data) < 3 {
+			return 1, g0, g1
+		}
+		switch data[2] {
+		case '(', ',':
+			if len(data) < 4 {
+				return 1, g0, g1
+			}
+			return 4, data[3], g1
+		case ')', '-':
+			if len(data) < 4 {
+				return 1, g0, g1
+			}
+			return 4, g0, data[3]
+		default:
+			return 3, data[2], g1
+		}
+	}
+	return 1, g0, g1
+}
+
+// DecodeMARC8 converts MARC-8 encoded bytes to a UTF-8 string. Escape
+// sequences switch the working G0/G1 sets, combining diacritics are moved
+// after their base character and the result is normalized to NFC.
+// Characters that cannot be mapped are replaced by U+FFFD.
+func DecodeMARC8(data []byte) string {
+	g0, g1 := byte(MARC8BasicLatin), byte(MARC8ANSEL)
+	out := make([]rune, 0, len(data))
+	var pending []rune
+
+	emit := func(ch marc8Char) {
+		if ch.combining {
+			pending = append(pending, ch.r)
+			return
+		}
+		out = append(out, ch.r)
+		out = append(out, pending...)
+		pending = pending[:0]
+	}
+
+	for i := 0; i < len(data); {
+		b := data[i]
+		switch {
+		case b == marc8Escape:
+			n, ng0, ng1 := parseMARC8Escape(data[i:], g0, g1)
+			g0, g1 = ng0, ng1
+			i += n
+			continue
+		case b <= 0x20 || b == 0x7F:
+			emit(marc8Char{r: rune(b)})
+		case b == 0x88 || b == 0x89:
+			// Non-sort begin/end markers carry no text.
+		case b == 0x8D:
+			emit(marc8Char{r: 0x200D})
+		case b == 0x8E:
+			emit(marc8Char{r: 0x200C})
+		case b < 0x7F || (b >= 0xA1 && b < 0xFF):
+			set := g0
+			if b > 0x7F {
+				set = g1
+			}
+			if isMultibyteMARC8(set) {
+				if i+3 > len(data) {
+					emit(marc8Char{r: utf8.RuneError})
+					i = len(data)
+					continue
+				}
+				code := uint32(data[i]&0x7F)<<16 | uint32(data[i+1]&0x7F)<<8 | uint32(data[i+2]&0x7F)
+				ch, ok := lookupMARC8(set, code)
+				if !ok {
+					ch = marc8Char{r: utf8.RuneError}
+				}
+				emit(ch)
+				i += 3
+				continue
+			}
+			ch, ok := lookupMARC8(set, uint32(b&0x7F))
+			if !ok {
+				ch = marc8Char{r: utf8.RuneError}
+			}
+			emit(ch)
+		default:
+			emit(marc8Char{r: utf8.RuneError})
+		}
+		i++
+	}
+	out = append(out, pending...)
+	return norm.NFC.String(string(out))
+}
+
+// EncodeMARC8 converts a UTF-8 string to MARC-8. G1 is left as ANSEL and
+// other sets are designated into G0 as needed; the output always ends with
+// G0 reset to ASCII. Characters with no MARC-8 equivalent are written as
+// numeric character references (&#xXXXX;) as recommended by LC.
+func EncodeMARC8(s string) []byte {
+	runes := []rune(norm.NFD.String(s))
+	var buf bytes.Buffer
+	g0 := byte(MARC8BasicLatin)
+
+	loadEmbeddedMARC8()
+	marc8Mu.RLock()
+	defer marc8Mu.RUnlock()
+
+	setG0 := func(set byte) {
+		if g0 == set {
+			return
+		}
+		buf.WriteByte(marc8Escape)
+		switch {
+		case set == MARC8BasicLatin:
+			buf.WriteByte('s')
+		case set == MARC8GreekSymbols || set == MARC8Subscripts || set == MARC8Superscripts:
+			buf.WriteByte(set)
+		case isMultibyteMARC8(set):
+			buf.WriteByte('$')
+			buf.WriteByte(set)
+		default:
+			buf.WriteByte('(')
+			buf.WriteByte(set)
+		}
+		g0 = set
+	}
+
+	writeRef := func(ref marc8Ref) {
+		switch {
+		case ref.set == MARC8ANSEL:
+			buf.WriteByte(byte(ref.code) | 0x80)
+		case isMultibyteMARC8(ref.set):
+			buf.WriteByte(byte(ref.code >> 16))
+			buf.WriteByte(byte(ref.code >> 8))
+			buf.WriteByte(byte(ref.code))
+		default:
+			buf.WriteByte(byte(ref.code))
+		}
+	}
+
+	for i := 0; i < len(runes); {
+		base := runes[i]
+		j := i + 1
+		var marks []marc8Ref
+		for j < len(runes) {
+			ref, ok := marc8Reverse[runes[j]]
+			if !ok || ref.set != MARC8ANSEL || !marc8Tables[MARC8ANSEL][ref.code].combining {
+				break
+			}
+			marks = append(marks, ref)
+			j++
+		}
+
+		ref, ok := marc8Reverse[base]
+		switch {
+		case base <= 0x20 || base == 0x7F:
+			setG0(MARC8BasicLatin)
+			for _, m := range marks {
+				writeRef(m)
+			}
+			buf.WriteByte(byte(base))
+		case ok:
+			if ref.set != MARC8ANSEL {
+				setG0(ref.set)
+			}
+			for _, m := range marks {
+				writeRef(m)
+			}
+			writeRef(ref)
+		default:
+			setG0(MARC8BasicLatin)
+			for _, m := range marks {
+				writeRef(m)
+			}
+			fmt.Fprintf(&buf, "&#x%04X;", base)
+		}
+		i = j
+	}
+	setG0(MARC8BasicLatin)
+	return buf.Bytes()
+}
+
+// The Library of Congress code tables (codetables.xml), gzipped, supply the
+// Hebrew, Arabic, Greek, Extended Cyrillic and EACC (CJK) sets; the
+// built-in tables only cover Latin, Basic Cyrillic and the Technique 1
+// sets. go generate fetches them into codetables/.
+//
+//go:generate sh -c "curl -fsS https://www.loc.gov/marc/specifications/codetables.xml | gzip -9n > codetables/codetables.xml.gz"
+//go:embed codetables
+var marc8CodeTablesFS embed.FS
+
+const marc8CodeTablesFile = "codetables/codetables.xml.gz"
+
+var (
+	marc8EmbeddedOnce sync.Once
+	marc8Embedded     bool
+)
+
+// loadEmbeddedMARC8 merges the embedded code tables into the codec, once,
+// before any other table is used or loaded.
+func loadEmbeddedMARC8() {
+	marc8EmbeddedOnce.Do(func() {
+		f, err := marc8CodeTablesFS.Open(marc8CodeTablesFile)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			slog.Error("embedded marc-8 code tables are corrupt", "error", err)
+			return
+		}
+		loaded, err := parseMARC8CodeTables(zr)
+		if err != nil {
+			slog.Error("embedded marc-8 code tables are corrupt", "error", err)
+			return
+		}
+		mergeMARC8Tables(loaded)
+		marc8Embedded = true
+	})
+}
+
+// MARC8CodeTablesEmbedded reports whether the binary carries LC's code
+// tables, and with them the non-Latin MARC-8 sets.
+func MARC8CodeTablesEmbedded() bool {
+	loadEmbeddedMARC8()
+	return marc8Embedded
+}
+
+// LoadMARC8CodeTables reads character sets from a Library of Congress
+// codetables.xml file and merges them into the codec, over the embedded
+// tables.
+func LoadMARC8CodeTables(r io.Reader) error {
+	loadEmbeddedMARC8()
+	loaded, err := parseMARC8CodeTables(r)
+	if err != nil {
+		return err
+	}
+	mergeMARC8Tables(loaded)
+	return nil
+}
+
+// parseMARC8CodeTables reads the character sets of a codetables.xml file,
+// keyed as in marc8Tables.
+func parseMARC8CodeTables(r io.Reader) (map[byte]map[uint32]marc8Char, error) {
+	var doc struct {
+		CodeTables []struct {
+			CharacterSets []struct {
+				ISOCode string `xml:"ISOcode,attr"`
+				Codes   []struct {
+					MARC        string `xml:"marc"`
+					UCS         string `xml:"ucs"`
+					Alt         string `xml:"alt"`
+					IsCombining string `xml:"isCombining"`
+				} `xml:"code"`
+			} `xml:"characterSet"`
+		} `xml:"codeTable"`
+	}
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parse marc-8 code tables: %w", err)
+	}
+
+	loaded := make(map[byte]map[uint32]marc8Char)
+	for _, ct := range doc.CodeTables {
+		for _, cs := range ct.CharacterSets {
+			setID, err := strconv.ParseUint(strings.TrimSpace(cs.ISOCode), 16, 8)
+			if err != nil {
+				continue
+			}
+			set := byte(setID)
+			if set == MARC8BasicLatin {
+				continue
+			}
+			table := loaded[set]
+			if table == nil {
+				table = make(map[uint32]marc8Char)
+				loaded[set] = table
+			}
+			for _, c := range cs.Codes {
+				code, err := strconv.ParseUint(strings.TrimSpace(c.MARC), 16, 32)
+				if err != nil {
+					continue
+				}
+				ucs := strings.TrimSpace(c.UCS)
+				if ucs == "" {
+					ucs = strings.TrimSpace(c.Alt)
+				}
+				r, err := strconv.ParseUint(ucs, 16, 32)
+				if err != nil {
+					continue
+				}
+				key := uint32(code) & 0x7F
+				if isMultibyteMARC8(set) {
+					key = uint32(code) & 0x7F7F7F
+				}
+				if key < 0x21 {
+					continue
+				}
+				table[key] = marc8Char{r: rune(r), combining: strings.TrimSpace(c.IsCombining) == "true"}
+			}
+		}
+	}
+	if len(loaded) == 0 {
+		return nil, fmt.Errorf("no marc-8 character sets found")
+	}
+	return loaded, nil
+}
+
+// mergeMARC8Tables adds loaded to the codec's tables, replacing codes
+// already known.
+func mergeMARC8Tables(loaded map[byte]map[uint32]marc8Char) {
+	marc8Mu.Lock()
+	defer marc8Mu.Unlock()
+	for set, table := range loaded {
+		merged := marc8Tables[set]
+		if merged == nil {
+			merged = make(map[uint32]marc8Char, len(table))
+			marc8Tables[set] = merged
+		}
+		for k, v := range table {
+			merged[k] = v
+		}
+	}
+	rebuildMARC8Reverse()
+}
+
+// looksLikeMARC8 reports whether data plausibly is MARC-8 rather than a
+// legacy double-byte encoding (GBK, Big5...) mislabelled by the leader.
+func looksLikeMARC8(data []byte) bool {
+	if bytes.IndexByte(data, marc8Escape) >= 0 {
+		return true
+	}
+	for _, b := range data {
+		if b < 0x80 {
+			continue
+		}
+		switch {
+		case b == 0x88 || b == 0x89 || b == 0x8D || b == 0x8E:
+		case b >= 0xA1 && b < 0xFF:
+			if _, ok := lookupMARC8(MARC8ANSEL, uint32(b&0x7F)); !ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
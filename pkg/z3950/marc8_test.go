@@ -0,0 +1,104 @@
+package z3950
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeMARC8(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"ASCII", []byte("Plain title"), "Plain title"},
+		{"Combining acute precedes base", []byte("Caf\xE2e"), "Café"},
+		{"Stacked diacritics", []byte("Vi\xE3\xF2et"), "Việt"},
+		{"Spacing ANSEL", []byte("\xA1\xB2d\xC3"), "Łød©"},
+		{"Superscript escape", []byte("x\x1Bp2\x1Bs"), "x²"},
+		{"Subscript escape", []byte("H\x1Bb2\x1BsO"), "H₂O"},
+		{"Basic Cyrillic", []byte("\x1B(Nmoskwa\x1B(B"), "МОСКВА"},
+		{"Unknown character", []byte("\x1B$1~~~"), "\uFFFD"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := DecodeMARC8(tc.in); got != tc.want {
+				t.Errorf("DecodeMARC8(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEncodeMARC8RoundTrip(t *testing.T) {
+	for _, s := range []string{"Café", "Việt Nam", "Łódź", "МОСКВА", "H₂O", "x²", "Ærø"} {
+		enc := EncodeMARC8(s)
+		if got := DecodeMARC8(enc); got != s {
+			t.Errorf("round trip %q: encoded %q, decoded %q", s, enc, got)
+		}
+	}
+
+	// Combining marks must come before the base character.
+	if got := EncodeMARC8("é"); string(got) != "\xE2e" {
+		t.Errorf("EncodeMARC8(é) = %q, want %q", got, "\xE2e")
+	}
+	// Characters outside MARC-8 fall back to numeric character references.
+	if got := string(EncodeMARC8("中")); got != "&#x4E2D;" {
+		t.Errorf("EncodeMARC8(中) = %q", got)
+	}
+}
+
+func TestEmbeddedMARC8CodeTables(t *testing.T) {
+	if !MARC8CodeTablesEmbedded() {
+		t.Skip("codetables/codetables.xml.gz is missing; run go generate ./pkg/z3950")
+	}
+	// Runs before TestLoadMARC8CodeTables adds the same code
+	if got := DecodeMARC8([]byte("\x1B$1!0!\x1B(B")); got != "一" {
+		t.Errorf("EACC decode = %q, want %q", got, "一")
+	}
+}
+
+func TestLoadMARC8CodeTables(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<codeTables>
+  <codeTable name="Han">
+    <characterSet name="EACC" ISOcode="31">
+      <code><marc>213021</marc><ucs>4E00</ucs><name>CJK</name></code>
+    </characterSet>
+  </codeTable>
+</codeTables>`
+	if err := LoadMARC8CodeTables(strings.NewReader(xml)); err != nil {
+		t.Fatalf("LoadMARC8CodeTables failed: %v", err)
+	}
+	if got := DecodeMARC8([]byte("\x1B$1!0!\x1B(B")); got != "一" {
+		t.Errorf("EACC decode = %q, want %q", got, "一")
+	}
+	if got := string(EncodeMARC8("一")); got != "\x1B$1!0!\x1Bs" {
+		t.Errorf("EACC encode = %q", got)
+	}
+}
+
+func TestParseMARCSelectsMARC8(t *testing.T) {
+	utf := BuildMARC(nil, "001", "Café society", "Dvořák", "", "", "", "", "")
+	marc8, err := ToMARC8(utf)
+	if err != nil {
+		t.Fatalf("ToMARC8 failed: %v", err)
+	}
+	if marc8[9] != ' ' {
+		t.Fatalf("expected blank leader/09, got %q", marc8[9])
+	}
+	if strings.Contains(string(marc8), "Café") {
+		t.Fatal("record was not transcoded")
+	}
+
+	rec, err := ParseMARC(marc8)
+	if err != nil {
+		t.Fatalf("ParseMARC failed: %v", err)
+	}
+	if !strings.Contains(rec.Title, "Café society") {
+		t.Errorf("Title = %q", rec.Title)
+	}
+	if !strings.Contains(rec.Author, "Dvořák") {
+		t.Errorf("Author = %q", rec.Author)
+	}
+}
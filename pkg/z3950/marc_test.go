@@ -1,6 +1,7 @@
 package z3950
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -82,4 +83,152 @@ func TestMARCBuildAndParse(t *testing.T) {
 
 func contains(s, substr string) bool {
 	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
-}
\ No newline at end of file
+}
+func TestParseMARCSubfields(t *testing.T) {
+	data := BuildMARC(nil, "42", "Golang", "Pike, Rob", "", "Addison-Wesley", "2015", "", "")
+	rec, err := ParseMARC(data)
+	if err != nil {
+		t.Fatalf("ParseMARC failed: %v", err)
+	}
+
+	if id := rec.GetFields("001"); len(id) != 1 || !id[0].IsControl() || id[0].Value != "42" || id[0].Subfields != nil {
+		t.Errorf("unexpected control field: %+v", id)
+	}
+
+	pub := rec.GetFields("260")
+	if len(pub) != 1 {
+		t.Fatalf("expected one 260 field, got %d", len(pub))
+	}
+	if pub[0].Indicator1 != " " || pub[0].Indicator2 != " " {
+		t.Errorf("indicators = %q %q", pub[0].Indicator1, pub[0].Indicator2)
+	}
+	want := []MARCSubfield{{Code: "b", Value: "Addison-Wesley"}, {Code: "c", Value: "2015"}}
+	if len(pub[0].Subfields) != len(want) {
+		t.Fatalf("subfields = %+v", pub[0].Subfields)
+	}
+	for i, sf := range want {
+		if pub[0].Subfields[i] != sf {
+			t.Errorf("subfield %d = %+v, want %+v", i, pub[0].Subfields[i], sf)
+		}
+	}
+	if pub[0].GetSubfield("c") != "2015" {
+		t.Errorf("GetSubfield(c) = %q", pub[0].GetSubfield("c"))
+	}
+	if pub[0].Value != "Addison-Wesley 2015" {
+		t.Errorf("flattened Value = %q", pub[0].Value)
+	}
+}
+
+func TestParseMARCJSONSubfields(t *testing.T) {
+	js := `{"leader":"00000nam a2200000 a 4500","fields":[
+		{"001":"ocm123"},
+		{"245":{"ind1":"1","ind2":"4","subfields":[{"a":"The title :"},{"b":"a subtitle"}]}}
+	]}`
+	rec, err := ParseMARCJSON(js)
+	if err != nil {
+		t.Fatalf("ParseMARCJSON failed: %v", err)
+	}
+	f := rec.GetFields("245")
+	if len(f) != 1 || f[0].Indicator1 != "1" || f[0].Indicator2 != "4" {
+		t.Fatalf("unexpected 245: %+v", f)
+	}
+	if f[0].GetSubfield("a") != "The title :" || f[0].GetSubfield("b") != "a subtitle" {
+		t.Errorf("subfields = %+v", f[0].Subfields)
+	}
+	if rec.Title != "The title : a subtitle" {
+		t.Errorf("Title = %q", rec.Title)
+	}
+}
+
+func TestMarshalISO2709RoundTrip(t *testing.T) {
+	orig, err := ParseMARC(BuildMARC(nil, "77", "Golang", "Pike, Rob", "9781234567890", "Addison-Wesley", "2015", "", "Go"))
+	if err != nil {
+		t.Fatalf("ParseMARC failed: %v", err)
+	}
+	orig.Fields = append(orig.Fields, MARCField{Tag: "520", Indicator1: "8", Indicator2: " ",
+		Subfields: []MARCSubfield{{Code: "a", Value: "A summary."}}, Value: "A summary."})
+	orig.Holdings = []Holding{{CallNumber: "QA76", Status: "Available", Location: "Main"}}
+
+	rec, err := ParseMARC(orig.MarshalISO2709())
+	if err != nil {
+		t.Fatalf("ParseMARC of marshalled record failed: %v", err)
+	}
+	if rec.RecordID != "77" || rec.Summary != "A summary." {
+		t.Errorf("RecordID = %q, Summary = %q", rec.RecordID, rec.Summary)
+	}
+	if len(rec.Fields) != len(orig.Fields)+1 {
+		t.Fatalf("expected %d fields (plus 852), got %d", len(orig.Fields), len(rec.Fields))
+	}
+	for i, f := range orig.Fields {
+		got := rec.Fields[i]
+		if got.Tag != f.Tag || got.Value != f.Value || got.Indicator1 != f.Indicator1 || got.Indicator2 != f.Indicator2 {
+			t.Errorf("field %d: got %+v, want %+v", i, got, f)
+		}
+	}
+	if h := rec.GetFields("852"); len(h) != 1 || h[0].GetSubfield("h") != "QA76" {
+		t.Errorf("holdings not embedded as 852: %+v", h)
+	}
+}
+
+func TestParseMARCCharset(t *testing.T) {
+	// MARC-8 text in a record whose leader claims Unicode
+	rec := &MARCRecord{Fields: []MARCField{{Tag: "245", Indicator1: "1", Indicator2: "0",
+		Subfields: []MARCSubfield{{Code: "a", Value: "Caf\xE2e"}}}}}
+	data := rec.MarshalISO2709()
+
+	parsed, err := ParseMARCCharset(data, "MARC-8")
+	if err != nil {
+		t.Fatalf("ParseMARCCharset failed: %v", err)
+	}
+	if parsed.Title != "Café" {
+		t.Errorf("Title = %q, want Café", parsed.Title)
+	}
+	if guessed, _ := ParseMARC(data); guessed.Title == "Café" {
+		t.Error("expected the leader to mislead guessing")
+	}
+
+	// Negotiated UTF-8 still falls back to guessing on invalid data
+	if parsed, _ := ParseMARCCharset(data, "UTF-8"); parsed.Title != DecodeText([]byte("Caf\xE2e")) {
+		t.Errorf("UTF-8 Title = %q", parsed.Title)
+	}
+}
+
+func TestParseMARCMalformedLeader(t *testing.T) {
+	rec := &MARCRecord{Fields: []MARCField{{Tag: "245", Indicator1: "1", Indicator2: "0",
+		Subfields: []MARCSubfield{{Code: "a", Value: "Title"}}}}}
+	good := rec.MarshalISO2709()
+	withBase := func(base string) []byte {
+		data := append([]byte(nil), good...)
+		copy(data[12:17], base)
+		return data
+	}
+
+	for name, data := range map[string][]byte{
+		"base one past end":  withBase(fmt.Sprintf("%05d", len(good)+1)),
+		"base far past end":  withBase("99999"),
+		"base inside leader": withBase("00010"),
+		"base not a number":  withBase("0x1A3"),
+		"leader only":        good[:24],
+	} {
+		if _, err := ParseMARC(data); err == nil {
+			t.Errorf("%s: ParseMARC accepted the record", name)
+		}
+		if _, err := ToMARC8(data); err == nil {
+			t.Errorf("%s: ToMARC8 accepted the record", name)
+		}
+	}
+
+	// A directory entry pointing before the base address is skipped
+	data := append([]byte(nil), good...)
+	copy(data[31:36], "-0001")
+	parsed, err := ParseMARC(data)
+	if err != nil {
+		t.Fatalf("ParseMARC failed: %v", err)
+	}
+	if len(parsed.Fields) != 0 {
+		t.Errorf("Fields = %+v, want the bad entry skipped", parsed.Fields)
+	}
+	if _, err := ToMARC8(data); err != nil {
+		t.Errorf("ToMARC8 failed: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package pool
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"sync"
@@ -11,13 +12,17 @@ import (
 
 // Config 连接池配置
 type Config struct {
-	MaxIdle     int           // 每个 Target 最大空闲连接数
-	IdleTimeout time.Duration // 空闲超时时间
+	MaxIdle        int           // 每个 Target 最大空闲连接数
+	IdleTimeout    time.Duration // 空闲超时时间
+	MaxSessions    int           // 保留远程结果集的会话连接上限
+	SessionTimeout time.Duration // 会话连接的过期时间
 }
 
 var DefaultConfig = Config{
-	MaxIdle:     5,
-	IdleTimeout: 5 * time.Minute,
+	MaxIdle:        5,
+	IdleTimeout:    5 * time.Minute,
+	MaxSessions:    50,
+	SessionTimeout: 10 * time.Minute,
 }
 
 // ClientWrapper 包装 z3950.Client，增加元数据
@@ -26,14 +31,19 @@ type ClientWrapper struct {
 	Host     string
 	Port     int
 	DBName   string
+	Auth     z3950.Authentication
 	LastUsed time.Time
+	Records  map[int]*z3950.MARCRecord // 检索时随 SearchResponse 捎带返回的记录，按结果集位置索引
+	// ElementSet 是 Records 所用的元素集名
+	ElementSet string
 }
 
 // Pool 管理多目标的连接池
 type Pool struct {
-	mu      sync.Mutex
-	pools   map[string][]*ClientWrapper // key: "host:port:db"
-	config  Config
+	mu       sync.Mutex
+	pools    map[string][]*ClientWrapper // key: "host:port:db"，带凭据时再加上凭据
+	sessions map[string]*ClientWrapper   // key: 会话 ID，连接上保留着该会话的远程结果集
+	config   Config
 }
 
 var globalPool *Pool
@@ -49,19 +59,31 @@ func GetGlobalPool() *Pool {
 }
 
 func NewPool(cfg Config) *Pool {
+	if cfg.MaxSessions <= 0 {
+		cfg.MaxSessions = DefaultConfig.MaxSessions
+	}
+	if cfg.SessionTimeout <= 0 {
+		cfg.SessionTimeout = DefaultConfig.SessionTimeout
+	}
 	return &Pool{
-		pools:  make(map[string][]*ClientWrapper),
-		config: cfg,
+		pools:    make(map[string][]*ClientWrapper),
+		sessions: make(map[string]*ClientWrapper),
+		config:   cfg,
 	}
 }
 
-func (p *Pool) genKey(host string, port int, db string) string {
-	return fmt.Sprintf("%s:%d:%s", host, port, db)
+// genKey 生成连接的键。以不同凭据登录的连接互不复用。
+func (p *Pool) genKey(host string, port int, db string, auth z3950.Authentication) string {
+	key := fmt.Sprintf("%s:%d:%s", host, port, db)
+	if !auth.IsZero() {
+		key += fmt.Sprintf(":%q", []string{auth.Open, auth.GroupID, auth.UserID, auth.Password})
+	}
+	return key
 }
 
-// Get 从池中获取连接，如果没有则新建
-func (p *Pool) Get(host string, port int, db string) (*ClientWrapper, error) {
-	key := p.genKey(host, port, db)
+// Get 从池中获取以 auth 登录的连接，如果没有则新建
+func (p *Pool) Get(ctx context.Context, host string, port int, db string, auth z3950.Authentication) (*ClientWrapper, error) {
+	key := p.genKey(host, port, db, auth)
 	
 	p.mu.Lock()
 	conns := p.pools[key]
@@ -74,7 +96,7 @@ func (p *Pool) Get(host string, port int, db string) (*ClientWrapper, error) {
 		if time.Since(wrapper.LastUsed) > p.config.IdleTimeout {
 			slog.Info("pool: connection expired, closing", "host", host)
 			wrapper.Client.Close()
-			return p.Get(host, port, db)
+			return p.Get(ctx, host, port, db, auth)
 		}
 		
 		slog.Info("pool: hit", "host", host)
@@ -83,11 +105,17 @@ func (p *Pool) Get(host string, port int, db string) (*ClientWrapper, error) {
 	p.mu.Unlock()
 
 	slog.Info("pool: miss, creating new connection", "host", host)
+	return p.Dial(ctx, host, port, db, auth)
+}
+
+// Dial 绕过空闲连接，新建一个连接并以 auth 初始化
+func (p *Pool) Dial(ctx context.Context, host string, port int, db string, auth z3950.Authentication) (*ClientWrapper, error) {
 	client := z3950.NewClient(host, port)
-	if err := client.Connect(); err != nil {
+	client.Auth = auth
+	if err := client.Connect(ctx); err != nil {
 		return nil, err
 	}
-	if err := client.Init(); err != nil {
+	if err := client.Init(ctx); err != nil {
 		client.Close()
 		return nil, err
 	}
@@ -97,18 +125,21 @@ func (p *Pool) Get(host string, port int, db string) (*ClientWrapper, error) {
 		Host:   host,
 		Port:   port,
 		DBName: db,
+		Auth:   auth,
 		LastUsed: time.Now(),
 	}, nil
 }
 
 // Put 归还连接
 func (p *Pool) Put(cw *ClientWrapper) {
-	if cw == nil || cw.Client == nil {
+	// 被 context 中断的连接已经关闭，不再放回池中
+	if cw == nil || cw.Client == nil || !cw.Client.Connected() {
 		return
 	}
 	
 	cw.LastUsed = time.Now()
-	key := p.genKey(cw.Host, cw.Port, cw.DBName)
+	cw.Records, cw.ElementSet = nil, "" // 结果集不再保留，捎带的记录随之作废
+	key := p.genKey(cw.Host, cw.Port, cw.DBName, cw.Auth)
 	
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -123,22 +154,98 @@ func (p *Pool) Put(cw *ClientWrapper) {
 	p.pools[key] = append(conns, cw)
 }
 
+// Hold 把保留着远程结果集的连接挂到会话上，供之后的 Present 复用。
+// 会话已有连接时关闭旧连接；会话数超过 MaxSessions 时关闭最久未用的会话。
+func (p *Pool) Hold(sessionID string, cw *ClientWrapper) {
+	if cw == nil || cw.Client == nil || !cw.Client.Connected() {
+		return
+	}
+	cw.LastUsed = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if old, ok := p.sessions[sessionID]; ok && old != cw {
+		old.Client.Close()
+	}
+	p.sessions[sessionID] = cw
+
+	for len(p.sessions) > p.config.MaxSessions {
+		oldestID := ""
+		for id, s := range p.sessions {
+			if oldestID == "" || s.LastUsed.Before(p.sessions[oldestID].LastUsed) {
+				oldestID = id
+			}
+		}
+		slog.Info("pool: too many sessions, closing oldest", "session", oldestID)
+		p.sessions[oldestID].Client.Close()
+		delete(p.sessions, oldestID)
+	}
+}
+
+// Acquire 取出会话的连接独占使用，用完后应再次 Hold 或关闭。
+// 会话不存在或已过期时返回 false，调用方需要重新检索。
+func (p *Pool) Acquire(sessionID string) (*ClientWrapper, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cw, ok := p.sessions[sessionID]
+	if !ok {
+		return nil, false
+	}
+	delete(p.sessions, sessionID)
+	if time.Since(cw.LastUsed) > p.config.SessionTimeout {
+		slog.Info("pool: session expired, closing", "session", sessionID)
+		cw.Client.Close()
+		return nil, false
+	}
+	return cw, true
+}
+
+// Release 结束会话：不再保留其远程结果集，连接放回空闲池（池满时关闭）
+func (p *Pool) Release(sessionID string) {
+	p.mu.Lock()
+	cw, ok := p.sessions[sessionID]
+	delete(p.sessions, sessionID)
+	p.mu.Unlock()
+
+	if ok {
+		p.Put(cw)
+	}
+}
+
+// SessionTimeout 返回会话连接的过期时间
+func (p *Pool) SessionTimeout() time.Duration {
+	return p.config.SessionTimeout
+}
+
 func (p *Pool) cleanupLoop() {
 	ticker := time.NewTicker(1 * time.Minute)
 	for range ticker.C {
-		p.mu.Lock()
-		now := time.Now()
-		for key, conns := range p.pools {
-			var valid []*ClientWrapper
-			for _, cw := range conns {
-				if now.Sub(cw.LastUsed) <= p.config.IdleTimeout {
-					valid = append(valid, cw)
-				} else {
-					cw.Client.Close()
-				}
+		p.cleanup(time.Now())
+	}
+}
+
+// cleanup 关闭超时的空闲连接和会话连接
+func (p *Pool) cleanup(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, conns := range p.pools {
+		var valid []*ClientWrapper
+		for _, cw := range conns {
+			if now.Sub(cw.LastUsed) <= p.config.IdleTimeout {
+				valid = append(valid, cw)
+			} else {
+				cw.Client.Close()
 			}
-			p.pools[key] = valid
 		}
-		p.mu.Unlock()
+		p.pools[key] = valid
 	}
-}
\ No newline at end of file
+	for id, cw := range p.sessions {
+		if now.Sub(cw.LastUsed) > p.config.SessionTimeout {
+			cw.Client.Close()
+			delete(p.sessions, id)
+		}
+	}
+}
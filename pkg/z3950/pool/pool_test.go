@@ -6,6 +6,7 @@ import (
 	"time"
 
 	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/yourusername/open-z3950-gateway/pkg/z3950"
 )
 
 // Simple Mock Server for Handshake
@@ -73,7 +74,7 @@ func TestPool_GetAndPut(t *testing.T) {
 	db := "Default"
 
 	// 1. Get New Connection
-	cw, err := pool.Get(host, port, db)
+	cw, err := pool.Get(t.Context(), host, port, db, z3950.Authentication{})
 	if err != nil {
 		t.Fatalf("Failed to get connection: %v", err)
 	}
@@ -96,7 +97,7 @@ func TestPool_GetAndPut(t *testing.T) {
 	// Revert change.
 	cw.DBName = "Default"
 	
-	cw2, err := pool.Get(host, port, db)
+	cw2, err := pool.Get(t.Context(), host, port, db, z3950.Authentication{})
 	if err != nil {
 		t.Fatalf("Failed to get connection 2: %v", err)
 	}
@@ -111,19 +112,31 @@ func TestPool_GetAndPut(t *testing.T) {
 	
 	// 4. Test Max Idle
 	// Get 3 connections
-	c1, _ := pool.Get(host, port, db)
-	c2, _ := pool.Get(host, port, db)
-	c3, _ := pool.Get(host, port, db)
+	c1, _ := pool.Get(t.Context(), host, port, db, z3950.Authentication{})
+	c2, _ := pool.Get(t.Context(), host, port, db, z3950.Authentication{})
+	c3, _ := pool.Get(t.Context(), host, port, db, z3950.Authentication{})
 	
 	// Put 3 back. MaxIdle=2.
 	pool.Put(c1)
 	pool.Put(c2)
 	pool.Put(c3) // Should close c3
 	
-	pLen := len(pool.pools[pool.genKey(host, port, db)])
+	pLen := len(pool.pools[pool.genKey(host, port, db, z3950.Authentication{})])
 	if pLen > 2 {
 		t.Errorf("Pool exceeded max idle: got %d, want <= 2", pLen)
 	}
+
+	// 5. Connections logged in with other credentials are not shared
+	ca, err := pool.Get(t.Context(), host, port, db, z3950.Authentication{UserID: "user", Password: "secret"})
+	if err != nil {
+		t.Fatalf("Get with credentials failed: %v", err)
+	}
+	if ca == c1 || ca == c2 || ca.Auth.UserID != "user" {
+		t.Error("Get with credentials reused an anonymous connection")
+	}
+	if n := len(pool.pools[pool.genKey(host, port, db, z3950.Authentication{})]); n != pLen {
+		t.Errorf("anonymous idle connections = %d, want %d", n, pLen)
+	}
 }
 
 func TestPool_Cleanup(t *testing.T) {
@@ -143,14 +156,14 @@ func TestPool_Cleanup(t *testing.T) {
 	// We can't call cleanupLoop easily as it loops forever.
 	// But we can test the logic by just calling Get() after wait.
 	
-	cw, _ := pool.Get("127.0.0.1", server.Port, "Default")
+	cw, _ := pool.Get(t.Context(), "127.0.0.1", server.Port, "Default", z3950.Authentication{})
 	pool.Put(cw)
 	
 	// Force expire AFTER Put, because Put resets LastUsed to time.Now()
 	cw.LastUsed = time.Now().Add(-1 * time.Hour) 
 	
 	// Now Get should find it expired and create new
-	cw2, err := pool.Get("127.0.0.1", server.Port, "Default")
+	cw2, err := pool.Get(t.Context(), "127.0.0.1", server.Port, "Default", z3950.Authentication{})
 	if err != nil {
 		t.Fatalf("Failed to get: %v", err)
 	}
@@ -174,3 +187,84 @@ func TestGetGlobalPool(t *testing.T) {
 		t.Error("Global pool is not singleton")
 	}
 }
+
+func TestPool_Sessions(t *testing.T) {
+	server, err := StartMockServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	pool := NewPool(Config{MaxIdle: 5, IdleTimeout: time.Minute, MaxSessions: 2, SessionTimeout: time.Minute})
+	get := func() *ClientWrapper {
+		cw, err := pool.Get(t.Context(), "127.0.0.1", server.Port, "Default", z3950.Authentication{})
+		if err != nil {
+			t.Fatalf("Failed to get: %v", err)
+		}
+		return cw
+	}
+
+	a := get()
+	pool.Hold("a", a)
+	got, ok := pool.Acquire("a")
+	if !ok || got != a {
+		t.Fatal("Acquire did not return the held connection")
+	}
+	if _, ok := pool.Acquire("a"); ok {
+		t.Error("connection handed out twice")
+	}
+	pool.Hold("a", a)
+
+	// A third session evicts the least recently used one.
+	a.LastUsed = time.Now().Add(-time.Second)
+	pool.Hold("b", get())
+	pool.Hold("c", get())
+	if _, ok := pool.Acquire("a"); ok {
+		t.Error("oldest session was not evicted")
+	}
+
+	// Expired sessions are closed by cleanup and refused by Acquire.
+	pool.cleanup(time.Now().Add(2 * time.Minute))
+	if len(pool.sessions) != 0 {
+		t.Errorf("cleanup left %d sessions", len(pool.sessions))
+	}
+	d := get()
+	pool.Hold("d", d)
+	d.LastUsed = time.Now().Add(-2 * time.Minute)
+	if _, ok := pool.Acquire("d"); ok {
+		t.Error("expired session was handed out")
+	}
+}
+
+func TestPool_Release(t *testing.T) {
+	server, err := StartMockServer()
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer server.Close()
+
+	pool := NewPool(Config{MaxIdle: 5, IdleTimeout: time.Minute, MaxSessions: 2, SessionTimeout: time.Minute})
+	cw, err := pool.Get(t.Context(), "127.0.0.1", server.Port, "Default", z3950.Authentication{})
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	cw.Records = map[int]*z3950.MARCRecord{1: {}}
+	pool.Hold("a", cw)
+	pool.Release("a")
+	pool.Release("a") // already released: no-op
+
+	if _, ok := pool.Acquire("a"); ok {
+		t.Error("released session was handed out")
+	}
+	// The connection goes back to the idle pool, without its records.
+	got, err := pool.Get(t.Context(), "127.0.0.1", server.Port, "Default", z3950.Authentication{})
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if got != cw {
+		t.Error("released connection was not reused")
+	}
+	if got.Records != nil {
+		t.Error("released connection kept its records")
+	}
+}
@@ -0,0 +1,325 @@
+package z3950
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// attributeSetNames maps the attribute set names accepted in PQF to OIDs.
+var attributeSetNames = map[string]string{
+	"bib-1":         OID_Bib1,
+	"bib1":          OID_Bib1,
+	"exp-1":         "1.2.840.10003.3.2",
+	"exp1":          "1.2.840.10003.3.2",
+	"ext-1":         "1.2.840.10003.3.3",
+	"ccl-1":         "1.2.840.10003.3.4",
+	"gils":          "1.2.840.10003.3.5",
+	"stas":          "1.2.840.10003.3.6",
+	"collections-1": "1.2.840.10003.3.7",
+	"cimi-1":        "1.2.840.10003.3.8",
+	"geo-1":         "1.2.840.10003.3.9",
+	"zbig":          "1.2.840.10003.3.10",
+	"util":          "1.2.840.10003.3.11",
+	"xd-1":          "1.2.840.10003.3.12",
+	"zthes":         "1.2.840.10003.3.13",
+	"fin-1":         "1.2.840.10003.3.14",
+	"dan-1":         "1.2.840.10003.3.15",
+	"holdings":      "1.2.840.10003.3.16",
+}
+
+// attributeSetOID resolves a PQF attribute set name or dotted OID.
+func attributeSetOID(name string) (string, error) {
+	if oid, ok := attributeSetNames[strings.ToLower(name)]; ok {
+		return oid, nil
+	}
+	for _, arc := range strings.Split(name, ".") {
+		if _, err := strconv.Atoi(arc); err != nil {
+			return "", fmt.Errorf("pqf: unknown attribute set %q", name)
+		}
+	}
+	return name, nil
+}
+
+// pqfParser holds the tokens of a PQF query being parsed.
+type pqfParser struct {
+	tokens []pqfToken
+	pos    int
+}
+
+// pqfToken is a PQF word; quoted tokens are always terms, never operators.
+type pqfToken struct {
+	text   string
+	quoted bool
+}
+
+// ParsePQF parses a query in YAZ's Prefix Query Format, e.g.
+//
+//	@attrset bib-1 @and @attr 1=4 "go" @attr 1=1003 pike
+//
+// Attributes given before an operator apply to every term below it unless
+// a term sets the same type itself. All six Bib-1 attribute types are
+// supported, as are @and, @or, @not and @prox.
+func ParsePQF(query string) (StructuredQuery, error) {
+	tokens, err := tokenizePQF(query)
+	if err != nil {
+		return StructuredQuery{}, err
+	}
+	p := &pqfParser{tokens: tokens}
+	var q StructuredQuery
+	if tok, ok := p.peek(); ok && !tok.quoted && tok.text == "@attrset" {
+		p.pos++
+		name, err := p.next("attribute set")
+		if err != nil {
+			return StructuredQuery{}, err
+		}
+		if q.AttributeSet, err = attributeSetOID(name.text); err != nil {
+			return StructuredQuery{}, err
+		}
+	}
+	q.Root, err = p.parse(QueryClause{})
+	if err != nil {
+		return StructuredQuery{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return StructuredQuery{}, fmt.Errorf("pqf: unexpected %q after query", p.tokens[p.pos].text)
+	}
+	return q, nil
+}
+
+func tokenizePQF(s string) ([]pqfToken, error) {
+	var tokens []pqfToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			var b strings.Builder
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, fmt.Errorf("pqf: unterminated quoted term")
+			}
+			i++
+			tokens = append(tokens, pqfToken{text: b.String(), quoted: true})
+		default:
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t\n\r", rune(s[i])) {
+				i++
+			}
+			tokens = append(tokens, pqfToken{text: s[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+func (p *pqfParser) peek() (pqfToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return pqfToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *pqfParser) next(what string) (pqfToken, error) {
+	tok, ok := p.peek()
+	if !ok {
+		return pqfToken{}, fmt.Errorf("pqf: missing %s", what)
+	}
+	p.pos++
+	return tok, nil
+}
+
+func (p *pqfParser) nextInt(what string) (int, error) {
+	tok, err := p.next(what)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(tok.text)
+	if err != nil {
+		return 0, fmt.Errorf("pqf: %s must be a number, got %q", what, tok.text)
+	}
+	return n, nil
+}
+
+// parse reads one query structure; attrs holds the attributes inherited
+// from enclosing @attr specifications.
+func (p *pqfParser) parse(attrs QueryClause) (QueryNode, error) {
+	tok, err := p.next("query")
+	if err != nil {
+		return nil, err
+	}
+	if tok.quoted || !strings.HasPrefix(tok.text, "@") {
+		clause := attrs
+		clause.Term = tok.text
+		return clause, nil
+	}
+
+	switch tok.text {
+	case "@attr":
+		spec, err := p.next("attribute")
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(spec.text, "=") {
+			// An attribute set precedes the type=value pair.
+			if attrs.AttributeSet, err = attributeSetOID(spec.text); err != nil {
+				return nil, err
+			}
+			if spec, err = p.next("attribute"); err != nil {
+				return nil, err
+			}
+		}
+		typ, val, ok := strings.Cut(spec.text, "=")
+		t, terr := strconv.Atoi(typ)
+		v, verr := strconv.Atoi(val)
+		if !ok || terr != nil || verr != nil {
+			return nil, fmt.Errorf("pqf: invalid attribute %q, want type=value", spec.text)
+		}
+		if t < AttributeTypeUse || t > AttributeTypeCompleteness {
+			return nil, fmt.Errorf("pqf: unsupported attribute type %d", t)
+		}
+		attrs.SetAttribute(t, v)
+		return p.parse(attrs)
+	case "@and", "@or", "@not":
+		op := map[string]string{"@and": "AND", "@or": "OR", "@not": "AND-NOT"}[tok.text]
+		return p.parseOperands(QueryComplex{Operator: op}, attrs)
+	case "@prox":
+		prox, err := p.parseProximity()
+		if err != nil {
+			return nil, err
+		}
+		return p.parseOperands(QueryComplex{Operator: "PROX", Proximity: prox}, attrs)
+	case "@term":
+		// The term type (general, numeric, string, ...) only affects the
+		// encoding, which is always general here.
+		if _, err := p.next("term type"); err != nil {
+			return nil, err
+		}
+		return p.parse(attrs)
+	case "@set":
+		return nil, fmt.Errorf("pqf: result set references are not supported")
+	}
+	return nil, fmt.Errorf("pqf: unknown operator %q", tok.text)
+}
+
+func (p *pqfParser) parseOperands(node QueryComplex, attrs QueryClause) (QueryNode, error) {
+	var err error
+	if node.Left, err = p.parse(attrs); err != nil {
+		return nil, err
+	}
+	if node.Right, err = p.parse(attrs); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// parseProximity reads "exclusion distance ordered relation which unit",
+// e.g. "@prox 0 3 1 2 k 2" for "within 3 words, in order".
+func (p *pqfParser) parseProximity() (*ProximityOperator, error) {
+	prox := &ProximityOperator{}
+	excl, err := p.next("proximity exclusion")
+	if err != nil {
+		return nil, err
+	}
+	prox.Exclusion = excl.text == "1"
+	if prox.Distance, err = p.nextInt("proximity distance"); err != nil {
+		return nil, err
+	}
+	ordered, err := p.nextInt("proximity ordered flag")
+	if err != nil {
+		return nil, err
+	}
+	prox.Ordered = ordered != 0
+	if prox.Relation, err = p.nextInt("proximity relation"); err != nil {
+		return nil, err
+	}
+	which, err := p.next("proximity unit kind")
+	if err != nil {
+		return nil, err
+	}
+	if prox.Unit, err = p.nextInt("proximity unit"); err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(which.text) {
+	case "k", "known", "0":
+	case "p", "private", "1":
+		prox.Unit = -prox.Unit
+	default:
+		return nil, fmt.Errorf("pqf: invalid proximity unit kind %q", which.text)
+	}
+	return prox, nil
+}
+
+// FormatPQF renders a query in Prefix Query Format, the inverse of
+// ParsePQF. It is meant for logging and for handing queries to YAZ tools.
+func FormatPQF(q StructuredQuery) string {
+	var b strings.Builder
+	if q.AttributeSet != "" {
+		b.WriteString("@attrset ")
+		b.WriteString(q.AttributeSet)
+		b.WriteByte(' ')
+	}
+	formatPQFNode(&b, q.Root)
+	return b.String()
+}
+
+func formatPQFNode(b *strings.Builder, node QueryNode) {
+	switch n := node.(type) {
+	case QueryClause:
+		attrs := n.Attributes()
+		for typ := AttributeTypeUse; typ <= AttributeTypeCompleteness; typ++ {
+			val, ok := attrs[typ]
+			if !ok {
+				continue
+			}
+			b.WriteString("@attr ")
+			if n.AttributeSet != "" {
+				b.WriteString(n.AttributeSet)
+				b.WriteByte(' ')
+			}
+			fmt.Fprintf(b, "%d=%d ", typ, val)
+		}
+		b.WriteString(quotePQF(n.Term))
+	case QueryComplex:
+		switch n.Operator {
+		case "OR":
+			b.WriteString("@or ")
+		case "AND-NOT":
+			b.WriteString("@not ")
+		case "PROX":
+			prox := n.Proximity
+			if prox == nil {
+				prox = &ProximityOperator{}
+			}
+			excl, ordered, which, unit := 0, 0, "k", prox.Unit
+			if prox.Exclusion {
+				excl = 1
+			}
+			if prox.Ordered {
+				ordered = 1
+			}
+			if unit < 0 {
+				which, unit = "p", -unit
+			}
+			fmt.Fprintf(b, "@prox %d %d %d %d %s %d ", excl, prox.Distance, ordered, prox.Relation, which, unit)
+		default:
+			b.WriteString("@and ")
+		}
+		formatPQFNode(b, n.Left)
+		b.WriteByte(' ')
+		formatPQFNode(b, n.Right)
+	}
+}
+
+// quotePQF quotes a term when it would otherwise not read back as one.
+func quotePQF(term string) string {
+	if term != "" && !strings.HasPrefix(term, "@") && !strings.ContainsAny(term, " \t\n\r\"\\") {
+		return term
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(term) + `"`
+}
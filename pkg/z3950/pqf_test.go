@@ -0,0 +1,111 @@
+package z3950
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePQF(t *testing.T) {
+	testCases := []struct {
+		name  string
+		pqf   string
+		query StructuredQuery
+	}{
+		{
+			name:  "Bare term",
+			pqf:   "dinosaur",
+			query: StructuredQuery{Root: QueryClause{Term: "dinosaur"}},
+		},
+		{
+			name: "Boolean with attributes",
+			pqf:  `@and @attr 1=4 "go programming" @attr 1=1003 pike`,
+			query: StructuredQuery{Root: QueryComplex{
+				Operator: "AND",
+				Left:     QueryClause{Attribute: UseAttributeTitle, Term: "go programming"},
+				Right:    QueryClause{Attribute: UseAttributeAuthor, Term: "pike"},
+			}},
+		},
+		{
+			name: "All attribute types and sets",
+			pqf:  `@attrset bib-1 @attr 1=31 @attr 2=4 @attr 3=1 @attr 4=4 @attr 5=100 @attr 6=3 2001`,
+			query: StructuredQuery{AttributeSet: OID_Bib1, Root: QueryClause{
+				Attribute: UseAttributeDatePub, Relation: RelationGreaterEqual, Position: PositionFirstInField,
+				Structure: StructureYear, Truncation: TruncationNone, Completeness: CompletenessCompleteField, Term: "2001",
+			}},
+		},
+		{
+			name:  "Per-attribute set",
+			pqf:   `@attr 1.2.840.10003.3.2 1=1 x`,
+			query: StructuredQuery{Root: QueryClause{AttributeSet: "1.2.840.10003.3.2", Attribute: 1, Term: "x"}},
+		},
+		{
+			name: "Inherited attributes",
+			pqf:  `@attr 1=4 @or @attr 5=1 comp unix`,
+			query: StructuredQuery{Root: QueryComplex{
+				Operator: "OR",
+				Left:     QueryClause{Attribute: UseAttributeTitle, Truncation: TruncationRight, Term: "comp"},
+				Right:    QueryClause{Attribute: UseAttributeTitle, Term: "unix"},
+			}},
+		},
+		{
+			name: "Nested not and proximity",
+			pqf:  `@not @prox 0 3 1 2 k 2 a b "c \"d\""`,
+			query: StructuredQuery{Root: QueryComplex{
+				Operator: "AND-NOT",
+				Left: QueryComplex{
+					Operator:  "PROX",
+					Left:      QueryClause{Term: "a"},
+					Right:     QueryClause{Term: "b"},
+					Proximity: &ProximityOperator{Distance: 3, Ordered: true, Relation: RelationLessEqual, Unit: ProxUnitWord},
+				},
+				Right: QueryClause{Term: `c "d"`},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParsePQF(tc.pqf)
+			if err != nil {
+				t.Fatalf("ParsePQF(%q) failed: %v", tc.pqf, err)
+			}
+			if !reflect.DeepEqual(got, tc.query) {
+				t.Fatalf("ParsePQF(%q) = %+v, want %+v", tc.pqf, got, tc.query)
+			}
+			again, err := ParsePQF(FormatPQF(got))
+			if err != nil || !reflect.DeepEqual(again, got) {
+				t.Errorf("FormatPQF round trip: %q -> %+v (%v)", FormatPQF(got), again, err)
+			}
+		})
+	}
+}
+
+func TestParsePQFErrors(t *testing.T) {
+	for _, pqf := range []string{
+		"",
+		"@and a",
+		`"unterminated`,
+		"@attr 1=x term",
+		"@attr 7=1 term",
+		"@attr nosuchset 1=4 term",
+		"@set default",
+		"@frobnicate a b",
+		"a b",
+	} {
+		if _, err := ParsePQF(pqf); err == nil {
+			t.Errorf("ParsePQF(%q) succeeded, want error", pqf)
+		}
+	}
+}
+
+func TestFormatPQF(t *testing.T) {
+	q := StructuredQuery{Root: QueryComplex{
+		Operator: "AND",
+		Left:     QueryClause{Attribute: UseAttributeTitle, Truncation: TruncationRight, Term: "go"},
+		Right:    QueryClause{Attribute: UseAttributeAuthor, Term: "Rob Pike"},
+	}}
+	want := `@and @attr 1=4 @attr 5=1 go @attr 1=1003 "Rob Pike"`
+	if got := FormatPQF(q); got != want {
+		t.Errorf("FormatPQF = %q, want %q", got, want)
+	}
+}
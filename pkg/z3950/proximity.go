@@ -0,0 +1,66 @@
+package z3950
+
+import (
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Encode builds the prox choice [3] of an RPN Operator:
+//
+//	ProximityOperator ::= SEQUENCE {
+//	    exclusion         [1] BOOLEAN OPTIONAL,
+//	    distance          [2] INTEGER,
+//	    ordered           [3] BOOLEAN,
+//	    relationType      [4] INTEGER,
+//	    proximityUnitCode [5] CHOICE { known [1] INTEGER, private [2] INTEGER } }
+func (p *ProximityOperator) Encode() *ber.Packet {
+	prox := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "ProximityOperator")
+	if p.Exclusion {
+		prox.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 1, true, "Exclusion"))
+	}
+	prox.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 2, int64(p.Distance), "Distance"))
+	prox.AppendChild(ber.NewBoolean(ber.ClassContext, ber.TypePrimitive, 3, p.Ordered, "Ordered"))
+	relation := p.Relation
+	if relation == 0 {
+		relation = RelationLessEqual
+	}
+	prox.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 4, int64(relation), "RelationType"))
+	unit := p.Unit
+	if unit == 0 {
+		unit = ProxUnitWord
+	}
+	code := ber.Encode(ber.ClassContext, ber.TypeConstructed, 5, nil, "ProximityUnitCode")
+	code.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, int64(unit), "Known"))
+	prox.AppendChild(code)
+	return prox
+}
+
+// ParseProximityOperator decodes the prox choice of an RPN Operator. A
+// private unit code is returned as its negative value so that it cannot be
+// mistaken for a known unit.
+func ParseProximityOperator(p *ber.Packet) *ProximityOperator {
+	prox := &ProximityOperator{Relation: RelationLessEqual, Unit: ProxUnitWord}
+	for _, c := range p.Children {
+		if c.ClassType != ber.ClassContext {
+			continue
+		}
+		switch c.Tag {
+		case 1:
+			prox.Exclusion = DecodeBool(c)
+		case 2:
+			prox.Distance = int(DecodeInt(c))
+		case 3:
+			prox.Ordered = DecodeBool(c)
+		case 4:
+			prox.Relation = int(DecodeInt(c))
+		case 5:
+			if len(c.Children) > 0 {
+				unit := c.Children[0]
+				prox.Unit = int(DecodeInt(unit))
+				if unit.Tag == 2 {
+					prox.Unit = -prox.Unit
+				}
+			}
+		}
+	}
+	return prox
+}
@@ -0,0 +1,36 @@
+package z3950
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestProximityOperatorRoundTrip(t *testing.T) {
+	want := &ProximityOperator{Exclusion: true, Distance: 3, Ordered: true, Relation: RelationLess, Unit: ProxUnitWord}
+	pkt := ber.DecodePacket(want.Encode().Bytes())
+	if pkt.ClassType != ber.ClassContext || pkt.Tag != 3 {
+		t.Fatalf("unexpected tag %d/%d", pkt.ClassType, pkt.Tag)
+	}
+	if got := ParseProximityOperator(pkt); *got != *want {
+		t.Errorf("ParseProximityOperator = %+v, want %+v", got, want)
+	}
+}
+
+func TestBuildRPNOperators(t *testing.T) {
+	for op, tag := range map[string]ber.Tag{"AND": 0, "OR": 1, "AND-NOT": 2, "PROX": 3} {
+		node := QueryComplex{
+			Operator:  op,
+			Left:      QueryClause{Attribute: UseAttributeTitle, Term: "a"},
+			Right:     QueryClause{Attribute: UseAttributeTitle, Term: "b"},
+			Proximity: &ProximityOperator{Distance: 2},
+		}
+		pkt := ber.DecodePacket(buildRPN(node).Bytes())
+		if len(pkt.Children) != 3 || pkt.Children[2].Tag != 46 || len(pkt.Children[2].Children) != 1 {
+			t.Fatalf("%s: malformed RpnRpnOp", op)
+		}
+		if got := pkt.Children[2].Children[0].Tag; got != tag {
+			t.Errorf("%s: operator tag = %d, want %d", op, got, tag)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package z3950
+
+import (
+	"strconv"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+// Sort statuses (SortResponse sortStatus).
+const (
+	SortStatusSuccess = 0
+	SortStatusPartial = 1
+	SortStatusFailure = 2
+)
+
+// Sort relations (SortKeySpec sortRelation), as in SortKey.Relation.
+const (
+	SortAscending  = 0
+	SortDescending = 1
+)
+
+// SortRequest asks for the result sets named in Input to be sorted on
+// Keys into the result set Output, which may be one of the inputs.
+type SortRequest struct {
+	Input  []string
+	Output string
+	Keys   []SortKey
+}
+
+// Encode builds the SortRequest PDU. Each key is sent as a generic sort
+// key of Bib-1 sort attributes holding its use attribute, compared
+// case-insensitively; relations other than descending sort ascending.
+func (r SortRequest) Encode() *ber.Packet {
+	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 43, nil, "SortRequest")
+
+	input := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "InputResultSetNames")
+	for _, name := range r.Input {
+		input.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagVisibleString, name, "ResultSetName"))
+	}
+	pdu.AppendChild(input)
+	pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 4, r.Output, "SortedResultSetName"))
+
+	seq := ber.Encode(ber.ClassContext, ber.TypeConstructed, 5, nil, "SortSequence")
+	for _, k := range r.Keys {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "AttributeElement")
+		attr.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 120, 1, "AttributeType"))
+		attr.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 121, int64(k.Attribute), "AttributeValue"))
+		list := ber.Encode(ber.ClassContext, ber.TypeConstructed, 44, nil, "AttributeList")
+		list.AppendChild(attr)
+
+		attrs := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "SortAttributes")
+		attrs.AppendChild(NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, OID_Bib1, "AttributeSetId"))
+		attrs.AppendChild(list)
+		generic := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "Generic")
+		generic.AppendChild(attrs)
+
+		spec := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeySpec")
+		spec.AppendChild(generic)
+		relation := SortAscending
+		if k.Relation == SortDescending {
+			relation = SortDescending
+		}
+		spec.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, int64(relation), "SortRelation"))
+		spec.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 2, 1, "CaseInsensitive"))
+		seq.AppendChild(spec)
+	}
+	pdu.AppendChild(seq)
+	return pdu
+}
+
+// ParseSortRequest reads a SortRequest PDU. Keys must be generic Bib-1
+// sort attributes naming a use attribute, sorted ascending or descending;
+// any other key is returned as a diagnostic.
+func ParseSortRequest(pdu *ber.Packet) (SortRequest, *Diagnostic) {
+	var r SortRequest
+	for _, c := range pdu.Children {
+		if c.ClassType != ber.ClassContext {
+			continue
+		}
+		switch c.Tag {
+		case 3:
+			for _, name := range c.Children {
+				r.Input = append(r.Input, DecodeString(name))
+			}
+		case 4:
+			r.Output = DecodeString(c)
+		case 5:
+			for i, spec := range c.Children {
+				key, diag := parseSortKeySpec(spec)
+				if diag != nil {
+					if diag.AddInfo == "" {
+						diag.AddInfo = "key " + strconv.Itoa(i+1)
+					}
+					return r, diag
+				}
+				r.Keys = append(r.Keys, key)
+			}
+		}
+	}
+	return r, nil
+}
+
+// parseSortKeySpec decodes one SortKeySpec into a SortKey.
+func parseSortKeySpec(spec *ber.Packet) (SortKey, *Diagnostic) {
+	key := SortKey{Relation: SortAscending}
+	found := false
+	for _, c := range spec.Children {
+		if c.ClassType != ber.ClassContext {
+			continue
+		}
+		switch c.Tag {
+		case 1:
+			if c.TagType == ber.TypePrimitive {
+				key.Relation = int(DecodeInt(c))
+				continue
+			}
+			// generic [1] SortKey: only sortAttributes [2] are supported
+			if len(c.Children) == 0 || c.Children[0].ClassType != ber.ClassContext || c.Children[0].Tag != 2 {
+				return key, NewDiagnostic(DiagSortSequenceUnsupported, "")
+			}
+			for _, a := range c.Children[0].Children {
+				if a.ClassType == ber.ClassUniversal && a.Tag == ber.TagObjectIdentifier {
+					if oid := PacketOID(a); oid != OID_Bib1 {
+						return key, NewDiagnostic(DiagUnsupportedAttributeSet, oid)
+					}
+					continue
+				}
+				if use, ok := sortUseAttribute(a); ok {
+					key.Attribute, found = use, true
+				}
+			}
+		case 2:
+			if c.TagType == ber.TypeConstructed {
+				// databaseSpecific [2]
+				return key, NewDiagnostic(DiagSortSequenceUnsupported, "database-specific sort key")
+			}
+		}
+	}
+	if !found {
+		return key, NewDiagnostic(DiagSortSequenceUnsupported, "")
+	}
+	if key.Relation != SortAscending && key.Relation != SortDescending {
+		return key, NewDiagnostic(DiagSortRelationIllegal, strconv.Itoa(key.Relation))
+	}
+	return key, nil
+}
+
+// sortUseAttribute returns the use attribute (type 1) in an AttributeList.
+func sortUseAttribute(list *ber.Packet) (int, bool) {
+	for _, attr := range list.Children {
+		var ints []int
+		for _, c := range attr.Children {
+			if c.ClassType == ber.ClassContext && c.Tag == 1 {
+				continue // attributeSet
+			}
+			ints = append(ints, int(DecodeInt(c)))
+		}
+		if len(ints) >= 2 && ints[0] == 1 {
+			return ints[1], true
+		}
+	}
+	return 0, false
+}
+
+// EncodeSortResponse builds a SortResponse with status, reporting count
+// records in the sorted set on success and diag otherwise.
+func EncodeSortResponse(status, count int, diag *Diagnostic) *ber.Packet {
+	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 44, nil, "SortResponse")
+	pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 3, int64(status), "SortStatus"))
+	if status == SortStatusFailure {
+		pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 4, 4, "ResultSetStatus")) // none
+	}
+	if diag != nil {
+		diags := ber.Encode(ber.ClassContext, ber.TypeConstructed, 5, nil, "Diagnostics")
+		diags.AppendChild(diag.Encode(ber.TagSequence))
+		pdu.AppendChild(diags)
+	}
+	if status != SortStatusFailure {
+		pdu.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 6, int64(count), "ResultCount"))
+	}
+	return pdu
+}
+
+// sortResponseDiagnostic returns the first of the diagnostics [5] of a
+// SortResponse.
+func sortResponseDiagnostic(resp *ber.Packet) *Diagnostic {
+	for _, c := range resp.Children {
+		if c.ClassType == ber.ClassContext && c.Tag == 5 && len(c.Children) > 0 {
+			return ParseDiagnostic(c.Children[0])
+		}
+	}
+	return nil
+}
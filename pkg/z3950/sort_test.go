@@ -0,0 +1,77 @@
+package z3950
+
+import (
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+)
+
+func TestSortRequestRoundTrip(t *testing.T) {
+	req := SortRequest{
+		Input:  []string{"default"},
+		Output: "sorted",
+		Keys:   []SortKey{{Attribute: 4, Relation: SortDescending}, {Attribute: 1003}},
+	}
+	p, err := ber.DecodePacketErr(req.Encode().Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, diag := ParseSortRequest(p)
+	if diag != nil {
+		t.Fatalf("ParseSortRequest diagnostic = %v", diag)
+	}
+	if len(got.Input) != 1 || got.Input[0] != "default" || got.Output != "sorted" {
+		t.Errorf("names = %v -> %q", got.Input, got.Output)
+	}
+	if len(got.Keys) != 2 || got.Keys[0] != req.Keys[0] || got.Keys[1] != (SortKey{Attribute: 1003, Relation: SortAscending}) {
+		t.Errorf("keys = %+v", got.Keys)
+	}
+}
+
+// sortRequestWith builds a SortRequest of one use attribute 4 key under
+// attribute set oid, sorted by relation.
+func sortRequestWith(oid string, relation int) *ber.Packet {
+	attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "AttributeElement")
+	attr.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 120, 1, "AttributeType"))
+	attr.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 121, 4, "AttributeValue"))
+	list := ber.Encode(ber.ClassContext, ber.TypeConstructed, 44, nil, "AttributeList")
+	list.AppendChild(attr)
+	attrs := ber.Encode(ber.ClassContext, ber.TypeConstructed, 2, nil, "SortAttributes")
+	attrs.AppendChild(NewOID(ber.ClassUniversal, ber.TagObjectIdentifier, oid, "AttributeSetId"))
+	attrs.AppendChild(list)
+	generic := ber.Encode(ber.ClassContext, ber.TypeConstructed, 1, nil, "Generic")
+	generic.AppendChild(attrs)
+	spec := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "SortKeySpec")
+	spec.AppendChild(generic)
+	spec.AppendChild(ber.NewInteger(ber.ClassContext, ber.TypePrimitive, 1, int64(relation), "SortRelation"))
+	seq := ber.Encode(ber.ClassContext, ber.TypeConstructed, 5, nil, "SortSequence")
+	seq.AppendChild(spec)
+
+	pdu := ber.Encode(ber.ClassContext, ber.TypeConstructed, 43, nil, "SortRequest")
+	input := ber.Encode(ber.ClassContext, ber.TypeConstructed, 3, nil, "InputResultSetNames")
+	input.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagVisibleString, "default", "ResultSetName"))
+	pdu.AppendChild(input)
+	pdu.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 4, "default", "SortedResultSetName"))
+	pdu.AppendChild(seq)
+	return pdu
+}
+
+func TestParseSortRequestDiagnostics(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		oid      string
+		relation int
+		code     int
+	}{
+		{"relation 3", OID_Bib1, 3, DiagSortRelationIllegal},
+		{"other attribute set", "1.2.840.10003.3.2", SortAscending, DiagUnsupportedAttributeSet},
+	} {
+		p, err := ber.DecodePacketErr(sortRequestWith(tc.oid, tc.relation).Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, diag := ParseSortRequest(p); diag == nil || diag.Code != tc.code {
+			t.Errorf("%s: diagnostic = %v, want %d", tc.name, diag, tc.code)
+		}
+	}
+}
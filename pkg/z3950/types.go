@@ -36,27 +36,153 @@ type QueryNode interface {
 	isQueryNode()
 }
 
-// QueryClause represents a leaf node (a single search term).
+// Bib-1 attribute types.
+const (
+	AttributeTypeUse          = 1
+	AttributeTypeRelation     = 2
+	AttributeTypePosition     = 3
+	AttributeTypeStructure    = 4
+	AttributeTypeTruncation   = 5
+	AttributeTypeCompleteness = 6
+)
+
+// Bib-1 Relation attribute values.
+const (
+	RelationLess         = 1
+	RelationLessEqual    = 2
+	RelationEqual        = 3
+	RelationGreaterEqual = 4
+	RelationGreater      = 5
+	RelationNotEqual     = 6
+)
+
+// Bib-1 Position attribute values.
+const (
+	PositionFirstInField    = 1
+	PositionFirstInSubfield = 2
+	PositionAny             = 3
+)
+
+// Bib-1 Structure attribute values.
+const (
+	StructurePhrase           = 1
+	StructureWord             = 2
+	StructureKey              = 3
+	StructureYear             = 4
+	StructureDateNormalized   = 5
+	StructureWordList         = 6
+	StructureDateUnnormalized = 100
+)
+
+// Bib-1 Truncation attribute values.
+const (
+	TruncationRight     = 1
+	TruncationLeft      = 2
+	TruncationLeftRight = 3
+	TruncationNone      = 100
+)
+
+// Bib-1 Completeness attribute values.
+const (
+	CompletenessIncompleteSubfield = 1
+	CompletenessCompleteSubfield   = 2
+	CompletenessCompleteField      = 3
+)
+
+// QueryClause represents a leaf node (a single search term). Attribute is
+// the Use attribute; the other attribute types are 0 when not given.
+// AttributeSet is the OID of the clause's attribute set when it differs
+// from the query's.
 type QueryClause struct {
-	Attribute int
-	Term      string
+	AttributeSet string
+	Attribute    int
+	Relation     int
+	Position     int
+	Structure    int
+	Truncation   int
+	Completeness int
+	Term         string
+}
+
+// Attributes returns the clause's Bib-1 attributes as type -> value,
+// omitting those that are not set.
+func (c QueryClause) Attributes() map[int]int {
+	attrs := make(map[int]int)
+	for typ, val := range map[int]int{
+		AttributeTypeUse:          c.Attribute,
+		AttributeTypeRelation:     c.Relation,
+		AttributeTypePosition:     c.Position,
+		AttributeTypeStructure:    c.Structure,
+		AttributeTypeTruncation:   c.Truncation,
+		AttributeTypeCompleteness: c.Completeness,
+	} {
+		if val != 0 {
+			attrs[typ] = val
+		}
+	}
+	return attrs
+}
+
+// SetAttribute stores a Bib-1 attribute of the given type. Unknown types
+// are ignored.
+func (c *QueryClause) SetAttribute(typ, val int) {
+	switch typ {
+	case AttributeTypeUse:
+		c.Attribute = val
+	case AttributeTypeRelation:
+		c.Relation = val
+	case AttributeTypePosition:
+		c.Position = val
+	case AttributeTypeStructure:
+		c.Structure = val
+	case AttributeTypeTruncation:
+		c.Truncation = val
+	case AttributeTypeCompleteness:
+		c.Completeness = val
+	}
 }
 func (QueryClause) isQueryNode() {}
 
-// QueryComplex represents a branch node (boolean operation).
+// Known proximity unit codes.
+const (
+	ProxUnitCharacter = 1
+	ProxUnitWord      = 2
+	ProxUnitSentence  = 3
+	ProxUnitParagraph = 4
+	ProxUnitSection   = 5
+	ProxUnitChapter   = 6
+	ProxUnitDocument  = 7
+	ProxUnitElement   = 8
+)
+
+// ProximityOperator holds the parameters of the RPN prox operator: the
+// operands must occur within Distance units of each other, compared with
+// Relation (one of the Relation* values). Exclusion negates the match.
+type ProximityOperator struct {
+	Exclusion bool
+	Distance  int
+	Ordered   bool
+	Relation  int
+	Unit      int
+}
+
+// QueryComplex represents a branch node (boolean or proximity operation).
 type QueryComplex struct {
-	Operator string // "AND", "OR", "AND-NOT"
-	Left     QueryNode
-	Right    QueryNode
+	Operator  string // "AND", "OR", "AND-NOT", "PROX"
+	Left      QueryNode
+	Right     QueryNode
+	Proximity *ProximityOperator // set when Operator is "PROX"
 }
 func (QueryComplex) isQueryNode() {}
 
 // StructuredQuery represents a parsed Z39.50 query as a Tree.
 type StructuredQuery struct {
-	Root     QueryNode
-	Limit    int
-	Offset   int
-	SortKeys []SortKey
+	Root         QueryNode
+	AttributeSet string // OID of the query's attribute set; empty means Bib-1
+	Limit        int
+	Offset       int
+	SortKeys     []SortKey
+	ElementSet   string // element set of the records fetched with the search; empty means full
 }
 
 type SortKey struct {
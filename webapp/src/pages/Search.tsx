@@ -13,6 +13,8 @@ type QueryRow = {
   operator: string
 }
 
+const PAGE_SIZE = 20
+
 type SearchHistoryItem = {
   timestamp: number
   db: string
@@ -50,6 +52,12 @@ export default function Search() {
   const [sortOrder, setSortOrder] = useState('asc')
 
   const [results, setResults] = useState<Book[]>([])
+  const [total, setTotal] = useState(0)
+  const [page, setPage] = useState(1)
+  const [lastSearch, setLastSearch] = useState<{ db: string, rows?: any[], term?: string, session?: string } | null>(null)
+  const [failedTargets, setFailedTargets] = useState<{ db: string, error: string }[]>([])
+  const [pageCount, setPageCount] = useState(0)
+  const [progress, setProgress] = useState<Record<string, { status: string, total?: number }>>({})
   const [loading, setLoading] = useState(false)
   const [error, setError] = useState('')
   const [requestStatus, setRequestStatus] = useState<{msg: string, type: 'success' | 'error'} | null>(null)
@@ -146,15 +154,21 @@ export default function Search() {
     }
   }, [location.search, token])
 
-  const doSearch = async (db: string, advancedRows?: any[], simpleTerm?: string) => {
+  const doSearch = async (db: string, advancedRows?: any[], simpleTerm?: string, pageNum: number = 1, session?: string) => {
     setLoading(true)
     setError('')
     setResults([])
+    setFailedTargets([])
+    setProgress({})
     setRequestStatus(null)
 
     try {
       const params = new URLSearchParams()
       params.append('db', db)
+      params.append('page', String(pageNum))
+      params.append('pageSize', String(PAGE_SIZE))
+      // Later pages are read from the results the first page kept
+      if (session) params.append('session', session)
       
       // Append Sort Params
       params.append('sortAttr', sortAttr)
@@ -179,17 +193,32 @@ export default function Search() {
         return // Nothing to search
       }
 
-      const response = await fetch(`/api/search?${params.toString()}`, {
-        headers: { 'Authorization': `Bearer ${token}` }
-      })
-      
-      if (!response.ok) throw new Error(`Error: ${response.statusText}`)
-      const data = await response.json()
-      if (data.error) throw new Error(data.error)
-      
-      const list = data.data || []
-      setResults(list)
+      let list: Book[]
+      let nextSession: string | undefined
+      if (db.includes(',')) {
+        ({ list, session: nextSession } = await streamSearch(params))
+      } else {
+        const response = await fetch(`/api/search?${params.toString()}`, {
+          headers: { 'Authorization': `Bearer ${token}` }
+        })
+        
+        if (!response.ok) throw new Error(`Error: ${response.statusText}`)
+        const data = await response.json()
+        if (data.error) throw new Error(data.error)
+        
+        list = data.data || []
+        setResults(list)
+        setTotal(data.total ?? list.length)
+        setPageCount(Math.ceil((data.total ?? list.length) / PAGE_SIZE))
+        setFailedTargets((data.targets || []).filter((t: any) => t.error))
+        nextSession = data.session
+      }
+      setPage(pageNum)
+      setLastSearch({ db, rows: advancedRows, term: simpleTerm, session: nextSession })
       if (list.length === 0) setError(t('search.no_results'))
+
+      // Other pages of the same search are not new history entries
+      if (pageNum > 1) return
         
       // Save history on success (even if 0 results, valid query)
       saveToHistory({
@@ -208,6 +237,66 @@ export default function Search() {
     }
   }
 
+  // Federated searches are streamed, so records from fast targets are shown
+  // while slow ones are still searching. Each target returns its own page.
+  const streamSearch = async (params: URLSearchParams): Promise<{ list: Book[], session?: string }> => {
+    params.append('format', 'ndjson')
+    const response = await fetch(`/api/search/stream?${params.toString()}`, {
+      headers: { 'Authorization': `Bearer ${token}` }
+    })
+    if (!response.ok || !response.body) throw new Error(`Error: ${response.statusText}`)
+
+    let list: Book[] = []
+    let session: string | undefined
+    let largest = 0
+    const handle = (ev: any) => {
+      switch (ev.type) {
+        case 'records':
+          list = [...list, ...ev.records]
+          setResults(list)
+          setLoading(false)
+          return
+        case 'merged':
+          // Once every target has answered, duplicates are merged
+          list = ev.records
+          setResults(list)
+          return
+        case 'done':
+          setTotal(ev.total)
+          setPageCount(Math.ceil(largest / PAGE_SIZE))
+          setFailedTargets((ev.targets || []).filter((t: any) => t.error))
+          session = ev.session
+          return
+        case 'hits':
+          largest = Math.max(largest, ev.total)
+          break
+      }
+      setProgress(p => ({ ...p, [ev.db]: { status: ev.type, total: ev.total } }))
+    }
+
+    const reader = response.body.getReader()
+    const decoder = new TextDecoder()
+    let buffer = ''
+    for (;;) {
+      const { done, value } = await reader.read()
+      if (done) break
+      buffer += decoder.decode(value, { stream: true })
+      let nl
+      while ((nl = buffer.indexOf('\n')) >= 0) {
+        const line = buffer.slice(0, nl).trim()
+        buffer = buffer.slice(nl + 1)
+        if (line) handle(JSON.parse(line))
+      }
+    }
+    return { list, session }
+  }
+
+  const goToPage = (pageNum: number) => {
+    if (!lastSearch) return
+    doSearch(lastSearch.db, lastSearch.rows, lastSearch.term, pageNum, lastSearch.session)
+    window.scrollTo(0, 0)
+  }
+
   const addRow = () => {
     setRows([...rows, { id: Date.now(), attribute: '1016', term: '', operator: 'AND' }])
   }
@@ -245,7 +334,7 @@ export default function Search() {
           title: book.title,
           author: book.author,
           isbn: book.isbn,
-          target_db: targetDB,
+          target_db: book.source || targetDB,
           record_id: book.record_id || 'unknown'
         })
       })
@@ -335,6 +424,7 @@ export default function Search() {
                 >
                   {targets.map(t => <option key={t} value={t}>{t}</option>)}
                   {targets.length === 0 && <option value="LCDB">LCDB</option>}
+                  {targets.length > 0 && <option value={['Local', ...targets].join(',')}>{t('search.target.all')}</option>}
                 </select>
               </div>
             </div>
@@ -440,6 +530,27 @@ export default function Search() {
         </article>
       )}
 
+      {Object.keys(progress).length > 0 && (
+        <p>
+          {Object.entries(progress).map(([db, p]) => (
+            <span key={db} style={{ marginRight: '15px', whiteSpace: 'nowrap' }}>
+              <strong>{db}</strong>: {p.status === 'hits'
+                ? t('search.status.hits', { total: String(p.total ?? 0) })
+                : t(`search.status.${p.status}` as any)}
+            </span>
+          ))}
+        </p>
+      )}
+
+      {failedTargets.length > 0 && (
+        <article className="pico-background-amber-200">
+          <strong>{t('search.target.failed')}</strong>
+          <ul style={{ marginBottom: 0 }}>
+            {failedTargets.map(f => <li key={f.db}><strong>{f.db}</strong>: {f.error}</li>)}
+          </ul>
+        </article>
+      )}
+
       {requestStatus && (
         <article className={requestStatus.type === 'success' ? "pico-background-green-200" : "pico-background-red-200"}>
           <strong>{requestStatus.type === 'success' ? '✅' : '❌'}</strong> {requestStatus.msg}
@@ -456,7 +567,7 @@ export default function Search() {
             <article key={index}>
               <div style={{ display: 'flex', gap: '20px', alignItems: 'flex-start' }}>
                 <div style={{ flexShrink: 0 }}>
-                  <Link to={`/book/${targetDB}/${encodeURIComponent(item.record_id || '')}`}>
+                  <Link to={`/book/${item.source || targetDB}/${encodeURIComponent(item.record_id || '')}`}>
                     <img 
                       src={item.isbn 
                         ? `https://covers.openlibrary.org/b/isbn/${cleanISBN(item.isbn)}-M.jpg?default=https://placehold.co/100x150/e0e0e0/808080?text=No+Cover`
@@ -478,10 +589,24 @@ export default function Search() {
                 <div style={{ flexGrow: 1 }}>
                   <header style={{ marginBottom: '10px' }}>
                     <strong>
-                      <Link to={`/book/${targetDB}/${encodeURIComponent(item.record_id || '')}`} style={{textDecoration: 'none', color: 'inherit'}}>
+                      <Link to={`/book/${item.source || targetDB}/${encodeURIComponent(item.record_id || '')}`} style={{textDecoration: 'none', color: 'inherit'}}>
                         {item.title || 'Untitled'}
                       </Link>
                     </strong>
+                    {item.source && <div><small className="secondary">{t('search.result.source')}: {item.source}</small></div>}
+                    {item.members && item.members.length > 1 && (
+                      <div>
+                        <small>
+                          {t('search.result.also_in')}{' '}
+                          {item.members.slice(1).map((m, i) => (
+                            <span key={i}>
+                              {i > 0 && ', '}
+                              <Link to={`/book/${m.source}/${encodeURIComponent(m.record_id || '')}`}>{m.source}</Link>
+                            </span>
+                          ))}
+                        </small>
+                      </div>
+                    )}
                   </header>
                   <p style={{ marginBottom: '5px' }}><strong>Author:</strong> {item.author || 'Unknown'}</p>
                   <p style={{ marginBottom: '5px' }}><strong>ISBN:</strong> {item.isbn || 'Unknown'}</p>
@@ -541,6 +666,18 @@ export default function Search() {
         </div>
       ) : null}
 
+      {!loading && pageCount > 1 && (
+        <nav style={{ justifyContent: 'center', alignItems: 'center', gap: '20px', marginTop: '20px' }}>
+          <button className="secondary outline" disabled={page <= 1} onClick={() => goToPage(page - 1)}>
+            {t('search.page.prev')}
+          </button>
+          <span>{t('search.page.status', { page: String(page), pages: String(pageCount), total: String(total) })}</span>
+          <button className="secondary outline" disabled={page >= pageCount} onClick={() => goToPage(page + 1)}>
+            {t('search.page.next')}
+          </button>
+        </nav>
+      )}
+
       {/* Citation Modal */}
       {citation && (
         <dialog open>
@@ -9,6 +9,8 @@ interface Target {
   port: number
   database_name: string
   encoding: string
+  protocol: string
+  auth_user?: string
 }
 
 export default function Settings() {
@@ -24,6 +26,9 @@ export default function Settings() {
   const [newPort, setNewPort] = useState(210)
   const [newDB, setNewDB] = useState('')
   const [newEncoding, setNewEncoding] = useState('MARC21')
+  const [newProtocol, setNewProtocol] = useState('Z39.50')
+  const [newAuthUser, setNewAuthUser] = useState('')
+  const [newAuthPass, setNewAuthPass] = useState('')
   const [testResult, setTestResult] = useState<{msg: string, type: 'success' | 'error'} | null>(null)
 
   const fetchTargets = async () => {
@@ -56,7 +61,8 @@ export default function Settings() {
     }
   }
 
-  const handleTest = async (host: string, port: number) => {
+  // Stored targets are tested by name, with their stored credentials
+  const handleTest = async (test: { name?: string, host?: string, port?: number, database_name?: string, protocol?: string, auth_user?: string, auth_password?: string }) => {
     setTestResult(null)
     try {
       const response = await fetch('/api/admin/targets/test', {
@@ -65,11 +71,12 @@ export default function Settings() {
           'Content-Type': 'application/json',
           'Authorization': `Bearer ${token}`
         },
-        body: JSON.stringify({ host, port })
+        body: JSON.stringify(test)
       })
       const data = await response.json()
       if (data.status === 'success') {
-        setTestResult({ msg: data.message, type: 'success' })
+        // Show the charset the target agreed to, if it negotiated one
+        setTestResult({ msg: data.charset ? `${data.message} (${data.charset})` : data.message, type: 'success' })
       } else {
         setTestResult({ msg: data.message, type: 'error' })
       }
@@ -92,7 +99,10 @@ export default function Settings() {
           host: newHost,
           port: Number(newPort),
           database_name: newDB,
-          encoding: newEncoding
+          encoding: newEncoding,
+          protocol: newProtocol,
+          auth_user: newAuthUser,
+          auth_password: newAuthPass
         })
       })
       if (!response.ok) throw new Error("Failed to create")
@@ -102,6 +112,9 @@ export default function Settings() {
       setNewHost('')
       setNewPort(210)
       setNewDB('')
+      setNewProtocol('Z39.50')
+      setNewAuthUser('')
+      setNewAuthPass('')
       setTestResult(null)
       fetchTargets()
     } catch (err: any) {
@@ -130,6 +143,7 @@ export default function Settings() {
           <thead>
             <tr>
               <th>{t('settings.col.name')}</th>
+              <th>{t('settings.col.protocol')}</th>
               <th>{t('settings.col.host')}</th>
               <th>{t('settings.col.db')}</th>
               <th>{t('settings.col.encoding')}</th>
@@ -140,12 +154,13 @@ export default function Settings() {
             {targets.map(t => (
               <tr key={t.id}>
                 <td><strong>{t.name}</strong></td>
-                <td><small>{t.host}:{t.port}</small></td>
+                <td>{t.protocol || 'Z39.50'}</td>
+                <td><small>{t.host}:{t.port}</small>{t.auth_user && <small> 🔒</small>}</td>
                 <td>{t.database_name}</td>
                 <td><mark>{t.encoding}</mark></td>
                 <td>
                   <div role="group" style={{ marginBottom: 0 }}>
-                    <button className="outline secondary" onClick={() => handleTest(t.host, t.port)} style={{ padding: '2px 8px', fontSize: '0.8em' }}>{t('settings.btn.test')}</button>
+                    <button className="outline secondary" onClick={() => handleTest({ name: t.name })} style={{ padding: '2px 8px', fontSize: '0.8em' }}>{t('settings.btn.test')}</button>
                     <button className="outline contrast" onClick={() => handleDelete(t.id)} style={{ padding: '2px 8px', fontSize: '0.8em' }}>{t('settings.btn.del')}</button>
                   </div>
                 </td>
@@ -172,6 +187,12 @@ export default function Settings() {
       )}
       <form onSubmit={handleAdd}>
         <div className="grid">
+          <label>{t('settings.add.protocol')}
+            <select value={newProtocol} onChange={e => { setNewProtocol(e.target.value); setNewPort(e.target.value === 'SRU' ? 80 : 210) }}>
+              <option value="Z39.50">Z39.50</option>
+              <option value="SRU">SRU</option>
+            </select>
+          </label>
           <label>{t('settings.add.name')} <input value={newName} onChange={e => setNewName(e.target.value)} placeholder="e.g. British Library" required /></label>
           <label>{t('settings.add.host')} <input value={newHost} onChange={e => setNewHost(e.target.value)} placeholder="z3950.bl.uk" required /></label>
           <label>{t('settings.add.port')} <input type="number" value={newPort} onChange={e => setNewPort(Number(e.target.value))} required /></label>
@@ -185,8 +206,12 @@ export default function Settings() {
               <option value="CNMARC">CNMARC</option>
             </select>
           </label>
+        </div>
+        <div className="grid">
+          <label>{t('settings.add.auth_user')} <input value={newAuthUser} onChange={e => setNewAuthUser(e.target.value)} placeholder={t('settings.add.auth_user_hint')} autoComplete="off" /></label>
+          <label>{t('settings.add.auth_pass')} <input type="password" value={newAuthPass} onChange={e => setNewAuthPass(e.target.value)} autoComplete="new-password" /></label>
           <div style={{ display: 'flex', gap: '10px', alignItems: 'flex-end' }}>
-            <button type="button" className="secondary outline" onClick={() => handleTest(newHost, newPort)} disabled={!newHost}>{t('settings.add.test_link')}</button>
+            <button type="button" className="secondary outline" onClick={() => handleTest({ host: newHost, port: newPort, database_name: newDB, protocol: newProtocol, auth_user: newAuthUser, auth_password: newAuthPass })} disabled={!newHost}>{t('settings.add.test_link')}</button>
             <button type="submit">{t('settings.add.submit')}</button>
           </div>
         </div>
@@ -7,6 +7,7 @@ export interface Book {
   pub_year?: string
   publisher?: string
   source?: string
+  members?: Book[]
   record_id?: string
   summary?: string
   toc?: string
@@ -15,6 +16,20 @@ export interface Book {
   series?: string
   notes?: string
   holdings?: Holding[]
+  fields?: MARCField[]
+}
+
+export interface MARCSubfield {
+  code: string
+  value: string
+}
+
+export interface MARCField {
+  Tag: string
+  ind1?: string
+  ind2?: string
+  subfields?: MARCSubfield[]
+  Value: string
 }
 
 export interface Holding {